@@ -0,0 +1,170 @@
+package cloudlus
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// archive saves the job j and its output files to the server's ArchiveDir
+// so they can still be retrieved after j is purged from the job db.  It does
+// nothing if ArchiveDir is empty.
+func (s *Server) archive(j *Job) {
+	if s.ArchiveDir == "" {
+		return
+	}
+
+	if err := os.MkdirAll(s.ArchiveDir, 0755); err != nil {
+		s.logf(LogError, "[ARCHIVE] %v", err)
+		return
+	}
+
+	data, err := json.Marshal(j)
+	if err != nil {
+		s.logf(LogError, "[ARCHIVE] job %v: %v", j.Id, err)
+		return
+	}
+	if err := ioutil.WriteFile(s.archiveJobPath(j.Id), data, 0644); err != nil {
+		s.logf(LogError, "[ARCHIVE] job %v: %v", j.Id, err)
+		return
+	}
+
+	if err := s.archiveOutfiles(j.Id); err != nil && !os.IsNotExist(err) {
+		s.logf(LogError, "[ARCHIVE] job %v outfiles: %v", j.Id, err)
+	}
+	s.logf(LogInfo, "[ARCHIVE] job %v", j.Id)
+}
+
+// archiveOutfiles copies the output files of job id from the server's
+// Outfiles store to its ArchiveDir.
+func (s *Server) archiveOutfiles(id JobId) error {
+	rc, err := s.Outfiles.Get(outfileName(id))
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return DirStore{Dir: s.ArchiveDir}.Put(outfileName(id), rc)
+}
+
+// purge archives the job j (see archive) that is being purged from the job
+// db and removes its output files from the server's Outfiles store.
+func (s *Server) purge(j *Job) {
+	s.archive(j)
+	if err := s.Outfiles.Delete(outfileName(j.Id)); err != nil {
+		s.logf(LogError, "[PURGE] job %v outfiles: %v", j.Id, err)
+	}
+}
+
+// expiredMeta is the db name under which the server's expiredBefore is
+// persisted so a restarted server doesn't recheck already expired jobs.
+const expiredMeta = "expired-before"
+
+// expiredJob records a job whose output files were deleted by
+// expireResults along with its objective value if it was read first.
+type expiredJob struct {
+	Id        JobId
+	Objective *float64
+}
+
+// expireResult is sent by expireResults to the dispatcher.  Until is the
+// finish time before which all jobs' output files have been expired.
+type expireResult struct {
+	Jobs  []expiredJob
+	Until time.Time
+}
+
+// expireResults deletes the output files of jobs that finished between
+// since and until from the server's Outfiles store.  The objective values of
+// complete jobs are read first.  It runs in its own goroutine so that
+// reading and deleting output files (possibly remote - see Store) doesn't
+// block the dispatcher, and sends the jobs to be marked OutfilesExpired back
+// to it (see markExpired).
+func (s *Server) expireResults(since, until time.Time) {
+	res := expireResult{Until: until}
+	jobs, err := s.alljobs.FinishedRange(since, until)
+	if err != nil {
+		s.logf(LogError, "[EXPIRE] %v", err)
+		res.Until = since
+		jobs = nil
+	}
+
+	for _, j := range jobs {
+		if j.OutfilesExpired {
+			continue
+		}
+		e := expiredJob{Id: j.Id}
+		if j.Status == StatusComplete && j.Objective == nil && j.ObjFile != "" {
+			if val, err := s.readObjective(j); err == nil {
+				e.Objective = &val
+			}
+		}
+		if err := s.Outfiles.Delete(outfileName(j.Id)); err != nil {
+			// retry on the next GC
+			s.logf(LogError, "[EXPIRE] job %v outfiles: %v", j.Id, err)
+			if j.Finished.Before(res.Until) {
+				res.Until = j.Finished
+			}
+			continue
+		}
+		res.Jobs = append(res.Jobs, e)
+	}
+
+	select {
+	case s.expired <- res:
+	case <-s.kill:
+	}
+}
+
+// markExpired marks the jobs whose output files were deleted by
+// expireResults as OutfilesExpired - caching any objective values read -
+// and persists the server's expiry progress.  It is only called by the
+// dispatcher.
+func (s *Server) markExpired(res expireResult) {
+	for _, e := range res.Jobs {
+		j, err := s.alljobs.Get(e.Id)
+		if err != nil {
+			continue // purged meanwhile
+		}
+		j.OutfilesExpired = true
+		if j.Objective == nil {
+			j.Objective = e.Objective
+		}
+		if err := s.alljobs.Put(j); err != nil {
+			s.logf(LogError, "[EXPIRE] job %v: %v", j.Id, err)
+		}
+	}
+	s.expiredBefore = res.Until
+	if err := s.alljobs.putMeta(expiredMeta, res.Until); err != nil {
+		s.logf(LogError, "[EXPIRE] %v", err)
+	}
+	s.logf(LogInfo, "[EXPIRE] deleted output files of %v jobs older than %v", len(res.Jobs), s.ResultTTL)
+}
+
+// unarchive loads the job with the given id from the server's ArchiveDir.
+func (s *Server) unarchive(id JobId) (*Job, error) {
+	if s.ArchiveDir == "" {
+		return nil, fmt.Errorf("job %v not archived: no archive configured", id)
+	}
+
+	data, err := ioutil.ReadFile(s.archiveJobPath(id))
+	if err != nil {
+		return nil, err
+	}
+
+	j := &Job{}
+	if err := json.Unmarshal(data, j); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+func (s *Server) archiveJobPath(id JobId) string {
+	return filepath.Join(s.ArchiveDir, id.String()+".json")
+}
+
+func (s *Server) archiveOutfilePath(id JobId) string {
+	return filepath.Join(s.ArchiveDir, outfileName(id))
+}
@@ -0,0 +1,249 @@
+package cloudlus
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// BlobStore stores jobs' zipped output files (see Server.Outfiles).  Blobs
+// are identified by key.
+type BlobStore interface {
+	// Put stores the data read from r under key - replacing any existing
+	// blob with the same key.
+	Put(key string, r io.Reader) error
+	// Get opens the blob stored under key for reading.  If there is no such
+	// blob, the returned error satisfies os.IsNotExist.
+	Get(key string) (io.ReadCloser, error)
+	// Delete removes the blob stored under key.  Deleting a blob that
+	// doesn't exist is not an error.
+	Delete(key string) error
+}
+
+// DirStore is a BlobStore that keeps blobs as files in a local directory.
+type DirStore struct {
+	// Dir is the directory blobs are stored in - it is created if it doesn't
+	// exist.  The current working directory is used if it is empty.
+	Dir string
+}
+
+func (d DirStore) path(key string) string { return filepath.Join(d.Dir, key) }
+
+// Put writes the blob to a temporary file first so a partially written blob
+// is never visible under key.
+func (d DirStore) Put(key string, r io.Reader) error {
+	if d.Dir != "" {
+		if err := os.MkdirAll(d.Dir, 0755); err != nil {
+			return err
+		}
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(d.path(key)), ".blob-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	} else if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), d.path(key))
+}
+
+func (d DirStore) Get(key string) (io.ReadCloser, error) { return os.Open(d.path(key)) }
+
+func (d DirStore) Delete(key string) error {
+	if err := os.Remove(d.path(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// S3Store is a BlobStore that keeps blobs as objects in a bucket of an S3
+// (or S3-compatible, e.g. minio) object storage service.  Requests are
+// authenticated with AWS signature version 4 and use path-style bucket
+// addressing.
+type S3Store struct {
+	// Endpoint is the base url of the service - e.g.
+	// "https://s3.us-east-1.amazonaws.com" or "http://localhost:9000".
+	Endpoint string
+	Bucket   string
+	// Prefix is prepended to each key to form the object name (e.g.
+	// "cloudlus/").
+	Prefix string
+	// Region is the region requests are signed for - "us-east-1" if empty.
+	Region    string
+	AccessKey string
+	SecretKey string
+	// Client is used to make requests - http.DefaultClient if nil.
+	Client *http.Client
+}
+
+// Put buffers r in a temporary file first if its size isn't known because
+// S3 requires the length of uploaded objects up front.
+func (s *S3Store) Put(key string, r io.Reader) error {
+	switch r.(type) {
+	case *bytes.Buffer, *bytes.Reader, *strings.Reader:
+		// http.NewRequest determines their length
+	default:
+		f, err := ioutil.TempFile("", "cloudlus-blob-")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		if _, err := io.Copy(f, r); err != nil {
+			return err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		} else if _, err := f.Seek(0, 0); err != nil {
+			return err
+		}
+		r = io.NewSectionReader(f, 0, info.Size())
+	}
+
+	resp, err := s.do("PUT", key, r)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3Store) Get(key string) (io.ReadCloser, error) {
+	resp, err := s.do("GET", key, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *S3Store) Delete(key string) error {
+	resp, err := s.do("DELETE", key, nil)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	} else if err == nil {
+		resp.Body.Close()
+	}
+	return nil
+}
+
+// do sends a signed request for the object with the given key.  Responses
+// with an unsuccessful status are returned as an error.
+func (s *S3Store) do(method, key string, body io.Reader) (*http.Response, error) {
+	u := strings.TrimRight(s.Endpoint, "/") + "/" + url.PathEscape(s.Bucket) + "/" + escapeKey(s.Prefix+key)
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if sr, ok := body.(*io.SectionReader); ok {
+		req.ContentLength = sr.Size()
+	}
+
+	region := s.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	signV4(req, "UNSIGNED-PAYLOAD", region, s.AccessKey, s.SecretKey, time.Now())
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, &os.PathError{Op: strings.ToLower(method), Path: s.Bucket + "/" + s.Prefix + key, Err: os.ErrNotExist}
+	} else if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+		return nil, fmt.Errorf("s3 %v %v failed (%v): %s", method, key, resp.Status, bytes.TrimSpace(msg))
+	}
+	return resp, nil
+}
+
+// escapeKey uri-encodes each segment of the object key k.
+func escapeKey(k string) string {
+	segs := strings.Split(k, "/")
+	for i, seg := range segs {
+		segs[i] = url.PathEscape(seg)
+	}
+	return strings.Join(segs, "/")
+}
+
+// signV4 signs req for the S3 service with AWS signature version 4 by
+// setting its X-Amz-Date, X-Amz-Content-Sha256 and Authorization headers.
+// All the request's headers (and its host) are signed.  payloadHash is the
+// hex encoded SHA256 of the request body or "UNSIGNED-PAYLOAD".
+func signV4(req *http.Request, payloadHash, region, accessKey, secretKey string, t time.Time) {
+	t = t.UTC()
+	amzdate := t.Format("20060102T150405Z")
+	date := t.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzdate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, vals := range req.Header {
+		for i := range vals {
+			vals[i] = strings.TrimSpace(vals[i])
+		}
+		headers[strings.ToLower(name)] = strings.Join(vals, ",")
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	canonHeaders := ""
+	for _, name := range names {
+		canonHeaders += name + ":" + headers[name] + "\n"
+	}
+	signed := strings.Join(names, ";")
+
+	canonReq := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.Query().Encode(),
+		canonHeaders,
+		signed,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	reqHash := sha256.Sum256([]byte(canonReq))
+	toSign := "AWS4-HMAC-SHA256\n" + amzdate + "\n" + scope + "\n" + hex.EncodeToString(reqHash[:])
+
+	key := []byte("AWS4" + secretKey)
+	for _, part := range []string{date, region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	sig := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%v/%v, SignedHeaders=%v, Signature=%v", accessKey, scope, signed, sig))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
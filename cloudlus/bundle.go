@@ -0,0 +1,88 @@
+package cloudlus
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+
+	"github.com/rwcarlsen/cloudlus/scen"
+)
+
+// handleBundle responds with a zip archive of everything needed to
+// reproduce a completed scenario job (see scen.Scenario.Bundle) along with
+// its objective value.  The job must carry its scenario file and cyclus
+// input file template (and template partials) - as jobs from
+// runscen.BuildRemoteJob and NewJobScenario do.
+func (s *Server) handleBundle(w http.ResponseWriter, r *http.Request) {
+	idstr := r.URL.Path[len("/api/v1/job-bundle/"):]
+	j, err := s.getjob(idstr)
+	if err != nil {
+		s.httperror(w, r, err.Error(), http.StatusNotFound)
+		return
+	} else if j.Status != StatusComplete {
+		msg := fmt.Sprintf("job %v is %v - only complete jobs can be bundled", j.Id, j.Status)
+		s.httpstatus(w, r, msg, http.StatusConflict)
+		return
+	}
+
+	scn, vars, err := bundleScenario(j)
+	if err != nil {
+		s.httperror(w, r, fmt.Sprintf("job %v can't be bundled: %v", j.Id, err), http.StatusBadRequest)
+		return
+	}
+
+	// jobs without an objective file (e.g. NewJobScenario jobs) are still
+	// bundled
+	m := &scen.Manifest{CyclusVersion: j.CyclusVersion}
+	if val, err := s.objective(j); err == nil {
+		m.Objective = &val
+	}
+
+	var buf bytes.Buffer
+	if err := scn.WriteBundle(&buf, vars, m); err != nil {
+		s.httperror(w, r, fmt.Sprintf("job %v can't be bundled: %v", j.Id, err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%v-bundle.zip", j.Id))
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+	w.Write(buf.Bytes())
+}
+
+// bundleScenario returns the scenario job j runs with its cyclus input file
+// template and partials loaded from j's input files and the vars it was run
+// with (nil if they aren't known).
+func bundleScenario(j *Job) (*scen.Scenario, []float64, error) {
+	scn, err := decodeJobScenario(j)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tmpl := j.infile(filepath.ToSlash(scn.CyclusTmpl))
+	if scn.CyclusTmpl == "" || tmpl == nil {
+		return nil, nil, fmt.Errorf("cyclus input file template '%v' not found", scn.CyclusTmpl)
+	} else if err := scn.ParseTmpl(string(tmpl.Data)); err != nil {
+		return nil, nil, err
+	}
+	for _, name := range scn.TmplPartials() {
+		partial := j.infile(filepath.ToSlash(name))
+		if partial == nil {
+			return nil, nil, fmt.Errorf("cyclus input file template partial '%v' not found", name)
+		} else if err := scn.AddTmplPartial(name, string(partial.Data)); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := scn.Validate(); err != nil {
+		return nil, nil, err
+	}
+
+	var vars []float64
+	if f := j.infile(scen.BundleVars); f != nil {
+		if err := json.Unmarshal(f.Data, &vars); err != nil {
+			return nil, nil, fmt.Errorf("invalid vars file: %v", err)
+		}
+	}
+	return scn, vars, nil
+}
@@ -0,0 +1,126 @@
+package cloudlus
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// checkpoint is the state saved to a server's CheckpointFile.
+type checkpoint struct {
+	Time    time.Time
+	Queue   []*Job
+	Running []*Job
+}
+
+// Checkpoint saves the server's queued and running jobs to its
+// CheckpointFile.  This happens automatically every CheckpointFreq and when
+// the server is closed.
+func (s *Server) Checkpoint() error {
+	if s.CheckpointFile == "" {
+		return errors.New("no checkpoint file configured")
+	}
+	ch := make(chan error, 1)
+	select {
+	case s.checkpoints <- ch:
+		return <-ch
+	case <-s.kill:
+		return errors.New("server is closed")
+	}
+}
+
+// checkpointLoop saves a checkpoint every CheckpointFreq until the server is
+// closed.
+func (s *Server) checkpointLoop() {
+	tick := time.NewTicker(s.CheckpointFreq)
+	defer tick.Stop()
+	for {
+		select {
+		case <-s.kill:
+			return
+		case <-tick.C:
+			if err := s.Checkpoint(); err != nil {
+				s.logf(LogError, "[CHECKPOINT] %v", err)
+			}
+		}
+	}
+}
+
+// writeCheckpoint writes the checkpoint file.  It is only called by the
+// dispatcher.  The file is replaced atomically so a crash while writing
+// leaves the previous checkpoint intact.
+func (s *Server) writeCheckpoint() error {
+	cp := checkpoint{Time: time.Now(), Queue: s.queue, Running: []*Job{}}
+	for _, j := range s.running {
+		cp.Running = append(cp.Running, j)
+	}
+	sort.Slice(cp.Running, func(i, j int) bool { return cp.Running[i].Submitted.Before(cp.Running[j].Submitted) })
+
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(s.CheckpointFile), ".checkpoint-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	} else if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), s.CheckpointFile); err != nil {
+		return err
+	}
+	s.logf(LogInfo, "[CHECKPOINT] saved %v queued and %v running jobs", len(cp.Queue), len(cp.Running))
+	return nil
+}
+
+// restoreCheckpoint requeues the queued and running jobs in the server's
+// CheckpointFile that aren't already queued or finished.  It must be called
+// before the dispatcher is started.  A missing checkpoint file is not an
+// error.
+func (s *Server) restoreCheckpoint() error {
+	if s.CheckpointFile == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(s.CheckpointFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	cp := checkpoint{}
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return err
+	}
+
+	queued := map[JobId]bool{}
+	for _, j := range s.queue {
+		queued[j.Id] = true
+	}
+
+	n := 0
+	for _, j := range append(cp.Queue, cp.Running...) {
+		if queued[j.Id] {
+			continue
+		} else if dbj, err := s.alljobs.Get(j.Id); err == nil && dbj.Done() {
+			continue
+		}
+		j.Status = StatusQueued
+		s.alljobs.Put(j)
+		s.queue = append(s.queue, j)
+		queued[j.Id] = true
+		n++
+	}
+	s.logf(LogInfo, "[CHECKPOINT] requeued %v jobs from checkpoint of %v", n, cp.Time)
+	return nil
+}
@@ -8,13 +8,18 @@ import (
 	"net/http"
 	"net/rpc"
 	"strings"
+	"sync"
 	"time"
 )
 
 type Client struct {
-	client *rpc.Client
-	err    error
-	addr   string
+	// mu guards client which may be replaced by reconnect while in use
+	// (e.g. by Heartbeat).
+	mu      sync.Mutex
+	client  *rpc.Client
+	err     error
+	addr    string
+	rpcaddr string
 }
 
 func Dial(addr string) (*Client, error) {
@@ -25,12 +30,40 @@ func Dial(addr string) (*Client, error) {
 	if err != nil {
 		return nil, err
 	}
+	rpcaddr := addr
 	if !strings.HasPrefix(addr, "http://") {
 		addr = "http://" + addr
 	}
-	return &Client{client: client, addr: addr}, nil
+	return &Client{client: client, addr: addr, rpcaddr: rpcaddr}, nil
 }
 
+// rpc returns the client's current rpc connection.
+func (c *Client) rpc() *rpc.Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.client
+}
+
+// reconnect replaces the client's rpc connection with a fresh one - e.g.
+// after the server restarted or the network dropped the old connection.
+func (c *Client) reconnect() error {
+	client, err := rpc.DialHTTP("tcp", c.rpcaddr)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	old := c.client
+	c.client = client
+	c.mu.Unlock()
+	old.Close()
+	return nil
+}
+
+// Heartbeat beats for job j every beatInterval until done is closed or the
+// server says to kill the job (sending true on kill).  If a beat fails, the
+// client reconnects to the server and keeps beating so a network blip or
+// server restart doesn't get the job requeued.
 func (c *Client) Heartbeat(w WorkerId, j JobId, done chan struct{}) (kill chan bool) {
 	kill = make(chan bool, 1)
 	go func() {
@@ -40,10 +73,17 @@ func (c *Client) Heartbeat(w WorkerId, j JobId, done chan struct{}) (kill chan b
 			select {
 			case <-tick.C:
 				var killval bool
-				err := c.client.Call("RPC.Heartbeat", NewBeat(w, j), &killval)
+				err := c.rpc().Call("RPC.Heartbeat", NewBeat(w, j), &killval)
+				if err != nil {
+					log.Printf("heartbeat for job %v failed: %v", j, err)
+					if err := c.reconnect(); err != nil {
+						log.Printf("reconnecting to %v: %v", c.rpcaddr, err)
+						continue
+					}
+					err = c.rpc().Call("RPC.Heartbeat", NewBeat(w, j), &killval)
+				}
 				if err != nil {
 					log.Print(err)
-					return
 				} else if killval {
 					kill <- true
 					return
@@ -58,7 +98,7 @@ func (c *Client) Heartbeat(w WorkerId, j JobId, done chan struct{}) (kill chan b
 
 func (c *Client) Retrieve(j JobId) (*Job, error) {
 	var result *Job
-	err := c.client.Call("RPC.Retrieve", j, &result)
+	err := c.rpc().Call("RPC.Retrieve", j, &result)
 	if err != nil {
 		return nil, err
 	}
@@ -113,7 +153,7 @@ func (c *Client) RetrieveOutfileData(j *Job, fname string) ([]byte, error) {
 
 func (c *Client) Submit(j *Job) error {
 	var unused int
-	return c.client.Call("RPC.SubmitAsync", j, &unused)
+	return c.rpc().Call("RPC.SubmitAsync", j, &unused)
 }
 
 func (c *Client) Run(j *Job) (*Job, error) {
@@ -138,7 +178,7 @@ func (c *Client) Start(j *Job, ch chan *Job) chan *Job {
 
 	go func() {
 		result := &Job{}
-		c.err = c.client.Call("RPC.Submit", j, &result)
+		c.err = c.rpc().Call("RPC.Submit", j, &result)
 		if c.err != nil {
 			ch <- nil
 		} else {
@@ -150,16 +190,40 @@ func (c *Client) Start(j *Job, ch chan *Job) chan *Job {
 
 func (c *Client) Fetch(w *Worker) (*Job, error) {
 	j := &Job{}
-	err := c.client.Call("RPC.Fetch", w.Id, &j)
+	var err error
+	if w.Class == "" {
+		err = c.rpc().Call("RPC.Fetch", w.Id, &j)
+	} else {
+		err = c.rpc().Call("RPC.FetchClass", FetchRequest{WorkerId: w.Id, Class: w.Class}, &j)
+	}
 	if err != nil {
 		return nil, err
 	}
 	return j, nil
 }
 
+// FetchN fetches up to n jobs for the worker w in a single request (see
+// RPC.FetchN).
+func (c *Client) FetchN(w *Worker, n int) ([]*Job, error) {
+	jobs := []*Job{}
+	err := c.rpc().Call("RPC.FetchN", FetchRequest{WorkerId: w.Id, Class: w.Class, N: n}, &jobs)
+	if err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
 func (c *Client) Push(w *Worker, j *Job) error {
+	j.WorkerId = w.Id
+	var unused int
+	return c.rpc().Call("RPC.Push", j, &unused)
+}
+
+// PushLog sends a running job's new log output to the server (see
+// RPC.PushLog).
+func (c *Client) PushLog(lc LogChunk) error {
 	var unused int
-	return c.client.Call("RPC.Push", j, &unused)
+	return c.rpc().Call("RPC.PushLog", lc, &unused)
 }
 
-func (c *Client) Close() error { return c.client.Close() }
+func (c *Client) Close() error { return c.rpc().Close() }
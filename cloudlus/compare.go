@@ -0,0 +1,254 @@
+package cloudlus
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rwcarlsen/cloudlus/scen"
+)
+
+var comparetmplstr = `
+<!DOCTYPE html>
+<html lang="en-US">
+<head>
+    <title> Cyclus Run Comparison </title>
+	<style>
+		table {
+			border-collapse:collapse;
+			margin-bottom:20px;
+		}
+		th, td {
+			padding:4px;
+			border:1px solid #a9a9a9;
+		}
+		th {
+			background-color:#b8b8b8;
+		}
+		tr.diff {
+			background-color:#FFE0B2;
+		}
+	</style>
+</head>
+<body lang="en">
+<h2>Job comparison</h2>
+<table>
+    <tr><th></th>{{range .Jobs}}<th>{{.Id}}</th>{{end}}</tr>
+    <tr><td>Status</td>{{range .Jobs}}<td>{{.Status}}</td>{{end}}</tr>
+    <tr{{if .CyclusDiff}} class="diff"{{end}}><td>Cyclus</td>{{range .Jobs}}<td>{{.CyclusVersion}}</td>{{end}}</tr>
+    <tr{{if .ObjDiff}} class="diff"{{end}}><td>Objective</td>{{range .Jobs}}<td>{{.Objective}}</td>{{end}}</tr>
+    <tr{{if .ScenDiff}} class="diff"{{end}}><td>Scenario</td>{{range .Jobs}}<td>{{.Summary}}</td>{{end}}</tr>
+    <tr><td>Problems</td>{{range .Jobs}}<td>{{.Error}}</td>{{end}}</tr>
+</table>
+
+<h3>Deployment schedules</h3>
+{{if .Rows}}
+<table>
+    <tr><th>Time</th><th>Prototype</th>{{range .Jobs}}<th>{{.Id}} count</th>{{end}}{{range .Jobs}}<th>{{.Id}} cumulative power</th>{{end}}</tr>
+    {{range .Rows}}
+    <tr{{if .Diff}} class="diff"{{end}}>
+        <td>{{.Time}}</td><td>{{.Proto}}</td>
+        {{range .Counts}}<td>{{.}}</td>{{end}}
+        {{range .Powers}}<td>{{.}}</td>{{end}}
+    </tr>
+    {{end}}
+</table>
+{{else}}
+<p>neither job has a deployment schedule</p>
+{{end}}
+</body>
+</html>
+`
+
+var comparetmpl = template.Must(template.New("compare").Parse(comparetmplstr))
+
+// compareJob is one job's column on the dashboard comparison page.
+type compareJob struct {
+	Id            string
+	Status        string
+	CyclusVersion string
+	Objective     string
+	Summary       string
+	// Error describes why (some of) the job's details aren't available.
+	Error string
+	// sched maps schedule keys (see compareKey) to the job's ScheduleCSV
+	// count and cumulative power columns.
+	sched map[compareKey][2]string
+}
+
+type compareKey struct {
+	Time  int
+	Proto string
+}
+
+// compareRow is one time step and prototype row of the compared deployment
+// schedules.  Diff is true if the jobs' counts differ.
+type compareRow struct {
+	compareKey
+	Counts []string
+	Powers []string
+	Diff   bool
+}
+
+type comparePage struct {
+	Jobs       []*compareJob
+	Rows       []compareRow
+	ObjDiff    bool
+	ScenDiff   bool
+	CyclusDiff bool
+}
+
+// dashboardCompare renders the deployment schedules and objective values of
+// the two jobs given by the "a" and "b" parameters side by side.  Missing
+// jobs, incomplete jobs, and jobs that aren't scenario runs just have fewer
+// details.
+func (s *Server) dashboardCompare(w http.ResponseWriter, r *http.Request) {
+	ids := []string{strings.TrimSpace(r.FormValue("a")), strings.TrimSpace(r.FormValue("b"))}
+	if ids[0] == "" || ids[1] == "" {
+		s.httperror(w, r, "two job ids (a and b) are required", http.StatusBadRequest)
+		return
+	}
+
+	page := comparePage{}
+	for _, id := range ids {
+		page.Jobs = append(page.Jobs, s.compareJob(id))
+	}
+	a, b := page.Jobs[0], page.Jobs[1]
+	page.ObjDiff = a.Objective != b.Objective
+	page.ScenDiff = a.Summary != b.Summary
+	page.CyclusDiff = a.CyclusVersion != b.CyclusVersion
+
+	keys := map[compareKey]bool{}
+	for _, cj := range page.Jobs {
+		for k := range cj.sched {
+			keys[k] = true
+		}
+	}
+	for k := range keys {
+		row := compareRow{compareKey: k}
+		for _, cj := range page.Jobs {
+			vals, ok := cj.sched[k]
+			if !ok {
+				vals = [2]string{"0", ""}
+			}
+			row.Counts = append(row.Counts, vals[0])
+			row.Powers = append(row.Powers, vals[1])
+		}
+		row.Diff = row.Counts[0] != row.Counts[1]
+		page.Rows = append(page.Rows, row)
+	}
+	sort.Slice(page.Rows, func(i, j int) bool {
+		ki, kj := page.Rows[i].compareKey, page.Rows[j].compareKey
+		if ki.Time != kj.Time {
+			return ki.Time < kj.Time
+		}
+		return ki.Proto < kj.Proto
+	})
+
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+	if err := comparetmpl.Execute(w, page); err != nil {
+		s.httperror(w, r, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// compareJob collects the comparison details of the job with id idstr.
+func (s *Server) compareJob(idstr string) *compareJob {
+	cj := &compareJob{Id: idstr, Objective: "n/a"}
+	j, err := s.getjob(idstr)
+	if err != nil {
+		cj.Error = err.Error()
+		return cj
+	}
+	cj.Status = j.Status
+	cj.CyclusVersion = j.CyclusVersion
+
+	var errs []string
+	if j.Status == StatusComplete {
+		if val, err := s.objective(j); err != nil {
+			errs = append(errs, err.Error())
+		} else {
+			cj.Objective = strconv.FormatFloat(val, 'g', -1, 64)
+		}
+	}
+
+	if scn, err := jobScenario(j); err != nil {
+		errs = append(errs, err.Error())
+	} else if cj.sched, err = scheduleOf(scn); err != nil {
+		errs = append(errs, err.Error())
+	} else {
+		cj.Summary = scn.Summary()
+	}
+	cj.Error = strings.Join(errs, "; ")
+	return cj
+}
+
+// jobScenario returns the scenario (with its Builds) that job j runs - the
+// scenario file passed to cycobj with -scen or a "scenario.json" input file.
+func jobScenario(j *Job) (*scen.Scenario, error) {
+	scn, err := decodeJobScenario(j)
+	if err != nil {
+		return nil, err
+	}
+	// the template isn't needed to link the builds to their prototypes
+	scn.CyclusTmpl = ""
+	if err := scn.Validate(); err != nil {
+		return nil, err
+	}
+	return scn, nil
+}
+
+// decodeJobScenario decodes job j's scenario file (see jobScenario) without
+// validating it.
+func decodeJobScenario(j *Job) (*scen.Scenario, error) {
+	name := "scenario.json"
+	for i, arg := range j.Cmd {
+		if arg == "-scen" && i+1 < len(j.Cmd) {
+			name = j.Cmd[i+1]
+		}
+	}
+
+	f := j.infile(name)
+	if f == nil {
+		return nil, errors.New("job has no scenario")
+	}
+	scn := &scen.Scenario{}
+	if err := json.Unmarshal(f.Data, scn); err != nil {
+		return nil, fmt.Errorf("invalid scenario file %v: %v", name, err)
+	}
+	return scn, nil
+}
+
+// scheduleOf returns the ScheduleCSV count and cumulative power columns of
+// the scenario's Builds keyed by time and prototype.
+func scheduleOf(scn *scen.Scenario) (map[compareKey][2]string, error) {
+	builds := map[string][]scen.Build{}
+	for _, b := range scn.Builds {
+		builds[b.Proto] = append(builds[b.Proto], b)
+	}
+
+	var buf bytes.Buffer
+	if err := scn.ScheduleCSV(&buf, builds); err != nil {
+		return nil, err
+	}
+	recs, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	sched := map[compareKey][2]string{}
+	for _, rec := range recs[1:] {
+		t, err := strconv.Atoi(rec[0])
+		if err != nil {
+			return nil, err
+		}
+		sched[compareKey{t, rec[1]}] = [2]string{rec[2], rec[3]}
+	}
+	return sched, nil
+}
@@ -4,26 +4,46 @@ import (
 	"fmt"
 	"html/template"
 	"net/http"
-	"sort"
+	"strconv"
 	"time"
 )
 
 var dashtmplstr = `
+<div class="dash-nav">
+    <select onchange="showDash(this.value)">
+    {{range .Statuses}}
+        {{if .Selected}}
+        <option value="{{.Query}}" selected>{{.Label}}</option>
+        {{else}}
+        <option value="{{.Query}}">{{.Label}}</option>
+        {{end}}
+    {{end}}
+    </select>
+    {{if .Jobs}}jobs {{.First}}-{{.Last}}{{else}}no jobs{{end}}
+    {{if .Prev}}<a href="#" onclick="showDash({{.Prev}}); return false">&laquo; newer</a>{{end}}
+    {{if .Next}}<a href="#" onclick="showDash({{.Next}}); return false">older &raquo;</a>{{end}}
+</div>
 <table>
-    <tr><th>Job ID</th><th>Status</th><th>Output</th></tr>
+    <tr><th>Job ID</th><th>Status</th><th>Attempts</th><th>Cyclus</th><th>Tags</th><th>Output</th></tr>
 
-    {{ range $job := .}}
+    {{ range $job := .Jobs}}
     <tr class="status-{{$job.Status}}">
         <td><a href="{{$job.Host}}/dashboard/infile/{{$job.Id}}">{{$job.Id}}</a></td>
 
         {{if eq $job.Status "complete"}}
         <td><a href="{{$job.Host}}/dashboard/output/{{$job.Id}}">{{$job.Status}}</a></td>
         {{else if eq $job.Status "failed"}}
+        <td><a href="{{$job.Host}}/dashboard/output/{{$job.Id}}">{{$job.Status}}</a></td>
+        {{else if eq $job.Status "canceled"}}
         <td><a href="{{$job.Host}}/dashboard/output/{{$job.Id}}">{{$job.Status}}</a></td>
 		{{else}}
         <td>{{$job.Status}}</td>
         {{end}}
 
+        <td title="{{$job.LastError}}">{{$job.Attempts}}</td>
+        <td>{{$job.CyclusVersion}}</td>
+        <td>{{range $k, $v := $job.Tags}}{{$k}}:{{$v}} {{end}}</td>
+
         {{if eq $job.Status "complete"}}
         <td><a href="{{$job.Host}}/api/v1/job-outfiles/{{$job.Id}}">Results</a></td>
         {{else}}
@@ -37,13 +57,43 @@ var tmpl = template.Must(template.New("dashtable").Parse(dashtmplstr))
 var hometmpl = template.Must(template.New("home").Parse(home))
 var resettmpl = template.Must(template.New("reset").Parse(resetPage))
 
+// ncompleted is the default number of jobs per dashboard page.
 const ncompleted = 100
 
+// dashStatuses are the job statuses the dashboard can be filtered by - the
+// empty status shows all jobs.
+var dashStatuses = []string{"", StatusQueued, StatusRunning, StatusComplete, StatusFailed, StatusCanceled}
+
 type JobData struct {
 	Id        string
 	Status    string
 	Submitted time.Time
 	Host      string
+	Attempts  int
+	LastError string
+	Tags      map[string]string
+	// CyclusVersion is the cyclus version the job last ran with.
+	CyclusVersion string
+}
+
+// dashPage is a page of the dashboard's job table.  Query strings (e.g.
+// Prev) are relative to the /dashboard path.
+type dashPage struct {
+	Jobs []JobData
+	// First and Last are the (1-based) positions of the page's jobs among
+	// all the jobs matching the page's filter.
+	First, Last int
+	Statuses    []dashOption
+	// Prev and Next are the query strings for the pages of newer and older
+	// jobs - empty if there isn't one.
+	Prev, Next string
+}
+
+// dashOption is an entry in the dashboard's status filter dropdown.
+type dashOption struct {
+	Label    string
+	Query    string
+	Selected bool
 }
 
 type JobList []*Job
@@ -55,27 +105,77 @@ type BySubmitted struct{ JobList }
 
 func (s BySubmitted) Less(i, j int) bool { return s.JobList[i].Submitted.After(s.JobList[j].Submitted) }
 
+// dashboard renders one page of the job table - newest jobs first.  The
+// jobs can be filtered with the same query parameters as /api/v1/jobs (see
+// parseJobFilter) and paged with the "limit" (default ncompleted) and
+// "offset" parameters.
 func (s *Server) dashboard(w http.ResponseWriter, r *http.Request) {
-	jobs, _ := s.alljobs.Current()
-	completed, _ := s.alljobs.Recent(ncompleted)
-	jobs = append(jobs, completed...)
-	sort.Sort(BySubmitted{jobs})
+	f, err := parseJobFilter(r)
+	if err != nil {
+		s.httperror(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	offset, limit := 0, ncompleted
+	if v := r.FormValue("offset"); v != "" {
+		if offset, err = strconv.Atoi(v); err != nil || offset < 0 {
+			s.httperror(w, r, fmt.Sprintf("invalid offset '%v'", v), http.StatusBadRequest)
+			return
+		}
+	}
+	if v := r.FormValue("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+			s.httperror(w, r, fmt.Sprintf("invalid limit '%v'", v), http.StatusBadRequest)
+			return
+		}
+	}
 
-	jds := []JobData{}
+	jobs, more := s.ListPage(f, offset, limit)
+	page := dashPage{First: offset + 1, Last: offset + len(jobs)}
 	for _, j := range jobs {
-		jd := JobData{
-			Id:        fmt.Sprintf("%v", j.Id),
-			Status:    j.Status,
-			Submitted: j.Submitted,
-			Host:      s.Host,
+		page.Jobs = append(page.Jobs, JobData{
+			Id:            j.Id.String(),
+			Status:        j.Status,
+			Submitted:     j.Submitted,
+			Host:          s.Host,
+			Attempts:      j.Attempts,
+			LastError:     j.LastError,
+			Tags:          j.Tags,
+			CyclusVersion: j.CyclusVersion,
+		})
+	}
+
+	pageQuery := func(off int) string {
+		q := r.URL.Query()
+		q.Set("offset", strconv.Itoa(off))
+		return "?" + q.Encode()
+	}
+	if offset > 0 {
+		prev := offset - limit
+		if prev < 0 {
+			prev = 0
 		}
-		jds = append(jds, jd)
+		page.Prev = pageQuery(prev)
+	}
+	if more {
+		page.Next = pageQuery(offset + limit)
+	}
+
+	for _, status := range dashStatuses {
+		q := r.URL.Query()
+		q.Del("offset")
+		q.Set("status", status)
+		opt := dashOption{Label: status, Query: "?" + q.Encode(), Selected: status == f.Status}
+		if status == "" {
+			q.Del("status")
+			opt.Label, opt.Query = "all", "?"+q.Encode()
+		}
+		page.Statuses = append(page.Statuses, opt)
 	}
 
 	// allow cross-domain ajax requests for the dashboard content
 	w.Header().Add("Access-Control-Allow-Origin", "*")
-	if err := tmpl.Execute(w, jds); err != nil {
-		httperror(w, err.Error(), http.StatusInternalServerError)
+	if err := tmpl.Execute(w, page); err != nil {
+		s.httperror(w, r, err.Error(), http.StatusInternalServerError)
 	}
 }
 
@@ -83,7 +183,7 @@ func (s *Server) dashmain(w http.ResponseWriter, r *http.Request) {
 	w.Header().Add("Access-Control-Allow-Origin", "*")
 	err := hometmpl.Execute(w, s)
 	if err != nil {
-		httperror(w, err.Error(), http.StatusInternalServerError)
+		s.httperror(w, r, err.Error(), http.StatusInternalServerError)
 	}
 }
 
@@ -91,7 +191,7 @@ func (s *Server) dashreset(w http.ResponseWriter, r *http.Request) {
 	w.Header().Add("Access-Control-Allow-Origin", "*")
 	err := resettmpl.Execute(w, s)
 	if err != nil {
-		httperror(w, err.Error(), http.StatusInternalServerError)
+		s.httperror(w, r, err.Error(), http.StatusInternalServerError)
 	}
 }
 
@@ -99,19 +199,24 @@ func (s *Server) dashboardInfile(w http.ResponseWriter, r *http.Request) {
 	idstr := r.URL.Path[len("/dashboard/infile/"):]
 	j, err := s.getjob(idstr)
 	if err != nil {
-		httperror(w, err.Error(), http.StatusInternalServerError)
+		s.httperror(w, r, err.Error(), http.StatusInternalServerError)
 		return
 	} else if j == nil {
-		httperror(w, "job id not found", http.StatusBadRequest)
+		s.httperror(w, r, "job id not found", http.StatusBadRequest)
 		return
 	}
 
+	f, err := cyclusInfile(j)
+	if err != nil {
+		s.httperror(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
 	w.Header().Add("Content-Type", "text/xml")
 	w.Header().Add("Content-Disposition", fmt.Sprintf("filename=\"job-id-%v-infile.xml\"", j.Id))
-	if len(j.Infiles) == 0 {
+	if f == nil {
 		fmt.Fprint(w, "[job contains no input data]")
 	} else {
-		w.Write(j.Infiles[0].Data)
+		w.Write(f.Data)
 	}
 }
 
@@ -119,18 +224,18 @@ func (s *Server) dashboardOutput(w http.ResponseWriter, r *http.Request) {
 	idstr := r.URL.Path[len("/dashboard/output/"):]
 	j, err := s.getjob(idstr)
 	if err != nil {
-		httperror(w, err.Error(), http.StatusInternalServerError)
+		s.httperror(w, r, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	_, err = w.Write([]byte(j.Stdout))
 	if err != nil {
-		httperror(w, err.Error(), http.StatusInternalServerError)
+		s.httperror(w, r, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	_, err = w.Write([]byte(j.Stderr))
 	if err != nil {
-		httperror(w, err.Error(), http.StatusInternalServerError)
+		s.httperror(w, r, err.Error(), http.StatusInternalServerError)
 		return
 	}
 }
@@ -141,7 +246,7 @@ func (s *Server) dashboardDefaultInfile(w http.ResponseWriter, r *http.Request)
 	w.Header().Add("Content-Type", "text/plain")
 	_, err := w.Write([]byte(defaultInfile))
 	if err != nil {
-		httperror(w, err.Error(), http.StatusInternalServerError)
+		s.httperror(w, r, err.Error(), http.StatusInternalServerError)
 		return
 	}
 }
@@ -258,6 +363,16 @@ const home = `
 		#dashboard tr.status-failed {
 			background-color:#F0C2B2;
 		}
+		#dashboard tr.status-canceled {
+			background-color:#E0E0E0;
+		}
+
+		#dashboard .dash-nav {
+			width:80%;
+			margin:auto;
+			padding:4px;
+			text-align:left;
+		}
 
 		#stats,#since {
 			width:80%;
@@ -297,6 +412,9 @@ const home = `
 			<li>
 				{{.Stats.NFailed}} jobs failed
 			</li>
+			<li>
+				{{.Stats.NCanceled}} jobs canceled
+			</li>
 			<li>
 				{{.Stats.NSubmitted}} jobs received
 			</li>
@@ -305,9 +423,16 @@ const home = `
 			<li>
 				{{.Stats.NRequeued}} jobs requeued
 			</li>
+			<li>
+				{{.Stats.NRetried}} failed jobs retried
+			</li>
 			<li>
 				{{.Stats.NPurged}} old jobs purged.
 			</li>
+			<li>
+				{{.Stats.DBSizeMB}} of {{.Stats.DBLimitMB}} MB job db used
+				({{.Stats.DBRawMB}} MB uncompressed, {{printf "%.1f" .Stats.DBCompression}}x compression).
+			</li>
 			<li>
 				{{.Stats.NBanned}} workers banned.
 			</li>
@@ -338,20 +463,43 @@ const home = `
 
     <script> 
         var server = "{{.Host}}"
+        // query string selecting the dashboard page being viewed
+        var dashquery = ""
 
         function submitJob() {
             var text = $('#infile-box').val();
             $.post(server + "/api/v1/job-infile", text, function(data) {
                 var resp = JSON.parse(data)
                 $('#jobid').text(resp.Id);
-                $('#dashboard').load(server + "/dashboard");
+                $('#dashboard').load(server + "/dashboard" + dashquery);
             })
         }
+        function showDash(query) {
+            dashquery = query;
+            $('#dashboard').load(server + "/dashboard" + dashquery);
+        }
         function loadDash() {
-            $('#dashboard').load(server + "/dashboard", function() {
+            $('#dashboard').load(server + "/dashboard" + dashquery, function() {
                 setTimeout("loadDash()", 30000)
             });
         }
+        // reload the dashboard (at most once a second) whenever job
+        // statuses change.
+        function watchJobs() {
+            var base = server ? server.replace(/^http/, "ws") : "ws://" + location.host;
+            var ws = new WebSocket(base + "/ws/jobs");
+            var pending = false;
+            ws.onmessage = function() {
+                if (pending) {
+                    return;
+                }
+                pending = true;
+                setTimeout(function() {
+                    pending = false;
+                    $('#dashboard').load(server + "/dashboard" + dashquery);
+                }, 1000);
+            };
+        }
         function loadDefaultInfile() {
             $.get(server + "/dashboard/default-infile", function( data ) {
                 $('#infile-box').text(data);
@@ -360,6 +508,7 @@ const home = `
 
         loadDefaultInfile();
         loadDash();
+        watchJobs();
     </script>
 
 </body>
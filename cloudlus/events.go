@@ -0,0 +1,95 @@
+package cloudlus
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// eventBuffer is the number of events buffered for each subscriber.  Events
+// are dropped for subscribers that fall further behind than this.
+const eventBuffer = 100
+
+// JobEvent describes a change in a job's status.
+type JobEvent struct {
+	Id JobId
+	// OldStatus is the job's previous status (empty for newly submitted
+	// jobs).
+	OldStatus string
+	NewStatus string
+	Time      time.Time
+}
+
+// Subscribe returns a channel that receives an event for every job status
+// change on the server.  Events are never allowed to block the server, so
+// slow subscribers may miss events.  Unsubscribe should be called when the
+// channel is no longer needed.
+func (s *Server) Subscribe() chan JobEvent {
+	ch := make(chan JobEvent, eventBuffer)
+	select {
+	case s.subscribe <- ch:
+	case <-s.kill:
+	}
+	return ch
+}
+
+// Unsubscribe stops sending events to ch.
+func (s *Server) Unsubscribe(ch chan JobEvent) {
+	select {
+	case s.unsubscribe <- ch:
+	case <-s.kill:
+	}
+}
+
+// notify sends a status change event for j to all subscribers.  It must only
+// be called from the dispatcher.
+func (s *Server) notify(j *Job, oldstatus string) {
+	ev := JobEvent{Id: j.Id, OldStatus: oldstatus, NewStatus: j.Status, Time: time.Now()}
+	for ch := range s.subscribers {
+		select {
+		case ch <- ev:
+		default:
+			s.logf(LogWarn, "[EVENT] dropped event for slow subscriber (job %v)", j.Id)
+		}
+	}
+}
+
+// handleJobEvents streams job status change events as JSON messages over a
+// websocket connection.
+func (s *Server) handleJobEvents(w http.ResponseWriter, r *http.Request) {
+	// subscribe before completing the handshake so clients don't miss events
+	// that happen right after they connect.
+	ch := s.Subscribe()
+	defer s.Unsubscribe(ch)
+
+	conn, err := wsUpgrade(w, r)
+	if err != nil {
+		s.httperror(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer conn.Close()
+
+	closed := make(chan struct{})
+	go func() {
+		conn.WaitClose()
+		close(closed)
+	}()
+
+	for {
+		select {
+		case ev := <-ch:
+			data, err := json.Marshal(ev)
+			if err != nil {
+				s.logf(LogError, "[EVENT] %v", err)
+				continue
+			}
+			if err := conn.WriteText(data); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		case <-s.kill:
+			return
+		}
+	}
+}
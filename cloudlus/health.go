@@ -0,0 +1,55 @@
+package cloudlus
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// dispatchLimit returns how long the dispatcher may go without completing a
+// loop iteration before it is considered wedged.  The dispatcher wakes up at
+// least every beatCheckFreq even when idle.
+func dispatchLimit() time.Duration { return 3 * beatCheckFreq }
+
+// tick records that the dispatcher is alive and processing events.
+func (s *Server) tick() { s.dispatchTick.Store(time.Now().UnixNano()) }
+
+// dispatcherHealth returns an error if the dispatcher isn't running or
+// hasn't made progress recently.
+func (s *Server) dispatcherHealth() error {
+	last := s.dispatchTick.Load()
+	if last == 0 {
+		return fmt.Errorf("dispatcher not running")
+	}
+	if since := time.Since(time.Unix(0, last)); since > dispatchLimit() {
+		return fmt.Errorf("dispatcher unresponsive for %v", since)
+	}
+	return nil
+}
+
+// handleHealthz is a liveness check - it responds with 200 (OK) as long as
+// the http server and the dispatcher are alive and 503 (Service
+// Unavailable) otherwise.
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if err := s.dispatcherHealth(); err != nil {
+		s.reqlogf(r, LogError, "[HEALTH] %v", err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// handleReadyz is a readiness check - it responds with 200 (OK) once the
+// server can process jobs: the job db has been loaded (which NewServer does
+// before returning) and the dispatcher is running.  Otherwise it responds
+// with 503 (Service Unavailable).
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if s.alljobs == nil {
+		http.Error(w, "job db not loaded", http.StatusServiceUnavailable)
+		return
+	} else if err := s.dispatcherHealth(); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
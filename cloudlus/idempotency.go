@@ -0,0 +1,35 @@
+package cloudlus
+
+// maxIdemKeys is the number of submission idempotency keys a server
+// remembers.
+var maxIdemKeys = 10000
+
+// idemKeys is a bounded map of the idempotency keys of job submissions to
+// the ids of the jobs submitted with them.  Once it holds maxIdemKeys keys,
+// the oldest keys are forgotten first.  Its zero value is ready to use.
+type idemKeys struct {
+	ids   map[string]JobId
+	order []string
+}
+
+// get returns the id of the job submitted with key.  The empty key is never
+// found.
+func (k *idemKeys) get(key string) (JobId, bool) {
+	id, ok := k.ids[key]
+	return id, ok && key != ""
+}
+
+func (k *idemKeys) add(key string, id JobId) {
+	if k.ids == nil {
+		k.ids = map[string]JobId{}
+	}
+	if _, ok := k.ids[key]; !ok {
+		k.order = append(k.order, key)
+	}
+	k.ids[key] = id
+
+	for len(k.order) > maxIdemKeys {
+		delete(k.ids, k.order[0])
+		k.order = k.order[1:]
+	}
+}
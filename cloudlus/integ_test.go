@@ -1,12 +1,15 @@
 package cloudlus
 
 import (
+	"bytes"
 	"io/ioutil"
 	"log"
+	"os"
 	"testing"
 	"time"
 
 	"code.google.com/p/go-uuid/uuid"
+	"github.com/rwcarlsen/cloudlus/scen"
 )
 
 const workerpoll = 1 * time.Second
@@ -61,8 +64,9 @@ func TestRequeue(t *testing.T) {
 	// empty path for in-memory db
 	db, err := NewDB("", dblimit)
 	s := NewServer(testaddr, testaddr, db)
+	errs := make(chan error, 1)
 	go func() {
-		t.Fatal(s.ListenAndServe())
+		errs <- s.ListenAndServe()
 	}()
 	defer s.Close()
 
@@ -71,6 +75,11 @@ func TestRequeue(t *testing.T) {
 	s.Start(j, nil)
 
 	time.Sleep(1 * time.Second)
+	select {
+	case err := <-errs:
+		t.Fatal(err)
+	default:
+	}
 
 	kill1 := make(chan struct{})
 	w1 := &badWorker{ServerAddr: testaddr, MaxFetch: 1}
@@ -109,6 +118,106 @@ func TestRequeue(t *testing.T) {
 	close(kill2)
 }
 
+// TestRetry checks that failed jobs are rerun up to their MaxRetries limit
+// before being marked as permanently failed.
+func TestRetry(t *testing.T) {
+	testaddr := "127.0.0.1:45690"
+	retryBackoff = 100 * time.Millisecond
+
+	// empty path for in-memory db
+	db, _ := NewDB("", dblimit)
+	s := NewServer(testaddr, testaddr, db)
+	nolog(s)
+	go s.ListenAndServe()
+	defer s.Close()
+
+	// goodWorker only runs 'date', so this job always fails
+	j := NewJobCmd("false")
+	j.MaxRetries = 2
+	ch := s.Start(j, nil)
+
+	w := &goodWorker{ServerAddr: testaddr}
+	kill := make(chan struct{})
+	go w.Run(kill)
+	defer close(kill)
+
+	select {
+	case j = <-ch:
+	case <-time.After(10 * workerpoll):
+		t.Fatalf("job was not finished after %v", 10*workerpoll)
+	}
+
+	if j.Status != StatusFailed {
+		t.Errorf("wrong job status: got '%v', expected '%v'", j.Status, StatusFailed)
+	}
+	if want := j.MaxRetries + 1; j.Attempts != want {
+		t.Errorf("wrong number of attempts: got %v, expected %v", j.Attempts, want)
+	}
+	if j.LastError == "" {
+		t.Errorf("LastError was not recorded for retried job")
+	}
+}
+
+// TestLocalWorkers checks that a server with local workers runs jobs to
+// completion without any external workers.
+func TestLocalWorkers(t *testing.T) {
+	testaddr := "127.0.0.1:45691"
+	localWait = 100 * time.Millisecond
+
+	// empty path for in-memory db
+	db, _ := NewDB("", dblimit)
+	s := NewServer(testaddr, testaddr, db)
+	s.LocalWorkers = 2
+	nolog(s)
+	go s.ListenAndServe()
+	defer s.Close()
+
+	j := NewJobCmd("sh", "-c", "echo hello > out.txt")
+	j.AddOutfile("out.txt")
+	ch := s.Start(j, nil)
+	defer os.Remove(outfileName(j.Id))
+
+	select {
+	case j = <-ch:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("job was not finished after %v", 5*time.Second)
+	}
+
+	if j.Status != StatusComplete {
+		t.Fatalf("wrong job status: got '%v', expected '%v' (stderr: %v)", j.Status, StatusComplete, j.Stderr)
+	} else if j.CyclusVersion != "" {
+		t.Errorf("got cyclus version %q for a job not running cyclus, want none", j.CyclusVersion)
+	}
+
+	data, err := ioutil.ReadFile(outfileName(j.Id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, err := j.GetOutfile(bytes.NewReader(data), len(data), "out.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	out, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	} else if string(out) != "hello\n" {
+		t.Errorf("wrong outfile contents: got %q, expected %q", out, "hello\n")
+	}
+
+	j = NewJobCmd("true")
+	j.RecordCyclusVersion = true
+	ch = s.Start(j, nil)
+	select {
+	case j = <-ch:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("job was not finished after %v", 5*time.Second)
+	}
+	if j.CyclusVersion != scen.CyclusVersion() {
+		t.Errorf("got job cyclus version %q, want %q", j.CyclusVersion, scen.CyclusVersion())
+	}
+}
+
 type goodWorker struct {
 	Id         WorkerId
 	ServerAddr string
@@ -9,17 +9,36 @@ import (
 	"log"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 
 	"code.google.com/p/go-uuid/uuid"
 )
 
+// Job statuses.  A job's status moves through the lifecycle:
+//
+//	queued -> running -> complete, failed, or canceled
+//
+// The allowed transitions are:
+//
+//   - queued -> running: a worker fetched the job.
+//   - running -> queued: the job's worker stopped beating (requeue) or the
+//     job failed and has retries left.
+//   - running -> complete or failed: the worker finished the job (or it
+//     timed out).
+//   - queued -> failed: the queue was reset.
+//   - queued or running -> canceled: the job was canceled by a user (see
+//     Server.Cancel).
+//
+// Complete, failed, and canceled are final - see Job.Done.
 const (
 	StatusQueued   = "queued"
 	StatusRunning  = "running"
 	StatusComplete = "complete"
 	StatusFailed   = "failed"
+	StatusCanceled = "canceled"
 )
 
 const DefaultInfile = "input.xml"
@@ -27,25 +46,82 @@ const DefaultInfile = "input.xml"
 var DefaultTimeout = 600 * time.Second
 
 type Job struct {
-	Id        JobId
-	Cmd       []string
-	Infiles   []File
-	Outfiles  []File
-	Status    string
-	Stdout    string
-	Stderr    string
-	Timeout   time.Duration
-	Submitted time.Time
-	Fetched   time.Time
-	Started   time.Time
-	CmdDur    time.Duration
-	Finished  time.Time
-	WorkerId  WorkerId
-	Note      string
-	dir       string
-	wd        string
-	whitelist []string
-	log       io.Writer
+	Id       JobId
+	Cmd      []string
+	Infiles  []File
+	Outfiles []File
+	// OutfilePatterns optionally holds glob patterns (see filepath.Match) that
+	// restrict which of the Outfiles are collected and returned after the job
+	// runs - Outfiles whose names match none of the patterns are dropped.  All
+	// Outfiles are returned if it is empty.
+	OutfilePatterns []string
+	Status          string
+	Stdout          string
+	Stderr          string
+	Timeout         time.Duration
+	Submitted       time.Time
+	Fetched         time.Time
+	Started         time.Time
+	CmdDur          time.Duration
+	Finished        time.Time
+	WorkerId        WorkerId
+	Note            string
+	// Tags holds arbitrary user metadata for the job (e.g. an optimizer
+	// generation number or experiment name).  Job listings can be filtered
+	// by tag (see JobFilter).
+	Tags map[string]string
+	// MaxRetries is the number of times the server will requeue the job
+	// after a failed run before marking it as permanently failed.
+	MaxRetries int
+	// Attempts is the number of times the job has been run to completion
+	// (successfully or not) by a worker.
+	Attempts int
+	// LastError holds the last line of stderr from the most recent failed
+	// run of the job.
+	LastError string
+	// NotBefore is the earliest time at which the job may be handed out to
+	// a worker.  It is used to back off between retries of failed jobs.
+	NotBefore time.Time
+	// Deadline, if non-zero, is the latest time at which the job may be
+	// started.  Jobs still queued after their deadline are canceled instead
+	// of being handed out to a worker.
+	Deadline time.Time
+	// ObjFile, if non-empty, names the output file holding the job's
+	// objective value (a single number) - e.g. for scenario jobs built by
+	// runscen.BuildRemoteJob.
+	ObjFile string
+	// Objective caches the value read from ObjFile once it has been
+	// requested from the server (see Server.Objectives).  It is nil until
+	// then.
+	Objective *float64
+	// WorkerClass, if non-empty, restricts the job to only be run by
+	// workers of the same class (e.g. "highmem").  Jobs with an empty class
+	// can be run by any worker.
+	WorkerClass string
+	// DependsOn lists jobs that must complete successfully before the job
+	// is handed out to a worker.  The job fails if any of them fails, is
+	// canceled, or is unknown to the server - so dependencies must be
+	// submitted before the jobs depending on them.
+	DependsOn []JobId
+	// OutfilesExpired is set once the server has deleted the job's output
+	// files because they were older than its ResultTTL.  The rest of the job
+	// (e.g. its status and objective) is kept.
+	OutfilesExpired bool
+	// RecordCyclusVersion, if true, has the worker running the job record
+	// its cyclus version in CyclusVersion.  It is set for jobs that run
+	// cyclus - e.g. scenario jobs built by runscen.BuildRemoteJob.
+	RecordCyclusVersion bool
+	// CyclusVersion is the version of cyclus installed on the worker that
+	// last ran the job (see scen.CyclusVersion) - empty if the job hasn't
+	// run yet or doesn't have RecordCyclusVersion set.
+	CyclusVersion string
+	dir           string
+	wd            string
+	whitelist     []string
+	log           io.Writer
+	// maxoutput, if nonzero, limits the total size of the job's collected
+	// output files (see Worker.MaxOutputSize).
+	maxoutput int64
 }
 
 type File struct {
@@ -74,6 +150,7 @@ func NewJobCmd(cmd string, args ...string) *Job {
 func NewJobDefault(data []byte) *Job {
 	j := NewJobCmd("cyclus", DefaultInfile)
 	j.AddOutfile("cyclus.sqlite")
+	j.OutfilePatterns = []string{"*.sqlite"}
 	j.AddInfile(DefaultInfile, data)
 	return j
 }
@@ -86,12 +163,49 @@ func NewJobDefaultFile(fname string) (*Job, error) {
 	return NewJobDefault(data), nil
 }
 
+// Rerun returns a new, unsubmitted job with a fresh id and the same
+// definition as j - its command, input and output files, timeout, retries,
+// dependencies, deadline, worker class, etc.  None of j's run state (e.g.
+// its status, output, or attempts) is copied, but a Deadline that has
+// already passed is, so such a rerun is canceled once submitted.  An error
+// is returned if any of j's input file data is no longer available.
+func (j *Job) Rerun() (*Job, error) {
+	jj := NewJob()
+	jj.Cmd = append([]string{}, j.Cmd...)
+	jj.Timeout = j.Timeout
+	jj.Note = j.Note
+	jj.Deadline = j.Deadline
+	jj.WorkerClass = j.WorkerClass
+	jj.DependsOn = append([]JobId(nil), j.DependsOn...)
+	jj.OutfilePatterns = append([]string(nil), j.OutfilePatterns...)
+	if j.Tags != nil {
+		jj.Tags = map[string]string{}
+		for k, v := range j.Tags {
+			jj.Tags[k] = v
+		}
+	}
+	jj.MaxRetries = j.MaxRetries
+	jj.ObjFile = j.ObjFile
+	jj.RecordCyclusVersion = j.RecordCyclusVersion
+	for _, f := range j.Infiles {
+		if len(f.Data) < f.Size {
+			return nil, fmt.Errorf("job %v input file '%v' data is no longer available", j.Id, f.Name)
+		}
+		jj.Infiles = append(jj.Infiles, File{f.Name, f.Data, len(f.Data), f.Cache})
+	}
+	for _, f := range j.Outfiles {
+		jj.AddOutfile(f.Name)
+	}
+	return jj, nil
+}
+
 func (j *Job) Whitelist(cmds ...string) {
 	j.whitelist = append(j.whitelist, cmds...)
 }
 
+// Done returns true if the job has reached a final status.
 func (j *Job) Done() bool {
-	return j.Status == StatusComplete || j.Status == StatusFailed
+	return j.Status == StatusComplete || j.Status == StatusFailed || j.Status == StatusCanceled
 }
 
 func (j *Job) AddOutfile(fname string) {
@@ -102,6 +216,27 @@ func (j *Job) AddInfile(fname string, data []byte) {
 	j.Infiles = append(j.Infiles, File{fname, data, len(data), false})
 }
 
+// dependsOn returns true if id is one of the job's DependsOn.
+func (j *Job) dependsOn(id JobId) bool {
+	for _, dep := range j.DependsOn {
+		if dep == id {
+			return true
+		}
+	}
+	return false
+}
+
+// infile returns the job's input file with the given name or nil if it has
+// none.
+func (j *Job) infile(name string) *File {
+	for i, f := range j.Infiles {
+		if f.Name == name {
+			return &j.Infiles[i]
+		}
+	}
+	return nil
+}
+
 func (j *Job) AddInfileCached(fname string, data []byte) {
 	j.Infiles = append(j.Infiles, File{fname, data, len(data), true})
 }
@@ -165,6 +300,7 @@ func (j *Job) Execute(kill chan bool, outbuf io.Writer) {
 	var err error
 
 	cmd := exec.Command(j.Cmd[0], j.Cmd[1:]...)
+	cmd.Dir = j.dir
 	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true} // required to kill all child processes together with parent
 	fmt.Fprintf(j.log, "running job %v command: %v\n", j.Id, cmd.Args)
 
@@ -214,10 +350,21 @@ func (j *Job) Execute(kill chan bool, outbuf io.Writer) {
 		return
 	}
 
+	j.Outfiles, err = j.matchOutfiles()
+	if err != nil {
+		j.Status = StatusFailed
+		fmt.Fprintf(multierr, "%v\n", err)
+		return
+	} else if err := j.checkOutputSize(); err != nil {
+		j.Status = StatusFailed
+		fmt.Fprintf(multierr, "%v\n", err)
+		return
+	}
+
 	// collect output data
 	zw := zip.NewWriter(outbuf)
 	for i, f := range j.Outfiles {
-		w, err := zw.Create(f.Name)
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: f.Name, Method: zip.Deflate})
 		if err != nil {
 			j.Status = StatusFailed
 			fmt.Fprintf(multierr, "%v\n", err)
@@ -225,7 +372,7 @@ func (j *Job) Execute(kill chan bool, outbuf io.Writer) {
 		}
 
 		func() {
-			r, err := os.Open(f.Name)
+			r, err := os.Open(filepath.Join(j.dir, f.Name))
 			if err != nil {
 				j.Status = StatusFailed
 				fmt.Fprintf(multierr, "%v\n", err)
@@ -251,6 +398,54 @@ func (j *Job) Execute(kill chan bool, outbuf io.Writer) {
 	}
 }
 
+// checkOutputSize returns an error listing the job's output files and their
+// sizes if their total size exceeds the job's output size limit.  Missing
+// output files are left for the collection step to report.
+func (j *Job) checkOutputSize() error {
+	if j.maxoutput <= 0 {
+		return nil
+	}
+
+	var total int64
+	sizes := []string{}
+	for _, f := range j.Outfiles {
+		info, err := os.Stat(filepath.Join(j.dir, f.Name))
+		if err != nil {
+			continue
+		}
+		total += info.Size()
+		sizes = append(sizes, fmt.Sprintf("%v (%v bytes)", f.Name, info.Size()))
+	}
+	if total > j.maxoutput {
+		return fmt.Errorf("output files total %v bytes which exceeds the worker's %v byte limit: %v",
+			total, j.maxoutput, strings.Join(sizes, ", "))
+	}
+	return nil
+}
+
+// matchOutfiles returns the job's Outfiles that match its OutfilePatterns.
+func (j *Job) matchOutfiles() ([]File, error) {
+	if len(j.OutfilePatterns) == 0 {
+		return j.Outfiles, nil
+	}
+	for _, pat := range j.OutfilePatterns {
+		if _, err := filepath.Match(pat, ""); err != nil {
+			return nil, fmt.Errorf("invalid outfile pattern '%v': %v", pat, err)
+		}
+	}
+
+	var files []File
+	for _, f := range j.Outfiles {
+		for _, pat := range j.OutfilePatterns {
+			if ok, _ := filepath.Match(pat, f.Name); ok {
+				files = append(files, f)
+				break
+			}
+		}
+	}
+	return files, nil
+}
+
 func (j *Job) GetOutfile(outbuf io.ReaderAt, size int, fname string) (io.ReadCloser, error) {
 	r, err := zip.NewReader(outbuf, int64(size))
 	if err != nil {
@@ -268,6 +463,10 @@ func (j *Job) GetOutfile(outbuf io.ReaderAt, size int, fname string) (io.ReadClo
 	return nil, fmt.Errorf("outfile '%v' not found for job %v", fname, j.Id)
 }
 
+// setup creates a fresh directory for the job and writes the job's input
+// files to it.  The job command is run inside this directory without
+// changing the process working directory so that multiple jobs can safely
+// be executed concurrently within a single process.
 func (j *Job) setup() error {
 	var err error
 	if j.wd == "" {
@@ -276,35 +475,44 @@ func (j *Job) setup() error {
 			return err
 		}
 	}
-	j.dir = uuid.NewRandom().String()
+	j.dir = filepath.Join(j.wd, uuid.NewRandom().String())
 	err = os.MkdirAll(j.dir, 0755)
 	if err != nil {
 		return err
 	}
 
-	if err := os.Chdir(j.dir); err != nil {
-		return err
-	}
-
 	for _, f := range j.Infiles {
-		err := ioutil.WriteFile(f.Name, f.Data, 0755)
+		path, err := infilePath(j.dir, f.Name)
 		if err != nil {
 			return err
 		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(path, f.Data, 0755); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
+// infilePath returns the path in the job run directory dir where the named
+// input file is placed.  Names may contain subdirectories (e.g.
+// "recipes/uox.xml") allowing a job to carry a whole tree of files, but must
+// be relative paths that stay inside dir.
+func infilePath(dir, name string) (string, error) {
+	clean := filepath.Clean(filepath.FromSlash(name))
+	if name == "" || filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid input file name '%v': must be a relative path inside the job directory", name)
+	}
+	return filepath.Join(dir, clean), nil
+}
+
 func (j *Job) teardown() error {
 	defer func() {
 		j.dir = ""
 	}()
 
-	if err := os.Chdir(j.wd); err != nil {
-		log.Print(err)
-		return err
-	}
-
 	if err := os.RemoveAll(j.dir); err != nil {
 		log.Print(err)
 		return err
@@ -325,20 +533,74 @@ type JobStat struct {
 	Submitted time.Time
 	Started   time.Time
 	Finished  time.Time
+	Attempts  int
+	LastError string
+	Tags      map[string]string
+	// CyclusVersion is the same as the job's field.
+	CyclusVersion string
+	// OutfilesExpired is the same as the job's field.
+	OutfilesExpired bool
+	// QueuePos is the job's position (starting at 1) in the server's queue
+	// - zero if the job isn't queued.
+	QueuePos int
+	// EstWait is a rough estimate of the time until a queued job starts
+	// running based on recent average job durations.
+	EstWait time.Duration
 }
 
 func NewJobStat(j *Job) *JobStat {
 	return &JobStat{
-		Id:        j.Id,
-		Cmd:       j.Cmd,
-		Status:    j.Status,
-		Size:      j.Size(),
-		Stdout:    j.Stdout,
-		Stderr:    j.Stderr,
-		Submitted: j.Submitted,
-		Started:   j.Started,
-		Finished:  j.Finished,
+		Id:              j.Id,
+		Cmd:             j.Cmd,
+		Status:          j.Status,
+		Size:            j.Size(),
+		Stdout:          j.Stdout,
+		Stderr:          j.Stderr,
+		Submitted:       j.Submitted,
+		Started:         j.Started,
+		Finished:        j.Finished,
+		Attempts:        j.Attempts,
+		LastError:       j.LastError,
+		Tags:            j.Tags,
+		CyclusVersion:   j.CyclusVersion,
+		OutfilesExpired: j.OutfilesExpired,
+	}
+}
+
+// JobSummary holds the few job fields needed to list many jobs at once.
+type JobSummary struct {
+	Id        JobId
+	Status    string
+	Submitted time.Time
+	Finished  time.Time
+	// Duration is the time it took to run the job (zero for unfinished
+	// jobs).
+	Duration time.Duration
+	Tags     map[string]string
+	// Attempts, LastError, and CyclusVersion are the same as the job's
+	// fields.
+	Attempts      int
+	LastError     string
+	CyclusVersion string
+}
+
+func NewJobSummary(j *Job) *JobSummary {
+	js := &JobSummary{
+		Id:            j.Id,
+		Status:        j.Status,
+		Submitted:     j.Submitted,
+		Tags:          j.Tags,
+		Attempts:      j.Attempts,
+		LastError:     j.LastError,
+		CyclusVersion: j.CyclusVersion,
+	}
+	if j.Done() {
+		js.Finished = j.Finished
+		if !j.Started.IsZero() {
+			js.Duration = j.Finished.Sub(j.Started)
+		}
 	}
+	return js
 }
 
 func killall(multierr io.Writer, cmd *exec.Cmd) {
@@ -352,7 +614,6 @@ func killall(multierr io.Writer, cmd *exec.Cmd) {
 
 	if err == nil {
 		syscall.Kill(-pgid, 15) // note the minus sign
-		cmd.Wait()
 	} else {
 		fmt.Fprintf(multierr, "\n%v\n", err)
 	}
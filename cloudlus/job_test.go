@@ -1,9 +1,13 @@
 package cloudlus
 
 import (
+	"archive/zip"
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
@@ -49,3 +53,196 @@ func TestJobKill(t *testing.T) {
 	}
 	fmt.Fprintf(os.Stderr, "\n")
 }
+
+func TestOutfilePatterns(t *testing.T) {
+	tests := []struct {
+		Patterns []string
+		Want     []string
+	}{
+		{nil, []string{"a.txt", "b.sqlite"}},
+		{[]string{"*.sqlite"}, []string{"b.sqlite"}},
+		{[]string{"*.sqlite", "a.*"}, []string{"a.txt", "b.sqlite"}},
+		{[]string{"*.dat"}, nil},
+	}
+
+	for _, test := range tests {
+		j := NewJobCmd("sh", "-c", "echo a > a.txt; echo b > b.sqlite")
+		j.AddOutfile("a.txt")
+		j.AddOutfile("b.sqlite")
+		j.OutfilePatterns = test.Patterns
+		j.log = devnull
+
+		var buf bytes.Buffer
+		j.Execute(nil, &buf)
+		if j.Status != StatusComplete {
+			t.Errorf("patterns %v: job failed: %v", test.Patterns, j.Stderr)
+			continue
+		}
+
+		var got []string
+		for _, f := range j.Outfiles {
+			got = append(got, f.Name)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(test.Want) {
+			t.Errorf("patterns %v: got outfiles %v, want %v", test.Patterns, got, test.Want)
+		}
+
+		r, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Errorf("patterns %v: %v", test.Patterns, err)
+			continue
+		}
+		var zipped []string
+		for _, f := range r.File {
+			zipped = append(zipped, f.Name)
+		}
+		if fmt.Sprint(zipped) != fmt.Sprint(test.Want) {
+			t.Errorf("patterns %v: got zipped outfiles %v, want %v", test.Patterns, zipped, test.Want)
+		}
+	}
+
+	j := NewJobCmd("true")
+	j.AddOutfile("a.txt")
+	j.OutfilePatterns = []string{"[a"}
+	j.log = devnull
+	j.Execute(nil, ioutil.Discard)
+	if j.Status != StatusFailed {
+		t.Errorf("job with a malformed outfile pattern got status %v, want %v", j.Status, StatusFailed)
+	}
+}
+
+func TestInfileTree(t *testing.T) {
+	j := NewJobCmd("sh", "-c", "cat input.xml recipes/uox.xml regions/a/region.xml > out.txt")
+	j.AddInfile("input.xml", []byte("main\n"))
+	j.AddInfile("recipes/uox.xml", []byte("recipe\n"))
+	j.AddInfile("regions/a/region.xml", []byte("region\n"))
+	j.AddOutfile("out.txt")
+	j.log = devnull
+
+	var buf bytes.Buffer
+	j.Execute(nil, &buf)
+	if j.Status != StatusComplete {
+		t.Fatalf("job with nested input files failed: %v", j.Stderr)
+	}
+
+	r, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	} else if len(r.File) != 1 {
+		t.Fatalf("got %v output files, want 1", len(r.File))
+	}
+	f, err := r.File[0].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	data, _ := ioutil.ReadAll(f)
+	if got, want := string(data), "main\nrecipe\nregion\n"; got != want {
+		t.Errorf("got output %q, want %q", got, want)
+	}
+
+	for _, name := range []string{"../escape.xml", "a/../../escape.xml", "/etc/escape.xml", ""} {
+		j := NewJobCmd("true")
+		j.AddInfile(name, []byte("bad"))
+		j.log = devnull
+		j.Execute(nil, ioutil.Discard)
+		if j.Status != StatusFailed {
+			t.Errorf("job with input file %q got status %v, want %v", name, j.Status, StatusFailed)
+		}
+	}
+}
+
+func TestMaxOutputSize(t *testing.T) {
+	j := NewJobCmd("sh", "-c", "head -c 600 /dev/zero > a.dat; head -c 500 /dev/zero > b.dat")
+	j.AddOutfile("a.dat")
+	j.AddOutfile("b.dat")
+	j.maxoutput = 1000
+	j.log = devnull
+
+	var buf bytes.Buffer
+	j.Execute(nil, &buf)
+	if j.Status != StatusFailed {
+		t.Fatalf("job exceeding the output limit got status %v, want %v", j.Status, StatusFailed)
+	} else if buf.Len() != 0 {
+		t.Errorf("job exceeding the output limit sent %v bytes of output", buf.Len())
+	}
+	for _, want := range []string{"a.dat (600 bytes)", "b.dat (500 bytes)", "1000 byte limit"} {
+		if !strings.Contains(j.Stderr, want) {
+			t.Errorf("failure reason %q doesn't contain %q", j.Stderr, want)
+		}
+	}
+
+	j = NewJobCmd("sh", "-c", "head -c 600 /dev/zero > a.dat")
+	j.AddOutfile("a.dat")
+	j.maxoutput = 1000
+	j.log = devnull
+	j.Execute(nil, ioutil.Discard)
+	if j.Status != StatusComplete {
+		t.Errorf("job within the output limit failed: %v", j.Stderr)
+	}
+}
+
+// TestRerun checks that every job definition field is copied by Rerun and
+// none of the run state is.
+func TestRerun(t *testing.T) {
+	// fields describing a job's runs rather than its definition
+	runstate := map[string]bool{
+		"Id": true, "Status": true, "Stdout": true, "Stderr": true,
+		"Submitted": true, "Fetched": true, "Started": true, "CmdDur": true,
+		"Finished": true, "WorkerId": true, "Attempts": true, "LastError": true,
+		"NotBefore": true, "Objective": true, "OutfilesExpired": true,
+		"CyclusVersion": true,
+	}
+
+	obj := 1.5
+	j := NewJobCmd("cyclus", "in.xml")
+	j.AddInfile("in.xml", []byte("<sim/>"))
+	j.AddOutfile("cyclus.sqlite")
+	j.OutfilePatterns = []string{"*.sqlite"}
+	j.Status = StatusFailed
+	j.Stdout, j.Stderr, j.LastError = "out", "err", "err"
+	j.Timeout = time.Minute
+	j.Submitted, j.Fetched, j.Started, j.Finished = time.Now(), time.Now(), time.Now(), time.Now()
+	j.CmdDur = time.Second
+	j.WorkerId = WorkerId{1}
+	j.Note = "note"
+	j.Tags = map[string]string{"gen": "1"}
+	j.MaxRetries, j.Attempts = 2, 3
+	j.NotBefore = time.Now()
+	j.Deadline = time.Now().Add(time.Hour)
+	j.ObjFile = "obj.dat"
+	j.Objective = &obj
+	j.WorkerClass = "highmem"
+	j.DependsOn = []JobId{{2}}
+	j.OutfilesExpired = true
+	j.RecordCyclusVersion = true
+	j.CyclusVersion = "1.0"
+
+	jj, err := j.Rerun()
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, vv := reflect.ValueOf(j).Elem(), reflect.ValueOf(jj).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+		if f.PkgPath != "" { // unexported
+			continue
+		} else if reflect.DeepEqual(v.Field(i).Interface(), reflect.Zero(f.Type).Interface()) {
+			t.Errorf("field %v isn't set by the test", f.Name)
+		} else if runstate[f.Name] {
+			if f.Name != "Id" && reflect.DeepEqual(vv.Field(i).Interface(), v.Field(i).Interface()) {
+				t.Errorf("run state %v was copied", f.Name)
+			}
+		} else if !reflect.DeepEqual(vv.Field(i).Interface(), v.Field(i).Interface()) {
+			t.Errorf("%v: got %v, want %v", f.Name, vv.Field(i).Interface(), v.Field(i).Interface())
+		}
+	}
+	if jj.Id == j.Id {
+		t.Errorf("rerun has the same id %v", j.Id)
+	}
+
+	j.Infiles[0].Data = nil
+	if _, err := j.Rerun(); err == nil {
+		t.Errorf("rerun with missing input file data returned no error")
+	}
+}
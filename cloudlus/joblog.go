@@ -0,0 +1,205 @@
+package cloudlus
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// logPushInterval is the time between pushes of a running job's new log
+// output from its worker to the server.
+var logPushInterval = 5 * time.Second
+
+// logPollInterval is the time between checks for new log output when
+// streaming a running job's log to a client.
+var logPollInterval = 1 * time.Second
+
+// maxJobLog is the amount of each running job's most recent log output the
+// server keeps for streaming.  Older output is dropped.
+var maxJobLog = 1 * MB
+
+// LogChunk is a piece of a running job's combined stdout+stderr pushed to
+// the server by the job's worker (see RPC.PushLog).
+type LogChunk struct {
+	WorkerId WorkerId
+	JobId    JobId
+	Data     []byte
+}
+
+// logBuffer collects a job's log output between pushes to the server.  It is
+// safe for concurrent use because a job's stdout and stderr are written from
+// different goroutines.
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// take returns and clears the buffered output.
+func (b *logBuffer) take() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	data := append([]byte{}, b.buf.Bytes()...)
+	b.buf.Reset()
+	return data
+}
+
+// pushLogs calls push with the output collected in buf every logPushInterval
+// until done is closed.  Failed pushes are dropped - the job's full output
+// is still sent back when it finishes.
+func pushLogs(buf *logBuffer, push func(data []byte) error, done chan struct{}) {
+	tick := time.NewTicker(logPushInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			if data := buf.take(); len(data) > 0 {
+				push(data)
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// liveLog holds the tail of a running job's log output on the server.
+type liveLog struct {
+	// data is the most recent output (at most maxJobLog bytes).
+	data []byte
+	// n is the total number of bytes of output received.
+	n int64
+}
+
+func (l *liveLog) add(p []byte) {
+	l.data = append(l.data, p...)
+	l.n += int64(len(p))
+	if over := len(l.data) - maxJobLog; over > 0 {
+		l.data = append([]byte{}, l.data[over:]...)
+	}
+}
+
+// since returns the output after the first offset bytes and the new offset.
+// If some of that output was already dropped, the oldest output kept is
+// returned.
+func (l *liveLog) since(offset int64) ([]byte, int64) {
+	start := int64(len(l.data)) - (l.n - offset)
+	if start < 0 {
+		start = 0
+	} else if start > int64(len(l.data)) {
+		start = int64(len(l.data))
+	}
+	return append([]byte{}, l.data[start:]...), l.n
+}
+
+type logRequest struct {
+	Id     JobId
+	Offset int64
+	Resp   chan logResponse
+}
+
+type logResponse struct {
+	Data   []byte
+	Offset int64
+	// Status is StatusQueued or StatusRunning for queued and running jobs
+	// and empty otherwise.
+	Status string
+}
+
+// addLog appends the pushed log chunk c to its job's live log.  It is only
+// called by the dispatcher.  Chunks for jobs that aren't running on the
+// pushing worker are ignored.
+func (s *Server) addLog(c LogChunk) {
+	if b, ok := s.jobinfo[c.JobId]; !ok || b.WorkerId != c.WorkerId {
+		s.logf(LogWarn, "[LOG] ignoring log for job %v not running on worker %v", c.JobId, c.WorkerId)
+		return
+	}
+	l := s.joblogs[c.JobId]
+	if l == nil {
+		l = &liveLog{}
+		s.joblogs[c.JobId] = l
+	}
+	l.add(c.Data)
+}
+
+// jobLog returns the live log output of job jid after offset (see liveLog).
+// It is only called by the dispatcher.
+func (s *Server) jobLog(jid JobId, offset int64) logResponse {
+	if _, ok := s.running[jid]; ok {
+		resp := logResponse{Offset: offset, Status: StatusRunning}
+		if l := s.joblogs[jid]; l != nil {
+			resp.Data, resp.Offset = l.since(offset)
+		}
+		return resp
+	}
+	for _, j := range s.queue {
+		if j.Id == jid {
+			return logResponse{Offset: offset, Status: StatusQueued}
+		}
+	}
+	return logResponse{Offset: offset}
+}
+
+// handleJobLogs streams a job's combined stdout+stderr as it runs.  The
+// response is sent in chunks as the job's worker pushes new output and ends
+// when the job finishes (or the client disconnects).  For finished jobs, the
+// full captured stdout and stderr are returned.
+func (s *Server) handleJobLogs(w http.ResponseWriter, r *http.Request) {
+	idstr := r.URL.Path[len("/api/v1/job-logs/"):]
+	j, err := s.getjob(idstr)
+	if err != nil {
+		s.httperror(w, r, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+	if j.Done() {
+		fmt.Fprint(w, j.Stdout)
+		fmt.Fprint(w, j.Stderr)
+		return
+	}
+
+	fw := flushWriter{w}
+	tick := time.NewTicker(logPollInterval)
+	defer tick.Stop()
+	offset := int64(0)
+	for {
+		req := logRequest{Id: j.Id, Offset: offset, Resp: make(chan logResponse, 1)}
+		select {
+		case s.logreqs <- req:
+		case <-s.kill:
+			return
+		}
+		resp := <-req.Resp
+		if len(resp.Data) > 0 {
+			if _, err := fw.Write(resp.Data); err != nil {
+				return
+			}
+		}
+		offset = resp.Offset
+
+		if resp.Status == "" {
+			status := "finished"
+			if j, err := s.Get(j.Id); err == nil {
+				status = j.Status
+			}
+			fmt.Fprintf(fw, "\n[job %v %v - the full output is in the job's Stdout and Stderr]\n", j.Id, status)
+			return
+		}
+
+		select {
+		case <-tick.C:
+		case <-r.Context().Done():
+			return
+		case <-s.kill:
+			return
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package cloudlus
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"code.google.com/p/go-uuid/uuid"
+)
+
+// LogLevel is the severity of a server log message.
+type LogLevel int
+
+const (
+	// LogInfo is for routine server activity.
+	LogInfo LogLevel = iota
+	// LogWarn is for unusual events and client errors (e.g. bad requests)
+	// that don't indicate a problem with the server itself.
+	LogWarn
+	// LogError is for server faults (e.g. failed internal operations).
+	LogError
+)
+
+var levelNames = map[LogLevel]string{
+	LogInfo:  "INFO",
+	LogWarn:  "WARN",
+	LogError: "ERROR",
+}
+
+func (l LogLevel) String() string {
+	if name, ok := levelNames[l]; ok {
+		return name
+	}
+	return fmt.Sprintf("LEVEL%d", int(l))
+}
+
+// ParseLogLevel returns the log level with the given (case insensitive)
+// name: "info", "warn", or "error".
+func ParseLogLevel(name string) (LogLevel, error) {
+	for l, lname := range levelNames {
+		if strings.EqualFold(name, lname) {
+			return l, nil
+		}
+	}
+	return LogInfo, fmt.Errorf("invalid log level '%v'", name)
+}
+
+// logf writes a message to the server log tagged with its level.  Messages
+// below the server's LogLevel are discarded.
+func (s *Server) logf(lvl LogLevel, format string, args ...interface{}) {
+	if lvl < s.LogLevel {
+		return
+	}
+	s.log.Printf("%-5v %v", lvl, fmt.Sprintf(format, args...))
+}
+
+// reqlogf is the same as logf, but also tags the message with the id of the
+// http request r so all the log messages for a request can be found.
+func (s *Server) reqlogf(r *http.Request, lvl LogLevel, format string, args ...interface{}) {
+	s.logf(lvl, "[req %v] %v", requestId(r), fmt.Sprintf(format, args...))
+}
+
+// httperror sends msg to the client and logs it at a level appropriate to
+// code - errors caused by the client (4xx) are warnings.
+func (s *Server) httperror(w http.ResponseWriter, r *http.Request, msg string, code int) {
+	s.logHTTPError(r, msg, code)
+
+	// The api has always responded to every error with 400 (Bad Request)
+	// and clients rely on it - so code only determines the log level.
+	http.Error(w, msg, http.StatusBadRequest)
+}
+
+// httpstatus is the same as httperror except that code is sent to the
+// client.  It is for errors added to the api with a distinct status code
+// that clients may act on (e.g. 429 Too Many Requests).
+func (s *Server) httpstatus(w http.ResponseWriter, r *http.Request, msg string, code int) {
+	s.logHTTPError(r, msg, code)
+	http.Error(w, msg, code)
+}
+
+func (s *Server) logHTTPError(r *http.Request, msg string, code int) {
+	lvl := LogWarn
+	if code >= 500 {
+		lvl = LogError
+	}
+	s.reqlogf(r, lvl, "%v (%v)", msg, code)
+}
+
+type ctxKey int
+
+const requestIdKey ctxKey = 0
+
+// withRequestId assigns each request handled by h a unique id for
+// correlating log messages (see reqlogf).  Clients can provide their own id
+// in the X-Request-Id header.
+func withRequestId(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-Id")
+		if id == "" {
+			id = hex.EncodeToString(uuid.NewRandom()[:6])
+		}
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIdKey, id)))
+	})
+}
+
+// requestId returns the id assigned to r by withRequestId.
+func requestId(r *http.Request) string {
+	if id, ok := r.Context().Value(requestIdKey).(string); ok {
+		return id
+	}
+	return "-"
+}
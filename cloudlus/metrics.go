@@ -0,0 +1,77 @@
+package cloudlus
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// durationBuckets are the upper bounds (in seconds) of the job duration
+// histogram buckets reported by the metrics endpoint.
+var durationBuckets = []float64{1, 5, 30, 60, 300, 600, 1800, 3600, 7200, 21600}
+
+// histogram is a minimal cumulative histogram in the style of prometheus.
+type histogram struct {
+	mu     sync.Mutex
+	bounds []float64
+	counts []int
+	sum    float64
+	count  int
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]int, len(bounds))}
+}
+
+func (h *histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, bound := range h.bounds {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// write writes h to w in the prometheus text exposition format.
+func (h *histogram) write(w io.Writer, name, help string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %v %v\n", name, help)
+	fmt.Fprintf(w, "# TYPE %v histogram\n", name)
+	for i, bound := range h.bounds {
+		le := strconv.FormatFloat(bound, 'g', -1, 64)
+		fmt.Fprintf(w, "%v_bucket{le=\"%v\"} %v\n", name, le, h.counts[i])
+	}
+	fmt.Fprintf(w, "%v_bucket{le=\"+Inf\"} %v\n", name, h.count)
+	fmt.Fprintf(w, "%v_sum %v\n", name, h.sum)
+	fmt.Fprintf(w, "%v_count %v\n", name, h.count)
+}
+
+func writeMetric(w io.Writer, name, typ, help string, val interface{}) {
+	fmt.Fprintf(w, "# HELP %v %v\n", name, help)
+	fmt.Fprintf(w, "# TYPE %v %v\n", name, typ)
+	fmt.Fprintf(w, "%v %v\n", name, val)
+}
+
+// handleMetrics serves server statistics in the prometheus text format.
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	st := s.Stats
+	writeMetric(w, "cloudlus_jobs_submitted_total", "counter", "Total number of jobs submitted.", st.NSubmitted)
+	writeMetric(w, "cloudlus_jobs_completed_total", "counter", "Total number of jobs completed successfully.", st.NCompleted)
+	writeMetric(w, "cloudlus_jobs_failed_total", "counter", "Total number of jobs that failed.", st.NFailed)
+	writeMetric(w, "cloudlus_jobs_canceled_total", "counter", "Total number of jobs canceled by users.", st.NCanceled)
+	writeMetric(w, "cloudlus_jobs_retried_total", "counter", "Total number of failed jobs requeued for another attempt.", st.NRetried)
+	writeMetric(w, "cloudlus_jobs_requeued_total", "counter", "Total number of jobs requeued after their worker stopped responding.", st.NRequeued)
+	writeMetric(w, "cloudlus_jobs_purged_total", "counter", "Total number of old jobs purged from the database.", st.NPurged)
+	writeMetric(w, "cloudlus_jobs_queued", "gauge", "Number of jobs currently queued.", st.CurrQueued)
+	writeMetric(w, "cloudlus_jobs_running", "gauge", "Number of jobs currently running.", st.CurrRunning)
+	writeMetric(w, "cloudlus_workers_banned", "gauge", "Number of workers banned from receiving jobs.", st.NBanned)
+	s.jobDurs.write(w, "cloudlus_job_duration_seconds", "Run time of finished jobs.")
+}
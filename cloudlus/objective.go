@@ -0,0 +1,171 @@
+package cloudlus
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ObjectiveResult reports the objective value of a single job (see
+// Server.Objectives).
+type ObjectiveResult struct {
+	// Status is the job's status - Objective is only available for complete
+	// jobs.  It is empty for unknown jobs.
+	Status string
+	// Objective is the job's objective value or nil if it isn't available.
+	Objective *float64
+	// Error describes why the objective value isn't available for a
+	// complete (or unknown) job.
+	Error string
+}
+
+// Objectives returns the objective values of the jobs with the given ids.
+// Each job's value is read from its ObjFile output the first time it is
+// requested and cached on the job after that.  Results for jobs that aren't
+// complete yet just report their status.
+func (s *Server) Objectives(ids []JobId) map[JobId]ObjectiveResult {
+	results := map[JobId]ObjectiveResult{}
+	for _, id := range ids {
+		j, err := s.Get(id)
+		if err != nil {
+			results[id] = ObjectiveResult{Error: err.Error()}
+			continue
+		}
+
+		res := ObjectiveResult{Status: j.Status}
+		if j.Status == StatusComplete {
+			if val, err := s.objective(j); err != nil {
+				res.Error = err.Error()
+			} else {
+				res.Objective = &val
+			}
+		}
+		results[id] = res
+	}
+	return results
+}
+
+// objective returns the objective value of the complete job j - computing
+// and caching it if necessary.
+func (s *Server) objective(j *Job) (float64, error) {
+	if j.Objective != nil {
+		return *j.Objective, nil
+	} else if j.ObjFile == "" {
+		return 0, fmt.Errorf("job %v has no objective file", j.Id)
+	} else if j.OutfilesExpired {
+		return 0, fmt.Errorf("job %v output files have expired", j.Id)
+	}
+
+	val, err := s.readObjective(j)
+	if err != nil {
+		return 0, err
+	}
+	s.setobjective <- objectiveUpdate{Id: j.Id, Val: val}
+	return val, nil
+}
+
+// readObjective reads the objective value of job j from its ObjFile output.
+func (s *Server) readObjective(j *Job) (float64, error) {
+	rc, err := s.openOutfiles(j.Id)
+	if err != nil {
+		return 0, fmt.Errorf("job %v output files not found", j.Id)
+	}
+	defer rc.Close()
+	f, size, err := seekable(rc)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	rc, err = j.GetOutfile(f, int(size), j.ObjFile)
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return 0, err
+	}
+
+	val, err := strconv.ParseFloat(strings.TrimSpace(string(data)), 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid objective string '%s' for job %v", data, j.Id)
+	}
+	return val, nil
+}
+
+// openOutfiles opens the zipped output files of job jid from the server's
+// Outfiles store or its ArchiveDir.
+func (s *Server) openOutfiles(jid JobId) (io.ReadCloser, error) {
+	rc, err := s.Outfiles.Get(outfileName(jid))
+	if err != nil && s.ArchiveDir != "" {
+		rc, err = os.Open(s.archiveOutfilePath(jid))
+	}
+	return rc, err
+}
+
+// seekable returns the content of rc as a file for random access (e.g. to
+// read zip archives) along with its size.  rc is used directly if it is a
+// file - otherwise it is copied to a temporary file that is removed when the
+// returned file is closed.
+func seekable(rc io.ReadCloser) (f *os.File, size int64, err error) {
+	f, ok := rc.(*os.File)
+	if !ok {
+		if f, err = ioutil.TempFile("", "cloudlus-outfiles-"); err != nil {
+			return nil, 0, err
+		}
+		os.Remove(f.Name()) // it lives on until closed
+		if _, err := io.Copy(f, rc); err != nil {
+			f.Close()
+			return nil, 0, err
+		}
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, info.Size(), nil
+}
+
+// handleObjectives responds with a JSON object mapping each job id in the
+// comma separated "ids" parameter to its ObjectiveResult.
+func (s *Server) handleObjectives(w http.ResponseWriter, r *http.Request) {
+	idstrs := strings.Split(r.FormValue("ids"), ",")
+	ids := make([]JobId, 0, len(idstrs))
+	for _, idstr := range idstrs {
+		if idstr = strings.TrimSpace(idstr); idstr == "" {
+			continue
+		}
+		id, err := DecodeJobId(idstr)
+		if err != nil {
+			s.httperror(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		s.httperror(w, r, "no job ids given", http.StatusBadRequest)
+		return
+	}
+
+	results := map[string]ObjectiveResult{}
+	for id, res := range s.Objectives(ids) {
+		results[id.String()] = res
+	}
+
+	data, err := json.Marshal(results)
+	if err != nil {
+		s.httperror(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+	w.Write(data)
+}
@@ -0,0 +1,94 @@
+package cloudlus
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a set of token buckets keyed by client.  Each bucket holds
+// up to burst tokens and refills at rate tokens per second.
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: map[string]*bucket{}}
+}
+
+// allow takes a token from key's bucket if one is available.  Otherwise it
+// returns false and how long until a token will be available.
+func (l *rateLimiter) allow(key string, rate float64, burst int, now time.Time) (bool, time.Duration) {
+	if burst < 1 {
+		burst = 1
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		l.prune(rate, burst, now)
+		b = &bucket{tokens: float64(burst), last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	return false, wait
+}
+
+// prune forgets buckets that have refilled completely - they are
+// indistinguishable from new ones.
+func (l *rateLimiter) prune(rate float64, burst int, now time.Time) {
+	full := time.Duration(float64(burst) / rate * float64(time.Second))
+	for key, b := range l.buckets {
+		if now.Sub(b.last) > full {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// clientKey identifies the client that sent r for rate limiting - its IP
+// address.
+func clientKey(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// limitSubmit applies the server's job submission rate limit (see
+// Server.SubmitRate) to r.  If the client has exceeded the limit, it
+// responds with 429 (Too Many Requests) and a Retry-After header and returns
+// false.
+func (s *Server) limitSubmit(w http.ResponseWriter, r *http.Request) bool {
+	if s.SubmitRate <= 0 {
+		return true
+	}
+
+	ok, wait := s.limiter.allow(clientKey(r), s.SubmitRate, s.SubmitBurst, time.Now())
+	if ok {
+		return true
+	}
+
+	msg := fmt.Sprintf("job submission rate limit of %v/s exceeded by client %v", s.SubmitRate, clientKey(r))
+	w.Header().Set("Retry-After", fmt.Sprint(int(math.Ceil(wait.Seconds()))))
+	s.httpstatus(w, r, msg, http.StatusTooManyRequests)
+	return false
+}
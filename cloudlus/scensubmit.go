@@ -0,0 +1,109 @@
+package cloudlus
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/rwcarlsen/cloudlus/scen"
+)
+
+// scenarioTmpl is the name of the cyclus input file template stored with
+// submitted scenario jobs.
+const scenarioTmpl = "cyclus-tmpl.xml"
+
+// ScenarioSubmission is the JSON body of a scenario submission (see
+// handleSubmitScenario).
+type ScenarioSubmission struct {
+	// Scenario is the scenario to run.  Its CyclusTmpl is ignored - the
+	// template itself is given by Template.  It may not
+	// reference files on the server (i.e. a NuclideCostFile or template
+	// partials).
+	Scenario *scen.Scenario
+	// Vars are the optimization variables transformed into the scenario's
+	// Builds (see scen.Scenario.TransformVars).  If empty, the scenario's
+	// Builds are used as given.
+	Vars []float64
+	// Template is the text of the scenario's cyclus input file template.
+	Template string
+}
+
+// NewJobScenario renders the cyclus input file for the submitted scenario
+// and variables and returns a job that runs it.
+func NewJobScenario(sub *ScenarioSubmission) (*Job, error) {
+	scn := sub.Scenario
+	if scn == nil {
+		return nil, errors.New("no scenario given")
+	} else if sub.Template == "" {
+		return nil, errors.New("no cyclus input file template given")
+	} else if scn.NuclideCostFile != "" {
+		return nil, errors.New("scenario NuclideCostFile is not supported for submitted scenarios")
+	} else if len(scn.TmplPartials()) > 0 {
+		return nil, errors.New("cyclus input file template partials are not supported for submitted scenarios")
+	}
+
+	scn.File = ""
+	if err := scn.ParseTmpl(sub.Template); err != nil {
+		return nil, err
+	}
+	// the template is stored with the job under a fixed name because
+	// CyclusTmpl may not be a valid input file name
+	scn.CyclusTmpl = scenarioTmpl
+	if err := scn.Validate(); err != nil {
+		return nil, err
+	}
+	if len(sub.Vars) > 0 {
+		if _, err := scn.TransformVars(sub.Vars); err != nil {
+			return nil, err
+		}
+	}
+
+	data, err := scn.GenCyclusInfile()
+	if err != nil {
+		return nil, err
+	}
+	scendata, err := json.Marshal(scn)
+	if err != nil {
+		return nil, err
+	}
+
+	// the scenario, template, and vars aren't needed to run the job, but
+	// they record the deployment schedule (e.g. for the dashboard comparison
+	// page) and allow the run to be reproduced (see handleBundle).
+	j := NewJobDefault(data)
+	j.AddInfile("scenario.json", scendata)
+	j.AddInfile(scenarioTmpl, []byte(sub.Template))
+	if len(sub.Vars) > 0 {
+		varsdata, err := json.Marshal(sub.Vars)
+		if err != nil {
+			return nil, err
+		}
+		j.AddInfile(scen.BundleVars, varsdata)
+	}
+	return j, nil
+}
+
+// handleSubmitScenario renders the cyclus input file for a submitted scenario
+// (see ScenarioSubmission) and enqueues a job that runs it.  It responds like
+// the other job submission endpoints.
+func (s *Server) handleSubmitScenario(w http.ResponseWriter, r *http.Request) {
+	if !s.limitSubmit(w, r) {
+		return
+	}
+	data, err := s.readJobBody(w, r)
+	if err != nil {
+		return
+	}
+
+	sub := &ScenarioSubmission{}
+	if err := json.Unmarshal(data, sub); err != nil {
+		s.httperror(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	j, err := NewJobScenario(sub)
+	if err != nil {
+		s.httperror(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.createJob(r, w, j)
+}
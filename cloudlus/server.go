@@ -7,6 +7,8 @@ import (
 	"net/http"
 	"net/rpc"
 	"os"
+	"sort"
+	"sync/atomic"
 	"time"
 )
 
@@ -14,6 +16,10 @@ const MB = 1 << 20
 const cachelimit = 400 * MB
 const dblimit = 7000 * MB
 
+// DefaultMaxJobSize is the default limit on the size of submitted jobs (see
+// Server.MaxJobSize).
+const DefaultMaxJobSize = 64 * MB
+
 var nojoberr = errors.New("no jobs available to run")
 
 const defaultdbpath = "./jobdb"
@@ -21,59 +27,157 @@ const defaultdbpath = "./jobdb"
 // defaultCollectFreq if the duration between old job purging from db.
 var defaultCollectFreq = 2 * time.Minute
 
+// defaultCheckpointFreq is the default duration between checkpoints of the
+// queue (see Server.CheckpointFile).
+var defaultCheckpointFreq = 1 * time.Minute
+
 var beatInterval = 30 * time.Second
 var beatLimit = 3 * beatInterval
 var beatCheckFreq = beatInterval / 3
 
+// retryBackoff is the delay before a failed job is eligible to be run again.
+// The delay doubles with each successive retry of the same job.
+var retryBackoff = 10 * time.Second
+
+// maxBackoffShift limits the number of times the retry delay doubles so it
+// can't overflow for jobs with many retries.
+const maxBackoffShift = 10
+
 // nfailban is the number of consecutive jobs after which a worker is
 // permanently banned from receiving more jobs
 var nfailban = 4
 
 type Server struct {
-	log          *log.Logger
-	serv         *http.Server
-	Host         string
-	CollectFreq  time.Duration
+	log         *log.Logger
+	serv        *http.Server
+	Host        string
+	CollectFreq time.Duration
+	// LogLevel is the minimum severity of messages written to the server
+	// log.  The zero value logs everything.
+	LogLevel LogLevel
+	// MaxJobSize is the maximum size in bytes of a job submission request
+	// (including its input files).  Larger submissions are rejected.
+	MaxJobSize int64
+	// SubmitRate is the maximum sustained rate (jobs per second) at which
+	// each client (by IP address) may submit jobs through the REST api.
+	// Faster submissions are rejected with status 429 (Too Many Requests).
+	// Zero disables rate limiting.
+	SubmitRate float64
+	// SubmitBurst is the number of jobs a client may submit in a burst
+	// before SubmitRate is enforced.  It is at least one.
+	SubmitBurst int
+	// MaxConcurrent is the maximum number of jobs that may be running at
+	// once regardless of how many workers are available - e.g. to respect
+	// a license or shared disk quota.  Zero means no limit.
+	MaxConcurrent int
+	// LocalWorkers is the number of in-process workers the server runs to
+	// execute jobs itself.  This allows a server to be used standalone
+	// without any separate worker processes.  Local workers are started by
+	// ListenAndServe.
+	LocalWorkers int
+	// CheckpointFile, if non-empty, is a file the server periodically saves
+	// its queued and running jobs to (see Checkpoint).  ListenAndServe
+	// requeues the jobs in an existing checkpoint on startup.
+	CheckpointFile string
+	// CheckpointFreq is the interval between checkpoints.
+	CheckpointFreq time.Duration
+	// Outfiles stores the zipped output files of jobs.  The default is a
+	// DirStore for the server's working directory.
+	Outfiles BlobStore
+	// ResultTTL, if non-zero, is how long the output files of finished jobs
+	// are kept.  Older output files are deleted from Outfiles during GC (see
+	// CollectFreq) and their jobs marked as OutfilesExpired.  The jobs
+	// themselves stay in the job db - with their objective values cached
+	// first so they remain available.
+	ResultTTL time.Duration
+	// ArchiveDir, if non-empty, is a directory where jobs purged from the
+	// job db by GC (along with their output files) are saved.  Archived jobs
+	// can still be retrieved through the server's API.
+	ArchiveDir   string
 	submitjobs   chan jobSubmit
-	submitchans  map[[16]byte]chan *Job
+	submitchans  map[[16]byte][]chan *Job
 	retrievejobs chan jobRequest
+	setobjective chan objectiveUpdate
+	listjobs     chan jobListRequest
+	queuepos     chan queuePosRequest
+	cancel       chan cancelRequest
+	subscribe    chan chan JobEvent
+	unsubscribe  chan chan JobEvent
+	subscribers  map[chan JobEvent]bool
 	pushjobs     chan *Job
 	fetchjobs    chan workRequest
+	pushlogs     chan LogChunk
+	logreqs      chan logRequest
 	reset        chan struct{}
+	collect      chan struct{}
+	checkpoints  chan chan error
 	queue        []*Job
 	alljobs      *DB
 	rpc          *RPC
 	jobinfo      map[JobId]Beat
 	running      map[JobId]*Job
+	joblogs      map[JobId]*liveLog
 	beat         chan Beat
 	rpcaddr      string
 	kill         chan struct{}
 	Stats        *Stats
 	rpcserv      *rpc.Server
+	// jobDurs tracks the distribution of finished job run times.
+	jobDurs *histogram
 	// workerFailures tracks consecutive failed jobs from workers
 	workerFailures map[WorkerId]int
+	// dispatchTick is the time (unix nanoseconds) of the dispatcher's most
+	// recent loop iteration - zero if it hasn't started.
+	dispatchTick atomic.Int64
+	// limiter tracks per-client job submission rates (see SubmitRate).
+	limiter *rateLimiter
+	// idemkeys maps submission idempotency keys to job ids.
+	idemkeys idemKeys
+	// depwait holds the queued jobs waiting for their dependencies to
+	// complete (see Job.DependsOn).  It is only updated as jobs are queued
+	// and finish so handing out jobs doesn't look up dependencies.
+	depwait map[JobId]bool
+	// expiredBefore is the finish time before which jobs' output files have
+	// already been expired (see ResultTTL).  It is persisted in the job db.
+	expiredBefore time.Time
+	// expired receives the results of expireResults, and expiring is true
+	// while it is running.
+	expired  chan expireResult
+	expiring bool
 }
 
 type Stats struct {
 	Started time.Time
 	// NBanned reports the number of workers that have been permanently banned
 	// from running more jobs due to a poor track record.
-	NBanned     int
-	NSubmitted  int
-	NCompleted  int
-	NFailed     int
-	NPurged     int
-	NRequeued   int
+	NBanned    int
+	NSubmitted int
+	NCompleted int
+	NFailed    int
+	NCanceled  int
+	NPurged    int
+	NRequeued  int
+	// NRetried is the number of failed jobs that have been requeued to be
+	// run again.
+	NRetried    int
 	CurrQueued  int
 	CurrRunning int
-	TotJobTime  time.Duration
-	AvgJobTime  time.Duration
-	MinJobTime  time.Duration
-	MaxJobTime  time.Duration
-	TotCmdTime  time.Duration
-	AvgCmdTime  time.Duration
-	MinCmdTime  time.Duration
-	MaxCmdTime  time.Duration
+	// DBSizeMB and DBLimitMB report the current size and GC threshold of
+	// the job db as of the most recent GC check.
+	DBSizeMB   int64
+	DBLimitMB  int64
+	TotJobTime time.Duration
+	AvgJobTime time.Duration
+	MinJobTime time.Duration
+	MaxJobTime time.Duration
+	TotCmdTime time.Duration
+	AvgCmdTime time.Duration
+	MinCmdTime time.Duration
+	MaxCmdTime time.Duration
+	// DBRawMB is the uncompressed size of the job db, and DBCompression is
+	// the ratio of its uncompressed to stored size (see DB.Compress).
+	DBRawMB       int64
+	DBCompression float64
 }
 
 // TODO: Make worker RPC serving separate from submitter RPC interface serving
@@ -82,20 +186,39 @@ type Stats struct {
 func NewServer(httpaddr, rpcaddr string, db *DB) *Server {
 	s := &Server{
 		submitjobs:     make(chan jobSubmit),
-		submitchans:    map[[16]byte]chan *Job{},
+		submitchans:    map[[16]byte][]chan *Job{},
 		retrievejobs:   make(chan jobRequest),
+		setobjective:   make(chan objectiveUpdate),
+		listjobs:       make(chan jobListRequest),
+		queuepos:       make(chan queuePosRequest),
+		cancel:         make(chan cancelRequest),
+		subscribe:      make(chan chan JobEvent),
+		unsubscribe:    make(chan chan JobEvent),
+		subscribers:    map[chan JobEvent]bool{},
 		pushjobs:       make(chan *Job),
 		fetchjobs:      make(chan workRequest),
+		pushlogs:       make(chan LogChunk),
+		logreqs:        make(chan logRequest),
 		jobinfo:        map[JobId]Beat{},
 		running:        map[JobId]*Job{},
+		joblogs:        map[JobId]*liveLog{},
 		beat:           make(chan Beat),
 		reset:          make(chan struct{}),
+		collect:        make(chan struct{}),
+		checkpoints:    make(chan chan error),
 		rpcaddr:        rpcaddr,
 		log:            log.New(os.Stdout, "", log.LstdFlags),
 		kill:           make(chan struct{}),
 		CollectFreq:    defaultCollectFreq,
+		CheckpointFreq: defaultCheckpointFreq,
+		MaxJobSize:     DefaultMaxJobSize,
+		Outfiles:       DirStore{},
+		limiter:        newRateLimiter(),
 		Stats:          &Stats{},
+		jobDurs:        newHistogram(durationBuckets),
 		workerFailures: map[WorkerId]int{},
+		depwait:        map[JobId]bool{},
+		expired:        make(chan expireResult),
 	}
 
 	var err error
@@ -105,6 +228,7 @@ func NewServer(httpaddr, rpcaddr string, db *DB) *Server {
 			panic(err)
 		}
 	}
+	db.OnPurge = s.purge
 	s.alljobs = db
 	q, err := db.Current()
 	if err != nil {
@@ -113,6 +237,9 @@ func NewServer(httpaddr, rpcaddr string, db *DB) *Server {
 	for _, j := range q {
 		s.queue = append(s.queue, j)
 	}
+	if _, err := db.getMeta(expiredMeta, &s.expiredBefore); err != nil {
+		panic(err)
+	}
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", s.dashmain)
@@ -122,14 +249,28 @@ func NewServer(httpaddr, rpcaddr string, db *DB) *Server {
 	mux.HandleFunc("/api/v1/job", s.handleJob)
 	mux.HandleFunc("/api/v1/job/", s.handleJob)
 	mux.HandleFunc("/api/v1/job-stat/", s.handleJobStat)
+	mux.HandleFunc("/api/v1/jobs", s.handleJobs)
 	mux.HandleFunc("/api/v1/job-infile", s.handleSubmitInfile)
+	mux.HandleFunc("/api/v1/job-infile/", s.handleInfile)
+	mux.HandleFunc("/api/v1/job-wait", s.handleSubmitWait)
+	mux.HandleFunc("/api/v1/scenario/submit", s.handleSubmitScenario)
+	mux.HandleFunc("/api/v1/job-resubmit/", s.handleResubmit)
+	mux.HandleFunc("/api/v1/job-cancel/", s.handleCancel)
 	mux.HandleFunc("/api/v1/job-outfiles/", s.handleOutfiles)
+	mux.HandleFunc("/api/v1/job-logs/", s.handleJobLogs)
+	mux.HandleFunc("/api/v1/job-bundle/", s.handleBundle)
+	mux.HandleFunc("/api/v1/objectives", s.handleObjectives)
 	mux.HandleFunc("/api/v1/server-stats/", s.handleServerStats)
+	mux.HandleFunc("/metrics", s.handleMetrics)
+	mux.HandleFunc("/healthz", s.handleHealthz)
+	mux.HandleFunc("/readyz", s.handleReadyz)
+	mux.HandleFunc("/ws/jobs", s.handleJobEvents)
 	mux.HandleFunc("/dashboard", s.dashboard)
 	mux.HandleFunc("/dashboard/", s.dashboard)
 	mux.HandleFunc("/dashboard/infile/", s.dashboardInfile)
 	mux.HandleFunc("/dashboard/output/", s.dashboardOutput)
 	mux.HandleFunc("/dashboard/default-infile", s.dashboardDefaultInfile)
+	mux.HandleFunc("/dashboard/compare", s.dashboardCompare)
 
 	s.rpc = &RPC{s}
 	s.rpcserv = rpc.NewServer()
@@ -141,29 +282,32 @@ func NewServer(httpaddr, rpcaddr string, db *DB) *Server {
 		s.rpcserv.HandleHTTP(rpc.DefaultRPCPath, rpc.DefaultDebugPath)
 	}
 
-	s.serv = &http.Server{Addr: httpaddr, Handler: mux}
+	s.serv = &http.Server{Addr: httpaddr, Handler: withRequestId(mux)}
 	return s
 }
 
 func (s *Server) ListenAndServe() error {
 	s.Stats.Started = time.Now()
+	if err := s.restoreCheckpoint(); err != nil {
+		return err
+	}
 	go s.dispatcher()
+	for i := 0; i < s.LocalWorkers; i++ {
+		go newLocalWorker(s).Run()
+	}
 	go func() {
 		for {
 			select {
 			case <-s.kill:
 				return
-			default:
-				npurged, nremain, err := s.alljobs.GC()
-				s.Stats.NPurged += npurged
-				if err != nil {
-					s.log.Print(err)
-				}
-				s.log.Printf("[INFO] purged %v old jobs from db, %v remain\n", npurged, nremain)
+			case s.collect <- struct{}{}:
 			}
 			<-time.After(s.CollectFreq)
 		}
 	}()
+	if s.CheckpointFile != "" {
+		go s.checkpointLoop()
+	}
 
 	if s.rpcaddr != s.serv.Addr {
 		go func() {
@@ -175,7 +319,14 @@ func (s *Server) ListenAndServe() error {
 	return s.serv.ListenAndServe()
 }
 
+// Close saves a final checkpoint (if CheckpointFile is set) and shuts down
+// the server.
 func (s *Server) Close() error {
+	if s.CheckpointFile != "" && s.dispatcherHealth() == nil {
+		if err := s.Checkpoint(); err != nil {
+			s.logf(LogError, "[CHECKPOINT] %v", err)
+		}
+	}
 	close(s.kill)
 	return s.alljobs.Close()
 }
@@ -188,16 +339,35 @@ func (s *Server) Run(j *Job) *Job {
 func (s *Server) Start(j *Job, ch chan *Job) chan *Job {
 	j.Status = StatusQueued
 	j.Submitted = time.Now()
-	s.alljobs.Put(j)
-	s.log.Printf("[SUBMIT] job %v\n", j.Id)
+	s.logf(LogInfo, "[SUBMIT] job %v", j.Id)
 
 	if ch == nil {
 		ch = make(chan *Job, 1)
 	}
-	s.submitjobs <- jobSubmit{j, ch}
+	s.submitjobs <- jobSubmit{J: j, Result: ch}
 	return ch
 }
 
+// startKeyed is the same as Start except that the submission has the
+// idempotency key (see idemKeys).  If a job was already submitted with the
+// same key, j is discarded and the earlier job's id is returned with dup
+// true.  If result is non-nil, the finished job - j or the earlier one - is
+// sent on it.
+func (s *Server) startKeyed(j *Job, key string, result chan *Job) (id JobId, dup bool) {
+	j.Status = StatusQueued
+	j.Submitted = time.Now()
+
+	ch := make(chan JobId, 1)
+	s.submitjobs <- jobSubmit{J: j, Result: result, Key: key, Id: ch}
+	id = <-ch
+	if id != j.Id {
+		s.logf(LogInfo, "[SUBMIT] idempotency key %q already used by job %v", key, id)
+		return id, true
+	}
+	s.logf(LogInfo, "[SUBMIT] job %v", j.Id)
+	return id, false
+}
+
 func (s *Server) Get(jid JobId) (*Job, error) {
 	ch := make(chan *Job, 1)
 	s.retrievejobs <- jobRequest{Id: jid, Resp: ch}
@@ -208,6 +378,49 @@ func (s *Server) Get(jid JobId) (*Job, error) {
 	return j, nil
 }
 
+// List returns summaries of all jobs known to the server that match f in
+// the reverse order of ListPage - oldest first.
+func (s *Server) List(f JobFilter) []*JobSummary {
+	jobs, _ := s.ListPage(f, 0, 0)
+	for i, j := 0, len(jobs)-1; i < j; i, j = i+1, j-1 {
+		jobs[i], jobs[j] = jobs[j], jobs[i]
+	}
+	return jobs
+}
+
+// ListPage returns summaries of one page of the jobs known to the server
+// that match f along with whether there are more matching jobs after the
+// page.  Queued and running jobs come first (newest submitted first)
+// followed by finished jobs (most recently finished first).  The page skips
+// the offset first jobs and holds at most limit jobs (all of the rest if
+// limit is not positive).  Only as many finished jobs as the page needs are
+// read from the database.
+func (s *Server) ListPage(f JobFilter, offset, limit int) (jobs []*JobSummary, more bool) {
+	ch := make(chan jobListResponse, 1)
+	s.listjobs <- jobListRequest{Filter: f, Offset: offset, Limit: limit, Resp: ch}
+	resp := <-ch
+	return resp.Jobs, resp.More
+}
+
+// QueuePosition returns the position (starting at 1) of the job jid in the
+// queue and a rough estimate of how long until it starts running.  Zero
+// values are returned if the job is not queued.
+func (s *Server) QueuePosition(jid JobId) (pos int, wait time.Duration) {
+	ch := make(chan queuePos, 1)
+	s.queuepos <- queuePosRequest{Id: jid, Resp: ch}
+	qp := <-ch
+	return qp.Pos, qp.Wait
+}
+
+// Cancel cancels the queued or running job jid giving it the final status
+// StatusCanceled.  If the job is running, its worker is told to kill it.  An
+// error is returned if the job isn't queued or running.
+func (s *Server) Cancel(jid JobId) error {
+	ch := make(chan error, 1)
+	s.cancel <- cancelRequest{Id: jid, Resp: ch}
+	return <-ch
+}
+
 // ResetQueue removes all jobs from the queue permanently.
 func (s *Server) ResetQueue() {
 	s.reset <- struct{}{}
@@ -221,7 +434,7 @@ func (s *Server) cleanQueue(delids ...JobId) {
 		if j.Status == StatusQueued {
 			newqueue = append(newqueue, j)
 		} else {
-			s.log.Printf("[GC] removed job with status %v from queue (id %v)\n", j.Status, j.Id)
+			s.logf(LogInfo, "[GC] removed job with status %v from queue (id %v)", j.Status, j.Id)
 		}
 	}
 	s.queue = newqueue
@@ -233,7 +446,7 @@ func (s *Server) cleanQueue(delids ...JobId) {
 		for _, delid := range delids {
 			if j.Id == delid {
 				skip = true
-				s.log.Printf("[GC] removed completed job from queue (id %v)\n", delid)
+				s.logf(LogInfo, "[GC] removed completed job from queue (id %v)", delid)
 				break
 			}
 		}
@@ -257,9 +470,11 @@ func (s *Server) checkbeat() {
 
 			delete(s.jobinfo, jid)
 			delete(s.running, jid)
-			s.log.Printf("[REQUEUE] job %v\n", jid)
+			delete(s.joblogs, jid)
+			s.logf(LogInfo, "[REQUEUE] job %v", jid)
 			s.Stats.NRequeued++
 			j.Status = StatusQueued
+			s.notify(j, StatusRunning)
 			s.queue = append([]*Job{j}, s.queue...)
 			s.alljobs.Put(j)
 		}
@@ -267,7 +482,7 @@ func (s *Server) checkbeat() {
 
 	// also check to see if any submitchans are waiting on jobs to finnish
 	// that we don't have record of them running in jobinfo
-	for jid, ch := range s.submitchans {
+	for jid, chs := range s.submitchans {
 		_, ok := s.jobinfo[jid]
 		if !ok {
 			// job is not currently running
@@ -281,17 +496,32 @@ func (s *Server) checkbeat() {
 
 			if !inqueue {
 				// job is also not queued
-				s.log.Printf("[GC] removed conn waiting for dropped job %v\n", JobId(jid))
+				s.logf(LogInfo, "[GC] removed conn waiting for dropped job %v", JobId(jid))
 				s.Stats.NFailed++
 				j, _ := s.alljobs.Get(jid)
-				ch <- j
-				close(ch)
+				for _, ch := range chs {
+					ch <- j
+					close(ch)
+				}
 				delete(s.submitchans, jid)
 			}
 		}
 	}
 }
 
+// waitJob sends the job with the given id on ch once it is finished - right
+// away if it already is.  It must only be called from the dispatcher.
+func (s *Server) waitJob(id JobId, ch chan *Job) {
+	if _, ok := s.running[id]; !ok {
+		if j, err := s.alljobs.Get(id); err == nil && j.Done() {
+			ch <- j
+			close(ch)
+			return
+		}
+	}
+	s.submitchans[id] = append(s.submitchans[id], ch)
+}
+
 func (s *Server) isBanned(wid WorkerId) bool {
 	return s.workerFailures[wid] >= nfailban
 }
@@ -306,11 +536,20 @@ func (s *Server) nBannedWorkers() int {
 	return n
 }
 
+// dispatcher is the single owner of the server's job state - the queue,
+// running jobs, and the job db (alljobs).  Other goroutines (e.g. http
+// handlers) must access them by sending requests over the server's channels.
 func (s *Server) dispatcher() {
 	beatcheck := time.NewTicker(beatCheckFreq)
 	defer beatcheck.Stop()
 
+	// jobs restored from the db may still be waiting on dependencies
+	for _, j := range append([]*Job{}, s.queue...) {
+		s.waitDeps(j)
+	}
+
 	for {
+		s.tick()
 		s.Stats.CurrQueued = len(s.queue)
 		s.Stats.CurrRunning = len(s.jobinfo)
 		s.Stats.NBanned = s.nBannedWorkers()
@@ -319,8 +558,11 @@ func (s *Server) dispatcher() {
 		case <-beatcheck.C:
 			s.checkbeat()
 		case <-s.reset:
-			s.log.Printf("[RESET] removed %v queued jobs\n", len(s.queue))
+			s.logf(LogInfo, "[RESET] removed %v queued jobs", len(s.queue))
 			for _, j := range s.queue {
+				if j.Done() {
+					continue // already failed with a dependency
+				}
 				j.Status = StatusFailed
 				j.Stderr += "\nkilled by server reset\n"
 				s.finnishJob(j)
@@ -328,70 +570,127 @@ func (s *Server) dispatcher() {
 			s.queue = s.queue[:0]
 		case <-s.kill:
 			return
+		case <-s.collect:
+			s.collectGarbage()
+		case res := <-s.expired:
+			s.expiring = false
+			s.markExpired(res)
+		case ch := <-s.checkpoints:
+			ch <- s.writeCheckpoint()
 		case js := <-s.submitjobs:
+			if id, ok := s.idemkeys.get(js.Key); ok {
+				if js.Result != nil {
+					s.waitJob(id, js.Result)
+				}
+				js.Id <- id
+				continue
+			}
+			s.alljobs.Put(js.J)
 			s.queue = append(s.queue, js.J)
+			s.notify(js.J, "")
 			s.Stats.NSubmitted++
 			if js.Result != nil {
-				s.submitchans[js.J.Id] = js.Result
+				s.waitJob(js.J.Id, js.Result)
+			}
+			if js.Key != "" {
+				s.idemkeys.add(js.Key, js.J.Id)
+				js.Id <- js.J.Id
 			}
+			s.waitDeps(js.J)
 		case req := <-s.retrievejobs:
 			if j, ok := s.running[req.Id]; ok {
-				s.log.Printf("[RETRIEVE] from run list job %v\n", j.Id)
+				s.logf(LogInfo, "[RETRIEVE] from run list job %v", j.Id)
 				req.Resp <- j
 			} else if j, err := s.alljobs.Get(req.Id); err == nil {
-				s.log.Printf("[RETRIEVE] from db job %v\n", j.Id)
+				s.logf(LogInfo, "[RETRIEVE] from db job %v", j.Id)
+				req.Resp <- j
+			} else if j, err := s.unarchive(req.Id); err == nil {
+				s.logf(LogInfo, "[RETRIEVE] from archive job %v", j.Id)
 				req.Resp <- j
 			} else {
-				s.log.Printf("[RETRIEVE] error: job %v not found\n", req.Id)
+				s.logf(LogWarn, "[RETRIEVE] job %v not found", req.Id)
 				req.Resp <- nil
 			}
+		case u := <-s.setobjective:
+			if j, err := s.alljobs.Get(u.Id); err == nil && j.Status == StatusComplete {
+				j.Objective = &u.Val
+				s.alljobs.Put(j)
+			}
+		case ch := <-s.subscribe:
+			s.subscribers[ch] = true
+		case ch := <-s.unsubscribe:
+			delete(s.subscribers, ch)
+		case req := <-s.listjobs:
+			jobs, more := s.listJobs(req.Filter, req.Offset, req.Limit)
+			req.Resp <- jobListResponse{Jobs: jobs, More: more}
+		case req := <-s.queuepos:
+			req.Resp <- s.queuePosition(req.Id)
+		case req := <-s.cancel:
+			req.Resp <- s.cancelJob(req.Id)
 		case j := <-s.pushjobs:
-			if j.Status == StatusComplete {
-				s.workerFailures[j.WorkerId] = 0
-			} else if j.Status == StatusFailed {
-				s.workerFailures[j.WorkerId]++
+			s.logf(LogInfo, "[PUSH] job %v", j.Id)
+			if j.Status == StatusFailed {
+				j.LastError = lastLine(j.Stderr)
 			}
+			if jj, ok := s.running[j.Id]; ok && s.jobinfo[j.Id].WorkerId == j.WorkerId {
+				if j.Status == StatusComplete {
+					s.workerFailures[j.WorkerId] = 0
+				} else if j.Status == StatusFailed {
+					s.workerFailures[j.WorkerId]++
+				}
 
-			s.log.Printf("[PUSH] job %v\n", j.Id)
-			if jj, ok := s.running[j.Id]; ok {
 				// workers nilify the Infiles to reduce network traffic
 				// we want to re-add the locally stored infiles back to keep
-				// job data complete.
+				// job data complete.  Attempts are counted on the server's
+				// copy so workers can't reset the retry budget.
 				j.Infiles = jj.Infiles
+				j.Attempts = jj.Attempts + 1
+				j.MaxRetries = jj.MaxRetries
+				if j.Status == StatusFailed && s.retry(j) {
+					continue
+				}
+			} else if old, err := s.alljobs.Get(j.Id); err == nil && old.Status == StatusCanceled {
+				s.logf(LogWarn, "[PUSH] ignoring push for canceled job %v", j.Id)
+				continue
+			} else if j.Status != StatusComplete {
+				// only the worker the job is running on gets to fail it
+				s.logf(LogWarn, "[PUSH] ignoring push for job %v not running on worker %v", j.Id, j.WorkerId)
+				continue
 			} else {
-				s.log.Printf("[PUSH] error: push for job not running (id=%v)\n", j.Id)
+				// a finished simulation wins even if the job was requeued or
+				// moved to another worker in the meantime
+				s.logf(LogWarn, "[PUSH] push for job not running on worker %v (id=%v)", j.WorkerId, j.Id)
+				s.workerFailures[j.WorkerId] = 0
+				if ok {
+					j.Infiles = jj.Infiles
+				} else if err == nil {
+					j.Infiles = old.Infiles
+				}
 			}
 			s.finnishJob(j)
+		case c := <-s.pushlogs:
+			s.addLog(c)
+		case req := <-s.logreqs:
+			req.Resp <- s.jobLog(req.Id, req.Offset)
 		case req := <-s.fetchjobs:
-			if s.isBanned(req.WorkerId) {
-				s.log.Printf("[FETCH] no work for banned worker %v)\n", req.WorkerId)
-				req.Ch <- nil
-				continue
-			} else if len(s.queue) == 0 {
-				s.log.Printf("[FETCH] no work in queue (worker %v)\n", req.WorkerId)
+			jobs := s.fetchJobs(req)
+			if req.Batch != nil {
+				req.Batch <- jobs
+			} else if len(jobs) == 0 {
 				req.Ch <- nil
-				continue
+			} else {
+				req.Ch <- jobs[0]
 			}
-
-			j := s.queue[0]
-			s.queue = append([]*Job{}, s.queue[1:]...)
-			s.log.Printf("[FETCH] job %v (worker %v)\n", j.Id, req.WorkerId)
-			s.jobinfo[j.Id] = NewBeat(req.WorkerId, j.Id)
-			s.running[j.Id] = j
-			j.Fetched = time.Now()
-			j.Status = StatusRunning
-			s.alljobs.Put(j)
-			req.Ch <- j
 		case b := <-s.beat:
 			oldb, ok := s.jobinfo[b.JobId]
 			if !ok {
-				// job was completed by another worker already
-				s.log.Printf("[BEAT] sending kill signal: job %v already completed by another worker\n", b.JobId)
+				// job was completed by another worker already or canceled
+				s.logf(LogWarn, "[BEAT] sending kill signal: job %v already finished or canceled", b.JobId)
 				b.kill <- true
 				continue
 			} else if oldb.WorkerId != b.WorkerId {
 				// job has been reassigned to another worker
-				s.log.Printf("[BEAT] sending kill signal: job %v was rescheduled to another worker\n", b.JobId)
+				s.logf(LogWarn, "[BEAT] sending kill signal: job %v was rescheduled to another worker", b.JobId)
 				b.kill <- true
 				continue
 			}
@@ -403,27 +702,375 @@ func (s *Server) dispatcher() {
 				// don't kill the job because maybe the db just hasn't synced
 				// fully yet.
 				b.kill <- true
-				s.log.Printf("[BEAT] sending kill signal: job %v not listed as running\n", b.JobId)
+				s.logf(LogWarn, "[BEAT] sending kill signal: job %v not listed as running", b.JobId)
 				continue
 			}
 
 			if j.Fetched.IsZero() {
-				s.log.Printf("[BEAT] job %v (worker %v), ??? left of %v\n", b.JobId, b.WorkerId, j.Timeout)
+				s.logf(LogInfo, "[BEAT] job %v (worker %v), ??? left of %v", b.JobId, b.WorkerId, j.Timeout)
 			} else {
-				s.log.Printf("[BEAT] job %v (worker %v), %v left of %v\n", b.JobId, b.WorkerId, j.Timeout-time.Now().Sub(j.Fetched), j.Timeout)
+				s.logf(LogInfo, "[BEAT] job %v (worker %v), %v left of %v", b.JobId, b.WorkerId, j.Timeout-time.Now().Sub(j.Fetched), j.Timeout)
 			}
 
 			if time.Now().Sub(j.Fetched) > j.Timeout && j.Timeout > 0 && !j.Fetched.IsZero() {
 				j.Status = StatusFailed
 				s.finnishJob(j)
-				s.log.Printf("[BEAT] sending kill signal: job %v timed out (worker %v)\n", b.JobId, b.WorkerId)
+				s.logf(LogWarn, "[BEAT] sending kill signal: job %v timed out (worker %v)", b.JobId, b.WorkerId)
 				b.kill <- true
+				continue
 			}
 			b.kill <- false
 		}
 	}
 }
 
+// collectGarbage purges old jobs from the job db (see DB.GC) and updates the
+// db stats.  It also starts expiring the output files of jobs older than
+// ResultTTL (see expireResults) unless that is still in progress.
+func (s *Server) collectGarbage() {
+	npurged, nremain, err := s.alljobs.GC()
+	s.Stats.NPurged += npurged
+	if err != nil {
+		s.logf(LogError, "[GC] %v", err)
+	}
+	if size, raw, err := s.alljobs.Sizes(); err == nil {
+		s.Stats.DBSizeMB = size / MB
+		s.Stats.DBRawMB = raw / MB
+		s.Stats.DBCompression = 1
+		if size > 0 {
+			s.Stats.DBCompression = float64(raw) / float64(size)
+		}
+	}
+	s.Stats.DBLimitMB = s.alljobs.Limit / MB
+	s.logf(LogInfo, "[GC] purged %v old jobs from db, %v remain", npurged, nremain)
+	if s.ResultTTL > 0 && !s.expiring {
+		s.expiring = true
+		go s.expireResults(s.expiredBefore, time.Now().Add(-s.ResultTTL))
+	}
+}
+
+// listJobs returns summaries of one page of the queued, running, and finished
+// jobs that match f (see ListPage) and whether more jobs follow the page.
+// Finished jobs are read from the finish index newest first only until the
+// page is full.
+func (s *Server) listJobs(f JobFilter, offset, limit int) (summaries []*JobSummary, more bool) {
+	summaries = []*JobSummary{}
+	seen := map[JobId]bool{}
+	add := func(j *Job) bool {
+		if seen[j.Id] || !f.match(j) {
+			return true
+		}
+		seen[j.Id] = true
+		if offset > 0 {
+			offset--
+			return true
+		} else if limit > 0 && len(summaries) == limit {
+			more = true
+			return false
+		}
+		summaries = append(summaries, NewJobSummary(j))
+		return true
+	}
+
+	unfinished := append([]*Job{}, s.queue...)
+	for _, j := range s.running {
+		unfinished = append(unfinished, j)
+	}
+	// BySubmitted sorts newest first
+	sort.Sort(BySubmitted{unfinished})
+	for _, j := range unfinished {
+		if !add(j) {
+			return summaries, more
+		}
+	}
+
+	if f.Status == "" || f.Status == StatusComplete || f.Status == StatusFailed || f.Status == StatusCanceled {
+		err := s.alljobs.EachFinished(f.Since, f.Until, add)
+		if err != nil {
+			s.logf(LogError, "[LIST] %v", err)
+		}
+	}
+	return summaries, more
+}
+
+// fetchJobs hands out up to req.N (at least one) queued jobs to the
+// requesting worker and marks them running.  Queued jobs past their deadline
+// are canceled first.  Fewer jobs are returned if the queue runs out of jobs
+// the worker can run or MaxConcurrent is reached, and none if the worker is
+// banned.
+func (s *Server) fetchJobs(req workRequest) []*Job {
+	s.expireJobs()
+	if s.isBanned(req.WorkerId) {
+		s.logf(LogWarn, "[FETCH] no work for banned worker %v", req.WorkerId)
+		return nil
+	}
+
+	n := req.N
+	if n < 1 {
+		n = 1
+	}
+	jobs := []*Job{}
+	for len(jobs) < n {
+		if len(s.queue) == 0 {
+			if len(jobs) == 0 {
+				s.logf(LogInfo, "[FETCH] no work in queue (worker %v)", req.WorkerId)
+			}
+			break
+		} else if s.MaxConcurrent > 0 && len(s.running) >= s.MaxConcurrent {
+			if len(jobs) == 0 {
+				s.logf(LogInfo, "[FETCH] no work: %v jobs already running (worker %v)", len(s.running), req.WorkerId)
+			}
+			break
+		}
+
+		j := s.nextJob(req.Class)
+		if j == nil {
+			if len(jobs) == 0 {
+				s.logf(LogInfo, "[FETCH] no work ready to run in queue (worker %v)", req.WorkerId)
+			}
+			break
+		}
+		s.logf(LogInfo, "[FETCH] job %v (worker %v)", j.Id, req.WorkerId)
+		s.jobinfo[j.Id] = NewBeat(req.WorkerId, j.Id)
+		s.running[j.Id] = j
+		j.Fetched = time.Now()
+		j.Status = StatusRunning
+		s.notify(j, StatusQueued)
+		s.alljobs.Put(j)
+		jobs = append(jobs, j)
+	}
+	return jobs
+}
+
+// expireJobs cancels all queued jobs that are past their Deadline.
+func (s *Server) expireJobs() {
+	now := time.Now()
+	expired := []*Job{}
+	for _, j := range s.queue {
+		if !j.Deadline.IsZero() && now.After(j.Deadline) {
+			expired = append(expired, j)
+		}
+	}
+
+	for _, j := range expired {
+		if j.Done() {
+			continue // already failed with a dependency
+		}
+		s.logf(LogInfo, "[EXPIRE] job %v not started before its deadline %v", j.Id, j.Deadline)
+		j.Status = StatusCanceled
+		j.Finished = now
+		j.Stderr += "\ncanceled: not started before its deadline\n"
+		s.finnishJob(j)
+	}
+}
+
+// nextJob removes and returns the first job in the queue that is ready to be
+// run by a worker of the given class.  nil is returned if there are no such
+// jobs.
+func (s *Server) nextJob(class string) *Job {
+	now := time.Now()
+	for i, j := range s.queue {
+		if now.Before(j.NotBefore) {
+			continue
+		} else if j.WorkerClass != "" && j.WorkerClass != class {
+			continue
+		} else if s.depwait[j.Id] {
+			continue
+		}
+		s.queue = append(append([]*Job{}, s.queue[:i]...), s.queue[i+1:]...)
+		return j
+	}
+	return nil
+}
+
+// checkDeps returns true if all of job j's dependencies (see Job.DependsOn)
+// are complete.  It returns an error if one of them failed, was canceled, or
+// can't be found - j can then never run.
+func (s *Server) checkDeps(j *Job) (ready bool, err error) {
+	ready = true
+	for _, id := range j.DependsOn {
+		var dep *Job
+		if jj, ok := s.running[id]; ok {
+			dep = jj
+		} else if jj, err := s.alljobs.Get(id); err == nil {
+			dep = jj
+		} else if jj, err := s.unarchive(id); err == nil {
+			dep = jj
+		} else {
+			return false, fmt.Errorf("dependency %v not found", id)
+		}
+
+		switch dep.Status {
+		case StatusComplete:
+		case StatusFailed, StatusCanceled:
+			return false, fmt.Errorf("dependency %v %v", id, dep.Status)
+		default:
+			ready = false
+		}
+	}
+	return ready, nil
+}
+
+// waitDeps checks the dependencies of the newly queued job j and adds it to
+// depwait if it must wait for them.  j is failed if it can never run - e.g.
+// if it depends on itself through other queued or running jobs.
+func (s *Server) waitDeps(j *Job) {
+	if len(j.DependsOn) == 0 {
+		return
+	} else if s.depCycle(j) {
+		s.failJob(j, errors.New("dependency cycle"))
+		return
+	}
+
+	ready, err := s.checkDeps(j)
+	if err != nil {
+		s.failJob(j, err)
+	} else if !ready {
+		s.depwait[j.Id] = true
+	}
+}
+
+// depCycle returns true if job j depends on itself - directly or through
+// other queued or running jobs.
+func (s *Server) depCycle(j *Job) bool {
+	jobs := map[JobId]*Job{}
+	for _, jj := range s.queue {
+		jobs[jj.Id] = jj
+	}
+	for id, jj := range s.running {
+		jobs[id] = jj
+	}
+
+	seen := map[JobId]bool{}
+	var reaches func(jj *Job) bool
+	reaches = func(jj *Job) bool {
+		for _, id := range jj.DependsOn {
+			if id == j.Id {
+				return true
+			} else if dep, ok := jobs[id]; ok && !seen[id] {
+				seen[id] = true
+				if reaches(dep) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	return reaches(j)
+}
+
+// releaseDependents re-checks the dependencies of the jobs in depwait that
+// depend on job j which just completed.
+func (s *Server) releaseDependents(j *Job) {
+	for _, jj := range append([]*Job{}, s.queue...) {
+		if !s.depwait[jj.Id] || !jj.dependsOn(j.Id) {
+			continue
+		}
+		ready, err := s.checkDeps(jj)
+		if err != nil {
+			s.failJob(jj, err)
+		} else if ready {
+			delete(s.depwait, jj.Id)
+		}
+	}
+}
+
+// failDependents fails the queued jobs depending on job j which failed or
+// was canceled - and in turn the jobs depending on them.
+func (s *Server) failDependents(j *Job) {
+	dependents := []*Job{}
+	for _, jj := range s.queue {
+		if jj.dependsOn(j.Id) {
+			dependents = append(dependents, jj)
+		}
+	}
+	for _, jj := range dependents {
+		if !jj.Done() {
+			s.failJob(jj, fmt.Errorf("dependency %v %v", j.Id, j.Status))
+		}
+	}
+}
+
+// failJob fails the queued job j which can't run because of a dependency.
+func (s *Server) failJob(j *Job, err error) {
+	s.logf(LogInfo, "[DEPENDS] job %v failed: %v", j.Id, err)
+	j.Status = StatusFailed
+	j.Finished = time.Now()
+	j.Stderr += fmt.Sprintf("\nfailed: %v\n", err)
+	s.finnishJob(j)
+}
+
+// queuePosition finds the job jid in the queue.  The wait is estimated
+// assuming jobs ahead in the queue take the average job time to run and are
+// spread evenly across as many workers as there are currently running jobs
+// (at least one).
+func (s *Server) queuePosition(jid JobId) queuePos {
+	for i, j := range s.queue {
+		if j.Id != jid {
+			continue
+		}
+		nworkers := len(s.running)
+		if nworkers == 0 {
+			nworkers = 1
+		}
+		rounds := i / nworkers
+		return queuePos{Pos: i + 1, Wait: time.Duration(rounds) * s.Stats.AvgJobTime}
+	}
+	return queuePos{}
+}
+
+// cancelJob cancels the queued or running job jid.  Running jobs are killed
+// by their worker the next time it beats.  An error is returned if the job
+// is not queued or running.
+func (s *Server) cancelJob(jid JobId) error {
+	var j *Job
+	if jj, ok := s.running[jid]; ok {
+		j = jj
+	} else {
+		for _, jj := range s.queue {
+			if jj.Id == jid {
+				j = jj
+				break
+			}
+		}
+	}
+	if j == nil {
+		return fmt.Errorf("job %v is not queued or running", jid)
+	}
+
+	s.logf(LogInfo, "[CANCEL] job %v (was %v)", jid, j.Status)
+	j.Status = StatusCanceled
+	j.Finished = time.Now()
+	j.Stderr += "\ncanceled by user\n"
+	s.finnishJob(j)
+	return nil
+}
+
+// retry requeues the failed job j if it has retries remaining and returns
+// true.  If j has used all its retries, it is left untouched and false is
+// returned.
+func (s *Server) retry(j *Job) bool {
+	if j.Attempts > j.MaxRetries {
+		return false
+	}
+
+	j.Status = StatusQueued
+	shift := j.Attempts - 1
+	if shift > maxBackoffShift {
+		shift = maxBackoffShift
+	}
+	j.NotBefore = time.Now().Add(retryBackoff << uint(shift))
+	s.notify(j, StatusRunning)
+	delete(s.jobinfo, j.Id)
+	delete(s.running, j.Id)
+	delete(s.joblogs, j.Id)
+	s.queue = append(s.queue, j)
+	s.alljobs.Put(j)
+	s.Stats.NRetried++
+	s.logf(LogInfo, "[RETRY] job %v (attempt %v of %v)", j.Id, j.Attempts, j.MaxRetries+1)
+	return true
+}
+
 func (s *Server) finnishJob(j *Job) {
 	if j == nil {
 		return
@@ -432,8 +1079,20 @@ func (s *Server) finnishJob(j *Job) {
 	// put this first to get data in db as soon as possible.
 	s.alljobs.Put(j)
 
+	oldstatus := StatusQueued
+	if _, ok := s.running[j.Id]; ok {
+		oldstatus = StatusRunning
+	}
+	s.notify(j, oldstatus)
+
+	if !j.Started.IsZero() && j.Finished.After(j.Started) {
+		s.jobDurs.Observe(j.Finished.Sub(j.Started).Seconds())
+	}
+
 	if j.Status == StatusFailed {
 		s.Stats.NFailed++
+	} else if j.Status == StatusCanceled {
+		s.Stats.NCanceled++
 	} else if j.Status == StatusComplete {
 		s.Stats.NCompleted++
 
@@ -457,15 +1116,23 @@ func (s *Server) finnishJob(j *Job) {
 		}
 	}
 
-	if ch, ok := s.submitchans[j.Id]; ok {
+	for _, ch := range s.submitchans[j.Id] {
 		ch <- j
 		close(ch)
-		delete(s.submitchans, j.Id)
 	}
+	delete(s.submitchans, j.Id)
 
 	delete(s.jobinfo, j.Id)
 	delete(s.running, j.Id)
+	delete(s.joblogs, j.Id)
+	delete(s.depwait, j.Id)
 	s.cleanQueue(j.Id)
+
+	if j.Status == StatusFailed || j.Status == StatusCanceled {
+		s.failDependents(j)
+	} else if j.Status == StatusComplete {
+		s.releaseDependents(j)
+	}
 }
 
 type jobRequest struct {
@@ -473,12 +1140,88 @@ type jobRequest struct {
 	Resp chan *Job
 }
 
+// JobFilter specifies which jobs to include in a job listing.
+type JobFilter struct {
+	// Status, if non-empty, selects only jobs with the given status.
+	Status string
+	// Since, if non-zero, selects only jobs that finished (or for unfinished
+	// jobs, were submitted) at or after Since.
+	Since time.Time
+	// Until, if non-zero, selects only jobs that finished (or for unfinished
+	// jobs, were submitted) before Until.
+	Until time.Time
+	// Tags, if non-empty, selects only jobs that have all the given tags
+	// with the same values.
+	Tags map[string]string
+}
+
+func (f JobFilter) match(j *Job) bool {
+	if f.Status != "" && j.Status != f.Status {
+		return false
+	}
+	for k, v := range f.Tags {
+		if jv, ok := j.Tags[k]; !ok || jv != v {
+			return false
+		}
+	}
+	t := j.Submitted
+	if j.Done() {
+		t = j.Finished
+	}
+	if !f.Until.IsZero() && !t.Before(f.Until) {
+		return false
+	}
+	return !t.Before(f.Since)
+}
+
+type objectiveUpdate struct {
+	Id  JobId
+	Val float64
+}
+
+type jobListRequest struct {
+	Filter        JobFilter
+	Offset, Limit int
+	Resp          chan jobListResponse
+}
+
+type jobListResponse struct {
+	Jobs []*JobSummary
+	More bool
+}
+
+type queuePos struct {
+	Pos  int
+	Wait time.Duration
+}
+
+type queuePosRequest struct {
+	Id   JobId
+	Resp chan queuePos
+}
+
+type cancelRequest struct {
+	Id   JobId
+	Resp chan error
+}
+
 type jobSubmit struct {
 	J      *Job
 	Result chan *Job
+	// Key is the submission's idempotency key (if any).  The id of the job
+	// submitted with it - J or an earlier job - is sent on Id.
+	Key string
+	Id  chan JobId
 }
 
 type workRequest struct {
 	WorkerId WorkerId
-	Ch       chan *Job
+	// Class is the class of the requesting worker (see Job.WorkerClass).
+	Class string
+	Ch    chan *Job
+	// N is the maximum number of jobs to hand out - one if N < 1.  If Batch
+	// is non-nil, all handed out jobs are sent on it (as a possibly empty
+	// slice) instead of on Ch.
+	N     int
+	Batch chan []*Job
 }
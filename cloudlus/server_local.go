@@ -0,0 +1,144 @@
+package cloudlus
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+	"github.com/rwcarlsen/cloudlus/scen"
+)
+
+// localWait is the time local workers wait between polls of an empty queue.
+var localWait = 1 * time.Second
+
+// localWorker runs jobs in-process for a server.  It fetches, heartbeats,
+// and pushes jobs through the server's dispatcher exactly like a remote
+// Worker does over RPC - just without the network hop.
+type localWorker struct {
+	Id WorkerId
+	s  *Server
+}
+
+func newLocalWorker(s *Server) *localWorker {
+	w := &localWorker{s: s}
+	copy(w.Id[:], uuid.NewRandom())
+	return w
+}
+
+func (w *localWorker) Run() {
+	for {
+		ran, err := w.dojob()
+		if err != nil {
+			w.s.logf(LogError, "[LOCAL] worker %v: %v", w.Id, err)
+		}
+
+		wait := localWait
+		if ran {
+			wait = 0
+		}
+		select {
+		case <-w.s.kill:
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (w *localWorker) dojob() (ran bool, err error) {
+	req := workRequest{WorkerId: w.Id, Ch: make(chan *Job, 1)}
+	select {
+	case w.s.fetchjobs <- req:
+	case <-w.s.kill:
+		return false, nil
+	}
+
+	j := <-req.Ch
+	if j == nil {
+		return false, nil
+	}
+
+	// the dispatcher owns the fetched job - run a copy of it
+	jj := *j
+	j = &jj
+	j.Outfiles = append([]File{}, j.Outfiles...)
+	if j.RecordCyclusVersion {
+		j.CyclusVersion = scen.CyclusVersion()
+	}
+
+	done := make(chan struct{})
+	kill := w.heartbeat(j.Id, done)
+
+	logs := &logBuffer{}
+	j.log = logs
+	go pushLogs(logs, func(data []byte) error {
+		select {
+		case w.s.pushlogs <- LogChunk{WorkerId: w.Id, JobId: j.Id, Data: data}:
+		case <-w.s.kill:
+		}
+		return nil
+	}, done)
+
+	if err = w.execute(j, kill); err != nil {
+		j.Status = StatusFailed
+		j.Stderr += fmt.Sprintf("\n%v\n", err)
+	}
+	close(done)
+
+	j.WorkerId = w.Id
+	select {
+	case w.s.pushjobs <- j:
+	case <-w.s.kill:
+	}
+	return true, err
+}
+
+// execute runs job j and stores its output files in the server's Outfiles
+// store.
+func (w *localWorker) execute(j *Job, kill chan bool) error {
+	f, err := ioutil.TempFile("", "cloudlus-outfiles-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	j.Execute(kill, f)
+	if _, err := f.Seek(0, 0); err != nil {
+		return err
+	}
+	return w.s.Outfiles.Put(outfileName(j.Id), f)
+}
+
+// heartbeat periodically notifies the server that the job jid is still being
+// run by w until done is closed.  The returned channel receives true if the
+// server requests the job be killed.
+func (w *localWorker) heartbeat(jid JobId, done chan struct{}) (kill chan bool) {
+	kill = make(chan bool, 1)
+	go func() {
+		tick := time.NewTicker(beatInterval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-tick.C:
+				b := NewBeat(w.Id, jid)
+				b.kill = make(chan bool, 1)
+				select {
+				case w.s.beat <- b:
+				case <-w.s.kill:
+					return
+				}
+				if <-b.kill {
+					kill <- true
+					return
+				}
+			case <-done:
+				return
+			case <-w.s.kill:
+				return
+			}
+		}
+	}()
+	return kill
+}
@@ -1,19 +1,36 @@
 package cloudlus
 
 import (
+	"compress/gzip"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
-	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 )
 
-func httperror(w http.ResponseWriter, msg string, code int) {
-	http.Error(w, msg, http.StatusBadRequest)
-	log.Print(msg)
+// readJobBody reads the body of a job submission request r.  Bodies larger
+// than the server's MaxJobSize are rejected with status 413 (Request Entity
+// Too Large).  If reading fails, the error has already been sent to the
+// client.
+func (s *Server) readJobBody(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, s.MaxJobSize))
+	var tooBig *http.MaxBytesError
+	if errors.As(err, &tooBig) {
+		msg := fmt.Sprintf("job submission exceeds the %v byte limit", s.MaxJobSize)
+		s.httpstatus(w, r, msg, http.StatusRequestEntityTooLarge)
+		return nil, err
+	} else if err != nil {
+		s.httperror(w, r, err.Error(), http.StatusBadRequest)
+		return nil, err
+	}
+	return data, nil
 }
 
 func (s *Server) handleJob(w http.ResponseWriter, r *http.Request) {
@@ -22,13 +39,13 @@ func (s *Server) handleJob(w http.ResponseWriter, r *http.Request) {
 
 		jid, err := DecodeJobId(idstr)
 		if err != nil {
-			httperror(w, err.Error(), http.StatusBadRequest)
+			s.httperror(w, r, err.Error(), http.StatusBadRequest)
 			return
 		}
 
 		j, err := s.Get(jid)
 		if err != nil {
-			httperror(w, err.Error(), http.StatusBadRequest)
+			s.httperror(w, r, err.Error(), http.StatusBadRequest)
 			return
 		}
 
@@ -40,22 +57,24 @@ func (s *Server) handleJob(w http.ResponseWriter, r *http.Request) {
 		}
 
 		if err != nil {
-			httperror(w, err.Error(), http.StatusBadRequest)
+			s.httperror(w, r, err.Error(), http.StatusBadRequest)
 			return
 		}
 
 		w.Header().Add("Content-Disposition", fmt.Sprintf("filename=\"job-%v.json\"", j.Id))
 		w.Write(data)
 	} else if r.Method == "POST" {
-		data, err := ioutil.ReadAll(r.Body)
+		if !s.limitSubmit(w, r) {
+			return
+		}
+		data, err := s.readJobBody(w, r)
 		if err != nil {
-			httperror(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
 		j := &Job{}
 		if err := json.Unmarshal(data, &j); err != nil {
-			httperror(w, err.Error(), http.StatusBadRequest)
+			s.httperror(w, r, err.Error(), http.StatusBadRequest)
 			return
 		}
 
@@ -72,30 +91,135 @@ func (s *Server) handleJobStat(w http.ResponseWriter, r *http.Request) {
 
 	jid, err := DecodeJobId(idstr)
 	if err != nil {
-		httperror(w, err.Error(), http.StatusBadRequest)
+		s.httperror(w, r, err.Error(), http.StatusBadRequest)
 		return
 	}
 
 	j, err := s.Get(jid)
 	if err != nil {
-		httperror(w, err.Error(), http.StatusBadRequest)
+		s.httperror(w, r, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	data, err := json.Marshal(NewJobStat(j))
+	// clients that prefer plain text (e.g. curl -H 'Accept: text/plain')
+	// just get the status string
+	if acceptQ(r, "text/plain") > acceptQ(r, "application/json") {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintln(w, j.Status)
+		return
+	}
+
+	stat := NewJobStat(j)
+	if j.Status == StatusQueued {
+		stat.QueuePos, stat.EstWait = s.QueuePosition(jid)
+	}
+
+	data, err := json.Marshal(stat)
+	if err != nil {
+		s.httperror(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// acceptQ returns the quality value (between 0 and 1) the Accept header of r
+// gives the media type mtype (e.g. "text/plain") using the most specific
+// matching media range.  It returns -1 if no media range matches (including
+// when there is no Accept header).
+func acceptQ(r *http.Request, mtype string) float64 {
+	typ := strings.SplitN(mtype, "/", 2)[0]
+	q, specificity := -1.0, -1
+	for _, v := range r.Header["Accept"] {
+		for _, field := range strings.Split(v, ",") {
+			params := strings.Split(field, ";")
+			rng := strings.ToLower(strings.TrimSpace(params[0]))
+			spec := -1
+			switch rng {
+			case mtype:
+				spec = 2
+			case typ + "/*":
+				spec = 1
+			case "*/*":
+				spec = 0
+			}
+			if spec <= specificity {
+				continue
+			}
+
+			specificity, q = spec, 1
+			for _, p := range params[1:] {
+				p = strings.Replace(p, " ", "", -1)
+				if val, err := strconv.ParseFloat(strings.TrimPrefix(p, "q="), 64); err == nil && strings.HasPrefix(p, "q=") {
+					q = val
+				}
+			}
+		}
+	}
+	return q
+}
+
+// handleJobs serves a JSON list of job summaries.  Jobs can be filtered with
+// the optional 'status', 'since' and 'until' (RFC 3339 times), and 'tag'
+// query parameters (see parseJobFilter).
+func (s *Server) handleJobs(w http.ResponseWriter, r *http.Request) {
+	f, err := parseJobFilter(r)
+	if err != nil {
+		s.httperror(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	data, err := json.Marshal(s.List(f))
 	if err != nil {
-		httperror(w, err.Error(), http.StatusBadRequest)
+		s.httperror(w, r, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Add("Access-Control-Allow-Origin", "*")
 	w.Write(data)
 }
 
+// parseJobFilter builds a job filter from r's "status", "since", "until",
+// and (repeated) "tag" parameters.  Times are in RFC3339 format and tags are
+// key:value pairs.
+func parseJobFilter(r *http.Request) (JobFilter, error) {
+	f := JobFilter{Status: r.FormValue("status")}
+	switch f.Status {
+	case "", StatusQueued, StatusRunning, StatusComplete, StatusFailed, StatusCanceled:
+	default:
+		return f, fmt.Errorf("invalid job status '%v'", f.Status)
+	}
+
+	for name, t := range map[string]*time.Time{"since": &f.Since, "until": &f.Until} {
+		if val := r.FormValue(name); val != "" {
+			tm, err := time.Parse(time.RFC3339, val)
+			if err != nil {
+				return f, err
+			}
+			*t = tm
+		}
+	}
+
+	for _, tag := range r.Form["tag"] {
+		kv := strings.SplitN(tag, ":", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return f, fmt.Errorf("invalid tag filter '%v' (want key:value)", tag)
+		}
+		if f.Tags == nil {
+			f.Tags = map[string]string{}
+		}
+		f.Tags[kv[0]] = kv[1]
+	}
+	return f, nil
+}
+
 func (s *Server) handleServerStats(w http.ResponseWriter, r *http.Request) {
 
   data, err := json.Marshal(s.Stats)
 	if err != nil {
-		httperror(w, err.Error(), http.StatusBadRequest)
+		s.httperror(w, r, err.Error(), http.StatusBadRequest)
 		return
 	}
 
@@ -103,18 +227,25 @@ func (s *Server) handleServerStats(w http.ResponseWriter, r *http.Request) {
 }
 
 
+// createJob submits the job j and responds with it.  If the request has an
+// Idempotency-Key header that was already used by an earlier submission, j
+// is discarded and the earlier job is the response (with status 200 rather
+// than 201) - so clients can safely retry submissions.
 func (s *Server) createJob(r *http.Request, w http.ResponseWriter, j *Job) {
-	s.Start(j, nil)
+	code, ok := s.submitJob(r, w, j, nil)
+	if !ok {
+		return
+	}
 
 	j, err := s.Get(j.Id)
 	if err != nil {
-		httperror(w, err.Error(), http.StatusBadRequest)
+		s.httperror(w, r, err.Error(), http.StatusBadRequest)
 		return
 	}
 
 	data, err := json.Marshal(j)
 	if err != nil {
-		httperror(w, err.Error(), http.StatusBadRequest)
+		s.httperror(w, r, err.Error(), http.StatusBadRequest)
 		return
 	}
 
@@ -123,14 +254,189 @@ func (s *Server) createJob(r *http.Request, w http.ResponseWriter, j *Job) {
 	w.Header().Set("Location", r.Host+"/api/v1/job/"+jid)
 
 	w.Header().Add("Access-Control-Allow-Origin", "*")
-	w.WriteHeader(http.StatusCreated)
+	w.WriteHeader(code)
+	w.Write(data)
+}
+
+// submitJob starts job j submitted by request r - deduplicated by the
+// request's Idempotency-Key header if it has one - and sends the finished
+// job on result if it is non-nil.  It returns the response status code:
+// http.StatusOK for a duplicate submission (j then takes the earlier job's
+// id) and http.StatusCreated otherwise.  If j can't be submitted, submitJob
+// responds with an error and returns false.
+func (s *Server) submitJob(r *http.Request, w http.ResponseWriter, j *Job, result chan *Job) (code int, ok bool) {
+	if j.dependsOn(j.Id) {
+		s.httperror(w, r, fmt.Sprintf("job %v depends on itself", j.Id), http.StatusBadRequest)
+		return 0, false
+	}
+
+	code = http.StatusCreated
+	if key := r.Header.Get("Idempotency-Key"); key != "" {
+		s.reqlogf(r, LogInfo, "[REST] submitting job %v with idempotency key %q", j.Id, key)
+		if id, dup := s.startKeyed(j, key, result); dup {
+			s.reqlogf(r, LogInfo, "[REST] duplicate submission of job %v", id)
+			j.Id = id
+			code = http.StatusOK
+		}
+	} else {
+		s.reqlogf(r, LogInfo, "[REST] submitting job %v", j.Id)
+		s.Start(j, result)
+	}
+	return code, true
+}
+
+// handleResubmit submits a new job that reruns the finished (complete or
+// failed) job with the given id using the same command and input files.
+// The response is the same as for a normal job submission.
+func (s *Server) handleResubmit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		s.httperror(w, r, "job-resubmit requires a POST request", http.StatusMethodNotAllowed)
+		return
+	} else if !s.limitSubmit(w, r) {
+		return
+	}
+
+	idstr := r.URL.Path[len("/api/v1/job-resubmit/"):]
+	jid, err := DecodeJobId(idstr)
+	if err != nil {
+		s.httperror(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	j, err := s.Get(jid)
+	if err != nil {
+		s.httperror(w, r, err.Error(), http.StatusNotFound)
+		return
+	} else if !j.Done() {
+		msg := fmt.Sprintf("job %v can't be resubmitted: it is still %v", jid, j.Status)
+		s.httperror(w, r, msg, http.StatusConflict)
+		return
+	}
+
+	jj, err := j.Rerun()
+	if err != nil {
+		s.httperror(w, r, err.Error(), http.StatusGone)
+		return
+	}
+	s.reqlogf(r, LogInfo, "[REST] resubmitting job %v as job %v", jid, jj.Id)
+	s.createJob(r, w, jj)
+}
+
+// handleCancel cancels the queued or running job with the given id and
+// responds with its job-stat JSON.  Jobs that have already finished can't be
+// canceled (409 Conflict).
+func (s *Server) handleCancel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		s.httperror(w, r, "job-cancel requires a POST request", http.StatusMethodNotAllowed)
+		return
+	}
+
+	idstr := r.URL.Path[len("/api/v1/job-cancel/"):]
+	jid, err := DecodeJobId(idstr)
+	if err != nil {
+		s.httperror(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	j, err := s.Get(jid)
+	if err != nil {
+		s.httpstatus(w, r, err.Error(), http.StatusNotFound)
+		return
+	} else if err := s.Cancel(jid); err != nil {
+		msg := fmt.Sprintf("job %v can't be canceled: it is %v", jid, j.Status)
+		s.httpstatus(w, r, msg, http.StatusConflict)
+		return
+	}
+
+	j, err = s.Get(jid)
+	if err != nil {
+		s.httperror(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data, err := json.Marshal(NewJobStat(j))
+	if err != nil {
+		s.httperror(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
 	w.Write(data)
 }
 
+// defaultWaitTimeout is the default maximum time the job-wait endpoint holds
+// a request open waiting for the job to finish.
+const defaultWaitTimeout = 60 * time.Second
+
+// handleSubmitWait submits the job in the request body and waits for it to
+// finish before responding with the complete job.  If the job doesn't finish
+// within the timeout given by the optional 'timeout' query parameter (e.g.
+// "30s"), 504 (Gateway Timeout) is returned - the job keeps running and can
+// be retrieved later.  Waiting stops early if the client goes away.
+func (s *Server) handleSubmitWait(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		s.httperror(w, r, "job-wait requires a POST request", http.StatusMethodNotAllowed)
+		return
+	}
+
+	timeout := defaultWaitTimeout
+	if v := r.FormValue("timeout"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			s.httperror(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		timeout = d
+	}
+
+	if !s.limitSubmit(w, r) {
+		return
+	}
+	data, err := s.readJobBody(w, r)
+	if err != nil {
+		return
+	}
+
+	j := &Job{}
+	if err := json.Unmarshal(data, &j); err != nil {
+		s.httperror(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ch := make(chan *Job, 1)
+	if _, ok := s.submitJob(r, w, j, ch); !ok {
+		return
+	}
+	w.Header().Set("Location", r.Host+"/api/v1/job/"+j.Id.String())
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+
+	select {
+	case result := <-ch:
+		if result == nil {
+			s.httperror(w, r, fmt.Sprintf("job %v was lost by the server", j.Id), http.StatusInternalServerError)
+			return
+		}
+		data, err = json.Marshal(result)
+		if err != nil {
+			s.httperror(w, r, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write(data)
+	case <-r.Context().Done():
+		s.reqlogf(r, LogInfo, "[REST] client stopped waiting for job %v", j.Id)
+	case <-time.After(timeout):
+		status := "unknown"
+		if j, err := s.Get(j.Id); err == nil {
+			status = j.Status
+		}
+		msg := fmt.Sprintf("job %v did not finish within %v (it is %v)", j.Id, timeout, status)
+		s.httpstatus(w, r, msg, http.StatusGatewayTimeout)
+	}
+}
+
 func (s *Server) handleSubmitInfile(w http.ResponseWriter, r *http.Request) {
-	data, err := ioutil.ReadAll(r.Body)
+	if !s.limitSubmit(w, r) {
+		return
+	}
+	data, err := s.readJobBody(w, r)
 	if err != nil {
-		httperror(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
@@ -138,55 +444,173 @@ func (s *Server) handleSubmitInfile(w http.ResponseWriter, r *http.Request) {
 	s.createJob(r, w, j)
 }
 
+// handleInfile responds with the raw bytes of one of a job's input files so
+// the run can be reproduced locally.  The optional name query parameter
+// selects the file - otherwise the job's cyclus input file is returned (see
+// cyclusInfile).
+func (s *Server) handleInfile(w http.ResponseWriter, r *http.Request) {
+	idstr := r.URL.Path[len("/api/v1/job-infile/"):]
+	j, err := s.getjob(idstr)
+	if err != nil {
+		s.httperror(w, r, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	var f *File
+	if name := r.URL.Query().Get("name"); name != "" {
+		for i := range j.Infiles {
+			if j.Infiles[i].Name == name {
+				f = &j.Infiles[i]
+				break
+			}
+		}
+	} else if f, err = cyclusInfile(j); err != nil {
+		s.httperror(w, r, fmt.Sprintf("job %v: %v", j.Id, err), http.StatusBadRequest)
+		return
+	}
+	if f == nil {
+		s.httperror(w, r, fmt.Sprintf("job %v has no such input file", j.Id), http.StatusNotFound)
+		return
+	}
+
+	ctype := "application/octet-stream"
+	if strings.EqualFold(filepath.Ext(f.Name), ".xml") {
+		ctype = "application/xml"
+	}
+	w.Header().Set("Content-Type", ctype)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"job-%v-%v\"", j.Id, filepath.Base(f.Name)))
+	w.Write(f.Data)
+}
+
+// cyclusInfile returns the job's cyclus input file: the default infile for
+// jobs created from a raw input file (see NewJobDefault), the input file
+// rendered from the job's scenario and template for scenario jobs (see
+// runscen.BuildRemoteJob), and otherwise the first xml input file (or just
+// the first input file).  It returns nil if the job has no input files.
+func cyclusInfile(j *Job) (*File, error) {
+	if len(j.Infiles) == 0 {
+		return nil, nil
+	} else if f := j.infile(DefaultInfile); f != nil {
+		return f, nil
+	}
+
+	if _, err := decodeJobScenario(j); err == nil {
+		scn, vars, err := bundleScenario(j)
+		if err != nil {
+			return nil, err
+		} else if len(scn.Builds) == 0 && len(vars) > 0 {
+			if _, err := scn.TransformVars(vars); err != nil {
+				return nil, err
+			}
+		}
+		data, err := scn.GenCyclusInfile()
+		if err != nil {
+			return nil, err
+		}
+		return &File{Name: DefaultInfile, Data: data, Size: len(data)}, nil
+	}
+
+	for i, f := range j.Infiles {
+		if strings.EqualFold(filepath.Ext(f.Name), ".xml") {
+			return &j.Infiles[i], nil
+		}
+	}
+	return &j.Infiles[0], nil
+}
+
+// acceptsEncoding returns true if the Accept-Encoding header of r allows the
+// named content encoding (e.g. "gzip").
+func acceptsEncoding(r *http.Request, enc string) bool {
+	for _, v := range r.Header["Accept-Encoding"] {
+		for _, field := range strings.Split(v, ",") {
+			params := strings.Split(field, ";")
+			if !strings.EqualFold(strings.TrimSpace(params[0]), enc) {
+				continue
+			}
+			for _, p := range params[1:] {
+				p = strings.Replace(p, " ", "", -1)
+				if q, err := strconv.ParseFloat(strings.TrimPrefix(p, "q="), 64); err == nil && q == 0 {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
 func (s *Server) handleOutfiles(w http.ResponseWriter, r *http.Request) {
 	idstr := r.URL.Path[len("/api/v1/job-outfiles/"):]
 	jid, err := DecodeJobId(idstr)
 	if err != nil {
-		httperror(w, err.Error(), http.StatusBadRequest)
+		s.httperror(w, r, err.Error(), http.StatusBadRequest)
 		return
 	}
 
 	if r.Method == "POST" {
-		fname := outfileName(jid)
-		f, err := os.Create(fname)
-		if err != nil {
+		if err := s.Outfiles.Put(outfileName(jid), r.Body); err != nil {
 			msg := fmt.Sprintf("job %v outfile subission failed: %v", idstr, err)
-			httperror(w, msg, http.StatusBadRequest)
-			return
-		}
-		defer f.Close()
-
-		_, err = io.Copy(f, r.Body)
-		if err != nil {
-			msg := fmt.Sprintf("job %v outfile subission failed: %v", idstr, err)
-			httperror(w, msg, http.StatusBadRequest)
+			s.httperror(w, r, msg, http.StatusBadRequest)
 			return
 		}
 	} else if r.Method == "GET" {
 		if j, err := s.Get(jid); err != nil {
-			s.log.Printf("[REST] warning: /api/v1/job-outfiles/ request for job not in db (id=%v)\n", jid)
+			s.reqlogf(r, LogWarn, "[REST] /api/v1/job-outfiles/ request for job not in db (id=%v)", jid)
+		} else if j.Status == StatusCanceled {
+			s.httpstatus(w, r, fmt.Sprintf("job %v was canceled and has no output files", jid), http.StatusConflict)
+			return
+		} else if j.OutfilesExpired {
+			s.httpstatus(w, r, fmt.Sprintf("job %v output files have expired (older than %v)", jid, s.ResultTTL), http.StatusGone)
+			return
 		} else if j.Status != StatusComplete {
-			s.log.Printf("[REST] warning: /api/v1/job-outfiles/ request for potentially incomplete job")
+			s.reqlogf(r, LogWarn, "[REST] /api/v1/job-outfiles/ request for potentially incomplete job")
 		}
 
-		w.Header().Add("Content-Disposition", fmt.Sprintf("filename=\"results-%v.zip\"", jid))
-
-		f, err := os.Open(outfileName(jid))
+		f, err := s.openOutfiles(jid)
 		if err != nil {
 			msg := fmt.Sprintf("[REST] error: job %v output files not found", jid)
-			httperror(w, msg, http.StatusBadRequest)
+			s.httperror(w, r, msg, http.StatusBadRequest)
 			return
 		}
 		defer f.Close()
 
-		_, err = io.Copy(w, f)
+		// stream the (possibly huge) zip file out as it is read with no
+		// Content-Length - i.e. chunked.
+		w.Header().Add("Content-Disposition", fmt.Sprintf("filename=\"results-%v.zip\"", jid))
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		var dst io.Writer = flushWriter{w}
+		if acceptsEncoding(r, "gzip") {
+			w.Header().Set("Content-Encoding", "gzip")
+			gw := gzip.NewWriter(dst)
+			defer gw.Close()
+			dst = gw
+		}
+
+		_, err = io.Copy(dst, f)
 		if err != nil {
-			httperror(w, err.Error(), http.StatusInternalServerError)
+			// headers are already sent - all we can do is stop
+			s.reqlogf(r, LogError, "[REST] streaming job %v output files: %v", jid, err)
 			return
 		}
 	}
 }
 
+// flushWriter flushes each write through to the client (if supported) so
+// streamed responses aren't held in server buffers.
+type flushWriter struct {
+	w io.Writer
+}
+
+func (fw flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	if f, ok := fw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return n, err
+}
+
 func (s *Server) getjob(idstr string) (*Job, error) {
 	uid, err := hex.DecodeString(idstr)
 	if err != nil {
@@ -17,8 +17,21 @@ func (r *RPC) Heartbeat(b Beat, kill *bool) error {
 	return nil
 }
 
+// checkSize returns an error if j is larger than the server's MaxJobSize.
+// Unlike for http submissions, the job has already been read into memory by
+// the time this is called - but at least it doesn't get stored or run.
+func (r *RPC) checkSize(j *Job) error {
+	if size := j.Size(); size > r.s.MaxJobSize {
+		return fmt.Errorf("server: job %v size %v exceeds the %v byte limit", j.Id, size, r.s.MaxJobSize)
+	}
+	return nil
+}
+
 // Submit j via rpc and block until complete returning the result job.
 func (r *RPC) Submit(j *Job, result **Job) error {
+	if err := r.checkSize(j); err != nil {
+		return err
+	}
 	gotj := r.s.Run(j)
 	*result = gotj
 	if gotj == nil {
@@ -29,6 +42,9 @@ func (r *RPC) Submit(j *Job, result **Job) error {
 
 // Submit j via rpc asynchronously.
 func (r *RPC) SubmitAsync(j *Job, unused *int) error {
+	if err := r.checkSize(j); err != nil {
+		return err
+	}
 	r.s.Start(j, nil)
 	return nil
 }
@@ -42,8 +58,24 @@ func (r *RPC) Retrieve(j JobId, result **Job) error {
 	return nil
 }
 
+// FetchRequest identifies a worker requesting a job via RPC.FetchClass.
+type FetchRequest struct {
+	WorkerId WorkerId
+	// Class is the worker's class (see Job.WorkerClass).
+	Class string
+	// N is the maximum number of jobs handed out by RPC.FetchN.
+	N int
+}
+
+// Fetch hands out the next queued job that has no worker class restriction.
 func (r *RPC) Fetch(wid WorkerId, j **Job) error {
-	req := workRequest{wid, make(chan *Job, 1)}
+	return r.FetchClass(FetchRequest{WorkerId: wid}, j)
+}
+
+// FetchClass hands out the next queued job that can be run by a worker of
+// the requested class.
+func (r *RPC) FetchClass(fr FetchRequest, j **Job) error {
+	req := workRequest{WorkerId: fr.WorkerId, Class: fr.Class, Ch: make(chan *Job, 1)}
 	r.s.fetchjobs <- req
 	*j = <-req.Ch
 	if *j == nil {
@@ -53,7 +85,28 @@ func (r *RPC) Fetch(wid WorkerId, j **Job) error {
 	return nil
 }
 
+// FetchN hands out up to fr.N (at least one) queued jobs that can be run by
+// a worker of the requested class in a single call - e.g. for workers that
+// run several jobs in parallel.  Fewer jobs are handed out if not enough are
+// queued or the server's MaxConcurrent limit is reached.
+func (r *RPC) FetchN(fr FetchRequest, jobs *[]*Job) error {
+	req := workRequest{WorkerId: fr.WorkerId, Class: fr.Class, N: fr.N, Batch: make(chan []*Job, 1)}
+	r.s.fetchjobs <- req
+	*jobs = <-req.Batch
+	if len(*jobs) == 0 {
+		return nojoberr
+	}
+	return nil
+}
+
 func (r *RPC) Push(j *Job, unused *int) error {
 	r.s.pushjobs <- j
 	return nil
 }
+
+// PushLog adds a running job's new log output to the job's live log (see
+// Server.handleJobLogs).
+func (r *RPC) PushLog(c LogChunk, unused *int) error {
+	r.s.pushlogs <- c
+	return nil
+}
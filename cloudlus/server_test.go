@@ -1,8 +1,26 @@
 package cloudlus
 
 import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/rwcarlsen/cloudlus/scen"
 )
 
 func TestServerJobGC(t *testing.T) {
@@ -45,3 +63,2273 @@ func TestServerJobGC(t *testing.T) {
 		t.Errorf("server failed to run job GC")
 	}
 }
+
+func TestMetrics(t *testing.T) {
+	const testaddr = "127.0.0.1:45688"
+	db, _ := NewDB("", dblimit)
+	s := NewServer(testaddr, testaddr, db)
+	nolog(s)
+	defer s.Close()
+
+	s.Stats.NSubmitted = 3
+	s.Stats.CurrQueued = 2
+	j := NewJobCmd("echo", "1")
+	j.Status = StatusComplete
+	j.Started = time.Now()
+	j.Finished = j.Started.Add(2 * time.Second)
+	s.finnishJob(j)
+
+	req, _ := http.NewRequest("GET", "/metrics", nil)
+	w := httptest.NewRecorder()
+	s.serv.Handler.ServeHTTP(w, req)
+
+	body := w.Body.String()
+	wants := []string{
+		"cloudlus_jobs_submitted_total 3\n",
+		"cloudlus_jobs_completed_total 1\n",
+		"cloudlus_jobs_queued 2\n",
+		"# TYPE cloudlus_job_duration_seconds histogram\n",
+		"cloudlus_job_duration_seconds_bucket{le=\"1\"} 0\n",
+		"cloudlus_job_duration_seconds_bucket{le=\"5\"} 1\n",
+		"cloudlus_job_duration_seconds_count 1\n",
+	}
+	for _, want := range wants {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics output missing %q", want)
+		}
+	}
+	if t.Failed() {
+		t.Logf("metrics output:\n%v", body)
+	}
+}
+
+// TestArchive checks that jobs purged from the db are saved to and can be
+// retrieved from the server's archive directory.
+func TestArchive(t *testing.T) {
+	const testaddr = "127.0.0.1:45692"
+	dir, err := ioutil.TempDir("", "cloudlus-archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// zero limit to force GC
+	db, _ := NewDB("", 0)
+	db.PurgeAge = 0 * time.Second
+	s := NewServer(testaddr, testaddr, db)
+	s.ArchiveDir = dir
+	nolog(s)
+	go s.dispatcher()
+	defer s.Close()
+
+	j := NewJobCmd("echo", "1")
+	j.Status = StatusComplete
+	j.Finished = time.Now().Add(-time.Minute)
+	if err := db.Put(j); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(outfileName(j.Id), []byte("outdata"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(outfileName(j.Id))
+
+	if npurged, _, err := db.GC(); err != nil {
+		t.Fatal(err)
+	} else if npurged != 1 {
+		t.Fatalf("GC purged %v jobs, want 1", npurged)
+	}
+
+	if _, err := db.Get(j.Id); err == nil {
+		t.Fatalf("job is still in db after GC")
+	}
+
+	got, err := s.Get(j.Id)
+	if err != nil {
+		t.Fatalf("failed to retrieve archived job: %v", err)
+	} else if got.Status != StatusComplete {
+		t.Errorf("wrong archived job status: got %v, want %v", got.Status, StatusComplete)
+	}
+
+	req, _ := http.NewRequest("GET", "/api/v1/job-outfiles/"+j.Id.String(), nil)
+	w := httptest.NewRecorder()
+	s.serv.Handler.ServeHTTP(w, req)
+	if body := w.Body.String(); body != "outdata" {
+		t.Errorf("wrong archived outfile data: got %q, want %q", body, "outdata")
+	}
+}
+
+// TestOutfilesStore checks that job output files are stored in, served
+// from, and purged from the server's Outfiles store.
+func TestOutfilesStore(t *testing.T) {
+	const testaddr = "127.0.0.1:45711"
+	dir, err := ioutil.TempDir("", "cloudlus-outfiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// zero limit to force GC
+	db, _ := NewDB("", 0)
+	db.PurgeAge = 0 * time.Second
+	s := NewServer(testaddr, testaddr, db)
+	s.Outfiles = DirStore{Dir: dir}
+	nolog(s)
+	go s.dispatcher()
+	defer s.Close()
+
+	j := NewJobCmd("echo", "1")
+	j.Status = StatusComplete
+	j.Finished = time.Now().Add(-time.Minute)
+	if err := db.Put(j); err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("POST", "/api/v1/job-outfiles/"+j.Id.String(), strings.NewReader("outdata"))
+	s.serv.Handler.ServeHTTP(httptest.NewRecorder(), req)
+	if _, err := os.Stat(filepath.Join(dir, outfileName(j.Id))); err != nil {
+		t.Fatalf("outfiles not in store: %v", err)
+	} else if _, err := os.Stat(outfileName(j.Id)); err == nil {
+		os.Remove(outfileName(j.Id))
+		t.Fatalf("outfiles written to working directory")
+	}
+
+	req, _ = http.NewRequest("GET", "/api/v1/job-outfiles/"+j.Id.String(), nil)
+	w := httptest.NewRecorder()
+	s.serv.Handler.ServeHTTP(w, req)
+	if body := w.Body.String(); body != "outdata" {
+		t.Errorf("wrong outfile data: got %q, want %q", body, "outdata")
+	}
+
+	if _, _, err := db.GC(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, outfileName(j.Id))); !os.IsNotExist(err) {
+		t.Errorf("purged job's outfiles still in store")
+	}
+}
+
+// TestResultTTL checks that the output files of jobs older than the
+// server's ResultTTL are deleted by GC while the jobs stay queryable.
+func TestResultTTL(t *testing.T) {
+	const testaddr = "127.0.0.1:45724"
+	dir, err := ioutil.TempDir("", "cloudlus-ttl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, _ := NewDB("", dblimit)
+	s := NewServer(testaddr, testaddr, db)
+	s.Outfiles = DirStore{Dir: dir}
+	s.ResultTTL = time.Minute
+	nolog(s)
+	go s.dispatcher()
+	defer s.Close()
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	f, _ := zw.Create("obj.dat")
+	f.Write([]byte("42.5\n"))
+	zw.Close()
+
+	old, recent := NewJobCmd("true"), NewJobCmd("true")
+	old.Finished = time.Now().Add(-2 * time.Minute)
+	recent.Finished = time.Now()
+	for _, j := range []*Job{old, recent} {
+		j.Status = StatusComplete
+		j.ObjFile = "obj.dat"
+		if err := db.Put(j); err != nil {
+			t.Fatal(err)
+		} else if err := s.Outfiles.Put(outfileName(j.Id), bytes.NewReader(buf.Bytes())); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// run GC twice to check already expired jobs are skipped; output files
+	// are expired asynchronously
+	var got *Job
+	for i := 0; i < 2; i++ {
+		s.collect <- struct{}{}
+		for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+			got, err = s.Get(old.Id)
+			if err != nil {
+				t.Fatalf("expired job not in db: %v", err)
+			} else if got.OutfilesExpired || time.Since(start) > 5*time.Second {
+				break
+			}
+		}
+	}
+
+	if !got.OutfilesExpired || got.Status != StatusComplete {
+		t.Errorf("expired job: got OutfilesExpired=%v, status %v", got.OutfilesExpired, got.Status)
+	} else if got.Objective == nil || *got.Objective != 42.5 {
+		t.Errorf("expired job: objective %v not kept, want 42.5", got.Objective)
+	}
+	if _, err := os.Stat(filepath.Join(dir, outfileName(old.Id))); !os.IsNotExist(err) {
+		t.Errorf("expired job's outfiles still in store")
+	}
+	if got, err := s.Get(recent.Id); err != nil || got.OutfilesExpired {
+		t.Errorf("recent job: got %+v (err %v), want outfiles kept", got, err)
+	} else if _, err := os.Stat(filepath.Join(dir, outfileName(recent.Id))); err != nil {
+		t.Errorf("recent job's outfiles were deleted: %v", err)
+	}
+
+	req, _ := http.NewRequest("GET", "/api/v1/job-outfiles/"+old.Id.String(), nil)
+	w := httptest.NewRecorder()
+	s.serv.Handler.ServeHTTP(w, req)
+	if w.Code != http.StatusGone {
+		t.Errorf("expired outfiles: got status %v, want %v", w.Code, http.StatusGone)
+	}
+
+	if res := s.Objectives([]JobId{old.Id})[old.Id]; res.Objective == nil || *res.Objective != 42.5 {
+		t.Errorf("expired job: got objective result %+v, want 42.5", res)
+	}
+
+	// expiry progress survives a restart
+	s2 := NewServer(testaddr, testaddr, db)
+	if !s2.expiredBefore.After(old.Finished) || s2.expiredBefore.After(recent.Finished) {
+		t.Errorf("restarted server: got expiredBefore %v, want between %v and %v", s2.expiredBefore, old.Finished, recent.Finished)
+	}
+	if n, err := db.Count(); err != nil || n != 2 {
+		t.Errorf("db with expiry progress: got %v jobs (err %v), want 2", n, err)
+	}
+}
+
+// TestCheckpoint checks that queued and running jobs saved in a checkpoint
+// are requeued by a restarted server.
+func TestCheckpoint(t *testing.T) {
+	const testaddr = "127.0.0.1:45712"
+	dir, err := ioutil.TempDir("", "cloudlus-checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cpfile := filepath.Join(dir, "queue.json")
+
+	db, _ := NewDB("", dblimit)
+	s := NewServer(testaddr, testaddr, db)
+	s.CheckpointFile = cpfile
+	s.CheckpointFreq = 10 * time.Millisecond
+	nolog(s)
+	go s.dispatcher()
+	go s.checkpointLoop()
+
+	jobs := []*Job{NewJobCmd("echo", "1"), NewJobCmd("echo", "2"), NewJobCmd("echo", "3")}
+	for _, j := range jobs {
+		s.Start(j, nil)
+	}
+	req := workRequest{WorkerId: WorkerId{1}, Ch: make(chan *Job, 1)}
+	s.fetchjobs <- req
+	if j := <-req.Ch; j == nil || j.Id != jobs[0].Id {
+		t.Fatalf("fetched wrong job %v", j)
+	}
+
+	// wait for a periodic checkpoint
+	for i := 0; ; i++ {
+		if _, err := os.Stat(cpfile); err == nil {
+			break
+		} else if i > 100 {
+			t.Fatalf("no periodic checkpoint written")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.Close()
+
+	// restart with an empty job db
+	db, _ = NewDB("", dblimit)
+	s = NewServer(testaddr, testaddr, db)
+	s.CheckpointFile = cpfile
+	nolog(s)
+	if err := s.restoreCheckpoint(); err != nil {
+		t.Fatal(err)
+	}
+	go s.dispatcher()
+	defer s.Close()
+
+	if queued := s.List(JobFilter{Status: StatusQueued}); len(queued) != len(jobs) {
+		t.Fatalf("restored %v jobs, want %v", len(queued), len(jobs))
+	}
+	for _, j := range jobs {
+		got, err := s.Get(j.Id)
+		if err != nil {
+			t.Errorf("job %v not restored: %v", j.Id, err)
+		} else if got.Status != StatusQueued {
+			t.Errorf("job %v restored with status %v, want %v", j.Id, got.Status, StatusQueued)
+		}
+	}
+
+	// a missing checkpoint is fine
+	s.CheckpointFile = filepath.Join(dir, "missing.json")
+	if err := s.restoreCheckpoint(); err != nil {
+		t.Errorf("restoring missing checkpoint: %v", err)
+	}
+}
+
+func TestListJobs(t *testing.T) {
+	const testaddr = "127.0.0.1:45693"
+	db, _ := NewDB("", dblimit)
+	s := NewServer(testaddr, testaddr, db)
+	nolog(s)
+	go s.dispatcher()
+	defer s.Close()
+
+	now := time.Now()
+	old := NewJobCmd("echo", "1")
+	old.Status = StatusComplete
+	old.Submitted = now.Add(-3 * time.Hour)
+	old.Started = now.Add(-2 * time.Hour)
+	old.Finished = now.Add(-1 * time.Hour)
+	old.Tags = map[string]string{"gen": "5", "exp": "a"}
+	failed := NewJobCmd("echo", "2")
+	failed.Status = StatusFailed
+	failed.Submitted = now.Add(-2 * time.Hour)
+	failed.Finished = now
+	failed.Tags = map[string]string{"gen": "6", "exp": "a"}
+	for _, j := range []*Job{old, failed} {
+		if err := db.Put(j); err != nil {
+			t.Fatal(err)
+		}
+	}
+	queued := NewJobCmd("echo", "3")
+	queued.Tags = map[string]string{"gen": "5"}
+	s.Start(queued, nil)
+
+	since := now.Add(-time.Minute).Format(time.RFC3339)
+	tests := []struct {
+		Query string
+		Want  []*Job
+	}{
+		{"", []*Job{old, failed, queued}},
+		{"?status=complete", []*Job{old}},
+		{"?status=queued", []*Job{queued}},
+		{"?status=running", []*Job{}},
+		{"?since=" + since, []*Job{failed, queued}},
+		{"?status=failed&since=" + since, []*Job{failed}},
+		{"?until=" + since, []*Job{old}},
+		{"?since=" + since + "&until=" + now.Add(time.Hour).Format(time.RFC3339), []*Job{failed, queued}},
+		{"?tag=gen:5", []*Job{old, queued}},
+		{"?tag=gen:5&tag=exp:a", []*Job{old}},
+		{"?tag=exp:b", []*Job{}},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "/api/v1/jobs"+test.Query, nil)
+		w := httptest.NewRecorder()
+		s.serv.Handler.ServeHTTP(w, req)
+
+		var got []*JobSummary
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Errorf("%v: bad response %q: %v", test.Query, w.Body.String(), err)
+			continue
+		}
+		if len(got) != len(test.Want) {
+			t.Errorf("%v: got %v jobs, want %v", test.Query, len(got), len(test.Want))
+			continue
+		}
+		for i, j := range test.Want {
+			if got[i].Id != j.Id || got[i].Status != j.Status || fmt.Sprint(got[i].Tags) != fmt.Sprint(j.Tags) {
+				t.Errorf("%v: job %v: got %v (%v), want %v (%v)", test.Query, i, got[i].Id, got[i].Status, j.Id, j.Status)
+			}
+		}
+	}
+
+	if got := s.List(JobFilter{Status: StatusComplete}); len(got) == 1 && got[0].Duration != time.Hour {
+		t.Errorf("wrong job duration: got %v, want %v", got[0].Duration, time.Hour)
+	}
+
+	for _, query := range []string{"?status=bogus", "?tag=bogus", "?until=yesterday"} {
+		req, _ := http.NewRequest("GET", "/api/v1/jobs"+query, nil)
+		w := httptest.NewRecorder()
+		s.serv.Handler.ServeHTTP(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("invalid filter %v: got code %v, want %v", query, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestDashboardPages(t *testing.T) {
+	const testaddr = "127.0.0.1:45710"
+	db, _ := NewDB("", dblimit)
+	s := NewServer(testaddr, testaddr, db)
+	nolog(s)
+	go s.dispatcher()
+	defer s.Close()
+
+	now := time.Now()
+	jobs := []*Job{}
+	for i := 0; i < 5; i++ {
+		j := NewJobCmd("echo", fmt.Sprint(i))
+		j.Status = StatusComplete
+		if i%2 == 1 {
+			j.Status = StatusFailed
+		}
+		j.Submitted = now.Add(time.Duration(i-10) * time.Minute)
+		j.Finished = j.Submitted.Add(time.Second)
+		if err := db.Put(j); err != nil {
+			t.Fatal(err)
+		}
+		jobs = append(jobs, j)
+	}
+
+	tests := []struct {
+		Query      string
+		Want       []*Job // newest first
+		Prev, Next bool
+	}{
+		{"", []*Job{jobs[4], jobs[3], jobs[2], jobs[1], jobs[0]}, false, false},
+		{"?limit=2", []*Job{jobs[4], jobs[3]}, false, true},
+		{"?limit=2&offset=2", []*Job{jobs[2], jobs[1]}, true, true},
+		{"?limit=2&offset=4", []*Job{jobs[0]}, true, false},
+		{"?limit=2&offset=9", []*Job{}, true, false},
+		{"?status=failed", []*Job{jobs[3], jobs[1]}, false, false},
+		{"?status=complete&limit=1&offset=1", []*Job{jobs[2]}, true, true},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "/dashboard"+test.Query, nil)
+		w := httptest.NewRecorder()
+		s.serv.Handler.ServeHTTP(w, req)
+		body := w.Body.String()
+		if w.Code != http.StatusOK {
+			t.Errorf("%v: got code %v: %v", test.Query, w.Code, body)
+			continue
+		}
+
+		// job rows appear in order
+		pos := 0
+		for _, j := range test.Want {
+			i := strings.Index(body[pos:], j.Id.String())
+			if i < 0 {
+				t.Errorf("%v: job %v missing or out of order", test.Query, j.Id)
+				break
+			}
+			pos += i
+		}
+		if n := strings.Count(body, "/dashboard/infile/"); n != len(test.Want) {
+			t.Errorf("%v: got %v jobs, want %v", test.Query, n, len(test.Want))
+		}
+		if got := strings.Contains(body, "newer"); got != test.Prev {
+			t.Errorf("%v: got prev link %v, want %v", test.Query, got, test.Prev)
+		}
+		if got := strings.Contains(body, "older"); got != test.Next {
+			t.Errorf("%v: got next link %v, want %v", test.Query, got, test.Next)
+		}
+	}
+
+	for _, query := range []string{"?limit=0", "?offset=-1", "?limit=x", "?status=bogus"} {
+		req, _ := http.NewRequest("GET", "/dashboard"+query, nil)
+		w := httptest.NewRecorder()
+		s.serv.Handler.ServeHTTP(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("invalid query %v: got code %v, want %v", query, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestJobEvents(t *testing.T) {
+	const testaddr = "127.0.0.1:45694"
+	db, _ := NewDB("", dblimit)
+	s := NewServer(testaddr, testaddr, db)
+	nolog(s)
+	go s.dispatcher()
+	defer s.Close()
+
+	ts := httptest.NewServer(s.serv.Handler)
+	defer ts.Close()
+
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// handshake key and accept values from RFC 6455
+	fmt.Fprintf(conn, "GET /ws/jobs HTTP/1.1\r\nHost: %v\r\n", ts.Listener.Addr())
+	fmt.Fprintf(conn, "Upgrade: websocket\r\nConnection: Upgrade\r\n")
+	fmt.Fprintf(conn, "Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n")
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("wrong handshake response code: got %v, want %v", resp.StatusCode, http.StatusSwitchingProtocols)
+	} else if got, want := resp.Header.Get("Sec-WebSocket-Accept"), "s3pPLMBiTxaQ9kYGzzhZRbK+xOo="; got != want {
+		t.Fatalf("wrong Sec-WebSocket-Accept: got %v, want %v", got, want)
+	}
+
+	j := NewJobCmd("echo", "1")
+	s.Start(j, nil)
+	var fetched *Job
+	if err := s.rpc.Fetch(WorkerId{}, &fetched); err != nil {
+		t.Fatal(err)
+	}
+	done := *fetched
+	done.Status = StatusComplete
+	s.rpc.Push(&done, nil)
+
+	wants := []struct{ Old, New string }{
+		{"", StatusQueued},
+		{StatusQueued, StatusRunning},
+		{StatusRunning, StatusComplete},
+	}
+	for i, want := range wants {
+		opcode, payload, err := readWSFrame(r)
+		if err != nil {
+			t.Fatalf("event %v: %v", i+1, err)
+		} else if opcode != wsText {
+			t.Fatalf("event %v: wrong frame opcode %v", i+1, opcode)
+		}
+
+		var ev JobEvent
+		if err := json.Unmarshal(payload, &ev); err != nil {
+			t.Fatalf("event %v: %v", i+1, err)
+		}
+		if ev.Id != j.Id || ev.OldStatus != want.Old || ev.NewStatus != want.New {
+			t.Errorf("event %v: got %v -> %v (job %v), want %v -> %v (job %v)", i+1, ev.OldStatus, ev.NewStatus, ev.Id, want.Old, want.New, j.Id)
+		}
+	}
+}
+
+func TestSubmitWait(t *testing.T) {
+	const testaddr = "127.0.0.1:45695"
+	localWait = 100 * time.Millisecond
+	db, _ := NewDB("", dblimit)
+	s := NewServer(testaddr, testaddr, db)
+	nolog(s)
+	go s.dispatcher()
+	go newLocalWorker(s).Run()
+	defer s.Close()
+
+	tests := []struct {
+		Cmd     []string
+		Timeout string
+		Code    int
+		Status  string
+	}{
+		{[]string{"echo", "hello"}, "5s", http.StatusOK, StatusComplete},
+		{[]string{"sleep", "10"}, "200ms", http.StatusGatewayTimeout, StatusRunning},
+	}
+
+	for _, test := range tests {
+		j := NewJobCmd(test.Cmd[0], test.Cmd[1:]...)
+		j.Timeout = 2 * time.Second
+		defer os.Remove(outfileName(j.Id))
+		data, _ := json.Marshal(j)
+		req, _ := http.NewRequest("POST", "/api/v1/job-wait?timeout="+test.Timeout, bytes.NewReader(data))
+		w := httptest.NewRecorder()
+		s.serv.Handler.ServeHTTP(w, req)
+
+		if w.Code != test.Code {
+			t.Errorf("%v: wrong response code: got %v, want %v", test.Cmd, w.Code, test.Code)
+		}
+		if loc := w.Header().Get("Location"); !strings.HasSuffix(loc, "/api/v1/job/"+j.Id.String()) {
+			t.Errorf("%v: wrong Location header %q", test.Cmd, loc)
+		}
+
+		if w.Code != http.StatusOK {
+			if !strings.Contains(w.Body.String(), test.Status) {
+				t.Errorf("%v: timeout response %q doesn't report status %v", test.Cmd, w.Body.String(), test.Status)
+			}
+			continue
+		}
+		got := &JobStat{}
+		if err := json.Unmarshal(w.Body.Bytes(), got); err != nil {
+			t.Errorf("%v: bad response %q: %v", test.Cmd, w.Body.String(), err)
+		} else if got.Status != test.Status {
+			t.Errorf("%v: wrong job status: got %v, want %v", test.Cmd, got.Status, test.Status)
+		}
+	}
+
+	// waiting stops when the client goes away
+	ctx, cancel := context.WithCancel(context.Background())
+	j := NewJobCmd("sleep", "10")
+	j.Timeout = 2 * time.Second
+	defer os.Remove(outfileName(j.Id))
+	data, _ := json.Marshal(j)
+	req, _ := http.NewRequest("POST", "/api/v1/job-wait?timeout=1m", bytes.NewReader(data))
+	done := make(chan struct{})
+	go func() {
+		s.serv.Handler.ServeHTTP(httptest.NewRecorder(), req.WithContext(ctx))
+		close(done)
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Errorf("job-wait kept waiting after the client went away")
+	}
+
+	// submissions are checked and deduplicated the same as for job-submit
+	wait := func(j *Job, key string) *httptest.ResponseRecorder {
+		data, _ := json.Marshal(j)
+		req, _ := http.NewRequest("POST", "/api/v1/job-wait?timeout=5s", bytes.NewReader(data))
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		w := httptest.NewRecorder()
+		s.serv.Handler.ServeHTTP(w, req)
+		return w
+	}
+
+	first := NewJobCmd("echo", "hello")
+	defer os.Remove(outfileName(first.Id))
+	wait(first, "key1")
+	dup := NewJobCmd("echo", "hello")
+	w := wait(dup, "key1")
+	got := &JobStat{}
+	if err := json.Unmarshal(w.Body.Bytes(), got); err != nil {
+		t.Errorf("duplicate submission: bad response %q: %v", w.Body.String(), err)
+	} else if got.Id != first.Id || got.Status != StatusComplete {
+		t.Errorf("duplicate submission: got job %v (%v), want %v (%v)", got.Id, got.Status, first.Id, StatusComplete)
+	}
+
+	self := NewJobCmd("true")
+	self.DependsOn = []JobId{self.Id}
+	if w := wait(self, ""); w.Code != http.StatusBadRequest {
+		t.Errorf("self-dependent job: got response code %v, want %v", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestOutfilesGzip(t *testing.T) {
+	const testaddr = "127.0.0.1:45696"
+	db, _ := NewDB("", dblimit)
+	s := NewServer(testaddr, testaddr, db)
+	nolog(s)
+	go s.dispatcher()
+	defer s.Close()
+
+	// highly compressible output file
+	const rawsize = 100000
+	j := NewJobCmd("sh", "-c", fmt.Sprintf("yes hello | head -c %v > out.txt", rawsize))
+	j.AddOutfile("out.txt")
+	j.log = devnull
+
+	f, err := os.Create(outfileName(j.Id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(outfileName(j.Id))
+	j.Execute(nil, f)
+	f.Close()
+	if j.Status != StatusComplete {
+		t.Fatalf("job failed: %v", j.Stderr)
+	}
+
+	tests := []struct {
+		AcceptEncoding string
+		Gzip           bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"deflate, gzip;q=0.5", true},
+		{"gzip;q=0", false},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "/api/v1/job-outfiles/"+j.Id.String(), nil)
+		if test.AcceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", test.AcceptEncoding)
+		}
+		w := httptest.NewRecorder()
+		s.serv.Handler.ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Errorf("Accept-Encoding %q: bad response code %v: %s", test.AcceptEncoding, w.Code, w.Body.Bytes())
+			continue
+		}
+		if w.Body.Len() >= rawsize {
+			t.Errorf("Accept-Encoding %q: retrieved %v bytes, want fewer than the %v raw bytes", test.AcceptEncoding, w.Body.Len(), rawsize)
+		}
+
+		data := w.Body.Bytes()
+		if got := w.Header().Get("Content-Encoding") == "gzip"; got != test.Gzip {
+			t.Errorf("Accept-Encoding %q: gzip content encoding = %v, want %v", test.AcceptEncoding, got, test.Gzip)
+			continue
+		} else if got {
+			gr, err := gzip.NewReader(w.Body)
+			if err != nil {
+				t.Errorf("Accept-Encoding %q: %v", test.AcceptEncoding, err)
+				continue
+			}
+			data, err = ioutil.ReadAll(gr)
+			if err != nil {
+				t.Errorf("Accept-Encoding %q: %v", test.AcceptEncoding, err)
+				continue
+			}
+		}
+
+		rc, err := j.GetOutfile(bytes.NewReader(data), len(data), "out.txt")
+		if err != nil {
+			t.Errorf("Accept-Encoding %q: %v", test.AcceptEncoding, err)
+			continue
+		}
+		out, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Errorf("Accept-Encoding %q: %v", test.AcceptEncoding, err)
+		} else if len(out) != rawsize {
+			t.Errorf("Accept-Encoding %q: got %v byte outfile, want %v bytes", test.AcceptEncoding, len(out), rawsize)
+		}
+	}
+}
+
+func TestOutfilesStream(t *testing.T) {
+	const testaddr = "127.0.0.1:45697"
+	db, _ := NewDB("", dblimit)
+	s := NewServer(testaddr, testaddr, db)
+	nolog(s)
+	go s.dispatcher()
+	defer s.Close()
+
+	ts := httptest.NewServer(s.serv.Handler)
+	defer ts.Close()
+
+	// the server streams whatever is in the outfile - it needn't be a real zip
+	j := NewJobCmd("true")
+	want := bytes.Repeat([]byte("0123456789abcdef"), 1<<16)
+	if err := ioutil.WriteFile(outfileName(j.Id), want, 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(outfileName(j.Id))
+
+	resp, err := http.Get(ts.URL + "/api/v1/job-outfiles/" + j.Id.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.ContentLength != -1 {
+		t.Errorf("got Content-Length %v, want none (chunked)", resp.ContentLength)
+	}
+	if len(resp.TransferEncoding) == 0 || resp.TransferEncoding[0] != "chunked" {
+		t.Errorf("got Transfer-Encoding %v, want chunked", resp.TransferEncoding)
+	}
+	if cd := resp.Header.Get("Content-Disposition"); !strings.Contains(cd, j.Id.String()) {
+		t.Errorf("bad Content-Disposition %q", cd)
+	}
+
+	got, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(got, want) {
+		t.Errorf("retrieved %v bytes that don't match the %v byte outfile", len(got), len(want))
+	}
+}
+
+func TestResubmit(t *testing.T) {
+	const testaddr = "127.0.0.1:45698"
+	db, _ := NewDB("", dblimit)
+	s := NewServer(testaddr, testaddr, db)
+	nolog(s)
+	go s.dispatcher()
+	defer s.Close()
+
+	complete := NewJobCmd("cyclus", "input.xml")
+	complete.AddInfile("input.xml", []byte("<simulation/>"))
+	complete.AddOutfile("cyclus.sqlite")
+	complete.Note = "original"
+	complete.MaxRetries = 2
+	complete.Tags = map[string]string{"gen": "5"}
+	complete.Status = StatusComplete
+
+	failed := NewJobCmd("cyclus", "input.xml")
+	failed.AddInfile("input.xml", []byte("<simulation/>"))
+	failed.Status = StatusFailed
+
+	// input data was dropped
+	evicted := NewJobCmd("cyclus", "input.xml")
+	evicted.Infiles = []File{{Name: "input.xml", Size: 13}}
+	evicted.Status = StatusFailed
+
+	queued := NewJobCmd("cyclus", "input.xml")
+	queued.Status = StatusQueued
+
+	for _, j := range []*Job{complete, failed, evicted, queued} {
+		if err := s.alljobs.Put(j); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		Id JobId
+		Ok bool
+	}{
+		{complete.Id, true},
+		{failed.Id, true},
+		{evicted.Id, false},
+		{queued.Id, false},
+		{NewJob().Id, false},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest("POST", "/api/v1/job-resubmit/"+test.Id.String(), nil)
+		w := httptest.NewRecorder()
+		s.serv.Handler.ServeHTTP(w, req)
+
+		if !test.Ok {
+			if w.Code == http.StatusCreated {
+				t.Errorf("job %v: resubmission succeeded, want failure", test.Id)
+			}
+			continue
+		} else if w.Code != http.StatusCreated {
+			t.Errorf("job %v: bad response code %v: %s", test.Id, w.Code, w.Body.Bytes())
+			continue
+		}
+
+		orig, _ := s.Get(test.Id)
+		got := &Job{}
+		if err := json.Unmarshal(w.Body.Bytes(), got); err != nil {
+			t.Errorf("job %v: bad response: %v", test.Id, err)
+			continue
+		}
+		if got.Id == orig.Id {
+			t.Errorf("job %v: resubmitted job has the original id", test.Id)
+		}
+		if got.Status != StatusQueued {
+			t.Errorf("job %v: resubmitted job status is %v, want %v", test.Id, got.Status, StatusQueued)
+		}
+		if !strings.HasSuffix(w.Header().Get("Location"), got.Id.String()) {
+			t.Errorf("job %v: bad Location header %q", test.Id, w.Header().Get("Location"))
+		}
+		if fmt.Sprint(got.Cmd) != fmt.Sprint(orig.Cmd) || got.Note != orig.Note || got.MaxRetries != orig.MaxRetries || fmt.Sprint(got.Tags) != fmt.Sprint(orig.Tags) {
+			t.Errorf("job %v: resubmitted job %+v doesn't match original %+v", test.Id, got, orig)
+		}
+		if len(got.Infiles) != 1 || !bytes.Equal(got.Infiles[0].Data, orig.Infiles[0].Data) {
+			t.Errorf("job %v: resubmitted job has wrong infiles %v", test.Id, got.Infiles)
+		}
+		if len(got.Outfiles) != len(orig.Outfiles) {
+			t.Errorf("job %v: resubmitted job has wrong outfiles %v", test.Id, got.Outfiles)
+		}
+	}
+}
+
+func TestJobStatAccept(t *testing.T) {
+	const testaddr = "127.0.0.1:45713"
+	db, _ := NewDB("", dblimit)
+	s := NewServer(testaddr, testaddr, db)
+	nolog(s)
+	go s.dispatcher()
+	defer s.Close()
+
+	j := NewJobCmd("true")
+	s.Start(j, nil)
+
+	tests := []struct {
+		Accept string
+		Plain  bool
+	}{
+		{"", false},
+		{"application/json", false},
+		{"*/*", false},
+		{"text/plain", true},
+		{"text/*", true},
+		{"text/plain, application/json;q=0.5", true},
+		{"application/json, text/*;q=0.9", false},
+		{"text/plain;q=0.2, */*;q=0.1", true},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "/api/v1/job-stat/"+j.Id.String(), nil)
+		if test.Accept != "" {
+			req.Header.Set("Accept", test.Accept)
+		}
+		w := httptest.NewRecorder()
+		s.serv.Handler.ServeHTTP(w, req)
+
+		ctype := w.Header().Get("Content-Type")
+		if test.Plain {
+			if body := w.Body.String(); body != StatusQueued+"\n" {
+				t.Errorf("Accept %q: got body %q, want plain status %q", test.Accept, body, StatusQueued)
+			} else if !strings.HasPrefix(ctype, "text/plain") {
+				t.Errorf("Accept %q: got content type %v, want text/plain", test.Accept, ctype)
+			}
+			continue
+		}
+
+		stat := &JobStat{}
+		if err := json.Unmarshal(w.Body.Bytes(), stat); err != nil {
+			t.Errorf("Accept %q: bad json response %q: %v", test.Accept, w.Body.String(), err)
+		} else if stat.Status != StatusQueued || ctype != "application/json" {
+			t.Errorf("Accept %q: got status %v (%v), want %v (application/json)", test.Accept, stat.Status, ctype, StatusQueued)
+		}
+	}
+}
+
+func TestJobStatQueuePos(t *testing.T) {
+	const testaddr = "127.0.0.1:45699"
+	db, _ := NewDB("", dblimit)
+	s := NewServer(testaddr, testaddr, db)
+	nolog(s)
+	s.Stats.AvgJobTime = time.Minute
+	go s.dispatcher()
+	defer s.Close()
+
+	var jobs []*Job
+	for i := 0; i < 4; i++ {
+		j := NewJobCmd("true")
+		s.Start(j, nil)
+		jobs = append(jobs, j)
+	}
+
+	done := NewJobCmd("true")
+	done.Status = StatusComplete
+	s.alljobs.Put(done)
+
+	stat := func(j *Job) *JobStat {
+		req, _ := http.NewRequest("GET", "/api/v1/job-stat/"+j.Id.String(), nil)
+		w := httptest.NewRecorder()
+		s.serv.Handler.ServeHTTP(w, req)
+		got := &JobStat{}
+		if err := json.Unmarshal(w.Body.Bytes(), got); err != nil {
+			t.Fatalf("bad job-stat response %q: %v", w.Body.String(), err)
+		}
+		return got
+	}
+
+	for i, j := range jobs {
+		got := stat(j)
+		if got.QueuePos != i+1 {
+			t.Errorf("job %v: got queue position %v, want %v", i, got.QueuePos, i+1)
+		}
+		if want := time.Duration(i) * time.Minute; got.EstWait != want {
+			t.Errorf("job %v: got estimated wait %v, want %v", i, got.EstWait, want)
+		}
+	}
+
+	if got := stat(done); got.QueuePos != 0 || got.EstWait != 0 {
+		t.Errorf("finished job: got queue position %v and wait %v, want zeros", got.QueuePos, got.EstWait)
+	}
+}
+
+func TestWorkerClass(t *testing.T) {
+	const testaddr = "127.0.0.1:45700"
+	db, _ := NewDB("", dblimit)
+	s := NewServer(testaddr, testaddr, db)
+	nolog(s)
+	go s.dispatcher()
+	defer s.Close()
+
+	highmem1 := NewJobCmd("true")
+	highmem1.WorkerClass = "highmem"
+	unclassed := NewJobCmd("true")
+	highmem2 := NewJobCmd("true")
+	highmem2.WorkerClass = "highmem"
+	for _, j := range []*Job{highmem1, unclassed, highmem2} {
+		s.Start(j, nil)
+	}
+
+	r := &RPC{s}
+	fetch := func(class string) *Job {
+		var j *Job
+		if class == "" {
+			r.Fetch(WorkerId{}, &j)
+		} else {
+			r.FetchClass(FetchRequest{Class: class}, &j)
+		}
+		return j
+	}
+
+	tests := []struct {
+		Class string
+		Want  *Job
+	}{
+		{"", unclassed},
+		{"", nil},
+		{"gpu", nil},
+		{"highmem", highmem1},
+		{"highmem", highmem2},
+		{"highmem", nil},
+	}
+
+	for i, test := range tests {
+		got := fetch(test.Class)
+		if test.Want == nil && got != nil {
+			t.Errorf("fetch %v (class %q): got job %v, want none", i, test.Class, got.Id)
+		} else if test.Want != nil && (got == nil || got.Id != test.Want.Id) {
+			t.Errorf("fetch %v (class %q): got job %v, want %v", i, test.Class, got, test.Want.Id)
+		}
+	}
+}
+
+func TestLogLevels(t *testing.T) {
+	const testaddr = "127.0.0.1:45701"
+	db, _ := NewDB("", dblimit)
+	s := NewServer(testaddr, testaddr, db)
+	nolog(s)
+	var buf bytes.Buffer
+	s.log = log.New(&buf, "", 0)
+	go s.dispatcher()
+	defer s.Close()
+
+	req, _ := http.NewRequest("GET", "/api/v1/job/not-a-job-id", nil)
+	req.Header.Set("X-Request-Id", "abc123")
+	resp := httptest.NewRecorder()
+	s.serv.Handler.ServeHTTP(resp, req)
+	if resp.Code != http.StatusBadRequest {
+		t.Errorf("bad job id: got status %v, want %v", resp.Code, http.StatusBadRequest)
+	}
+	if got := buf.String(); !strings.HasPrefix(got, "WARN  [req abc123] ") {
+		t.Errorf("bad request logged as %q, want WARN level with request id", got)
+	}
+
+	// generated request ids must be unique
+	ids := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		buf.Reset()
+		req, _ := http.NewRequest("GET", "/api/v1/job/not-a-job-id", nil)
+		s.serv.Handler.ServeHTTP(httptest.NewRecorder(), req)
+		fields := strings.Fields(buf.String())
+		if len(fields) < 3 || fields[1] != "[req" {
+			t.Fatalf("request logged without id: %q", buf.String())
+		}
+		ids[fields[2]] = true
+	}
+	if len(ids) != 2 {
+		t.Errorf("generated request ids are not unique: %v", ids)
+	}
+
+	buf.Reset()
+	s.LogLevel = LogError
+	s.logf(LogInfo, "info")
+	s.logf(LogWarn, "warn")
+	s.logf(LogError, "error")
+	if got, want := buf.String(), "ERROR error\n"; got != want {
+		t.Errorf("LogLevel=%v: got log %q, want %q", s.LogLevel, got, want)
+	}
+
+	for _, name := range []string{"info", "WARN", "Error"} {
+		if lvl, err := ParseLogLevel(name); err != nil || !strings.EqualFold(lvl.String(), name) {
+			t.Errorf("ParseLogLevel(%q) = %v, %v", name, lvl, err)
+		}
+	}
+	if _, err := ParseLogLevel("debug"); err == nil {
+		t.Errorf("ParseLogLevel(\"debug\") succeeded, want error")
+	}
+}
+
+func TestInfileDownload(t *testing.T) {
+	const testaddr = "127.0.0.1:45702"
+	db, _ := NewDB("", dblimit)
+	s := NewServer(testaddr, testaddr, db)
+	nolog(s)
+	go s.dispatcher()
+	defer s.Close()
+
+	submit := func(path string, body []byte) JobId {
+		req, _ := http.NewRequest("POST", path, bytes.NewReader(body))
+		w := httptest.NewRecorder()
+		s.serv.Handler.ServeHTTP(w, req)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("POST %v: bad response code %v: %s", path, w.Code, w.Body.Bytes())
+		}
+		j := &Job{}
+		if err := json.Unmarshal(w.Body.Bytes(), j); err != nil {
+			t.Fatal(err)
+		}
+		return j.Id
+	}
+
+	infile := []byte("<simulation><control/></simulation>")
+	tmpl := []byte(`<simulation>{{range .Builds}}<build proto="{{.Proto}}" n="{{.N}}"/>{{end}}</simulation>`)
+	scn := &scen.Scenario{
+		SimDur:      3,
+		BuildPeriod: 1,
+		CyclusTmpl:  "tmpl.xml",
+		Facs:        []scen.Facility{{Proto: "reactor", Cap: 1, Life: 10}},
+		MinPower:    []float64{0, 0},
+		MaxPower:    []float64{10, 10},
+		Builds:      []scen.Build{{Proto: "reactor", Time: 1, N: 2}},
+	}
+	scenfile, _ := json.Marshal(scn)
+
+	jraw := submit("/api/v1/job-infile", infile)
+
+	j := NewJobCmd("cycobj", "-scen", "scen.json")
+	j.AddInfile("scen.json", scenfile)
+	j.AddInfile("tmpl.xml", tmpl)
+	data, _ := json.Marshal(j)
+	jscen := submit("/api/v1/job", data)
+
+	// scenario jobs serve the input file rendered from their template
+	if err := scn.ParseTmpl(string(tmpl)); err != nil {
+		t.Fatal(err)
+	}
+	rendered, err := scn.GenCyclusInfile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		Id    JobId
+		Query string
+		Ok    bool
+		Data  []byte
+		Type  string
+		Fname string
+	}{
+		{jraw, "", true, infile, "application/xml", DefaultInfile},
+		{jscen, "", true, rendered, "application/xml", DefaultInfile},
+		{jscen, "?name=tmpl.xml", true, tmpl, "application/xml", "tmpl.xml"},
+		{jscen, "?name=scen.json", true, scenfile, "application/octet-stream", "scen.json"},
+		{jscen, "?name=missing.xml", false, nil, "", ""},
+		{NewJob().Id, "", false, nil, "", ""},
+	}
+
+	for _, test := range tests {
+		path := "/api/v1/job-infile/" + test.Id.String() + test.Query
+		req, _ := http.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		s.serv.Handler.ServeHTTP(w, req)
+
+		if !test.Ok {
+			if w.Code == http.StatusOK {
+				t.Errorf("GET %v: succeeded, want failure", path)
+			}
+			continue
+		} else if w.Code != http.StatusOK {
+			t.Errorf("GET %v: bad response code %v: %s", path, w.Code, w.Body.Bytes())
+			continue
+		}
+
+		if !bytes.Equal(w.Body.Bytes(), test.Data) {
+			t.Errorf("GET %v: got body %q, want %q", path, w.Body.Bytes(), test.Data)
+		}
+		if got := w.Header().Get("Content-Type"); got != test.Type {
+			t.Errorf("GET %v: got Content-Type %q, want %q", path, got, test.Type)
+		}
+		if got := w.Header().Get("Content-Disposition"); !strings.HasPrefix(got, "attachment;") || !strings.Contains(got, test.Fname) {
+			t.Errorf("GET %v: bad Content-Disposition %q", path, got)
+		}
+	}
+}
+
+func TestMaxJobSize(t *testing.T) {
+	const testaddr = "127.0.0.1:45703"
+	db, _ := NewDB("", dblimit)
+	s := NewServer(testaddr, testaddr, db)
+	nolog(s)
+	go s.dispatcher()
+	defer s.Close()
+
+	if s.MaxJobSize != DefaultMaxJobSize {
+		t.Errorf("got default MaxJobSize %v, want %v", s.MaxJobSize, DefaultMaxJobSize)
+	}
+	s.MaxJobSize = 1000
+
+	small := NewJobCmd("true")
+	small.AddInfile("input.xml", make([]byte, 100))
+	big := NewJobCmd("true")
+	big.AddInfile("input.xml", make([]byte, 2000))
+	smalldata, _ := json.Marshal(small)
+	bigdata, _ := json.Marshal(big)
+
+	tests := []struct {
+		Path string
+		Body []byte
+		Code int
+	}{
+		{"/api/v1/job", smalldata, http.StatusCreated},
+		{"/api/v1/job", bigdata, http.StatusRequestEntityTooLarge},
+		{"/api/v1/job-infile", make([]byte, 1000), http.StatusCreated},
+		{"/api/v1/job-infile", make([]byte, 1001), http.StatusRequestEntityTooLarge},
+		{"/api/v1/job-wait?timeout=1ns", bigdata, http.StatusRequestEntityTooLarge},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("POST", test.Path, bytes.NewReader(test.Body))
+		w := httptest.NewRecorder()
+		s.serv.Handler.ServeHTTP(w, req)
+		if w.Code != test.Code {
+			t.Errorf("POST %v with %v byte body: got status %v, want %v", test.Path, len(test.Body), w.Code, test.Code)
+		}
+	}
+
+	r := &RPC{s}
+	if err := r.SubmitAsync(NewJobCmd("true"), nil); err != nil {
+		t.Errorf("rpc submit of small job failed: %v", err)
+	}
+	if err := r.SubmitAsync(big, nil); err == nil {
+		t.Errorf("rpc submit of oversized job succeeded, want error")
+	}
+	if err := r.Submit(big, new(*Job)); err == nil {
+		t.Errorf("rpc blocking submit of oversized job succeeded, want error")
+	}
+}
+
+func TestHealthChecks(t *testing.T) {
+	const testaddr = "127.0.0.1:45704"
+	db, _ := NewDB("", dblimit)
+	s := NewServer(testaddr, testaddr, db)
+	nolog(s)
+	defer s.Close()
+
+	check := func(path string, want int) {
+		t.Helper()
+		req, _ := http.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		s.serv.Handler.ServeHTTP(w, req)
+		if w.Code != want {
+			t.Errorf("GET %v: got status %v, want %v: %s", path, w.Code, want, w.Body.Bytes())
+		}
+	}
+
+	// dispatcher not started yet
+	check("/healthz", http.StatusServiceUnavailable)
+	check("/readyz", http.StatusServiceUnavailable)
+
+	go s.dispatcher()
+	for i := 0; i < 100 && s.dispatchTick.Load() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	check("/healthz", http.StatusOK)
+	check("/readyz", http.StatusOK)
+
+	// simulate a wedged dispatcher
+	s.dispatchTick.Store(time.Now().Add(-2 * dispatchLimit()).UnixNano())
+	check("/healthz", http.StatusServiceUnavailable)
+	check("/readyz", http.StatusServiceUnavailable)
+
+	// any dispatcher activity brings it back
+	s.Get(NewJob().Id)
+	for i := 0; i < 100 && s.dispatcherHealth() != nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	check("/healthz", http.StatusOK)
+}
+
+func TestSubmitRateLimit(t *testing.T) {
+	const testaddr = "127.0.0.1:45705"
+	db, _ := NewDB("", dblimit)
+	s := NewServer(testaddr, testaddr, db)
+	nolog(s)
+	go s.dispatcher()
+	defer s.Close()
+
+	submit := func(client string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/api/v1/job-infile", strings.NewReader("<simulation/>"))
+		req.RemoteAddr = client
+		w := httptest.NewRecorder()
+		s.serv.Handler.ServeHTTP(w, req)
+		return w
+	}
+
+	// disabled by default
+	for i := 0; i < 5; i++ {
+		if w := submit("10.0.0.1:1234"); w.Code != http.StatusCreated {
+			t.Fatalf("unlimited submit %v: got status %v", i, w.Code)
+		}
+	}
+
+	s.SubmitRate = 0.01
+	s.SubmitBurst = 2
+	for i := 0; i < 2; i++ {
+		if w := submit("10.0.0.2:1234"); w.Code != http.StatusCreated {
+			t.Errorf("burst submit %v: got status %v, want %v", i, w.Code, http.StatusCreated)
+		}
+	}
+	w := submit("10.0.0.2:5678")
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("submit over limit: got status %v, want %v", w.Code, http.StatusTooManyRequests)
+	} else if got := w.Header().Get("Retry-After"); got != "100" {
+		t.Errorf("got Retry-After %q, want %q", got, "100")
+	}
+
+	// other clients are unaffected
+	if w := submit("10.0.0.3:1234"); w.Code != http.StatusCreated {
+		t.Errorf("submit from other client: got status %v, want %v", w.Code, http.StatusCreated)
+	}
+}
+
+func TestRateLimiterRefill(t *testing.T) {
+	l := newRateLimiter()
+	now := time.Now()
+	if ok, _ := l.allow("a", 2, 1, now); !ok {
+		t.Fatalf("first request denied")
+	}
+	ok, wait := l.allow("a", 2, 1, now)
+	if ok {
+		t.Fatalf("request over limit allowed")
+	} else if wait != 500*time.Millisecond {
+		t.Errorf("got wait %v, want %v", wait, 500*time.Millisecond)
+	}
+	if ok, _ := l.allow("a", 2, 1, now.Add(500*time.Millisecond)); !ok {
+		t.Errorf("request after refill denied")
+	}
+
+	// full buckets are forgotten
+	l.allow("b", 2, 1, now.Add(time.Hour))
+	if _, ok := l.buckets["a"]; ok || len(l.buckets) != 1 {
+		t.Errorf("stale buckets not pruned: %v", l.buckets)
+	}
+}
+
+func TestMaxConcurrent(t *testing.T) {
+	const testaddr = "127.0.0.1:45706"
+	db, _ := NewDB("", dblimit)
+	s := NewServer(testaddr, testaddr, db)
+	nolog(s)
+	s.MaxConcurrent = 2
+	go s.dispatcher()
+	defer s.Close()
+
+	for i := 0; i < 4; i++ {
+		s.Start(NewJobCmd("true"), nil)
+	}
+
+	r := &RPC{s}
+	var workers [3]WorkerId
+	for i := range workers {
+		copy(workers[i][:], NewJob().Id[:])
+	}
+
+	var running []*Job
+	for _, wid := range workers {
+		var j *Job
+		if err := r.Fetch(wid, &j); err == nil {
+			running = append(running, j)
+		} else if err != nojoberr {
+			t.Fatal(err)
+		}
+	}
+	if len(running) != 2 {
+		t.Fatalf("%v jobs running with MaxConcurrent=2 and 3 workers, want 2", len(running))
+	}
+
+	// finishing a job frees up a slot
+	running[0].Status = StatusComplete
+	running[0].WorkerId = workers[0]
+	r.Push(running[0], nil)
+
+	var j *Job
+	if err := r.Fetch(workers[2], &j); err != nil {
+		t.Errorf("fetch after a running job finished: %v", err)
+	}
+	if err := r.Fetch(workers[0], &j); err != nojoberr {
+		t.Errorf("fetch with MaxConcurrent jobs running: got error %v, want %v", err, nojoberr)
+	}
+}
+
+// TestPushOtherWorker checks that failures pushed by workers a job isn't
+// running on are ignored rather than counted as attempts.
+func TestPushOtherWorker(t *testing.T) {
+	const testaddr = "127.0.0.1:45725"
+	db, _ := NewDB("", dblimit)
+	s := NewServer(testaddr, testaddr, db)
+	nolog(s)
+	go s.dispatcher()
+	defer s.Close()
+
+	j := NewJobCmd("false")
+	j.MaxRetries = 1
+	s.Start(j, nil)
+
+	r := &RPC{s}
+	var owner, other WorkerId
+	copy(owner[:], NewJob().Id[:])
+	copy(other[:], NewJob().Id[:])
+	var fetched *Job
+	if err := r.Fetch(owner, &fetched); err != nil {
+		t.Fatal(err)
+	}
+
+	stale := *fetched
+	stale.Status = StatusFailed
+	stale.WorkerId = other
+	r.Push(&stale, nil)
+	if got, _ := s.Get(j.Id); got.Status != StatusRunning || got.Attempts != 0 {
+		t.Errorf("after another worker's push: got status %v with %v attempts, want %v with 0", got.Status, got.Attempts, StatusRunning)
+	}
+
+	// attempts are counted by the server whatever the worker sends back
+	defer func(d time.Duration) { retryBackoff = d }(retryBackoff)
+	retryBackoff = 0
+	failed := *fetched
+	failed.Status = StatusFailed
+	failed.WorkerId = owner
+	r.Push(&failed, nil)
+	if got, _ := s.Get(j.Id); got.Status != StatusQueued || got.Attempts != 1 {
+		t.Fatalf("after first failure: got status %v with %v attempts, want %v with 1", got.Status, got.Attempts, StatusQueued)
+	}
+
+	// the final failure records the last line of stderr
+	fetched = nil
+	if err := r.Fetch(owner, &fetched); err != nil {
+		t.Fatal(err)
+	}
+	final := *fetched
+	final.Status = StatusFailed
+	final.Attempts = 0
+	final.WorkerId = owner
+	final.Stderr = "some output\nthe error\n"
+	r.Push(&final, nil)
+	if got, _ := s.Get(j.Id); got.Status != StatusFailed || got.Attempts != 2 || got.LastError != "the error" {
+		t.Errorf("after final failure: got status %v, %v attempts, LastError %q", got.Status, got.Attempts, got.LastError)
+	}
+
+	// but a complete result from another worker is kept
+	j = NewJobCmd("true")
+	s.Start(j, nil)
+	fetched = nil
+	if err := r.Fetch(owner, &fetched); err != nil {
+		t.Fatal(err)
+	}
+	done := *fetched
+	done.Status = StatusComplete
+	done.WorkerId = other
+	r.Push(&done, nil)
+	if got, _ := s.Get(j.Id); got.Status != StatusComplete {
+		t.Errorf("after another worker's complete push: got status %v, want %v", got.Status, StatusComplete)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	const testaddr = "127.0.0.1:45707"
+	db, _ := NewDB("", dblimit)
+	s := NewServer(testaddr, testaddr, db)
+	nolog(s)
+	go s.dispatcher()
+	defer s.Close()
+
+	post := func(path string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", path, nil)
+		w := httptest.NewRecorder()
+		s.serv.Handler.ServeHTTP(w, req)
+		return w
+	}
+
+	running := NewJobCmd("true")
+	s.Start(running, nil)
+	queued := NewJobCmd("true")
+	result := s.Start(queued, nil)
+	complete := NewJobCmd("true")
+	complete.Status = StatusComplete
+	s.alljobs.Put(complete)
+
+	r := &RPC{s}
+	var wid WorkerId
+	copy(wid[:], NewJob().Id[:])
+	var fetched *Job
+	if err := r.Fetch(wid, &fetched); err != nil || fetched.Id != running.Id {
+		t.Fatalf("failed to fetch job to run: %v", err)
+	}
+
+	// queued -> canceled
+	if err := s.Cancel(queued.Id); err != nil {
+		t.Fatalf("canceling queued job: %v", err)
+	}
+	select {
+	case j := <-result:
+		if j.Status != StatusCanceled {
+			t.Errorf("submitter of canceled job got status %v, want %v", j.Status, StatusCanceled)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("submitter of canceled job was not notified")
+	}
+	if pos, _ := s.QueuePosition(queued.Id); pos != 0 {
+		t.Errorf("canceled job still in queue at position %v", pos)
+	}
+
+	// running -> canceled
+	w := post("/api/v1/job-cancel/" + running.Id.String())
+	if w.Code != http.StatusOK {
+		t.Fatalf("canceling running job: got status %v: %s", w.Code, w.Body.Bytes())
+	}
+	stat := &JobStat{}
+	if err := json.Unmarshal(w.Body.Bytes(), stat); err != nil {
+		t.Fatal(err)
+	} else if stat.Status != StatusCanceled {
+		t.Errorf("cancel response has status %v, want %v", stat.Status, StatusCanceled)
+	}
+
+	var kill bool
+	r.Heartbeat(NewBeat(wid, running.Id), &kill)
+	if !kill {
+		t.Errorf("worker running a canceled job was not told to kill it")
+	}
+
+	// a late push from the worker doesn't resurrect the job
+	fetched.Status = StatusComplete
+	fetched.WorkerId = wid
+	r.Push(fetched, nil)
+	if j, err := s.Get(running.Id); err != nil {
+		t.Fatal(err)
+	} else if j.Status != StatusCanceled {
+		t.Errorf("canceled job has status %v after late push, want %v", j.Status, StatusCanceled)
+	}
+
+	// finished jobs can't be canceled
+	for _, id := range []JobId{complete.Id, queued.Id} {
+		if w := post("/api/v1/job-cancel/" + id.String()); w.Code != http.StatusConflict {
+			t.Errorf("canceling finished job %v: got status %v, want %v", id, w.Code, http.StatusConflict)
+		}
+	}
+	if w := post("/api/v1/job-cancel/" + NewJob().Id.String()); w.Code != http.StatusNotFound {
+		t.Errorf("canceling unknown job: got status %v, want %v", w.Code, http.StatusNotFound)
+	}
+
+	req, _ := http.NewRequest("GET", "/api/v1/job-outfiles/"+running.Id.String(), nil)
+	w = httptest.NewRecorder()
+	s.serv.Handler.ServeHTTP(w, req)
+	if w.Code != http.StatusConflict {
+		t.Errorf("outfiles of canceled job: got status %v, want %v", w.Code, http.StatusConflict)
+	}
+
+	req, _ = http.NewRequest("GET", "/api/v1/jobs?status=canceled", nil)
+	w = httptest.NewRecorder()
+	s.serv.Handler.ServeHTTP(w, req)
+	var list []*JobSummary
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatalf("listing canceled jobs: %v: %s", err, w.Body.Bytes())
+	} else if len(list) != 2 {
+		t.Errorf("got %v canceled jobs listed, want 2", len(list))
+	}
+
+	if s.Stats.NCanceled != 2 {
+		t.Errorf("got %v canceled jobs in stats, want 2", s.Stats.NCanceled)
+	}
+	if j := (&Job{Status: StatusCanceled}); !j.Done() {
+		t.Errorf("canceled job is not Done")
+	}
+}
+
+func TestObjectives(t *testing.T) {
+	const testaddr = "127.0.0.1:45708"
+	db, _ := NewDB("", dblimit)
+	s := NewServer(testaddr, testaddr, db)
+	nolog(s)
+	go s.dispatcher()
+	defer s.Close()
+
+	complete := NewJobCmd("true")
+	complete.Status = StatusComplete
+	complete.ObjFile = "obj.dat"
+	s.alljobs.Put(complete)
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	f, _ := zw.Create("obj.dat")
+	f.Write([]byte("42.5\n"))
+	zw.Close()
+	if err := ioutil.WriteFile(outfileName(complete.Id), buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(outfileName(complete.Id))
+
+	noobj := NewJobCmd("true")
+	noobj.Status = StatusComplete
+	s.alljobs.Put(noobj)
+
+	queued := NewJobCmd("true")
+	s.Start(queued, nil)
+
+	unknown := NewJob().Id
+
+	ids := []string{complete.Id.String(), noobj.Id.String(), queued.Id.String(), unknown.String()}
+	req, _ := http.NewRequest("GET", "/api/v1/objectives?ids="+strings.Join(ids, ","), nil)
+	w := httptest.NewRecorder()
+	s.serv.Handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %v: %s", w.Code, w.Body.Bytes())
+	}
+
+	results := map[string]ObjectiveResult{}
+	if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+		t.Fatal(err)
+	}
+	if res := results[complete.Id.String()]; res.Objective == nil || *res.Objective != 42.5 {
+		t.Errorf("complete job: got %+v, want objective 42.5", res)
+	}
+	if res := results[noobj.Id.String()]; res.Objective != nil || res.Error == "" {
+		t.Errorf("job without ObjFile: got %+v, want an error", res)
+	}
+	if res := results[queued.Id.String()]; res.Status != StatusQueued || res.Objective != nil || res.Error != "" {
+		t.Errorf("queued job: got %+v, want just its status", res)
+	}
+	if res := results[unknown.String()]; res.Error == "" {
+		t.Errorf("unknown job: got %+v, want an error", res)
+	}
+
+	// the objective is cached on the job once computed
+	os.Remove(outfileName(complete.Id))
+	if j, err := s.Get(complete.Id); err != nil {
+		t.Fatal(err)
+	} else if j.Objective == nil || *j.Objective != 42.5 {
+		t.Errorf("objective not cached on job: got %v", j.Objective)
+	}
+	if res := s.Objectives([]JobId{complete.Id})[complete.Id]; res.Objective == nil || *res.Objective != 42.5 {
+		t.Errorf("cached objective: got %+v, want 42.5", res)
+	}
+
+	req, _ = http.NewRequest("GET", "/api/v1/objectives?ids=zzz", nil)
+	w = httptest.NewRecorder()
+	s.serv.Handler.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("malformed id: got status %v, want %v", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestIdempotentSubmit(t *testing.T) {
+	const testaddr = "127.0.0.1:45714"
+	db, _ := NewDB("", dblimit)
+	s := NewServer(testaddr, testaddr, db)
+	nolog(s)
+	go s.dispatcher()
+	defer s.Close()
+
+	submit := func(key string) (JobId, int) {
+		req, _ := http.NewRequest("POST", "/api/v1/job-infile", strings.NewReader("<simulation/>"))
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		w := httptest.NewRecorder()
+		s.serv.Handler.ServeHTTP(w, req)
+		j := &Job{}
+		if err := json.Unmarshal(w.Body.Bytes(), j); err != nil {
+			t.Fatalf("bad response %q: %v", w.Body.String(), err)
+		}
+		return j.Id, w.Code
+	}
+
+	id1, code := submit("abc")
+	if code != http.StatusCreated {
+		t.Errorf("first submit: got status %v, want %v", code, http.StatusCreated)
+	}
+	id2, code := submit("abc")
+	if code != http.StatusOK {
+		t.Errorf("repeated submit: got status %v, want %v", code, http.StatusOK)
+	} else if id2 != id1 {
+		t.Errorf("repeated submit: got job %v, want original job %v", id2, id1)
+	}
+	if id3, _ := submit("xyz"); id3 == id1 {
+		t.Errorf("submit with new key returned original job %v", id1)
+	}
+	if id4, _ := submit(""); id4 == id1 {
+		t.Errorf("submit without key returned original job %v", id1)
+	}
+
+	if jobs := s.List(JobFilter{}); len(jobs) != 3 {
+		t.Errorf("got %v jobs, want 3", len(jobs))
+	}
+}
+
+func TestIdemKeysBounded(t *testing.T) {
+	defer func(n int) { maxIdemKeys = n }(maxIdemKeys)
+	maxIdemKeys = 2
+
+	k := idemKeys{}
+	k.add("a", JobId{1})
+	k.add("b", JobId{2})
+	k.add("c", JobId{3})
+	if _, ok := k.get("a"); ok {
+		t.Errorf("oldest key was not forgotten")
+	}
+	if id, ok := k.get("c"); !ok || id != (JobId{3}) {
+		t.Errorf("got id %v (found=%v) for key c, want %v", id, ok, JobId{3})
+	}
+	if _, ok := k.get(""); ok {
+		t.Errorf("empty key was found")
+	}
+}
+
+func TestFetchN(t *testing.T) {
+	const testaddr = "127.0.0.1:45715"
+	db, _ := NewDB("", dblimit)
+	s := NewServer(testaddr, testaddr, db)
+	nolog(s)
+	go s.dispatcher()
+	defer s.Close()
+
+	highmem := NewJobCmd("true")
+	highmem.WorkerClass = "highmem"
+	s.Start(highmem, nil)
+	for i := 0; i < 3; i++ {
+		s.Start(NewJobCmd("true"), nil)
+	}
+
+	r := &RPC{s}
+	tests := []struct {
+		N     int
+		Class string
+		Want  int
+	}{
+		{2, "", 2},
+		{0, "", 1}, // unset means 1
+		{5, "", 0}, // only the highmem job is left
+		{5, "highmem", 1},
+		{5, "highmem", 0},
+	}
+	for i, test := range tests {
+		var jobs []*Job
+		err := r.FetchN(FetchRequest{Class: test.Class, N: test.N}, &jobs)
+		if len(jobs) != test.Want {
+			t.Errorf("test %v: fetched %v jobs, want %v", i, len(jobs), test.Want)
+		} else if test.Want == 0 && err != nojoberr {
+			t.Errorf("test %v: got error %v, want %v", i, err, nojoberr)
+		}
+		for _, j := range jobs {
+			if j.Status != StatusRunning {
+				t.Errorf("test %v: fetched job %v has status %v, want %v", i, j.Id, j.Status, StatusRunning)
+			}
+		}
+	}
+
+	// MaxConcurrent caps the number fetched
+	for i := 0; i < 3; i++ {
+		s.Start(NewJobCmd("true"), nil)
+	}
+	s.MaxConcurrent = len(s.List(JobFilter{Status: StatusRunning})) + 2
+	var jobs []*Job
+	if r.FetchN(FetchRequest{N: 10}, &jobs); len(jobs) != 2 {
+		t.Errorf("fetched %v jobs with MaxConcurrent %v, want 2", len(jobs), s.MaxConcurrent)
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	const testaddr = "127.0.0.1:45716"
+	db, _ := NewDB("", dblimit)
+	s := NewServer(testaddr, testaddr, db)
+	nolog(s)
+	go s.dispatcher()
+	defer s.Close()
+
+	expired := NewJobCmd("true")
+	expired.Deadline = time.Now().Add(-time.Second)
+	result := s.Start(expired, nil)
+	live := NewJobCmd("true")
+	live.Deadline = time.Now().Add(time.Hour)
+	s.Start(live, nil)
+
+	r := &RPC{s}
+	var j *Job
+	if err := r.Fetch(WorkerId{}, &j); err != nil {
+		t.Fatal(err)
+	} else if j.Id != live.Id {
+		t.Errorf("fetched job %v, want job %v before its deadline", j.Id, live.Id)
+	}
+	if err := r.Fetch(WorkerId{}, &j); err != nojoberr {
+		t.Errorf("expired job was dispatched (error %v)", err)
+	}
+
+	select {
+	case got := <-result:
+		if got.Status != StatusCanceled {
+			t.Errorf("blocked submitter got job status %v, want %v", got.Status, StatusCanceled)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("blocked submitter not notified of expired job")
+	}
+	if got, err := s.Get(expired.Id); err != nil {
+		t.Fatal(err)
+	} else if got.Status != StatusCanceled {
+		t.Errorf("expired job has status %v, want %v", got.Status, StatusCanceled)
+	}
+}
+
+func TestSubmitScenario(t *testing.T) {
+	const testaddr = "127.0.0.1:45717"
+	db, _ := NewDB("", dblimit)
+	s := NewServer(testaddr, testaddr, db)
+	nolog(s)
+	go s.dispatcher()
+	defer s.Close()
+
+	scn := &scen.Scenario{
+		SimDur:      3,
+		BuildPeriod: 1,
+		CyclusTmpl:  "tmpl.xml",
+		Facs:        []scen.Facility{{Proto: "reactor", Cap: 1, Life: 10}},
+		MinPower:    []float64{0, 0},
+		MaxPower:    []float64{10, 10},
+	}
+	tmpl := `<simulation>{{range .Builds}}<build proto="{{.Proto}}" time="{{.Time}}" n="{{.N}}"/>{{end}}</simulation>`
+
+	submit := func(sub *ScenarioSubmission) *httptest.ResponseRecorder {
+		data, err := json.Marshal(sub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, _ := http.NewRequest("POST", "/api/v1/scenario/submit", bytes.NewReader(data))
+		w := httptest.NewRecorder()
+		s.serv.Handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := submit(&ScenarioSubmission{Scenario: scn, Vars: []float64{0.5, 0.5}, Template: tmpl})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("got status %v (%s), want %v", w.Code, w.Body.Bytes(), http.StatusCreated)
+	}
+	j := &Job{}
+	if err := json.Unmarshal(w.Body.Bytes(), j); err != nil {
+		t.Fatal(err)
+	}
+	j, err := s.Get(j.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	infile, err := cyclusInfile(j)
+	if err != nil || infile == nil || !bytes.Contains(infile.Data, []byte(`<build proto="reactor"`)) {
+		t.Errorf("rendered infile has no builds: %+v", infile)
+	}
+
+	bad := []*ScenarioSubmission{
+		{Scenario: scn, Vars: []float64{0.5, 0.5}},
+		{Scenario: scn, Vars: []float64{0.5}, Template: tmpl},
+		{Scenario: scn, Template: `<simulation>{{include "/etc/passwd"}}</simulation>`},
+		{Vars: []float64{0.5, 0.5}, Template: tmpl},
+	}
+	for i, sub := range bad {
+		if w := submit(sub); w.Code != http.StatusBadRequest {
+			t.Errorf("bad submission %v: got status %v, want %v", i, w.Code, http.StatusBadRequest)
+		}
+	}
+	if jobs := s.List(JobFilter{}); len(jobs) != 1 {
+		t.Errorf("got %v jobs, want 1", len(jobs))
+	}
+}
+
+func TestDashboardCompare(t *testing.T) {
+	const testaddr = "127.0.0.1:45718"
+	db, _ := NewDB("", dblimit)
+	s := NewServer(testaddr, testaddr, db)
+	nolog(s)
+	go s.dispatcher()
+	defer s.Close()
+
+	newJob := func(vars []float64) *Job {
+		scn := &scen.Scenario{
+			SimDur:      3,
+			BuildPeriod: 1,
+			Facs:        []scen.Facility{{Proto: "reactor", Cap: 1, Life: 10}},
+			MinPower:    []float64{0, 0},
+			MaxPower:    []float64{10, 10},
+		}
+		j, err := NewJobScenario(&ScenarioSubmission{Scenario: scn, Vars: vars, Template: "<simulation/>"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Start(j, nil)
+		return j
+	}
+	a := newJob([]float64{0.5, 0.5})
+	b := newJob([]float64{0.5, 1})
+
+	compare := func(query string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/dashboard/compare"+query, nil)
+		w := httptest.NewRecorder()
+		s.serv.Handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := compare(fmt.Sprintf("?a=%v&b=%v", a.Id, b.Id))
+	body := w.Body.String()
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %v (%s), want %v", w.Code, body, http.StatusOK)
+	}
+	for _, want := range []string{a.Id.String(), b.Id.String(), "<td>reactor</td>", `class="diff"`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("comparison page doesn't contain %q:\n%s", want, body)
+		}
+	}
+
+	// the same job never differs from itself
+	if body := compare(fmt.Sprintf("?a=%v&b=%v", a.Id, a.Id)).Body.String(); strings.Contains(body, `class="diff"`) {
+		t.Errorf("job compared with itself has differences:\n%s", body)
+	}
+
+	// unknown jobs are reported rather than failing the page
+	w = compare(fmt.Sprintf("?a=%v&b=%v", a.Id, JobId{1}))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "<td>reactor</td>") {
+		t.Errorf("comparison with an unknown job: got status %v:\n%s", w.Code, w.Body.String())
+	}
+
+	if w := compare("?a=" + a.Id.String()); w.Code != http.StatusBadRequest {
+		t.Errorf("comparison of one job: got status %v, want %v", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestJobLogs(t *testing.T) {
+	const testaddr = "127.0.0.1:45719"
+	db, _ := NewDB("", dblimit)
+	s := NewServer(testaddr, testaddr, db)
+	nolog(s)
+	go s.dispatcher()
+	defer s.Close()
+
+	defer func(d time.Duration) { logPollInterval = d }(logPollInterval)
+	logPollInterval = 10 * time.Millisecond
+
+	j := NewJobCmd("echo", "hello")
+	s.Start(j, nil)
+
+	logs := func() (chan string, chan int) {
+		req, _ := http.NewRequest("GET", "/api/v1/job-logs/"+j.Id.String(), nil)
+		w := httptest.NewRecorder()
+		body, code := make(chan string, 1), make(chan int, 1)
+		go func() {
+			s.serv.Handler.ServeHTTP(w, req)
+			code <- w.Code
+			body <- w.Body.String()
+		}()
+		return body, code
+	}
+
+	wid := WorkerId{1}
+	req := workRequest{WorkerId: wid, Ch: make(chan *Job, 1)}
+	s.fetchjobs <- req
+	if jj := <-req.Ch; jj == nil || jj.Id != j.Id {
+		t.Fatalf("fetched wrong job %v", jj)
+	}
+
+	rpc := &RPC{s}
+	rpc.PushLog(LogChunk{WorkerId: wid, JobId: j.Id, Data: []byte("chunk1\n")}, nil)
+	body, code := logs()
+	rpc.PushLog(LogChunk{WorkerId: WorkerId{2}, JobId: j.Id, Data: []byte("otherworker\n")}, nil)
+	rpc.PushLog(LogChunk{WorkerId: wid, JobId: j.Id, Data: []byte("chunk2\n")}, nil)
+
+	time.Sleep(50 * time.Millisecond)
+	jj := *j
+	jj.Status = StatusComplete
+	jj.Stdout = "full stdout\n"
+	jj.WorkerId = wid
+	s.pushjobs <- &jj
+
+	select {
+	case c := <-code:
+		if c != http.StatusOK {
+			t.Fatalf("got status %v, want %v", c, http.StatusOK)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("log stream didn't end when the job finished")
+	}
+	got := <-body
+	for _, want := range []string{"chunk1\nchunk2\n", StatusComplete} {
+		if !strings.Contains(got, want) {
+			t.Errorf("streamed log doesn't contain %q:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "otherworker") {
+		t.Errorf("streamed log contains output pushed by the wrong worker:\n%s", got)
+	}
+
+	// finished jobs return their full output
+	body, code = logs()
+	if c, got := <-code, <-body; c != http.StatusOK || got != "full stdout\n" {
+		t.Errorf("finished job log: got status %v and %q, want full stdout", c, got)
+	}
+
+	req2, _ := http.NewRequest("GET", "/api/v1/job-logs/"+JobId{1}.String(), nil)
+	w := httptest.NewRecorder()
+	s.serv.Handler.ServeHTTP(w, req2)
+	if w.Code == http.StatusOK {
+		t.Errorf("unknown job log: got status %v", w.Code)
+	}
+}
+
+func TestLiveLogBounded(t *testing.T) {
+	defer func(n int) { maxJobLog = n }(maxJobLog)
+	maxJobLog = 4
+
+	l := &liveLog{}
+	l.add([]byte("abc"))
+	if data, off := l.since(0); string(data) != "abc" || off != 3 {
+		t.Errorf("since(0) = %q, %v; want \"abc\", 3", data, off)
+	}
+	l.add([]byte("defg"))
+	if data, off := l.since(3); string(data) != "defg" || off != 7 {
+		t.Errorf("since(3) = %q, %v; want \"defg\", 7", data, off)
+	}
+	// dropped output is skipped
+	if data, _ := l.since(0); string(data) != "defg" {
+		t.Errorf("since(0) after drop = %q, want \"defg\"", data)
+	}
+	if data, off := l.since(7); len(data) != 0 || off != 7 {
+		t.Errorf("since(7) = %q, %v; want nothing", data, off)
+	}
+}
+
+// depServer starts a server for dependency tests and returns functions to
+// fetch the next job (nil if none) and finish a fetched job with a status.
+func depServer(addr string) (s *Server, fetch func() *Job, finish func(j *Job, status string)) {
+	db, _ := NewDB("", dblimit)
+	s = NewServer(addr, addr, db)
+	nolog(s)
+	go s.dispatcher()
+
+	r := &RPC{s}
+	fetch = func() *Job {
+		var j *Job
+		r.Fetch(WorkerId{}, &j)
+		return j
+	}
+	finish = func(j *Job, status string) {
+		jj := *j
+		jj.Status = status
+		r.Push(&jj, nil)
+	}
+	return s, fetch, finish
+}
+
+func TestDependsOnChain(t *testing.T) {
+	s, fetch, finish := depServer("127.0.0.1:45720")
+	defer s.Close()
+
+	a := NewJobCmd("true")
+	b := NewJobCmd("true")
+	b.DependsOn = []JobId{a.Id}
+	c := NewJobCmd("true")
+	c.DependsOn = []JobId{b.Id}
+	for _, j := range []*Job{a, b, c} {
+		s.Start(j, nil)
+	}
+
+	if j := fetch(); j == nil || j.Id != a.Id {
+		t.Fatalf("fetched job %v, want %v", j, a.Id)
+	} else if j := fetch(); j != nil {
+		t.Fatalf("fetched job %v before its dependency completed", j.Id)
+	}
+	finish(a, StatusComplete)
+
+	j := fetch()
+	if j == nil || j.Id != b.Id {
+		t.Fatalf("fetched job %v, want %v", j, b.Id)
+	}
+	finish(j, StatusFailed)
+
+	if j, err := s.Get(c.Id); err != nil || j.Status != StatusFailed {
+		t.Errorf("job depending on a failed job: got %v (err=%v), want status %v", j, err, StatusFailed)
+	} else if !strings.Contains(j.Stderr, b.Id.String()) {
+		t.Errorf("failed dependent's stderr doesn't name the failed dependency:\n%s", j.Stderr)
+	}
+	if j := fetch(); j != nil {
+		t.Errorf("fetched job %v, want none", j.Id)
+	}
+
+	// dependencies that already failed or don't exist fail jobs immediately
+	for _, dep := range []JobId{b.Id, JobId{1}} {
+		d := NewJobCmd("true")
+		d.DependsOn = []JobId{dep}
+		s.Start(d, nil)
+		if j, err := s.Get(d.Id); err != nil || j.Status != StatusFailed {
+			t.Errorf("job depending on %v: got %v (err=%v), want status %v", dep, j, err, StatusFailed)
+		}
+	}
+}
+
+func TestDependsOnDiamond(t *testing.T) {
+	s, fetch, finish := depServer("127.0.0.1:45721")
+	defer s.Close()
+
+	// a -> (b, c) -> d
+	diamond := func() (a, b, c, d *Job) {
+		a = NewJobCmd("true")
+		b = NewJobCmd("true")
+		b.DependsOn = []JobId{a.Id}
+		c = NewJobCmd("true")
+		c.DependsOn = []JobId{a.Id}
+		d = NewJobCmd("true")
+		d.DependsOn = []JobId{b.Id, c.Id}
+		for _, j := range []*Job{a, b, c, d} {
+			s.Start(j, nil)
+		}
+		return a, b, c, d
+	}
+
+	a, b, c, d := diamond()
+	if j := fetch(); j == nil || j.Id != a.Id {
+		t.Fatalf("fetched job %v, want %v", j, a.Id)
+	}
+	finish(a, StatusComplete)
+	for _, want := range []*Job{b, c} {
+		if j := fetch(); j == nil || j.Id != want.Id {
+			t.Fatalf("fetched job %v, want %v", j, want.Id)
+		}
+	}
+	if j := fetch(); j != nil {
+		t.Fatalf("fetched job %v before all its dependencies completed", j.Id)
+	}
+	finish(b, StatusComplete)
+	if j := fetch(); j != nil {
+		t.Fatalf("fetched job %v before all its dependencies completed", j.Id)
+	}
+	finish(c, StatusComplete)
+	if j := fetch(); j == nil || j.Id != d.Id {
+		t.Fatalf("fetched job %v, want %v", j, d.Id)
+	}
+
+	// a failure fails every job downstream of it, each only once
+	a, b, c, d = diamond()
+	if j := fetch(); j == nil || j.Id != a.Id {
+		t.Fatalf("fetched job %v, want %v", j, a.Id)
+	}
+	finish(a, StatusFailed)
+	for _, jj := range []*Job{b, c, d} {
+		j, err := s.Get(jj.Id)
+		if err != nil || j.Status != StatusFailed {
+			t.Errorf("job %v downstream of a failed job: got %v (err=%v), want status %v", jj.Id, j, err, StatusFailed)
+		} else if n := strings.Count(j.Stderr, "failed:"); n != 1 {
+			t.Errorf("job %v failed %v times, want 1:\n%s", jj.Id, n, j.Stderr)
+		}
+	}
+	if j := fetch(); j != nil {
+		t.Errorf("fetched job %v, want none", j.Id)
+	}
+}
+
+func TestDependsOnCycle(t *testing.T) {
+	const testaddr = "127.0.0.1:45726"
+	db, _ := NewDB("", dblimit)
+
+	// a cycle can only be formed by jobs restored from the db
+	a := NewJobCmd("true")
+	b := NewJobCmd("true")
+	a.DependsOn = []JobId{b.Id}
+	b.DependsOn = []JobId{a.Id}
+	for _, j := range []*Job{a, b} {
+		if err := db.Put(j); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := NewServer(testaddr, testaddr, db)
+	nolog(s)
+	go s.dispatcher()
+	defer s.Close()
+
+	for _, jj := range []*Job{a, b} {
+		if j, err := s.Get(jj.Id); err != nil || j.Status != StatusFailed {
+			t.Errorf("job %v in a dependency cycle: got %v (err=%v), want status %v", jj.Id, j, err, StatusFailed)
+		}
+	}
+
+	self := NewJobCmd("true")
+	self.DependsOn = []JobId{self.Id}
+	data, _ := json.Marshal(self)
+	req, _ := http.NewRequest("POST", "/api/v1/job", bytes.NewReader(data))
+	w := httptest.NewRecorder()
+	s.serv.Handler.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("job depending on itself: got status %v, want %v", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestJobBundle(t *testing.T) {
+	const testaddr = "127.0.0.1:45722"
+	db, _ := NewDB("", dblimit)
+	s := NewServer(testaddr, testaddr, db)
+	nolog(s)
+	go s.dispatcher()
+	defer s.Close()
+
+	scn := &scen.Scenario{
+		SimDur:      3,
+		BuildPeriod: 1,
+		Facs:        []scen.Facility{{Proto: "reactor", Cap: 1, Life: 10}},
+		MinPower:    []float64{0, 0},
+		MaxPower:    []float64{10, 10},
+	}
+	vars := []float64{0.5, 1}
+	j, err := NewJobScenario(&ScenarioSubmission{
+		Scenario: scn,
+		Vars:     vars,
+		Template: `<simulation>{{range .Builds}}<build proto="{{.Proto}}" time="{{.Time}}" n="{{.N}}"/>{{end}}</simulation>`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := NewJobCmd("true")
+	s.Start(j, nil)
+	s.Start(other, nil)
+
+	bundle := func(id JobId) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/api/v1/job-bundle/"+id.String(), nil)
+		w := httptest.NewRecorder()
+		s.serv.Handler.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := bundle(j.Id); w.Code != http.StatusConflict {
+		t.Errorf("queued job bundle: got status %v, want %v", w.Code, http.StatusConflict)
+	}
+
+	for _, jj := range []*Job{j, other} {
+		done := *jj
+		done.Status = StatusComplete
+		s.pushjobs <- &done
+	}
+
+	w := bundle(j.Id)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %v (%s), want %v", w.Code, w.Body.Bytes(), http.StatusOK)
+	}
+	r, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{}
+	for _, f := range r.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[f.Name], _ = ioutil.ReadAll(rc)
+		rc.Close()
+	}
+
+	// the bundle reproduces the job's input file and vars exactly
+	infile, err := cyclusInfile(j)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := files[scen.BundleInfile], infile.Data; !bytes.Equal(got, want) {
+		t.Errorf("bundled infile:\n%s\nwant the job's infile:\n%s", got, want)
+	}
+	var gotvars []float64
+	if err := json.Unmarshal(files[scen.BundleVars], &gotvars); err != nil || !reflect.DeepEqual(gotvars, vars) {
+		t.Errorf("got bundled vars %v (err=%v), want %v", gotvars, err, vars)
+	}
+	m := scen.Manifest{}
+	if err := json.Unmarshal(files[scen.BundleManifest], &m); err != nil || m.Hash == "" {
+		t.Errorf("bad bundle manifest %+v (err=%v)", m, err)
+	}
+
+	if w := bundle(other.Id); w.Code != http.StatusBadRequest {
+		t.Errorf("non-scenario job bundle: got status %v, want %v", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestCyclusVersionReported(t *testing.T) {
+	const testaddr = "127.0.0.1:45723"
+	db, _ := NewDB("", dblimit)
+	s := NewServer(testaddr, testaddr, db)
+	nolog(s)
+	go s.dispatcher()
+	defer s.Close()
+
+	const version = "Cyclus Core 1.5.5 (1.5.5-0-g9b3f6)"
+	j := NewJobCmd("true")
+	s.Start(j, nil)
+	done := *j
+	done.Status = StatusComplete
+	done.CyclusVersion = version
+	done.Finished = time.Now()
+	s.pushjobs <- &done
+
+	get := func(path string) string {
+		req, _ := http.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		s.serv.Handler.ServeHTTP(w, req)
+		return w.Body.String()
+	}
+
+	stat := &JobStat{}
+	if err := json.Unmarshal([]byte(get("/api/v1/job-stat/"+j.Id.String())), stat); err != nil {
+		t.Fatal(err)
+	} else if stat.CyclusVersion != version {
+		t.Errorf("got job-stat cyclus version %q, want %q", stat.CyclusVersion, version)
+	}
+	if jobs := s.List(JobFilter{}); len(jobs) != 1 || jobs[0].CyclusVersion != version {
+		t.Errorf("job listing doesn't report the cyclus version: %+v", jobs)
+	}
+	if page := get("/dashboard"); !strings.Contains(page, version) {
+		t.Errorf("dashboard doesn't show the cyclus version:\n%s", page)
+	}
+}
@@ -2,11 +2,12 @@ package cloudlus
 
 import (
 	"bytes"
+	"compress/gzip"
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"os"
+	"io/ioutil"
 	"strings"
 	"time"
 
@@ -88,11 +89,24 @@ type DB struct {
 	// PurgeAge is the minimum age at which completed (successful and failed) jobs
 	// become elegible for removal from the database during GC.
 	PurgeAge time.Duration
+	// OnPurge, if non-nil, is called with each job just before it is removed
+	// from the database during GC.
+	OnPurge func(j *Job)
+	// Compress enables gzip compression of stored jobs larger than
+	// compressMin bytes (e.g. with sizeable Infiles or Outfiles).  Jobs are
+	// always decompressed transparently when read regardless of this
+	// setting.  It is enabled by NewDB.
+	Compress bool
 }
 
+// compressMin is the smallest encoded job that is compressed when
+// DB.Compress is enabled.  Smaller jobs don't compress well enough to be
+// worth it.
+const compressMin = 1024
+
 // NewDB returns a new database with a
 func NewDB(path string, dblimit int) (*DB, error) {
-	d := &DB{PurgeAge: 30 * time.Minute}
+	d := &DB{PurgeAge: 30 * time.Minute, Compress: true}
 	d.Limit = int64(dblimit)
 
 	var err error
@@ -134,15 +148,15 @@ func (d *DB) GC() (npurged, nremain int, err error) {
 			continue
 		}
 
-		j := &Job{}
-		data := it.Value()
-		err := json.Unmarshal(data, &j)
+		j, err := decodeJob(it.Value())
 		if err != nil {
 			return npurged, -1, err
 		}
 
 		if j.Done() && now.Sub(j.Finished) > d.PurgeAge {
-			os.Remove(outfileName(j.Id))
+			if d.OnPurge != nil {
+				d.OnPurge(j)
+			}
 			d.db.Delete(it.Key(), nil)
 			d.db.Delete(finishKey(j), nil)
 			d.db.Delete(currentKey(j), nil)
@@ -158,20 +172,34 @@ func (d *DB) GC() (npurged, nremain int, err error) {
 	return npurged, nremain, nil
 }
 
-// Size returns the cumulative size of all jobs in the database (uncompressed
-// and in json form).
+// Size returns the cumulative size of all jobs in the database as stored
+// (i.e. compressed if DB.Compress is enabled).
 func (d *DB) Size() (int64, error) {
+	size, _, err := d.Sizes()
+	return size, err
+}
+
+// Sizes returns the cumulative size of all jobs in the database as stored
+// and uncompressed (in json form).  Their ratio is the effective
+// compression ratio of the database.
+func (d *DB) Sizes() (stored, raw int64, err error) {
 	it := d.db.NewIterator(nil, nil)
 	defer it.Release()
 
-	var size int64
 	for it.Next() {
-		size += int64(len(it.Value()))
+		data := it.Value()
+		stored += int64(len(data))
+		if gzipped(data) && len(data) >= 18 {
+			// the gzip trailer ends with the uncompressed size (mod 2^32)
+			raw += int64(binary.LittleEndian.Uint32(data[len(data)-4:]))
+		} else {
+			raw += int64(len(data))
+		}
 	}
 	if err := it.Error(); err != nil {
-		return 0, err
+		return 0, 0, err
 	}
-	return size, nil
+	return stored, raw, nil
 }
 
 // Count returns the number of jobs in the database.
@@ -192,15 +220,35 @@ func (d *DB) Count() (int, error) {
 	return njobs, nil
 }
 
+// putMeta stores the json encoding of v in the db under the given name
+// separately from jobs.
+func (d *DB) putMeta(name string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return d.db.Put([]byte(metaPrefix+name), data, nil)
+}
+
+// getMeta decodes the value stored by putMeta under the given name into v.
+// It returns false if there is no such value.
+func (d *DB) getMeta(name string, v interface{}) (bool, error) {
+	data, err := d.db.Get([]byte(metaPrefix+name), nil)
+	if err == leveldb.ErrNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, json.Unmarshal(data, v)
+}
+
 func (d *DB) Close() error { return d.db.Close() }
 
 func notjob(key []byte) bool {
-	pfx1 := []byte(finishPrefix)
-	pfx2 := []byte(currPrefix)
-	if bytes.Equal(key[:len(pfx1)], pfx1) {
-		return true
-	} else if bytes.Equal(key[:len(pfx2)], pfx2) {
-		return true
+	for _, pfx := range []string{finishPrefix, currPrefix, metaPrefix} {
+		if bytes.HasPrefix(key, []byte(pfx)) {
+			return true
+		}
 	}
 	return false
 }
@@ -217,8 +265,7 @@ func (d *DB) Failed() ([]*Job, error) {
 			continue
 		}
 
-		j := &Job{}
-		err := json.Unmarshal(it.Value(), &j)
+		j, err := decodeJob(it.Value())
 		if err != nil {
 			return nil, err
 		}
@@ -259,12 +306,40 @@ func (d *DB) Current() ([]*Job, error) {
 }
 
 // Recent returns up to n of the most recently completed jobs (including
-// failed ones).
+// failed ones) oldest first.
+//
+// Deprecated: use EachFinished, which doesn't need the number of jobs up
+// front.
 func (d *DB) Recent(n int) ([]*Job, error) {
-	it := d.db.NewIterator(util.BytesPrefix([]byte(finishPrefix)), nil)
+	jobs := []*Job{}
+	if n <= 0 {
+		return jobs, nil
+	}
+	err := d.EachFinished(time.Time{}, time.Time{}, func(j *Job) bool {
+		jobs = append(jobs, j)
+		return len(jobs) < n
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i, k := 0, len(jobs)-1; i < k; i, k = i+1, k-1 {
+		jobs[i], jobs[k] = jobs[k], jobs[i]
+	}
+	return jobs, nil
+}
+
+// Finished returns all completed jobs (including failed ones) that finished
+// at or after since in order of their finish time.
+func (d *DB) Finished(since time.Time) ([]*Job, error) {
+	return d.FinishedRange(since, time.Time{})
+}
+
+// FinishedRange is the same as Finished except that only jobs that finished
+// before until are returned.  A zero until means no limit.
+func (d *DB) FinishedRange(since, until time.Time) ([]*Job, error) {
+	it := d.db.NewIterator(finishRange(since, until), nil)
 	defer it.Release()
 
-	// the last iterated over jobs are the most recent
 	ids := []JobId{}
 	for it.Next() {
 		var id JobId
@@ -275,20 +350,58 @@ func (d *DB) Recent(n int) ([]*Job, error) {
 		return nil, err
 	}
 
-	if len(ids) > n {
-		ids = ids[len(ids)-n:]
+	jobs := make([]*Job, 0, len(ids))
+	for _, id := range ids {
+		j, err := d.Get(id)
+		if err != nil {
+			return nil, err
+		} else if j.Finished.Before(since) || (!until.IsZero() && !j.Finished.Before(until)) {
+			continue // finish index only has 1 second resolution
+		}
+		jobs = append(jobs, j)
 	}
+	return jobs, nil
+}
 
-	jobs := make([]*Job, len(ids))
-	for i, id := range ids {
+// EachFinished calls fn with the completed jobs (including failed ones) that
+// finished at or after since and before until (a zero until means no limit)
+// newest first.  Iteration stops early if fn returns false, so only the jobs
+// fn is called with are read.
+func (d *DB) EachFinished(since, until time.Time, fn func(j *Job) bool) error {
+	it := d.db.NewIterator(finishRange(since, until), nil)
+	defer it.Release()
+
+	for ok := it.Last(); ok; ok = it.Prev() {
+		var id JobId
+		copy(id[:], it.Value())
 		j, err := d.Get(id)
 		if err != nil {
-			return nil, err
+			return err
+		} else if j.Finished.Before(since) || (!until.IsZero() && !j.Finished.Before(until)) {
+			continue // finish index only has 1 second resolution
+		} else if !fn(j) {
+			break
 		}
-		jobs[i] = j
 	}
+	return it.Error()
+}
 
-	return jobs, nil
+// finishRange returns the range of finish index keys for jobs that finished
+// in the second of since or later and in the second of until or earlier.
+func finishRange(since, until time.Time) *util.Range {
+	start := make([]byte, 8)
+	if since.Unix() > 0 {
+		binary.BigEndian.PutUint64(start, uint64(since.Unix()))
+	}
+	rng := util.BytesPrefix([]byte(finishPrefix))
+	rng.Start = append([]byte(finishPrefix), start...)
+	if !until.IsZero() {
+		// the limit is exclusive, so include the whole second until is in
+		end := make([]byte, 8)
+		binary.BigEndian.PutUint64(end, uint64(until.Unix()+1))
+		rng.Limit = append([]byte(finishPrefix), end...)
+	}
+	return rng
 }
 
 func (d *DB) Get(id JobId) (*Job, error) {
@@ -296,17 +409,60 @@ func (d *DB) Get(id JobId) (*Job, error) {
 	if err != nil {
 		return nil, err
 	}
+	return decodeJob(data)
+}
+
+// encodeJob returns the stored form of j - its json encoding, gzipped if
+// compress is true and that makes it smaller.
+func encodeJob(j *Job, compress bool) ([]byte, error) {
+	data, err := json.Marshal(j)
+	if err != nil || !compress || len(data) < compressMin {
+		return data, err
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(data)
+	if err := zw.Close(); err != nil {
+		return nil, err
+	} else if buf.Len() >= len(data) {
+		return data, nil
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeJob decodes a job stored by encodeJob.
+func decodeJob(data []byte) (*Job, error) {
+	if gzipped(data) {
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		if data, err = ioutil.ReadAll(zr); err != nil {
+			return nil, err
+		}
+	}
+
 	j := &Job{}
-	err = json.Unmarshal(data, &j)
-	if err != nil {
+	if err := json.Unmarshal(data, &j); err != nil {
 		return nil, err
 	}
 	return j, nil
 }
 
+// gzipped returns whether data is gzip compressed rather than plain json
+// (which can't start with the gzip magic number).
+func gzipped(data []byte) bool {
+	return len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b
+}
+
 const finishPrefix = "finish-"
 const currPrefix = "curr-"
 
+// metaPrefix prefixes the keys of non-job server state kept in the db (see
+// putMeta).
+const metaPrefix = "meta-"
+
 func finishKey(j *Job) []byte {
 	data := make([]byte, 8)
 	binary.BigEndian.PutUint64(data, uint64(j.Finished.Unix()))
@@ -320,7 +476,7 @@ func currentKey(j *Job) []byte {
 }
 
 func (d *DB) Put(j *Job) error {
-	data, err := json.Marshal(j)
+	data, err := encodeJob(j, d.Compress)
 	if err != nil {
 		return err
 	}
@@ -348,6 +504,12 @@ func (d *DB) Put(j *Job) error {
 	return d.db.Put(j.Id[:], data, nil)
 }
 
+// lastLine returns the last non-empty line of text in s.
+func lastLine(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
 func outfileName(id JobId) string {
 	return fmt.Sprintf("%s-outdata.zip", id)
 }
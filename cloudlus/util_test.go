@@ -1,6 +1,7 @@
 package cloudlus
 
 import (
+	"bytes"
 	"log"
 	"testing"
 	"time"
@@ -51,6 +52,92 @@ func TestDB_Count(t *testing.T) {
 	}
 }
 
+func TestDBEachFinished(t *testing.T) {
+	db, _ := NewDB("", dblimit)
+
+	now := time.Now()
+	jobs := []*Job{}
+	for i := 0; i < 5; i++ {
+		j := NewJobCmd("echo", "1")
+		j.Status = StatusComplete
+		j.Finished = now.Add(time.Duration(i) * time.Minute)
+		if err := db.Put(j); err != nil {
+			t.Fatal(err)
+		}
+		jobs = append(jobs, j)
+	}
+
+	// newest first, stopping when asked
+	got := []*Job{}
+	err := db.EachFinished(jobs[1].Finished, time.Time{}, func(j *Job) bool {
+		got = append(got, j)
+		return len(got) < 3
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*Job{jobs[4], jobs[3], jobs[2]}
+	if len(got) != len(want) {
+		t.Fatalf("got %v jobs, want %v", len(got), len(want))
+	}
+	for i := range want {
+		if got[i].Id != want[i].Id {
+			t.Errorf("job %v: got %v, want %v", i, got[i].Id, want[i].Id)
+		}
+	}
+
+	n := 0
+	db.EachFinished(jobs[1].Finished, jobs[3].Finished, func(j *Job) bool { n++; return true })
+	if n != 2 {
+		t.Errorf("got %v jobs in range, want 2", n)
+	}
+
+	// Recent returns the newest jobs oldest first
+	recent, err := db.Recent(2)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(recent) != 2 || recent[0].Id != jobs[3].Id || recent[1].Id != jobs[4].Id {
+		t.Errorf("got %v recent jobs, want jobs 3 and 4", len(recent))
+	}
+}
+
+func TestDBCompress(t *testing.T) {
+	db, _ := NewDB("", dblimit)
+
+	big := NewJobCmd("cyclus", "input.xml")
+	big.AddInfile("input.xml", bytes.Repeat([]byte("<facility><name>reactor</name></facility>\n"), 1000))
+	small := NewJobCmd("echo", "1")
+	db.Put(big)
+	db.Put(small)
+
+	// jobs stored before compression was enabled stay readable
+	db.Compress = false
+	plain := NewJobCmd("cyclus", "input.xml")
+	plain.AddInfile("input.xml", big.Infiles[0].Data)
+	db.Put(plain)
+	db.Compress = true
+
+	for _, want := range []*Job{big, small, plain} {
+		got, err := db.Get(want.Id)
+		if err != nil {
+			t.Fatal(err)
+		} else if len(got.Infiles) != len(want.Infiles) || len(want.Infiles) > 0 && !bytes.Equal(got.Infiles[0].Data, want.Infiles[0].Data) {
+			t.Errorf("job %v infiles not retrieved intact", want.Id)
+		}
+	}
+
+	// only the uncompressed job's size is counted in full
+	stored, raw, err := db.Sizes()
+	if err != nil {
+		t.Fatal(err)
+	} else if stored >= raw || stored < raw/2 {
+		t.Errorf("got stored size %v for raw size %v, want about half", stored, raw)
+	}
+	if size, _ := db.Size(); size != stored {
+		t.Errorf("got Size %v, want stored size %v", size, stored)
+	}
+}
+
 func TestGC(t *testing.T) {
 	tests := []test{
 		{[]string{StatusComplete}, full},
@@ -3,22 +3,20 @@ package cloudlus
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"math/rand"
 	"os"
 	"time"
 
 	"code.google.com/p/go-uuid/uuid"
+	"github.com/rwcarlsen/cloudlus/scen"
 )
 
-var devnull *os.File
-
-func init() {
-	var err error
-	devnull, err = os.Open(os.DevNull)
-	if err != nil {
-		panic(err.Error())
-	}
-}
+// devnull discards the output of jobs run by workers without logging.  It
+// must accept writes since a job's output is teed through it into the job's
+// Stdout and Stderr (see Job.Execute).
+var devnull io.Writer = ioutil.Discard
 
 type Worker struct {
 	Id WorkerId
@@ -27,8 +25,18 @@ type Worker struct {
 	JobTimeout time.Duration
 	ServerAddr string
 	FileCache  map[string][]byte
-	Wait       time.Duration
-	Whitelist  []string
+	// Wait is the time the worker waits before polling the server again
+	// when there are no jobs or the server can't be reached.  The wait
+	// doubles (with some random jitter) for each consecutive failed poll up
+	// to MaxWait.
+	Wait time.Duration
+	// MaxWait caps the time between polls (see Wait).  Zero means 8*Wait.
+	MaxWait   time.Duration
+	Whitelist []string
+	// Class is the worker class advertised to the server when fetching jobs.
+	// Only jobs with a matching (or no) WorkerClass are handed to the
+	// worker.
+	Class string
 	// lastjob is last time a job was completed.
 	lastjob time.Time
 	// MaxIdle is the length of time a worker will wait without receiving a
@@ -36,6 +44,10 @@ type Worker struct {
 	// forever.
 	MaxIdle time.Duration
 	nolog   bool
+	// MaxOutputSize, if nonzero, is the maximum total size in bytes of a
+	// job's collected output files.  Jobs whose output files exceed it fail
+	// without any output files being sent back to the server.
+	MaxOutputSize int64
 }
 
 func (w *Worker) Run() error {
@@ -54,22 +66,54 @@ func (w *Worker) Run() error {
 	if w.Wait == 0 {
 		w.Wait = 10 * time.Second
 	}
+	if w.MaxWait == 0 {
+		w.MaxWait = 8 * w.Wait
+	}
 
+	b := &backoff{Min: w.Wait, Max: w.MaxWait}
 	for {
 		wait, err := w.dojob()
 		if err != nil {
 			log.Print(err)
 		}
-		if w.MaxIdle > 0 && time.Now().Sub(w.lastjob) > w.MaxIdle {
+		idle := time.Now().Sub(w.lastjob)
+		if w.MaxIdle > 0 && idle > w.MaxIdle {
 			log.Printf("no jobs received for %v, shutting down", w.MaxIdle)
 			return nil
 		}
-		if wait {
-			<-time.After(w.Wait)
+		if !wait {
+			b.Reset()
+			continue
+		}
+
+		d := b.Next()
+		if w.MaxIdle > 0 && w.MaxIdle-idle < d {
+			// don't oversleep the idle shutdown
+			d = w.MaxIdle - idle
+		}
+		<-time.After(d)
+	}
+}
+
+// retry calls fn until it succeeds, backing off between attempts, up to
+// maxRetries times.  The last error is returned if all attempts fail.
+func (w *Worker) retry(fn func() error) error {
+	b := &backoff{Min: w.Wait, Max: w.MaxWait}
+	var err error
+	for i := 0; i < maxRetries; i++ {
+		if err = fn(); err == nil {
+			return nil
 		}
+		log.Printf("%v (retrying)", err)
+		<-time.After(b.Next())
 	}
+	return err
 }
 
+// maxRetries is the number of attempts a worker makes to send a finished
+// job back to the server before giving up on it.
+const maxRetries = 8
+
 func (w *Worker) dojob() (wait bool, err error) {
 	client, err2 := Dial(w.ServerAddr)
 	if err2 != nil {
@@ -78,8 +122,9 @@ func (w *Worker) dojob() (wait bool, err error) {
 	defer client.Close()
 
 	j, err2 := client.Fetch(w)
-	if err2 == nojoberr {
-		return false, nil
+	if err2 != nil && err2.Error() == nojoberr.Error() {
+		// errors lose their identity over rpc
+		return true, nil
 	} else if err2 != nil {
 		return true, err2
 	}
@@ -89,7 +134,13 @@ func (w *Worker) dojob() (wait bool, err error) {
 			j.Status = StatusFailed
 			j.Stderr += fmt.Sprintf("\n%v\n", err)
 		}
-		err2 := client.Push(w, j)
+		err2 := w.retry(func() error {
+			err := client.Push(w, j)
+			if err != nil {
+				client.reconnect()
+			}
+			return err
+		})
 		w.lastjob = time.Now()
 		if err == nil && err2 != nil {
 			err = err2
@@ -101,6 +152,10 @@ func (w *Worker) dojob() (wait bool, err error) {
 	}
 
 	j.Whitelist(w.Whitelist...)
+	j.maxoutput = w.MaxOutputSize
+	if j.RecordCyclusVersion {
+		j.CyclusVersion = scen.CyclusVersion()
+	}
 
 	// add precached files
 	for name, data := range w.FileCache {
@@ -121,27 +176,61 @@ func (w *Worker) dojob() (wait bool, err error) {
 	// run job
 	if w.nolog {
 		j.log = devnull
+	} else if j.log == nil {
+		j.log = os.Stdout
 	}
 
-	pr, pw := io.Pipe()
-	defer pr.Close()
+	// stream the job's output to the server while it runs
+	logs := &logBuffer{}
+	j.log = io.MultiWriter(j.log, logs)
+	go pushLogs(logs, func(data []byte) error {
+		return client.PushLog(LogChunk{WorkerId: w.Id, JobId: j.Id, Data: data})
+	}, done)
 
-	rundone := make(chan bool)
-	go func() {
-		j.Execute(kill, pw)
-		pw.Close()
-		close(rundone)
-	}()
+	// the output files are buffered on disk so they can be resent if the
+	// connection to the server is lost.
+	f, err := ioutil.TempFile("", "cloudlus-outfiles-")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	j.Execute(kill, f)
 
-	err = client.PushOutfile(j.Id, pr)
+	err = w.retry(func() error {
+		if _, err := f.Seek(0, 0); err != nil {
+			return err
+		}
+		return client.PushOutfile(j.Id, f)
+	})
 	if err != nil {
-		<-rundone
 		return false, err
 	}
-	<-rundone
 
 	j.WorkerId = w.Id
 	j.Infiles = nil // don't need to send back input files
 
 	return false, nil
 }
+
+// backoff computes exponentially increasing wait times with random jitter
+// between Min and Max.
+type backoff struct {
+	Min, Max time.Duration
+	curr     time.Duration
+}
+
+// Next returns the next wait time - the previous one doubled (starting at
+// Min and capped at Max) reduced by a random jitter of up to half.
+func (b *backoff) Next() time.Duration {
+	if b.curr == 0 {
+		b.curr = b.Min
+	} else if b.curr *= 2; b.curr > b.Max {
+		b.curr = b.Max
+	}
+	return b.curr/2 + time.Duration(rand.Int63n(int64(b.curr/2)+1))
+}
+
+// Reset starts the wait times over at Min.
+func (b *backoff) Reset() { b.curr = 0 }
@@ -1,6 +1,9 @@
 package cloudlus
 
 import (
+	"io"
+	"net"
+	"sync"
 	"testing"
 	"time"
 )
@@ -37,3 +40,111 @@ func TestWorkerLive(t *testing.T) {
 	case <-time.After(3 * time.Second):
 	}
 }
+
+// flakyProxy forwards tcp connections to a server and can drop all of them
+// (and refuse new ones) to simulate network blips and server restarts.
+type flakyProxy struct {
+	Addr, Target string
+	mu           sync.Mutex
+	ln           net.Listener
+	conns        []net.Conn
+}
+
+func (p *flakyProxy) Up() error {
+	ln, err := net.Listen("tcp", p.Addr)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	p.ln = ln
+	p.mu.Unlock()
+
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s, err := net.Dial("tcp", p.Target)
+			if err != nil {
+				c.Close()
+				continue
+			}
+			p.mu.Lock()
+			p.conns = append(p.conns, c, s)
+			p.mu.Unlock()
+			go func() { io.Copy(s, c); s.Close() }()
+			go func() { io.Copy(c, s); c.Close() }()
+		}
+	}()
+	return nil
+}
+
+func (p *flakyProxy) Down() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.ln != nil {
+		p.ln.Close()
+	}
+	for _, c := range p.conns {
+		c.Close()
+	}
+	p.conns = nil
+}
+
+// TestWorkerReconnect checks that a worker survives losing its connection
+// to the server - both while polling and while running a job - without the
+// job being requeued.
+func TestWorkerReconnect(t *testing.T) {
+	const testaddr = "127.0.0.1:45708"
+	const proxyaddr = "127.0.0.1:45709"
+	beatInterval = 500 * time.Millisecond
+	beatLimit = 4 * beatInterval
+	beatCheckFreq = beatInterval / 2
+
+	db, _ := NewDB("", dblimit)
+	s := NewServer(testaddr, testaddr, db)
+	nolog(s)
+	go s.ListenAndServe()
+	defer s.Close()
+
+	// the server is unreachable when the worker starts
+	p := &flakyProxy{Addr: proxyaddr, Target: testaddr}
+	w := &Worker{ServerAddr: proxyaddr, Wait: 100 * time.Millisecond, MaxWait: 400 * time.Millisecond, MaxIdle: 10 * time.Second, nolog: true}
+	go w.Run()
+	defer p.Down()
+
+	<-time.After(500 * time.Millisecond)
+	if err := p.Up(); err != nil {
+		t.Fatal(err)
+	}
+
+	j := NewJobCmd("sleep", "4")
+	result := s.Start(j, nil)
+
+	// drop the connection mid-run for less than the beat limit
+	<-time.After(time.Second)
+	if st, err := s.Get(j.Id); err != nil || st.Status != StatusRunning {
+		t.Fatalf("job not running before connection drop: %v", err)
+	}
+	p.Down()
+	<-time.After(time.Second)
+	if err := p.Up(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case got := <-result:
+		if got.Status != StatusComplete {
+			t.Errorf("job finished with status %v, want %v:\n%v", got.Status, StatusComplete, got.Stderr)
+		}
+		if got.Attempts != 1 {
+			t.Errorf("job ran %v times, want 1", got.Attempts)
+		}
+		if n := s.Stats.NRequeued; n != 0 {
+			t.Errorf("job was requeued %v times during the connection drop, want 0", n)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("worker failed to complete job after reconnecting")
+	}
+}
@@ -73,17 +73,58 @@ func serve(cmd string, args []string) {
 	rpcaddr := fs.String("rpc", "", "server rpc address (ip:port) for workers")
 	dbpath := fs.String("db", "./jobdb", "path to persistent, leveldb job database")
 	dblimit := fs.Int("dblimit", 8000, "max job db size in MB for disk persistence")
+	dbcompress := fs.Bool("dbcompress", true, "gzip compress large jobs (e.g. with big input/output files) in the job db")
+	nlocal := fs.Int("local", 0, "number of in-process workers to run jobs with")
+	archive := fs.String("archive", "", "directory to save jobs purged from the job db to (default is to discard them)")
+	maxjob := fs.Int("maxjobsize", cloudlus.DefaultMaxJobSize/cloudlus.MB, "max size in MB of submitted jobs")
+	maxrun := fs.Int("maxrunning", 0, "max number of jobs running at once (default is unlimited)")
+	rate := fs.Float64("submitrate", 0, "max jobs per second each client may submit (default is unlimited)")
+	burst := fs.Int("submitburst", 10, "number of jobs a client may submit in a burst when -submitrate is set")
+	loglevel := fs.String("loglevel", "info", "minimum severity of logged messages (info, warn, or error)")
+	checkpoint := fs.String("checkpoint", "", "file to periodically save queued and running jobs to and restore them from on startup")
+	cpfreq := fs.Duration("checkpointfreq", time.Minute, "interval between -checkpoint saves")
+	outdir := fs.String("outfiles", "", "directory to store job output files in (default is the working directory)")
+	s3url := fs.String("s3", "", "S3-compatible endpoint url to store job output files with instead of -outfiles (credentials are taken from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY)")
+	s3bucket := fs.String("s3bucket", "cloudlus", "bucket for job output files stored with -s3")
+	s3prefix := fs.String("s3prefix", "", "prefix for the names of job output files stored with -s3")
+	s3region := fs.String("s3region", "us-east-1", "region of the -s3 endpoint")
+	resultttl := fs.Duration("resultttl", 0, "delete job output files older than this - keeping the jobs themselves (default is to keep them until the job is purged)")
 	fs.Parse(args)
 
+	lvl, err := cloudlus.ParseLogLevel(*loglevel)
+	fatalif(err)
+
 	if *rpcaddr == "" {
 		*rpcaddr = *addr
 	}
 
 	db, err := cloudlus.NewDB(*dbpath, *dblimit*cloudlus.MB)
 	fatalif(err)
+	db.Compress = *dbcompress
 
 	s := cloudlus.NewServer(*addr, *rpcaddr, db)
 	s.Host = fulladdr(*host)
+	s.LocalWorkers = *nlocal
+	s.ArchiveDir = *archive
+	s.CheckpointFile = *checkpoint
+	s.CheckpointFreq = *cpfreq
+	s.Outfiles = cloudlus.DirStore{Dir: *outdir}
+	if *s3url != "" {
+		s.Outfiles = &cloudlus.S3Store{
+			Endpoint:  *s3url,
+			Bucket:    *s3bucket,
+			Prefix:    *s3prefix,
+			Region:    *s3region,
+			AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		}
+	}
+	s.ResultTTL = *resultttl
+	s.LogLevel = lvl
+	s.MaxJobSize = int64(*maxjob) * cloudlus.MB
+	s.SubmitRate = *rate
+	s.MaxConcurrent = *maxrun
+	s.SubmitBurst = *burst
 	fmt.Printf("Listening on %v\n", *addr)
 
 	sigs := make(chan os.Signal, 1)
@@ -105,9 +146,12 @@ func serve(cmd string, args []string) {
 func work(cmd string, args []string) {
 	fs := newFlagSet(cmd, "", "run a worker polling for jobs and workers")
 	wait := fs.Duration("interval", 20*time.Second, "time interval between work polls when idle")
+	maxwait := fs.Duration("maxinterval", 0, "maximum interval between polls when backing off from an idle or unreachable server (default 8*interval)")
 	maxidle := fs.Duration("maxidle", 0*time.Minute, "idle time at which the worker shuts down (default is infinite)")
 	timeout := fs.Duration("timeout", 0, "maximum run time for jobs before force killed - default is to use each job's custom timeout")
 	whitelist := fs.String("whitelist", "", "comma-separated list of allowed commands for jobs (default allows all commands)")
+	class := fs.String("class", "", "worker class for running jobs that require it (e.g. highmem)")
+	maxoutput := fs.Int64("maxoutput", 0, "maximum total size in bytes of a job's output files - jobs exceeding it fail (default is unlimited)")
 	fs.Parse(args)
 
 	wl := strings.Split(*whitelist, ",")
@@ -120,11 +164,14 @@ func work(cmd string, args []string) {
 	}
 
 	w := &cloudlus.Worker{
-		ServerAddr: *addr,
-		Wait:       *wait,
-		Whitelist:  cmds,
-		MaxIdle:    *maxidle,
-		JobTimeout: *timeout,
+		ServerAddr:    *addr,
+		Wait:          *wait,
+		MaxWait:       *maxwait,
+		Whitelist:     cmds,
+		MaxIdle:       *maxidle,
+		JobTimeout:    *timeout,
+		Class:         *class,
+		MaxOutputSize: *maxoutput,
 	}
 	w.Run()
 }
@@ -291,37 +338,37 @@ func unpack(cmd string, args []string) {
 }
 
 func pack(cmd string, args []string) {
-	fs := newFlagSet(cmd, "", "pack all files in the working directory into a job submit file")
+	fs := newFlagSet(cmd, "", "pack all files in (and below) the working directory into a job submit file")
 	fname := fs.String("o", "", "send pack data to file instead of stdout")
 	fs.Parse(args)
 
-	d, err := os.Open(".")
-	fatalif(err)
-	defer d.Close()
-
-	files, err := d.Readdir(-1)
-	fatalif(err)
 	j := cloudlus.NewJob()
-	for _, info := range files {
-		if info.IsDir() {
-			continue
+	err := filepath.Walk(".", func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
 		}
-		data, err := ioutil.ReadFile(info.Name())
-		fatalif(err)
-		if info.Name() == "cmd.txt" {
-			err := json.Unmarshal(data, &j.Cmd)
-			fatalif(err)
-		} else if info.Name() == "want.txt" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if path == "cmd.txt" {
+			return json.Unmarshal(data, &j.Cmd)
+		} else if path == "want.txt" {
 			list := []string{}
-			err := json.Unmarshal(data, &list)
-			fatalif(err)
+			if err := json.Unmarshal(data, &list); err != nil {
+				return err
+			}
 			for _, name := range list {
 				j.AddOutfile(name)
 			}
 		} else {
-			j.AddInfile(info.Name(), data)
+			// subdirectories are recreated in the job's run directory
+			j.AddInfile(filepath.ToSlash(path), data)
 		}
-	}
+		return nil
+	})
+	fatalif(err)
+
 	data, err := json.Marshal(j)
 	fatalif(err)
 
@@ -15,7 +15,6 @@ import (
 
 	"github.com/rwcarlsen/cloudlus/runscen"
 	"github.com/rwcarlsen/cloudlus/scen"
-	"github.com/rwcarlsen/cyan/post"
 	_ "github.com/rwcarlsen/go-sqlite3"
 )
 
@@ -29,6 +28,11 @@ var (
 	gen       = flag.Bool("gen", false, "true to just print out job file without submitting")
 	quiet     = flag.Bool("q", false, "don't print job stdout+stderr")
 	obj       = flag.String("obj", "", "(internal) if non-empty, run scenario and store objective in `FILE`")
+	infile    = flag.String("infile", "", "write the generated cyclus input file to `FILE` without running it")
+	checkscen = flag.Bool("check", false, "report all problems with the scenario file (and prototype mismatches with its cyclus template and infeasible build periods) and exit")
+	workdir   = flag.String("workdir", "", "write local runs' cyclus input and output files to `DIR`")
+	keep      = flag.Bool("keep", false, "keep local runs' cyclus input and output files")
+	diff      = flag.String("diff", "", "print the differences between the scenario file and `FILE` and exit")
 )
 
 var objfile = "cloudlus-cycobj.dat"
@@ -39,8 +43,26 @@ func main() {
 
 	scn := &scen.Scenario{}
 	err := scn.Load(*scenfile)
+	if *checkscen {
+		checkScen(scn, err)
+		return
+	}
 	check(err)
 
+	if *diff != "" {
+		other := &scen.Scenario{}
+		check(other.Load(*diff))
+		diffs, err := scn.Diff(other)
+		check(err)
+		for _, d := range diffs {
+			fmt.Println(d)
+		}
+		if len(diffs) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
 	if len(scn.Builds) == 0 && *db == "" {
 		parseSchedVars(scn)
 	} else {
@@ -48,6 +70,7 @@ func main() {
 	}
 
 	if *stats {
+		fmt.Println(scn.Summary())
 		scn.PrintStats()
 	} else if *transform && !*sched {
 		tw := tabwriter.NewWriter(os.Stdout, 4, 4, 1, ' ', 0)
@@ -63,6 +86,9 @@ func main() {
 		for _, val := range vars {
 			fmt.Printf("%v\n", val)
 		}
+	} else if *infile != "" {
+		err := scn.WriteInfile(*infile)
+		check(err)
 	} else if *gen {
 		j, err := runscen.BuildRemoteJob(scn, objfile)
 		check(err)
@@ -70,10 +96,13 @@ func main() {
 		check(err)
 		fmt.Printf("%s\n", data)
 	} else if *db != "" {
-		dbh, err := sql.Open("sqlite3", *db)
+		driver, err := scn.PostDriver()
+		check(err)
+		dbh, err := sql.Open(driver, *db)
 		check(err)
 		defer dbh.Close()
-		simids, err := post.Process(dbh)
+		simids, err := scn.PostProcess(dbh)
+		check(err)
 		val, err := scn.CalcObjective(*db, simids[0])
 		check(err)
 		fmt.Println(val)
@@ -88,6 +117,43 @@ func main() {
 	}
 }
 
+// checkScen prints every problem with the loaded scenario (loadErr is the
+// error from loading it) and exits with non-zero status if there are any.
+func checkScen(scn *scen.Scenario, loadErr error) {
+	probs := scn.Problems()
+	if len(probs) == 0 && loadErr != nil {
+		// e.g. a syntax error rather than an invalid configuration
+		probs = append(probs, loadErr)
+	}
+	if scn.CyclusTmpl != "" {
+		// mismatches are only warnings - the scan of the template is
+		// best-effort - but a template that can't be read is a problem (one
+		// Problems usually reports already while parsing it)
+		warnings, err := scn.CheckTmplPrototypes()
+		if err != nil && len(probs) == 0 {
+			probs = append(probs, err)
+		}
+		for _, w := range warnings {
+			fmt.Printf("%v: warning: %v\n", *scenfile, w)
+		}
+	}
+	for _, p := range probs {
+		fmt.Printf("%v: %v\n", *scenfile, p)
+	}
+	if len(probs) == 0 {
+		// infeasible periods are only warnings - TransformVars still
+		// produces a (constraint violating) deployment schedule for them
+		r, err := scn.FeasibilityReport()
+		check(err)
+		for _, p := range r.Infeasible {
+			fmt.Printf("%v: warning: %v\n", *scenfile, p)
+		}
+	}
+	if len(probs) > 0 {
+		os.Exit(1)
+	}
+}
+
 func check(err error) {
 	if err != nil {
 		log.Fatal(err)
@@ -168,7 +234,8 @@ func runjob(scen *scen.Scenario, addr string) float64 {
 	}
 
 	if addr == "" {
-		val, err := runscen.Local(scen, stdout, stderr)
+		runner := &runscen.Runner{WorkDir: *workdir, KeepFiles: *keep}
+		val, err := runner.Local(scen, stdout, stderr)
 		check(err)
 		return val
 	} else {
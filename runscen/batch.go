@@ -0,0 +1,85 @@
+package runscen
+
+import (
+	"context"
+	"math"
+	"runtime"
+	"sync"
+
+	"github.com/rwcarlsen/cloudlus/scen"
+)
+
+// evalFunc computes the objective for a scenario with its builds already set.
+type evalFunc func(ctx context.Context, s *scen.Scenario) (float64, error)
+
+// EvaluateBatch runs scenario s locally with the default (zero) Runner (see
+// Runner.EvaluateBatch).
+func EvaluateBatch(ctx context.Context, s *scen.Scenario, vars [][]float64, parallelism int) ([]float64, []error) {
+	return (&Runner{}).EvaluateBatch(ctx, s, vars, parallelism)
+}
+
+// EvaluateBatch runs scenario s locally (see LocalContext) once for each
+// variable vector in vars with at most parallelism simulations running
+// concurrently.  If parallelism is not positive, the number of CPUs is used.
+// Each simulation runs on its own clone of s, so s itself is not modified.
+// The returned objective values and errors are aligned with vars.  A failed
+// simulation doesn't affect the others in the batch - its objective value is
+// +Inf and its error is non-nil.  If ctx is canceled, running simulations are
+// killed and all unfinished vectors get ctx.Err() as their error.
+//
+// If FailFast is set, the first failure cancels the rest of the batch as if
+// ctx were canceled: running simulations are killed, no more are started,
+// and EvaluateBatch returns as soon as the killed ones exit.  The failed
+// vector keeps its own error.  Every unfinished vector has objective value
+// +Inf and error context.Canceled.  Vectors that completed before the
+// failure keep their results.
+func (r *Runner) EvaluateBatch(ctx context.Context, s *scen.Scenario, vars [][]float64, parallelism int) ([]float64, []error) {
+	return evaluateBatch(ctx, s, vars, parallelism, r.FailFast, r.RunAndScore)
+}
+
+func evaluateBatch(ctx context.Context, s *scen.Scenario, vars [][]float64, parallelism int, failfast bool, eval evalFunc) ([]float64, []error) {
+	if parallelism <= 0 {
+		parallelism = runtime.NumCPU()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	objs := make([]float64, len(vars))
+	errs := make([]error, len(vars))
+	for i := range objs {
+		objs[i] = math.Inf(1)
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, parallelism)
+	for i, v := range vars {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		// a slot may free up at the same time the batch is canceled
+		if err := ctx.Err(); err != nil {
+			for ; i < len(vars); i++ {
+				errs[i] = err
+			}
+			wg.Wait()
+			return objs, errs
+		}
+
+		wg.Add(1)
+		go func(i int, v []float64) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			clone := s.Clone()
+			if _, errs[i] = clone.TransformVars(v); errs[i] == nil {
+				objs[i], errs[i] = eval(ctx, clone)
+			}
+			if errs[i] != nil && failfast {
+				cancel()
+			}
+		}(i, v)
+	}
+	wg.Wait()
+	return objs, errs
+}
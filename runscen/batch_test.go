@@ -0,0 +1,164 @@
+package runscen
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rwcarlsen/cloudlus/scen"
+)
+
+func testScen() *scen.Scenario {
+	s := &scen.Scenario{
+		SimDur:      10,
+		BuildPeriod: 5,
+		MinPower:    []float64{0, 0},
+		MaxPower:    []float64{20, 20},
+		Facs: []scen.Facility{
+			{Proto: "lwr", Cap: 1, Life: 20},
+		},
+	}
+	if err := s.Validate(); err != nil {
+		panic(err)
+	}
+	return s
+}
+
+func totalBuilt(s *scen.Scenario) float64 {
+	n := 0
+	for _, b := range s.Builds {
+		n += b.N
+	}
+	return float64(n)
+}
+
+func TestEvaluateBatch(t *testing.T) {
+	s := testScen()
+	vars := [][]float64{
+		{0.1, 0.2},
+		{0.3, 0.5},
+		{0.1}, // wrong number of vars
+		{0.6, 0.8},
+		{0.9, 1},
+	}
+
+	want := make([]float64, len(vars))
+	for i, v := range vars {
+		want[i] = math.Inf(1)
+		clone := s.Clone()
+		if _, err := clone.TransformVars(v); err == nil {
+			want[i] = totalBuilt(clone)
+		}
+	}
+
+	const parallelism = 2
+	var mu sync.Mutex
+	running, maxrunning := 0, 0
+	eval := func(ctx context.Context, s *scen.Scenario) (float64, error) {
+		mu.Lock()
+		running++
+		if running > maxrunning {
+			maxrunning = running
+		}
+		mu.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return totalBuilt(s), nil
+	}
+
+	objs, errs := evaluateBatch(context.Background(), s, vars, parallelism, false, eval)
+	for i := range vars {
+		if objs[i] != want[i] {
+			t.Errorf("vars %v: got objective %v, want %v", vars[i], objs[i], want[i])
+		}
+		if wanterr := i == 2; (errs[i] != nil) != wanterr {
+			t.Errorf("vars %v: got error %v, want error: %v", vars[i], errs[i], wanterr)
+		}
+	}
+
+	if maxrunning > parallelism {
+		t.Errorf("%v simulations ran concurrently, want at most %v", maxrunning, parallelism)
+	}
+	if s.Builds != nil {
+		t.Errorf("original scenario was modified: Builds = %v", s.Builds)
+	}
+}
+
+func TestEvaluateBatchCancel(t *testing.T) {
+	s := testScen()
+	vars := [][]float64{{1, 2}, {3, 4}, {5, 6}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	eval := func(ctx context.Context, s *scen.Scenario) (float64, error) {
+		cancel()
+		<-ctx.Done()
+		return math.Inf(1), ctx.Err()
+	}
+
+	objs, errs := evaluateBatch(ctx, s, vars, 1, false, eval)
+	for i := range vars {
+		if errs[i] != context.Canceled {
+			t.Errorf("vars %v: got error %v, want %v", vars[i], errs[i], context.Canceled)
+		}
+		if !math.IsInf(objs[i], 1) {
+			t.Errorf("vars %v: got objective %v, want +Inf", vars[i], objs[i])
+		}
+	}
+}
+
+func TestEvaluateBatchFailFast(t *testing.T) {
+	s := testScen()
+	vars := [][]float64{{0.1, 0.2}, {0.3, 0.5}, {0.6, 0.8}, {0.9, 1}, {0.2, 0.4}}
+
+	failed := errors.New("simulation failed")
+	var mu sync.Mutex
+	started := 0
+	eval := func(ctx context.Context, s *scen.Scenario) (float64, error) {
+		mu.Lock()
+		started++
+		n := started
+		mu.Unlock()
+
+		if n == 1 {
+			return math.Inf(1), failed
+		}
+		// a long simulation that is killed when the batch is canceled
+		select {
+		case <-ctx.Done():
+			return math.Inf(1), ctx.Err()
+		case <-time.After(10 * time.Second):
+			return totalBuilt(s), nil
+		}
+	}
+
+	start := time.Now()
+	objs, errs := evaluateBatch(context.Background(), s, vars, 2, true, eval)
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("batch took %v to abort after a failure", d)
+	}
+	if started > 2 {
+		t.Errorf("%v simulations started after the first failure, want at most 1 more", started-1)
+	}
+
+	nfailed := 0
+	for i := range vars {
+		if !math.IsInf(objs[i], 1) {
+			t.Errorf("vars %v: got objective %v, want +Inf", vars[i], objs[i])
+		}
+		if errs[i] == failed {
+			nfailed++
+		} else if errs[i] != context.Canceled {
+			t.Errorf("vars %v: got error %v, want %v", vars[i], errs[i], context.Canceled)
+		}
+	}
+	if nfailed != 1 {
+		t.Errorf("got %v vectors with the simulation failure, want 1", nfailed)
+	}
+}
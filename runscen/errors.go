@@ -0,0 +1,52 @@
+package runscen
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrCyclusNotFound is returned by local runs if the cyclus executable isn't
+// in the PATH.  Unlike other run errors, it means no scenario can be run at
+// all (e.g. an optimizer should abort its campaign).
+var ErrCyclusNotFound = errors.New("runscen: cyclus executable not found in PATH")
+
+// ErrCyclusRun is returned by local runs if cyclus ran but failed - e.g. it
+// rejected the generated input file or crashed.  This is specific to the
+// scenario being run (e.g. an optimizer can score it as invalid and
+// continue).
+type ErrCyclusRun struct {
+	// ExitCode is the exit status of cyclus or -1 if it was killed by a
+	// signal.
+	ExitCode int
+	// Stderr holds the end of the standard error cyclus wrote (up to
+	// maxStderr bytes).
+	Stderr string
+	// Err is the error returned from running the cyclus process.
+	Err error
+}
+
+func (e *ErrCyclusRun) Error() string {
+	msg := fmt.Sprintf("cyclus failed (exit code %v): %v", e.ExitCode, e.Err)
+	if stderr := strings.TrimSpace(e.Stderr); stderr != "" {
+		msg += "\n" + stderr
+	}
+	return msg
+}
+
+func (e *ErrCyclusRun) Unwrap() error { return e.Err }
+
+// ErrPostProcess is returned by local runs if cyclus succeeded but its
+// output database couldn't be post-processed or the objective couldn't be
+// computed from it.
+type ErrPostProcess struct {
+	Err error
+}
+
+func (e *ErrPostProcess) Error() string { return "post-processing failed: " + e.Err.Error() }
+
+func (e *ErrPostProcess) Unwrap() error { return e.Err }
+
+// maxStderr is the number of trailing bytes of cyclus' standard error kept
+// for ErrCyclusRun.
+const maxStderr = 4096
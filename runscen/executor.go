@@ -0,0 +1,90 @@
+package runscen
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os/exec"
+)
+
+// Executor runs single cyclus simulations for local runs (see Runner).
+// It allows the way cyclus is run to be swapped out - e.g. for a pool of warm
+// cyclus processes fed input files one after another.  Cyclus has no such
+// batch/server mode yet, so OneShot is currently the only implementation.
+type Executor interface {
+	// Exec runs the simulation r and returns once it is complete.  Failures
+	// should be reported as ErrCyclusNotFound or *ErrCyclusRun.  If ctx is
+	// canceled or expires first, the simulation must be stopped and
+	// ctx.Err() returned.
+	Exec(ctx context.Context, r *CyclusRun) error
+}
+
+// CyclusRun describes a single cyclus simulation run by an Executor.
+type CyclusRun struct {
+	// Infile is the path to the cyclus input file.
+	Infile string
+	// Outfile is the path the output database is written to.
+	Outfile string
+	// Dir is the working directory for the simulation.
+	Dir string
+	// Env is the environment for the simulation (in os.Environ form).
+	Env    []string
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// OneShot is an Executor that starts a new cyclus process for every
+// simulation.
+type OneShot struct {
+	// Cmd is the cyclus executable - "cyclus" (from the PATH) if empty.
+	Cmd string
+}
+
+func (o OneShot) Exec(ctx context.Context, r *CyclusRun) error {
+	name := o.Cmd
+	if name == "" {
+		name = "cyclus"
+	}
+
+	cmd := exec.CommandContext(ctx, name, r.Infile, "-o", r.Outfile)
+	cmd.Dir = r.Dir
+	cmd.Env = r.Env
+	cmd.Stdout = r.Stdout
+	tail := &tailWriter{max: maxStderr}
+	cmd.Stderr = tail
+	if r.Stderr != nil {
+		cmd.Stderr = io.MultiWriter(r.Stderr, tail)
+	}
+
+	err := cmd.Run()
+	if err == nil {
+		return nil
+	} else if ctx.Err() != nil {
+		return ctx.Err()
+	} else if errors.Is(err, exec.ErrNotFound) {
+		return ErrCyclusNotFound
+	}
+
+	code := -1
+	var exiterr *exec.ExitError
+	if errors.As(err, &exiterr) {
+		code = exiterr.ExitCode()
+	}
+	return &ErrCyclusRun{ExitCode: code, Stderr: tail.String(), Err: err}
+}
+
+// tailWriter keeps the last max bytes written to it.
+type tailWriter struct {
+	max int
+	buf []byte
+}
+
+func (w *tailWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	if len(w.buf) > w.max {
+		w.buf = append(w.buf[:0], w.buf[len(w.buf)-w.max:]...)
+	}
+	return len(p), nil
+}
+
+func (w *tailWriter) String() string { return string(w.buf) }
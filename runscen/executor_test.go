@@ -0,0 +1,167 @@
+package runscen
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rwcarlsen/cloudlus/scen"
+	_ "github.com/rwcarlsen/go-sqlite3"
+)
+
+func TestOneShot(t *testing.T) {
+	r := &CyclusRun{Infile: "in.xml", Outfile: "out.sqlite"}
+	if err := (OneShot{Cmd: "true"}).Exec(context.Background(), r); err != nil {
+		t.Errorf("successful run: got error %v", err)
+	}
+
+	var runerr *ErrCyclusRun
+	if err := (OneShot{Cmd: "false"}).Exec(context.Background(), r); !errors.As(err, &runerr) || runerr.ExitCode != 1 {
+		t.Errorf("failed run: got error %v, want *ErrCyclusRun with exit code 1", err)
+	}
+
+	// stderr is still captured with no Stderr writer (e.g. cycobj -q)
+	dir, err := ioutil.TempDir("", "cloudlus-runscen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	script := filepath.Join(dir, "cyclus")
+	if err := ioutil.WriteFile(script, []byte("#!/bin/sh\necho 'bad spec' >&2; exit 2\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := (OneShot{Cmd: script}).Exec(context.Background(), r); !errors.As(err, &runerr) || !strings.Contains(runerr.Stderr, "bad spec") {
+		t.Errorf("failed run without Stderr: got error %v, want *ErrCyclusRun with stderr", err)
+	}
+
+	if err := (OneShot{Cmd: "cloudlus-no-such-cyclus"}).Exec(context.Background(), r); err != ErrCyclusNotFound {
+		t.Errorf("missing executable: got error %v, want %v", err, ErrCyclusNotFound)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := (OneShot{Cmd: "sleep"}).Exec(ctx, &CyclusRun{Infile: "10"}); err != context.Canceled {
+		t.Errorf("canceled run: got error %v, want %v", err, context.Canceled)
+	}
+}
+
+// fakeExecutor is an Executor that stands in for cyclus by recording the
+// input file it is given and writing the output database with the stmts.
+type fakeExecutor struct {
+	stmts  []string
+	infile []byte
+}
+
+func (f *fakeExecutor) Exec(ctx context.Context, r *CyclusRun) error {
+	data, err := ioutil.ReadFile(r.Infile)
+	if err != nil {
+		return err
+	}
+	f.infile = data
+
+	db, err := sql.Open("sqlite3", r.Outfile)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	for _, stmt := range f.stmts {
+		if _, err := db.Exec(stmt); err != nil {
+			return &ErrCyclusRun{ExitCode: 1, Err: err}
+		}
+	}
+	return nil
+}
+
+func TestLocalFakeExecutor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudlus-runscen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tmpl := `<simulation>{{range .Builds}}<build>{{.Proto}} {{.N}}</build>{{end}}</simulation>`
+	if err := ioutil.WriteFile(filepath.Join(dir, "tmpl.xml"), []byte(tmpl), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// slow_reactor generates 3 of the 4 units of energy
+	fake := &fakeExecutor{stmts: []string{
+		"CREATE TABLE Info (SimId BLOB, Duration INTEGER);",
+		"CREATE TABLE AgentEntry (SimId BLOB, AgentId INTEGER, Kind TEXT, Spec TEXT, Prototype TEXT, ParentId INTEGER, Lifetime INTEGER, EnterTime INTEGER);",
+		"CREATE TABLE TimeSeriesPower (SimId BLOB, AgentId INTEGER, Time INTEGER, Value REAL);",
+		"INSERT INTO Info VALUES (X'01', 10);",
+		"INSERT INTO AgentEntry VALUES (X'01',1,'Facility',':a:b','slow_reactor',0,-1,0),(X'01',2,'Facility',':a:b','fast_reactor',0,-1,0);",
+		"INSERT INTO TimeSeriesPower VALUES (X'01',1,0,1),(X'01',1,1,1),(X'01',1,2,1),(X'01',2,0,1);",
+	}}
+	r := &Runner{WorkDir: dir, Executor: fake}
+
+	s := &scen.Scenario{
+		SimDur:      10,
+		BuildPeriod: 5,
+		MinPower:    []float64{0, 0},
+		MaxPower:    []float64{10, 10},
+		Facs: []scen.Facility{
+			{Proto: "slow_reactor", Cap: 1, Life: 20},
+			{Proto: "fast_reactor", Cap: 1, Life: 20},
+		},
+		PostMetrics: []string{scen.PostAgents},
+		CyclusTmpl:  "tmpl.xml",
+		File:        filepath.Join(dir, "scenario.json"),
+	}
+	if err := s.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	vars := make([]float64, s.NVars())
+	for i := range vars {
+		vars[i] = 0.5
+	}
+	if _, err := s.TransformVars(vars); err != nil {
+		t.Fatal(err)
+	}
+
+	obj, err := r.RunAndScore(context.Background(), s)
+	if err != nil {
+		t.Fatal(err)
+	} else if math.Abs(obj-0.75) > 1e-9 {
+		t.Errorf("got objective %v, want 0.75", obj)
+	}
+
+	want, err := s.GenCyclusInfile()
+	if err != nil {
+		t.Fatal(err)
+	} else if string(fake.infile) != string(want) {
+		t.Errorf("executor got input file %q, want %q", fake.infile, want)
+	} else if !strings.Contains(string(want), "<build>slow_reactor") {
+		t.Errorf("input file %q has no slow_reactor builds", want)
+	}
+
+	// the input file and output database are cleaned up
+	if files, _ := filepath.Glob(filepath.Join(dir, "*.sqlite")); len(files) > 0 {
+		t.Errorf("output databases were not removed: %v", files)
+	}
+}
+
+// BenchmarkOneShot measures the per-simulation overhead of starting a new
+// process with a no-op stand-in for cyclus.  It is the baseline any pooled
+// Executor would need to improve on.
+func BenchmarkOneShot(b *testing.B) {
+	dir, err := ioutil.TempDir("", "cloudlus-runscen")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := &CyclusRun{Infile: filepath.Join(dir, "in.xml"), Outfile: filepath.Join(dir, "out.sqlite"), Dir: dir}
+	ex := OneShot{Cmd: "true"}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := ex.Exec(context.Background(), r); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
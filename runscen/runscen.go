@@ -1,7 +1,9 @@
 package runscen
 
 import (
+	"context"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -10,7 +12,7 @@ import (
 	"io/ioutil"
 	"math"
 	"os"
-	"os/exec"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -18,13 +20,70 @@ import (
 	"code.google.com/p/go-uuid/uuid"
 	"github.com/rwcarlsen/cloudlus/cloudlus"
 	"github.com/rwcarlsen/cloudlus/scen"
-	"github.com/rwcarlsen/cyan/post"
 )
 
 var objfile = "runsim-obj.dat"
 
 const DefaultTimeout = 2 * time.Hour
 
+// Runner holds the options for running scenarios on the local machine (see
+// Runner.LocalContext).  Its zero value runs cyclus from the PATH (see
+// OneShot) in the current working directory with randomly named files that
+// are removed after each run.  A Runner may be used by multiple goroutines
+// at once as long as its fields aren't changed.
+type Runner struct {
+	// WorkDir is the directory local runs write their generated cyclus input
+	// file and output database to.  It is created if it doesn't exist.  The
+	// current working directory is used if it is empty.
+	WorkDir string
+	// HashNames makes local runs name their generated cyclus input file and
+	// output database after the scenario's hash (see scen.Scenario.Hash)
+	// rather than a random UUID.  Identical scenarios then produce
+	// identically named artifacts which allows them to be kept (see
+	// KeepFiles) and deduplicated/cached by file name.  Concurrent runs of
+	// identical scenarios in the same WorkDir clobber each other's files.
+	HashNames bool
+	// KeepFiles makes local runs leave their generated cyclus input file and
+	// output database in WorkDir rather than removing them after computing
+	// the objective (e.g. for debugging or further analysis).
+	KeepFiles bool
+	// Executor runs the simulations of local runs - OneShot{} if nil.
+	Executor Executor
+	// FailFast makes EvaluateBatch stop at the first failed simulation
+	// instead of running the whole batch (e.g. for CI checks where any
+	// failure is fatal).
+	FailFast bool
+}
+
+// artifactPaths returns the absolute paths of the cyclus input file and
+// output database for a local run of s (see WorkDir).  The output
+// database's extension selects the scenario's cyclus output format.
+func (r *Runner) artifactPaths(s *scen.Scenario) (infile, dbfile string, err error) {
+	dir, err := filepath.Abs(r.WorkDir)
+	if err != nil {
+		return "", "", err
+	}
+	base, err := r.artifactBase(s)
+	if err != nil {
+		return "", "", err
+	}
+	base = filepath.Join(dir, base)
+	return base + ".cyclus.xml", base + s.CyclusOutExt(), nil
+}
+
+// artifactBase returns the base name (without extension) for the files
+// generated for a local run of s.
+func (r *Runner) artifactBase(s *scen.Scenario) (string, error) {
+	if r.HashNames {
+		h, err := s.Hash(nil)
+		if err != nil {
+			return "", err
+		}
+		return hex.EncodeToString(h[:16]), nil
+	}
+	return uuid.NewRandom().String(), nil
+}
+
 // RemoteTimeout is the same as Remote, but with a custom timeout rather than
 // the default.
 func RemoteTimeout(s *scen.Scenario, stdout, stderr io.Writer, addr string, timeout time.Duration) (float64, error) {
@@ -83,16 +142,74 @@ func Remote(s *scen.Scenario, stdout, stderr io.Writer, addr string) (float64, e
 	return RemoteTimeout(s, stdout, stderr, addr, DefaultTimeout)
 }
 
-// Local runs scenario scn on the local machine connecting the simulation's
-// standard out and error to stdout and stderr respectively.  The file names
-// of the generated cyclus input file and database are returned along with the
-// objective value.
+// Local runs scenario scn on the local machine with the default (zero)
+// Runner (see Runner.Local).
 func Local(scn *scen.Scenario, stdout, stderr io.Writer) (obj float64, err error) {
+	return (&Runner{}).Local(scn, stdout, stderr)
+}
+
+// LocalContext runs scenario scn on the local machine with the default
+// (zero) Runner (see Runner.LocalContext).
+func LocalContext(ctx context.Context, scn *scen.Scenario, stdout, stderr io.Writer) (obj float64, err error) {
+	return (&Runner{}).LocalContext(ctx, scn, stdout, stderr)
+}
+
+// RunAndScore runs scenario scn on the local machine with the default
+// (zero) Runner (see Runner.RunAndScore).
+func RunAndScore(ctx context.Context, scn *scen.Scenario) (float64, error) {
+	return (&Runner{}).RunAndScore(ctx, scn)
+}
+
+// Local runs scenario scn on the local machine connecting the simulation's
+// standard out and error to stdout and stderr respectively.  Cyclus is run
+// with the scenario's environment (see scen.Scenario.Environ).  The
+// objective value is returned.
+func (r *Runner) Local(scn *scen.Scenario, stdout, stderr io.Writer) (obj float64, err error) {
+	return r.LocalContext(context.Background(), scn, stdout, stderr)
+}
+
+// RunAndScore runs scenario scn on the local machine and returns its
+// objective value - generating the cyclus input file, running cyclus,
+// post-processing its output, and computing the objective.  It is the same as
+// LocalContext with the simulation output discarded.
+func (r *Runner) RunAndScore(ctx context.Context, scn *scen.Scenario) (float64, error) {
+	return r.LocalContext(ctx, scn, ioutil.Discard, ioutil.Discard)
+}
+
+// LocalContext is the same as Local except that the cyclus process(es) are
+// killed if ctx is canceled or its deadline expires before the simulation
+// completes.  In this case, ctx.Err() is returned (rather than the error
+// from the killed cyclus process) so callers can distinguish cancellation
+// from a failed simulation.  The generated cyclus input file and output
+// database are written to WorkDir and removed in all cases unless KeepFiles
+// is set.  Cyclus is run by the Runner's Executor.  Failures to run cyclus
+// are reported as ErrCyclusNotFound or *ErrCyclusRun and failures to
+// post-process its output as *ErrPostProcess (see errors.As).
+func (r *Runner) LocalContext(ctx context.Context, scn *scen.Scenario, stdout, stderr io.Writer) (obj float64, err error) {
+	ex := r.Executor
+	if ex == nil {
+		ex = OneShot{}
+	}
+
 	execfn := func(s *scen.Scenario) (float64, error) {
-		// generate cyclus input file and run cyclus
-		ui := uuid.NewRandom()
-		infile := ui.String() + ".cyclus.xml"
-		dbfile := ui.String() + ".sqlite"
+		if err := ctx.Err(); err != nil {
+			return math.Inf(1), err
+		}
+
+		// fail before generating the input file and running a simulation
+		// we can't post-process
+		driver, err := s.PostDriver()
+		if err != nil {
+			return math.Inf(1), err
+		}
+
+		infile, dbfile, err := r.artifactPaths(s)
+		if err != nil {
+			return math.Inf(1), err
+		}
+		if err := os.MkdirAll(filepath.Dir(infile), 0755); err != nil {
+			return math.Inf(1), err
+		}
 
 		data, err := s.GenCyclusInfile()
 		if err != nil {
@@ -102,49 +219,85 @@ func Local(scn *scen.Scenario, stdout, stderr io.Writer) (obj float64, err error
 		if err != nil {
 			return math.Inf(1), err
 		}
+		if !r.KeepFiles {
+			defer os.Remove(infile)
+			defer os.Remove(dbfile)
+		}
 
-		cmd := exec.Command("cyclus", infile, "-o", dbfile)
-		cmd.Stdout = stdout
-		cmd.Stderr = stderr
-
-		if err := cmd.Run(); err != nil {
+		// run from the scenario directory so relative references to aux
+		// files in the input file resolve.
+		run := &CyclusRun{
+			Infile:  infile,
+			Outfile: dbfile,
+			Dir:     s.Dir(),
+			Env:     s.Environ(),
+			Stdout:  stdout,
+			Stderr:  stderr,
+		}
+		if err := ex.Exec(ctx, run); err != nil {
 			return math.Inf(1), err
 		}
-		defer os.Remove(dbfile)
 
 		// post process cyclus output db
-		db, err := sql.Open("sqlite3", dbfile)
+		db, err := sql.Open(driver, dbfile)
 		if err != nil {
-			return math.Inf(1), err
+			return math.Inf(1), &ErrPostProcess{Err: err}
 		}
 		defer db.Close()
 
-		simids, err := post.Process(db)
+		simids, err := s.PostProcess(db)
 		if err != nil {
-			return math.Inf(1), err
+			return math.Inf(1), &ErrPostProcess{Err: err}
 		}
 
-		return s.CalcObjective(dbfile, simids[0])
+		obj, err := s.CalcObjective(dbfile, simids[0])
+		if err != nil {
+			return obj, &ErrPostProcess{Err: err}
+		}
+		return obj, nil
 	}
 	return scn.CalcTotalObjective(execfn)
 }
 
+// BuildRemoteJob creates a job that runs scenario s with cycobj writing the
+// objective value to objfile.  The job carries the scenario, its cyclus
+// template and template partials, and its AuxFiles laid out in the job's
+// run directory the same way they are relative to the scenario file
+// locally.  The worker running the job records its cyclus version in the
+// job's CyclusVersion.
 func BuildRemoteJob(s *scen.Scenario, objfile string) (*cloudlus.Job, error) {
-	scendata, err := json.Marshal(s)
+	// NuclideCostFile has already been merged into NuclideCost and may not
+	// be available (or at the same path) remotely.
+	c := *s
+	c.NuclideCostFile = ""
+	scendata, err := json.Marshal(&c)
 	if err != nil {
 		return nil, err
 	}
 
-	tmpldata, err := ioutil.ReadFile(s.CyclusTmpl)
+	tmpldata, err := ioutil.ReadFile(s.CyclusTmplPath())
 	if err != nil {
 		return nil, err
 	}
 
-	j := cloudlus.NewJobCmd("cycobj", "-obj", objfile, "-scen", s.File)
+	scenfile := "scenario.json"
+	if s.File != "" {
+		scenfile = filepath.Base(s.File)
+	}
+	j := cloudlus.NewJobCmd("cycobj", "-obj", objfile, "-scen", scenfile)
 	j.Timeout = 2 * time.Hour
-	j.AddInfile(s.CyclusTmpl, tmpldata)
-	j.AddInfile(s.File, scendata)
+	j.AddInfile(filepath.ToSlash(s.CyclusTmpl), tmpldata)
+	j.AddInfile(scenfile, scendata)
+	for _, name := range append(s.TmplPartials(), s.AuxFiles...) {
+		data, err := ioutil.ReadFile(filepath.Join(s.Dir(), name))
+		if err != nil {
+			return nil, err
+		}
+		j.AddInfile(filepath.ToSlash(name), data)
+	}
 	j.AddOutfile(objfile)
+	j.ObjFile = objfile
+	j.RecordCyclusVersion = true
 
 	if flag.NArg() > 0 {
 		j.Note = strings.Join(flag.Args(), " ")
@@ -0,0 +1,197 @@
+package runscen
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/rwcarlsen/cloudlus/scen"
+)
+
+func TestBuildRemoteJob(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudlus-runscen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"tmpl.xml":         "<simulation/>",
+		"recipes/uox.xml":  "<recipe/>",
+		"regions/east.xml": "<region/>",
+		"models/lwr.xml":   "<facility/>",
+	}
+	for name, data := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := &scen.Scenario{
+		CyclusTmpl:   "tmpl.xml",
+		File:         filepath.Join(dir, "scenario.json"),
+		AuxFiles:     []string{"recipes/uox.xml", "regions/east.xml"},
+		TmplVariants: map[string][]string{"lwr": {"models/lwr.xml"}},
+		TmplVariant:  "lwr",
+	}
+	j, err := BuildRemoteJob(s, "obj.dat")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantcmd := []string{"cycobj", "-obj", "obj.dat", "-scen", "scenario.json"}
+	if !reflect.DeepEqual(j.Cmd, wantcmd) {
+		t.Errorf("got command %v, want %v", j.Cmd, wantcmd)
+	} else if !j.RecordCyclusVersion {
+		t.Errorf("scenario job doesn't record the cyclus version")
+	}
+
+	got := map[string]string{}
+	for _, f := range j.Infiles {
+		got[f.Name] = string(f.Data)
+	}
+	if _, ok := got["scenario.json"]; !ok {
+		t.Errorf("job is missing the scenario file: got infiles %v", got)
+	}
+	for name, data := range files {
+		if got[name] != data {
+			t.Errorf("infile %v: got %q, want %q", name, got[name], data)
+		}
+	}
+
+	s.AuxFiles = append(s.AuxFiles, "missing.xml")
+	if _, err := BuildRemoteJob(s, "obj.dat"); err == nil {
+		t.Errorf("job built with a missing aux file, want error")
+	}
+}
+
+func TestArtifactBase(t *testing.T) {
+	r := &Runner{}
+	s1, s2 := testScen(), testScen()
+	s1.TransformVars([]float64{0.5, 0.5})
+	s2.TransformVars([]float64{0.5, 0.5})
+	other := testScen()
+	other.TransformVars([]float64{0.9, 0.1})
+	basename := func(s *scen.Scenario) string {
+		base, err := r.artifactBase(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base
+	}
+
+	if basename(s1) == basename(s2) {
+		t.Errorf("identical scenarios got identical random basenames")
+	}
+
+	r.HashNames = true
+	b1, b2 := basename(s1), basename(s2)
+	if b1 != b2 {
+		t.Errorf("identical scenarios got different hashed basenames %v and %v", b1, b2)
+	}
+	if b1 != basename(s1) {
+		t.Errorf("hashed basename is not stable across calls")
+	}
+	if b1 == basename(other) {
+		t.Errorf("different scenarios got the same hashed basename %v", b1)
+	}
+}
+
+func TestArtifactPaths(t *testing.T) {
+	r := &Runner{}
+	s := testScen()
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	infile, dbfile, err := r.artifactPaths(s)
+	if err != nil {
+		t.Fatal(err)
+	} else if filepath.Dir(infile) != wd || filepath.Dir(dbfile) != wd {
+		t.Errorf("default artifacts %v and %v not in working dir %v", infile, dbfile, wd)
+	}
+
+	r.WorkDir = "runs"
+	infile, dbfile, err = r.artifactPaths(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := filepath.Join(wd, "runs")
+	if filepath.Dir(infile) != want || filepath.Dir(dbfile) != want {
+		t.Errorf("artifacts %v and %v not in WorkDir %v", infile, dbfile, want)
+	}
+	if !strings.HasSuffix(infile, ".cyclus.xml") || !strings.HasSuffix(dbfile, ".sqlite") {
+		t.Errorf("bad artifact names %v and %v", infile, dbfile)
+	}
+	if strings.TrimSuffix(infile, ".cyclus.xml") != strings.TrimSuffix(dbfile, ".sqlite") {
+		t.Errorf("artifacts %v and %v have different base names", infile, dbfile)
+	}
+
+	s.CyclusOutFormat = scen.OutHDF5
+	if _, dbfile, _ = r.artifactPaths(s); filepath.Ext(dbfile) != ".h5" {
+		t.Errorf("hdf5 output database %v doesn't have the .h5 extension", dbfile)
+	}
+}
+
+func TestLocalErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudlus-runscen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "tmpl.xml"), []byte("<simulation/>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(path string) { os.Setenv("PATH", path) }(os.Getenv("PATH"))
+	r := &Runner{WorkDir: dir}
+
+	// fakeCyclus installs a cyclus executable running the shell script body.
+	fakeCyclus := func(body string) {
+		script := "#!/bin/sh\n" + body + "\n"
+		if err := ioutil.WriteFile(filepath.Join(dir, "cyclus"), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	run := func() error {
+		s := testScen()
+		s.CyclusTmpl = "tmpl.xml"
+		s.File = filepath.Join(dir, "scenario.json")
+		s.TransformVars([]float64{0.5, 0.5})
+		_, err := r.RunAndScore(context.Background(), s)
+		return err
+	}
+
+	os.Setenv("PATH", filepath.Join(dir, "empty"))
+	if err := run(); !errors.Is(err, ErrCyclusNotFound) {
+		t.Errorf("missing cyclus: got error %v, want %v", err, ErrCyclusNotFound)
+	}
+
+	os.Setenv("PATH", dir)
+	fakeCyclus("echo 'error: bad archetype spec' >&2; exit 3")
+	err = run()
+	var runerr *ErrCyclusRun
+	if !errors.As(err, &runerr) {
+		t.Errorf("failed cyclus: got error %v, want *ErrCyclusRun", err)
+	} else if runerr.ExitCode != 3 {
+		t.Errorf("failed cyclus: got exit code %v, want 3", runerr.ExitCode)
+	} else if !strings.Contains(runerr.Stderr, "bad archetype spec") || !strings.Contains(err.Error(), "bad archetype spec") {
+		t.Errorf("failed cyclus: stderr not captured in error %q", err)
+	}
+
+	fakeCyclus("echo 'not a database' > \"$3\"")
+	var posterr *ErrPostProcess
+	if err := run(); !errors.As(err, &posterr) {
+		t.Errorf("bad output db: got error %v, want *ErrPostProcess", err)
+	}
+}
@@ -0,0 +1,86 @@
+package scen
+
+import (
+	ziparch "archive/zip"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+)
+
+// Names of the files in a scenario bundle (see Bundle).
+const (
+	BundleManifest = "manifest.json"
+	BundleScenario = "scenario.json"
+	BundleVars     = "vars.json"
+	BundleInfile   = "cyclus.xml"
+)
+
+// Manifest describes a scenario bundle (see Bundle).
+type Manifest struct {
+	// Hash is the hex encoded Hash of the bundled scenario and vars.
+	Hash string
+	// CyclusVersion is the version of cyclus the scenario was run with -
+	// empty if unknown.
+	CyclusVersion string `json:",omitempty"`
+	// Objective is the objective value of the scenario run - nil if unknown.
+	Objective *float64 `json:",omitempty"`
+	// Files lists the other files in the bundle.
+	Files []string
+}
+
+// Bundle writes a zip archive with everything needed to reproduce a run of
+// the scenario with vars: the scenario (with the Builds transformed from
+// vars) as JSON, vars, the rendered cyclus input file, and a manifest (see
+// Manifest).  If vars is nil, the scenario's Builds are used as given and no
+// vars file is written.  s itself is not modified.
+func (s *Scenario) Bundle(vars []float64, w io.Writer) error {
+	return s.WriteBundle(w, vars, &Manifest{})
+}
+
+// WriteBundle is the same as Bundle except that the run's objective value
+// and cyclus version are recorded from m.  m's Hash and Files are set.
+func (s *Scenario) WriteBundle(w io.Writer, vars []float64, m *Manifest) error {
+	c := *s
+	if vars != nil {
+		if _, err := c.TransformVars(vars); err != nil {
+			return err
+		}
+	}
+	infile, err := c.GenCyclusInfile()
+	if err != nil {
+		return err
+	}
+	scendata, err := json.MarshalIndent(&c, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	m.Files = []string{BundleScenario, BundleInfile}
+	data := map[string][]byte{BundleScenario: scendata, BundleInfile: infile}
+	if vars != nil {
+		m.Files = append(m.Files, BundleVars)
+		if data[BundleVars], err = json.Marshal(vars); err != nil {
+			return err
+		}
+	}
+
+	sum, err := s.Hash(vars)
+	if err != nil {
+		return err
+	}
+	m.Hash = hex.EncodeToString(sum[:])
+	if data[BundleManifest], err = json.MarshalIndent(m, "", "    "); err != nil {
+		return err
+	}
+
+	zw := ziparch.NewWriter(w)
+	for _, name := range append([]string{BundleManifest}, m.Files...) {
+		fw, err := zw.Create(name)
+		if err != nil {
+			return err
+		} else if _, err := fw.Write(data[name]); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
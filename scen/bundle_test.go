@@ -0,0 +1,106 @@
+package scen
+
+import (
+	ziparch "archive/zip"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func TestBundle(t *testing.T) {
+	s := &Scenario{
+		SimDur:      3,
+		BuildPeriod: 1,
+		Facs:        []Facility{{Proto: "reactor", Cap: 1, Life: 10}},
+		MinPower:    []float64{0, 0},
+		MaxPower:    []float64{10, 10},
+	}
+	if err := s.ParseTmpl(`<simulation>{{range .Builds}}<build>{{.Proto}}</build>{{end}}</simulation>`); err != nil {
+		t.Fatal(err)
+	}
+	vars := []float64{0.5, 1}
+
+	readBundle := func(buf *bytes.Buffer) map[string][]byte {
+		r, err := ziparch.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files := map[string][]byte{}
+		for _, f := range r.File {
+			rc, err := f.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			files[f.Name], _ = ioutil.ReadAll(rc)
+			rc.Close()
+		}
+		return files
+	}
+
+	var buf bytes.Buffer
+	if err := s.Bundle(vars, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if s.Builds != nil {
+		t.Errorf("Bundle modified the scenario's Builds")
+	}
+	files := readBundle(&buf)
+
+	m := Manifest{}
+	if err := json.Unmarshal(files[BundleManifest], &m); err != nil {
+		t.Fatal(err)
+	}
+	sum := hash(t, s, vars)
+	if m.Hash != hex.EncodeToString(sum[:]) {
+		t.Errorf("manifest hash %v doesn't match the scenario hash", m.Hash)
+	} else if m.Objective != nil || m.CyclusVersion != "" {
+		t.Errorf("manifest has an unknown objective or cyclus version: %+v", m)
+	}
+	for _, name := range m.Files {
+		if _, ok := files[name]; !ok {
+			t.Errorf("bundle is missing manifest file %v", name)
+		}
+	}
+
+	var gotvars []float64
+	if err := json.Unmarshal(files[BundleVars], &gotvars); err != nil || !reflect.DeepEqual(gotvars, vars) {
+		t.Errorf("got vars %v (err=%v), want %v", gotvars, err, vars)
+	}
+	scn := &Scenario{}
+	if err := json.Unmarshal(files[BundleScenario], scn); err != nil {
+		t.Fatal(err)
+	} else if len(scn.Builds) == 0 {
+		t.Errorf("bundled scenario has no Builds")
+	}
+	if !bytes.Contains(files[BundleInfile], []byte("<build>reactor</build>")) {
+		t.Errorf("bundled infile doesn't deploy the builds:\n%s", files[BundleInfile])
+	}
+
+	// run details are recorded in the manifest
+	buf.Reset()
+	obj := 42.5
+	if err := s.WriteBundle(&buf, nil, &Manifest{Objective: &obj, CyclusVersion: "1.5.5"}); err != nil {
+		t.Fatal(err)
+	}
+	files = readBundle(&buf)
+	m = Manifest{}
+	if err := json.Unmarshal(files[BundleManifest], &m); err != nil {
+		t.Fatal(err)
+	} else if m.Objective == nil || *m.Objective != obj || m.CyclusVersion != "1.5.5" {
+		t.Errorf("manifest doesn't record the run details: %+v", m)
+	}
+	if _, ok := files[BundleVars]; ok {
+		t.Errorf("bundle without vars has a vars file")
+	}
+
+	// the hash covers the template text given to ParseTmpl
+	other := *s
+	if err := other.ParseTmpl(`<simulation/>`); err != nil {
+		t.Fatal(err)
+	} else if hash(t, &other, vars) == hash(t, s, vars) {
+		t.Errorf("scenarios with different templates hash the same")
+	}
+}
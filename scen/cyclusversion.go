@@ -0,0 +1,40 @@
+package scen
+
+import (
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// UnknownVersion is the cyclus version recorded when it can't be determined
+// (e.g. cyclus isn't installed).
+const UnknownVersion = "unknown"
+
+var cycver struct {
+	once sync.Once
+	v    string
+}
+
+// CyclusVersion returns the version of the cyclus on the PATH - the first
+// line of "cyclus --version" output (e.g. "Cyclus Core 1.5.5 (1.5.5-0-g9b3f6)").
+// Cyclus is only run the first time - the version is cached for the rest of
+// the process.  UnknownVersion is returned if cyclus can't be run.
+func CyclusVersion() string {
+	cycver.once.Do(func() { cycver.v = cyclusVersion("cyclus", "--version") })
+	return cycver.v
+}
+
+// cyclusVersion returns the first non-empty line of the output of running
+// cmd with args or UnknownVersion if it fails.
+func cyclusVersion(cmd string, args ...string) string {
+	out, err := exec.Command(cmd, args...).Output()
+	if err != nil {
+		return UnknownVersion
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			return line
+		}
+	}
+	return UnknownVersion
+}
@@ -0,0 +1,25 @@
+package scen
+
+import "testing"
+
+func TestCyclusVersion(t *testing.T) {
+	tests := []struct {
+		cmd  string
+		args []string
+		want string
+	}{
+		{"printf", []string{"\\nCyclus Core 1.5.5 (1.5.5-0-g9b3f6)\\n\\nDependencies:\\n   Boost 1_65_1\\n"}, "Cyclus Core 1.5.5 (1.5.5-0-g9b3f6)"},
+		{"true", nil, UnknownVersion},
+		{"false", nil, UnknownVersion},
+		{"cloudlus-no-such-cyclus", nil, UnknownVersion},
+	}
+	for _, test := range tests {
+		if got := cyclusVersion(test.cmd, test.args...); got != test.want {
+			t.Errorf("%v %q: got version %q, want %q", test.cmd, test.args, got, test.want)
+		}
+	}
+
+	if CyclusVersion() != CyclusVersion() || CyclusVersion() == "" {
+		t.Errorf("got inconsistent cyclus version %q", CyclusVersion())
+	}
+}
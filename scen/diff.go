@@ -0,0 +1,174 @@
+package scen
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// Diff returns a human-readable description of each difference between the
+// scenario and other, sorted by field path - e.g. "SimDur: 10 -> 20" or
+// "Facs[lwr].Life: 80 -> 60" (the value in s is on the left).  Facilities
+// and groups are matched by name, and builds are compared by the number of
+// facilities built for each build time, prototype and lifetime.  The
+// scenarios' File is ignored.  An empty result means the scenarios are
+// equivalent.  An error is returned if either scenario can't be encoded as
+// JSON (e.g. it has NaN or infinite values).
+func (s *Scenario) Diff(other *Scenario) ([]string, error) {
+	diffs := []string{}
+	add := func(path string, a, b interface{}) {
+		diffs = append(diffs, fmt.Sprintf("%v: %v -> %v", path, diffString(a), diffString(b)))
+	}
+
+	ja, err := toGeneric(s)
+	if err != nil {
+		return nil, err
+	}
+	jb, err := toGeneric(other)
+	if err != nil {
+		return nil, err
+	}
+	for _, field := range []string{"File", "Facs", "Groups", "StartBuilds", "ForcedBuilds", "Builds"} {
+		delete(ja, field)
+		delete(jb, field)
+	}
+	diffTree("", ja, jb, add)
+
+	// facilities and groups are already known to encode
+	facsa, facsb := map[string]interface{}{}, map[string]interface{}{}
+	for _, fac := range s.Facs {
+		facsa[fac.Proto], _ = toGeneric(fac)
+	}
+	for _, fac := range other.Facs {
+		facsb[fac.Proto], _ = toGeneric(fac)
+	}
+	diffKeyed("Facs", facsa, facsb, add)
+
+	groupsa, groupsb := map[string]interface{}{}, map[string]interface{}{}
+	for _, g := range s.Groups {
+		groupsa[g.Name], _ = toGeneric(g)
+	}
+	for _, g := range other.Groups {
+		groupsb[g.Name], _ = toGeneric(g)
+	}
+	diffKeyed("Groups", groupsa, groupsb, add)
+
+	diffKeyed("StartBuilds", buildCounts(s.StartBuilds), buildCounts(other.StartBuilds), add)
+	diffKeyed("ForcedBuilds", buildCounts(s.ForcedBuilds), buildCounts(other.ForcedBuilds), add)
+	diffKeyed("Builds", buildCounts(s.Builds), buildCounts(other.Builds), add)
+
+	sort.Strings(diffs)
+	return diffs, nil
+}
+
+// toGeneric returns the generic JSON object form of v.
+func toGeneric(v interface{}) (map[string]interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	m := map[string]interface{}{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// buildCounts returns the total number of facilities in builds keyed by
+// build time, prototype and lifetime.
+func buildCounts(builds []Build) map[string]interface{} {
+	m := map[string]interface{}{}
+	for _, b := range builds {
+		key := fmt.Sprintf("t=%v %v life=%v", b.Time, b.Proto, b.Life)
+		n, _ := m[key].(int)
+		m[key] = n + b.N
+	}
+	return m
+}
+
+// diffKeyed calls diffTree for each element of the keyed collections a and
+// b (e.g. facilities by prototype) with paths of the form "path[key]".
+func diffKeyed(path string, a, b map[string]interface{}, add func(path string, a, b interface{})) {
+	for _, k := range unionKeys(a, b) {
+		diffTree(path+"["+k+"]", a[k], b[k], add)
+	}
+}
+
+// diffTree calls add for each path at which the generic JSON values a and b
+// differ.  Objects are compared field by field and arrays element by
+// element.  Null values and empty arrays and objects are equivalent.
+func diffTree(path string, a, b interface{}, add func(path string, a, b interface{})) {
+	join := func(k string) string {
+		if path == "" {
+			return k
+		}
+		return path + "." + k
+	}
+
+	switch av := a.(type) {
+	case map[string]interface{}:
+		if bv, ok := b.(map[string]interface{}); ok {
+			for _, k := range unionKeys(av, bv) {
+				diffTree(join(k), av[k], bv[k], add)
+			}
+			return
+		}
+	case []interface{}:
+		if bv, ok := b.([]interface{}); ok {
+			for i := 0; i < len(av) || i < len(bv); i++ {
+				var ea, eb interface{}
+				if i < len(av) {
+					ea = av[i]
+				}
+				if i < len(bv) {
+					eb = bv[i]
+				}
+				diffTree(fmt.Sprintf("%v[%v]", path, i), ea, eb, add)
+			}
+			return
+		}
+	}
+
+	if isEmpty(a) && isEmpty(b) {
+		return
+	} else if !reflect.DeepEqual(a, b) {
+		add(path, a, b)
+	}
+}
+
+// unionKeys returns the keys of a and b in sorted order.
+func unionKeys(a, b map[string]interface{}) []string {
+	keys := []string{}
+	for k := range a {
+		keys = append(keys, k)
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func isEmpty(v interface{}) bool {
+	switch vv := v.(type) {
+	case nil:
+		return true
+	case map[string]interface{}:
+		return len(vv) == 0
+	case []interface{}:
+		return len(vv) == 0
+	}
+	return false
+}
+
+// diffString formats the generic JSON value v for Diff.
+func diffString(v interface{}) string {
+	if v == nil {
+		return "<none>"
+	}
+	data, _ := json.Marshal(v)
+	return string(data)
+}
@@ -0,0 +1,67 @@
+package scen
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	base := func() *Scenario {
+		return &Scenario{
+			SimDur:      10,
+			BuildPeriod: 2,
+			Facs: []Facility{
+				{Proto: "lwr", Cap: 1, Life: 80},
+				{Proto: "fr", Cap: 0.5, Life: 60},
+			},
+			MinPower:    []float64{1, 2, 3, 4},
+			MaxPower:    []float64{2, 3, 4, 5},
+			NuclideCost: map[string]float64{"Pu239": 1},
+			Builds:      []Build{{Time: 1, Proto: "lwr", N: 2}, {Time: 3, Proto: "fr", N: 1}},
+			File:        "a.json",
+		}
+	}
+
+	a, b := base(), base()
+	b.File = "b.json"
+	b.Facs[0], b.Facs[1] = b.Facs[1], b.Facs[0]
+	b.Builds = []Build{{Time: 3, Proto: "fr", N: 1}, {Time: 1, Proto: "lwr", N: 1}, {Time: 1, Proto: "lwr", N: 1}}
+	if diffs, err := a.Diff(b); err != nil {
+		t.Fatal(err)
+	} else if len(diffs) != 0 {
+		t.Errorf("equivalent scenarios: got differences %q", diffs)
+	}
+
+	b.SimDur = 12
+	b.MaxPower = append(b.MaxPower, 6)
+	b.Facs[0].Life = 40
+	b.Facs = append(b.Facs, Facility{Proto: "smr", Cap: 0.1})
+	b.NuclideCost["Pu239"] = 2
+	b.Builds[0].N = 3
+	want := []string{
+		`Builds[t=3 fr life=0]: 1 -> 3`,
+		`Facs[fr].Life: 60 -> 40`,
+		`Facs[smr]: <none> -> {`, // the whole facility follows
+		`MaxPower[4]: <none> -> 6`,
+		`NuclideCost.Pu239: 1 -> 2`,
+		`SimDur: 10 -> 12`,
+	}
+	got, _ := a.Diff(b)
+	if len(got) != len(want) {
+		t.Fatalf("got differences:\n%q\nwant:\n%q", got, want)
+	}
+	for i := range want {
+		if !strings.HasPrefix(got[i], want[i]) {
+			t.Errorf("difference %v: got %q, want %q", i, got[i], want[i])
+		}
+	}
+	if got, _ := b.Diff(a); len(got) != len(want) || got[5] != "SimDur: 12 -> 10" {
+		t.Errorf("reversed diff: got %q", got)
+	}
+
+	b.Facs[0].Cap = math.Inf(1)
+	if _, err := a.Diff(b); err == nil {
+		t.Errorf("scenario with an infinite value diffed without error")
+	}
+}
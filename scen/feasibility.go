@@ -0,0 +1,147 @@
+package scen
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// maxBlockCombos limits the number of combinations of reactor build blocks
+// FeasibilityReport tries per build period.  Periods needing more are
+// assumed to be feasible.
+const maxBlockCombos = 1000000
+
+// Report summarizes the size of a scenario's optimization problem and the
+// build periods whose power constraints can't be satisfied (see
+// FeasibilityReport).
+type Report struct {
+	// NVars is the total number of variables (see NVars) - NPeriods build
+	// periods with NVarsPerPeriod variables each.
+	NVars          int
+	NPeriods       int
+	NVarsPerPeriod int
+	// Infeasible lists the build periods whose power constraints can't be
+	// satisfied - in period order.
+	Infeasible []PeriodInfeasibility
+}
+
+// Feasible returns true if none of the build periods are infeasible.
+func (r Report) Feasible() bool { return len(r.Infeasible) == 0 }
+
+// PeriodInfeasibility describes why a build period's power constraints can't
+// be satisfied.
+type PeriodInfeasibility struct {
+	Period int
+	Time   int
+	Reason string
+}
+
+func (p PeriodInfeasibility) String() string {
+	return fmt.Sprintf("build period %v (time %v) is infeasible: %v", p.Period, p.Time, p.Reason)
+}
+
+// FeasibilityReport returns the dimensions of the scenario's variable space
+// and checks, for each build period, whether the power capacity deployed
+// can be kept within MinPower and MaxPower.  A period is reported as
+// infeasible if:
+//
+//   - its MinPower is greater than its MaxPower
+//   - the capacity of StartBuilds and ForcedBuilds alone exceeds MaxPower
+//   - no reactor can be built by then (and still be operating) to make up a
+//     shortfall of that capacity below MinPower
+//   - making up that shortfall with whole build blocks (see BuildBlock) of
+//     those reactors would exceed MaxPower
+//
+// Only the effective capacities of reactors (see EffCap) are used - i.e.
+// CapSchedule and MaxBuild are ignored - so reported periods are certainly
+// infeasible but periods that aren't reported may still be.  MinPower
+// shortfalls aren't checked for SoftPower scenarios.  An error is returned if
+// the scenario is invalid.
+func (s *Scenario) FeasibilityReport() (Report, error) {
+	if err := s.Validate(); err != nil {
+		return Report{}, err
+	}
+
+	r := Report{NVars: s.NVars(), NPeriods: s.NPeriods(), NVarsPerPeriod: s.NVarsPerPeriod()}
+
+	fixed := map[string][]Build{}
+	for _, bs := range [][]Build{s.StartBuilds, s.ForcedBuilds} {
+		for _, b := range bs {
+			fixed[b.Proto] = append(fixed[b.Proto], b)
+		}
+	}
+
+	times := s.PeriodTimes()
+	for i, t := range times {
+		addf := func(format string, args ...interface{}) {
+			r.Infeasible = append(r.Infeasible, PeriodInfeasibility{Period: i, Time: t, Reason: fmt.Sprintf(format, args...)})
+		}
+
+		minpow, maxpow := s.MinPower[i], s.MaxPower[i]
+		// ForcedBuilds during the period count toward it (see TransformVars)
+		fixedcap := s.PowerCap(fixed, t) + s.forcedCap(t)
+		if minpow > maxpow {
+			addf("MinPower %v is greater than MaxPower %v", minpow, maxpow)
+			continue
+		} else if fixedcap > maxpow {
+			addf("StartBuilds and ForcedBuilds capacity %v exceeds MaxPower %v", fixedcap, maxpow)
+			continue
+		}
+
+		need := minpow - fixedcap
+		if need <= 0 || s.SoftPower {
+			continue
+		}
+
+		// block capacities of the reactors that can be built by t and are
+		// still operating at t
+		blocks := []float64{}
+		for _, fac := range s.reactors() {
+			for _, tk := range times[:i+1] {
+				if fac.Available(tk) && fac.Alive(tk, t) {
+					blocks = append(blocks, float64(fac.block())*fac.EffCap())
+					break
+				}
+			}
+		}
+		if len(blocks) == 0 {
+			addf("no reactor can be built by then to make up the %v capacity below MinPower %v", need, minpow)
+		} else if !fitBlocks(blocks, need, maxpow-fixedcap) {
+			addf("making up the %v capacity below MinPower %v with whole build blocks exceeds MaxPower %v", need, minpow, maxpow)
+		}
+	}
+	return r, nil
+}
+
+// fitBlocks returns whether a sum of whole multiples of the capacities in
+// blocks falls between lo and hi (inclusive).  It gives up and returns true
+// after trying maxBlockCombos combinations.
+func fitBlocks(blocks []float64, lo, hi float64) bool {
+	const eps = 1e-9
+	blocks = append([]float64{}, blocks...)
+	sort.Sort(sort.Reverse(sort.Float64Slice(blocks)))
+
+	ntried := 0
+	var fit func(k int, sum float64) bool
+	fit = func(k int, sum float64) bool {
+		ntried++
+		if ntried > maxBlockCombos {
+			return true
+		}
+		// the smallest block fills the rest with the least overshoot
+		if last := blocks[len(blocks)-1]; k == len(blocks)-1 {
+			n := math.Max(0, math.Ceil((lo-sum)/last-eps))
+			return sum+n*last <= hi+eps
+		}
+		for sum < lo+blocks[k] {
+			if sum > hi+eps {
+				return false
+			} else if fit(k+1, sum) {
+				return true
+			}
+			sum += blocks[k]
+		}
+		return false
+	}
+	return fit(0, 0)
+}
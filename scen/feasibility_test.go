@@ -0,0 +1,106 @@
+package scen
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFeasibilityReport(t *testing.T) {
+	// 3 build periods at times 1, 3, and 5
+	newscen := func() *Scenario {
+		return &Scenario{
+			SimDur:      7,
+			BuildPeriod: 2,
+			Facs: []Facility{
+				{Proto: "lwr", Cap: 3},
+				{Proto: "sfr", Cap: 5, BuildAfter: 3},
+				{Proto: "repo", FracOfProtos: []string{"lwr"}},
+			},
+			MinPower: []float64{2, 7, 10},
+			MaxPower: []float64{4, 8, 12},
+		}
+	}
+
+	s := newscen()
+	r, err := s.FeasibilityReport()
+	if err != nil {
+		t.Fatal(err)
+	} else if r.NVars != 9 || r.NPeriods != 3 || r.NVarsPerPeriod != 3 {
+		t.Errorf("got %v vars (%v periods x %v), want 9 (3 x 3)", r.NVars, r.NPeriods, r.NVarsPerPeriod)
+	} else if !r.Feasible() {
+		// period 1 needs an lwr and an sfr (8) and period 2 two sfrs (10) or
+		// four lwrs (12)
+		t.Errorf("feasible scenario reported infeasible: %v", r.Infeasible)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(s *Scenario)
+		period int
+		reason string
+	}{
+		{"min over max", func(s *Scenario) { s.MinPower[1] = 9 }, 1, "greater than MaxPower"},
+		{"fixed over max", func(s *Scenario) { s.StartBuilds = []Build{{Proto: "lwr", N: 2}} }, 0, "exceeds MaxPower 4"},
+		// only the 3-pack of lwrs can be built in the first period
+		{"blocks over max", func(s *Scenario) { s.Facs[0].BuildBlock = 3 }, 0, "whole build blocks"},
+		{"nothing to build", func(s *Scenario) { s.Facs[0].BuildAfter, s.Facs[1].BuildAfter = 3, 3 }, 0, "no reactor can be built"},
+		// lwrs built in the first period have retired by the second
+		{"retired", func(s *Scenario) {
+			s.Facs[0].Life, s.Facs[0].BuildBefore = 2, 3
+			s.Facs[1].BuildAfter = 5
+		}, 1, "no reactor can be built"},
+	}
+	for _, test := range tests {
+		s := newscen()
+		test.modify(s)
+		r, err := s.FeasibilityReport()
+		if err != nil {
+			t.Errorf("%v: %v", test.name, err)
+			continue
+		}
+		found := false
+		for _, p := range r.Infeasible {
+			found = found || (p.Period == test.period && strings.Contains(p.Reason, test.reason))
+		}
+		if !found {
+			t.Errorf("%v: got infeasible periods %v, want period %v %q", test.name, r.Infeasible, test.period, test.reason)
+		}
+	}
+
+	// shortfalls are only penalized for soft power constraints
+	s = newscen()
+	s.Facs[0].BuildBlock = 3
+	s.SoftPower = true
+	if r, err := s.FeasibilityReport(); err != nil {
+		t.Fatal(err)
+	} else if !r.Feasible() {
+		t.Errorf("SoftPower scenario reported infeasible: %v", r.Infeasible)
+	}
+
+	s = newscen()
+	s.MaxPower = s.MaxPower[:2]
+	if _, err := s.FeasibilityReport(); err == nil {
+		t.Errorf("invalid scenario returned no error")
+	}
+}
+
+func TestFitBlocks(t *testing.T) {
+	tests := []struct {
+		blocks []float64
+		lo, hi float64
+		want   bool
+	}{
+		{[]float64{3}, 7, 8, false},
+		{[]float64{3}, 7, 9, true},
+		{[]float64{3, 5}, 7, 8, true},
+		{[]float64{5, 3}, 7, 7.5, false},
+		{[]float64{4, 6}, 7, 7.9, false},
+		{[]float64{0.1, 0.2}, 0.3, 0.3, true},
+		{[]float64{1000, 300}, 2500, 2600, true},
+	}
+	for _, test := range tests {
+		if got := fitBlocks(test.blocks, test.lo, test.hi); got != test.want {
+			t.Errorf("fitBlocks(%v, %v, %v): got %v, want %v", test.blocks, test.lo, test.hi, got, test.want)
+		}
+	}
+}
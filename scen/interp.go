@@ -1,15 +1,44 @@
 package scen
 
-import "sort"
+import (
+	"math"
+	"sort"
+)
 
 type smoothFn func(x float64) float64
 
-type sample struct {
+// Interpolation methods for Scenario.InterpMethod.
+const (
+	// InterpLinear interpolates linearly between samples.
+	InterpLinear = "linear"
+	// InterpPCHIP interpolates with monotone piecewise cubic Hermite
+	// (Fritsch-Carlson) splines.  They are smooth like cubic splines but
+	// never overshoot the samples: the interpolant is monotone wherever the
+	// samples are, so it stays non-negative between non-negative samples.
+	InterpPCHIP = "pchip"
+)
+
+// DefaultIntegrationIntervals is the number of integration intervals used
+// for the disrup-multi objective modes if Scenario.IntegrationIntervals is
+// zero.
+const DefaultIntegrationIntervals = 10000
+
+// interpolators maps interpolation method names to functions generating
+// interpolants for a set of samples.
+var interpolators = map[string]func([]Sample) smoothFn{
+	"":           interpolate,
+	InterpLinear: interpolate,
+	InterpPCHIP:  interpolatePCHIP,
+}
+
+// Sample is a point (X, Y) of a piecewise function such as a facility's
+// CapSchedule or an interpolated objective.
+type Sample struct {
 	X float64
 	Y float64
 }
 
-type sampleSet []sample
+type sampleSet []Sample
 
 func (s sampleSet) Len() int           { return len(s) }
 func (s sampleSet) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -20,32 +49,102 @@ func (s sampleSet) Less(i, j int) bool { return s[i].X < s[j].X }
 // bounds of the samples using the nearest (linear) slope.  The samples do not
 // need to be in any particular order.  Multiple samples at the same X point
 // are not allowed.
-func interpolate(samples []sample) smoothFn {
-	ss := make([]sample, len(samples))
+func interpolate(samples []Sample) smoothFn {
+	ss := make([]Sample, len(samples))
 	copy(ss, samples)
 	sort.Sort(sampleSet(ss))
-	return func(x float64) (y float64) {
-		for i := range ss[:len(ss)-1] {
-			left := ss[i].X
-			right := ss[i+1].X
-			if x <= right {
-				lefty := ss[i].Y
-				righty := ss[i+1].Y
-				return lefty + (x-left)/(right-left)*(righty-lefty)
+	return func(x float64) float64 { return linearAt(ss, x) }
+}
+
+// linearAt evaluates the linear interpolant (see interpolate) of ss at x
+// without allocating.  ss must have at least two samples and be sorted by X.
+func linearAt(ss []Sample, x float64) float64 {
+	for i := range ss[:len(ss)-1] {
+		left := ss[i].X
+		right := ss[i+1].X
+		if x <= right {
+			lefty := ss[i].Y
+			righty := ss[i+1].Y
+			return lefty + (x-left)/(right-left)*(righty-lefty)
+		}
+	}
+
+	// if x is beyond last sample x-val, just extrapolate slope between
+	// last two samples' x-vals.
+	end := len(ss) - 1
+	left := ss[end-1].X
+	right := ss[end].X
+	lefty := ss[end-1].Y
+	righty := ss[end].Y
+	return lefty + (x-left)/(right-left)*(righty-lefty)
+}
+
+// interpolatePCHIP generates a monotone piecewise cubic Hermite interpolant
+// through samples (see InterpPCHIP).  Like interpolate, it extrapolates
+// linearly (using the end slopes) outside the samples, the samples don't
+// need to be in any particular order, and multiple samples at the same X
+// point are not allowed.  A single sample gives a constant function.
+func interpolatePCHIP(samples []Sample) smoothFn {
+	ss := make([]Sample, len(samples))
+	copy(ss, samples)
+	sort.Sort(sampleSet(ss))
+
+	n := len(ss)
+	if n == 1 {
+		return func(x float64) float64 { return ss[0].Y }
+	}
+	h := make([]float64, n-1)     // interval widths
+	delta := make([]float64, n-1) // secant slopes
+	for k := range h {
+		h[k] = ss[k+1].X - ss[k].X
+		delta[k] = (ss[k+1].Y - ss[k].Y) / h[k]
+	}
+
+	// slopes at each sample
+	d := make([]float64, n)
+	if n == 2 {
+		d[0], d[1] = delta[0], delta[0]
+	} else {
+		for k := 1; k < n-1; k++ {
+			if delta[k-1]*delta[k] <= 0 {
+				continue // local extremum - flat to avoid overshoot
 			}
+			w1 := 2*h[k] + h[k-1]
+			w2 := h[k] + 2*h[k-1]
+			d[k] = (w1 + w2) / (w1/delta[k-1] + w2/delta[k])
 		}
+		d[0] = pchipEndSlope(h[0], h[1], delta[0], delta[1])
+		d[n-1] = pchipEndSlope(h[n-2], h[n-3], delta[n-2], delta[n-3])
+	}
 
-		// if x is beyond last sample x-val, just extrapolate slope between
-		// last two samples' x-vals.
-		end := len(ss) - 1
-		left := ss[end-1].X
-		right := ss[end].X
-		lefty := ss[end-1].Y
-		righty := ss[end].Y
-		return lefty + (x-left)/(right-left)*(righty-lefty)
+	return func(x float64) float64 {
+		if x <= ss[0].X {
+			return ss[0].Y + (x-ss[0].X)*d[0]
+		} else if x >= ss[n-1].X {
+			return ss[n-1].Y + (x-ss[n-1].X)*d[n-1]
+		}
+
+		k := sort.Search(n, func(i int) bool { return ss[i].X > x }) - 1
+		t := (x - ss[k].X) / h[k]
+		t2, t3 := t*t, t*t*t
+		return (2*t3-3*t2+1)*ss[k].Y + (t3-2*t2+t)*h[k]*d[k] +
+			(-2*t3+3*t2)*ss[k+1].Y + (t3-t2)*h[k]*d[k+1]
 	}
 }
 
+// pchipEndSlope computes the slope at an end sample from the widths and
+// secant slopes of the two intervals nearest to it (h0 and delta0 for the
+// end interval) with the shape-preserving three-point formula.
+func pchipEndSlope(h0, h1, delta0, delta1 float64) float64 {
+	d := ((2*h0+h1)*delta0 - h0*delta1) / (h0 + h1)
+	if math.Signbit(d) != math.Signbit(delta0) || delta0 == 0 {
+		return 0
+	} else if math.Signbit(delta0) != math.Signbit(delta1) && math.Abs(d) > 3*math.Abs(delta0) {
+		return 3 * delta0
+	}
+	return d
+}
+
 func productOf(fn1, fn2 smoothFn) smoothFn {
 	return func(x float64) (y float64) {
 		return fn1(x) * fn2(x)
@@ -63,6 +162,48 @@ func integrateMid(fn smoothFn, x1, x2 float64, ninterval int) float64 {
 	return tot
 }
 
+// integrateSimpson integrates fn from x1 to x2 with Simpson's rule over
+// ninterval intervals (rounded up to an even number).  It is exact for cubic
+// polynomials and converges much faster than integrateMid for smooth
+// functions.
+func integrateSimpson(fn smoothFn, x1, x2 float64, ninterval int) float64 {
+	if ninterval%2 != 0 {
+		ninterval++
+	}
+	dx := (x2 - x1) / float64(ninterval)
+	tot := fn(x1) + fn(x2)
+	for i := 1; i < ninterval; i++ {
+		w := 2.0
+		if i%2 != 0 {
+			w = 4
+		}
+		tot += w * fn(x1+float64(i)*dx)
+	}
+	return tot * dx / 3
+}
+
+// integrator computes the integral of a function from x1 to x2 using
+// ninterval intervals - e.g. integrateMid or integrateSimpson.
+type integrator func(fn smoothFn, x1, x2 float64, ninterval int) float64
+
+// expectedValue returns the expected value of obj over [x1, x2] weighted by
+// the (not necessarily normalized) probability density prob - i.e.
+// integral(obj*prob) / integral(prob) - computing both integrals with
+// integrate using ninterval intervals.  The result is NaN if prob integrates
+// to zero over the range.
+func expectedValue(obj, prob smoothFn, x1, x2 float64, ninterval int, integrate integrator) float64 {
+	num := integrate(productOf(obj, prob), x1, x2, ninterval)
+	denom := integrate(prob, x1, x2, ninterval)
+	if denom == 0 {
+		return math.NaN()
+	}
+	return num / denom
+}
+
+// sampleUniformProb returns nsample points between x1 and x2 that divide the
+// (unnormalized) probability density fn into equally probable intervals -
+// integrating with ninterval intervals per sample.  The points are
+// deterministic.
 func sampleUniformProb(fn smoothFn, x1, x2 float64, nsample, ninterval int) (xs []float64) {
 	totA := integrateMid(fn, x1, x2, ninterval*nsample)
 	sampleA := totA / float64(nsample)
@@ -80,22 +221,22 @@ func sampleUniformProb(fn smoothFn, x1, x2 float64, nsample, ninterval int) (xs
 	return xs
 }
 
-func zip(disrups []Disruption, objs []float64) []sample {
+func zip(disrups []Disruption, objs []float64) []Sample {
 	if len(disrups) != len(objs) {
 		panic("cannot zip slices of unequal length")
 	}
 
-	samples := make([]sample, len(disrups))
+	samples := make([]Sample, len(disrups))
 	for i := range disrups {
-		samples = append(samples, sample{float64(disrups[i].Time), objs[i]})
+		samples = append(samples, Sample{float64(disrups[i].Time), objs[i]})
 	}
 	return samples
 }
 
-func extractProbs(disrups []Disruption) []sample {
-	samples := []sample{}
+func extractProbs(disrups []Disruption) []Sample {
+	samples := []Sample{}
 	for _, d := range disrups {
-		samples = append(samples, sample{float64(d.Time), d.Prob})
+		samples = append(samples, Sample{float64(d.Time), d.Prob})
 	}
 	return samples
 }
@@ -58,13 +58,48 @@ func TestAggregateObj(t *testing.T) {
 	}
 
 	for i, test := range tests {
-		got := aggregateObj(test.SimDur, test.Disrups, test.Subobjs)
+		got := aggregateObj(test.SimDur, InterpLinear, DefaultIntegrationIntervals, test.Disrups, test.Subobjs)
 		if diff := math.Abs(got - test.Obj); diff > 1e-10 {
 			t.Errorf("case %v: got %v, want %v", i+1, got, test.Obj)
 		}
 	}
 }
 
+func TestAggregateObjConvergence(t *testing.T) {
+	disrups := []Disruption{
+		{Time: 0, BuildProto: "foo", Sample: true, Prob: 0.02},
+		{Time: 3, BuildProto: "foo", Sample: true, Prob: 0.15},
+		{Time: 7, BuildProto: "foo", Sample: true, Prob: 0.05},
+		{Time: 10, BuildProto: "foo", Sample: true, Prob: 0.01},
+	}
+	subobjs := []float64{4, 1, 8, 3}
+
+	for _, method := range []string{InterpLinear, InterpPCHIP} {
+		want := aggregateObj(10, method, 1000000, disrups, subobjs)
+		preverr := math.Inf(1)
+		for _, n := range []int{10, 100, 1000, 10000} {
+			got := aggregateObj(10, method, n, disrups, subobjs)
+			err := math.Abs(got - want)
+			if err > preverr {
+				t.Errorf("%v: error %v with %v intervals is larger than %v with fewer", method, err, n, preverr)
+			}
+			preverr = err
+		}
+		if preverr > 1e-6 {
+			t.Errorf("%v: got error %v with %v intervals, want < 1e-6", method, preverr, DefaultIntegrationIntervals)
+		}
+	}
+
+	s := &Scenario{}
+	if n := s.NIntervals(); n != DefaultIntegrationIntervals {
+		t.Errorf("got %v intervals by default, want %v", n, DefaultIntegrationIntervals)
+	}
+	s.IntegrationIntervals = 50
+	if n := s.NIntervals(); n != 50 {
+		t.Errorf("got %v intervals, want 50", n)
+	}
+}
+
 // this was used in my dissertation to generate equi-probable sample points
 // for my disruption probability distribution.
 func testSamplePoints(t *testing.T) {
@@ -113,9 +148,70 @@ func TestIntegrateMid(t *testing.T) {
 	}
 }
 
+func TestIntegrateSimpson(t *testing.T) {
+	tests := []struct {
+		fn        smoothFn
+		x1, x2    float64
+		ninterval int
+		Tot       float64
+	}{
+		// cubic - exact even with few intervals
+		{func(x float64) float64 { return x*x*x - 2*x + 1 }, 0, 2, 2, 2},
+		// odd interval count gets rounded up
+		{func(x float64) float64 { return 3 * x * x }, -1, 2, 3, 9},
+		// normal distribution segment
+		{func(x float64) float64 { return 1 / math.Sqrt(2*math.Pi) * math.Exp(-(x*x)/2) }, -2, -1, 1000, .1359051219835},
+	}
+
+	for i, test := range tests {
+		got := integrateSimpson(test.fn, test.x1, test.x2, test.ninterval)
+		if diff := math.Abs(got - test.Tot); diff > 1e-10 {
+			t.Errorf("case %v (integral from %v to %v): got %v, want %v", i+1, test.x1, test.x2, got, test.Tot)
+		}
+	}
+}
+
+func TestExpectedValue(t *testing.T) {
+	linear := func(x float64) float64 { return x }
+	tests := []struct {
+		Name      string
+		obj, prob smoothFn
+		x1, x2    float64
+		Want      float64
+	}{
+		// uniform density: the mean of the objective
+		{"uniform", linear, func(x float64) float64 { return 0.1 }, 0, 10, 5},
+		// unnormalized uniform density gives the same result
+		{"uniform-scaled", linear, func(x float64) float64 { return 7 }, 0, 10, 5},
+		// constant objective is unaffected by the density
+		{"constant", func(x float64) float64 { return 3 }, linear, 0, 4, 3},
+		// triangular density p(t)=t on [0,1]: int(t^2)/int(t) = (1/3)/(1/2)
+		{"triangular", linear, linear, 0, 1, 2.0 / 3},
+		// exponential density with rate 1 truncated to [0,50]: mean 1
+		{"exponential", linear, func(x float64) float64 { return math.Exp(-x) }, 0, 50, 1},
+		// density from interpolated disruption probabilities
+		{"interpolated", linear, interpolate([]Sample{{0, 0}, {10, 0.2}}), 0, 10, 20.0 / 3},
+	}
+
+	integrators := map[string]integrator{"mid": integrateMid, "simpson": integrateSimpson}
+	for iname, integ := range integrators {
+		for _, test := range tests {
+			got := expectedValue(test.obj, test.prob, test.x1, test.x2, 10000, integ)
+			if diff := math.Abs(got - test.Want); diff > 1e-5 {
+				t.Errorf("%v (%v): got %v, want %v", test.Name, iname, got, test.Want)
+			}
+		}
+	}
+
+	zero := func(x float64) float64 { return 0 }
+	if got := expectedValue(linear, zero, 0, 1, 100, integrateMid); !math.IsNaN(got) {
+		t.Errorf("zero density: got %v, want NaN", got)
+	}
+}
+
 // check that the interpolation function generator works
 func TestInterpolate(t *testing.T) {
-	samples := []sample{
+	samples := []Sample{
 		{1, 1},
 		{2, 2},
 		{3, 3},
@@ -154,3 +250,58 @@ func TestInterpolate(t *testing.T) {
 		}
 	}
 }
+
+// check that monotone cubic interpolation doesn't overshoot the samples
+// where a natural cubic spline would (e.g. dipping negative next to an
+// isolated spike in a probability density).
+func TestInterpolatePCHIP(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Samples  []Sample
+		Monotone bool
+	}{
+		{"spike", []Sample{{0, 0}, {1, 0}, {2, 0}, {3, 1}, {4, 0}, {5, 0}, {6, 0}}, false},
+		{"step", []Sample{{0, 0}, {1, 0}, {2, 0.1}, {3, 0.9}, {4, 1}, {5, 1}}, true},
+		{"uneven", []Sample{{0, 0}, {0.5, 0.02}, {4, 0.5}, {4.2, 0.51}, {9, 1}}, true},
+	}
+
+	for _, test := range tests {
+		fn := interpolatePCHIP(test.Samples)
+		for _, s := range test.Samples {
+			if y := fn(s.X); math.Abs(y-s.Y) > 1e-12 {
+				t.Errorf("%v: fn(%v) = %v, want sample value %v", test.Name, s.X, y, s.Y)
+			}
+		}
+
+		x0, x1 := test.Samples[0].X, test.Samples[len(test.Samples)-1].X
+		prev := fn(x0)
+		for i := 1; i <= 1000; i++ {
+			x := x0 + float64(i)/1000*(x1-x0)
+			y := fn(x)
+			if y < 0 || y > 1 {
+				t.Errorf("%v: fn(%v) = %v overshoots the samples' range [0, 1]", test.Name, x, y)
+				break
+			} else if test.Monotone && y < prev-1e-12 {
+				t.Errorf("%v: fn decreases from %v to %v at x=%v for monotone samples", test.Name, prev, y, x)
+				break
+			}
+			prev = y
+		}
+	}
+
+	// with just two samples, it is linear
+	fn := interpolatePCHIP([]Sample{{1, 1}, {3, 5}})
+	for _, x := range []float64{0, 1, 2, 3, 4} {
+		if y, want := fn(x), 2*x-1; math.Abs(y-want) > 1e-12 {
+			t.Errorf("two samples: fn(%v) = %v, want %v", x, y, want)
+		}
+	}
+
+	// and with one it is constant
+	fn = interpolatePCHIP([]Sample{{2, 0.5}})
+	for _, x := range []float64{0, 2, 4} {
+		if y := fn(x); y != 0.5 {
+			t.Errorf("one sample: fn(%v) = %v, want 0.5", x, y)
+		}
+	}
+}
@@ -86,6 +86,21 @@ var ObjFuncs = map[string]ObjFunc{
 	"slowvfast-penalty2": ObjSlowVsFastPowerPenaltySquared,
 	"slowvfast-fueled":   ObjSlowVsFastPowerFueled,
 	"ans2014":            ObjANS2014,
+	"waste-cost":         ObjWasteCost,
+}
+
+// DiscountFactor returns the factor that converts a cost incurred at time
+// step (month) t into its present (t=0) value using the scenario's annual
+// Discount rate r and Compounding convention:
+//
+//   * monthly: 1 / (1 + r/12)^t
+//
+//   * continuous: exp(-r * t/12)
+func (s *Scenario) DiscountFactor(t int) float64 {
+	if s.Compounding == CompoundContinuous {
+		return math.Exp(-s.Discount * float64(t) / 12)
+	}
+	return 1 / math.Pow(1+s.Discount/12, float64(t))
 }
 
 // ObjSlowVsFastPower returns:
@@ -153,7 +168,7 @@ func ObjSlowVsFastPowerPenalty(scen *Scenario, db *sql.DB, simid []byte) (float6
 	}
 	totcap := 0.0
 	for t := 0; t < scen.SimDur; t++ {
-		totcap += scen.PowerCap(builds, t)
+		totcap += scen.CyclusPower(scen.PowerCap(builds, t))
 	}
 
 	return slowE / totE * totcap / totE, nil
@@ -194,7 +209,7 @@ func ObjSlowVsFastPowerPenaltySquared(scen *Scenario, db *sql.DB, simid []byte)
 	}
 	totcap := 0.0
 	for t := 0; t < scen.SimDur; t++ {
-		totcap += scen.PowerCap(builds, t)
+		totcap += scen.CyclusPower(scen.PowerCap(builds, t))
 	}
 
 	return slowE / totE * math.Pow(totcap/totE, 2), nil
@@ -233,7 +248,7 @@ func ObjSlowVsFastPowerFueled(scen *Scenario, db *sql.DB, simid []byte) (float64
 	}
 	totcap := 0.0
 	for t := 0; t < scen.SimDur; t++ {
-		totcap += scen.PowerCap(builds, t)
+		totcap += scen.CyclusPower(scen.PowerCap(builds, t))
 	}
 
 	return (slowpower + totcap) / (slowpower + fastpower), nil
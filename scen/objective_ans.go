@@ -72,6 +72,8 @@ func ObjANS2014(scen *Scenario, db *sql.DB, simid []byte) (float64, error) {
 	if err != nil {
 		return math.Inf(1), err
 	}
+	// costs are discounted with the scenario's Compounding convention
+	disc := &Scenario{Discount: s.Discount, Compounding: scen.Compounding}
 
 	// add up overnight and operating costs converted to PV(t=0)
 	q1 := `
@@ -95,7 +97,7 @@ func ObjANS2014(scen *Scenario, db *sql.DB, simid []byte) (float64, error) {
 			if err := rows.Scan(&t); err != nil {
 				return math.Inf(1), err
 			}
-			totcost += PV(fac.OpCost, t, s.Discount)
+			totcost += fac.OpCost * disc.DiscountFactor(t)
 		}
 		if err := rows.Err(); err != nil {
 			return math.Inf(1), err
@@ -111,7 +113,7 @@ func ObjANS2014(scen *Scenario, db *sql.DB, simid []byte) (float64, error) {
 			if err := rows.Scan(&t); err != nil {
 				return math.Inf(1), err
 			}
-			totcost += PV(fac.CapitalCost, t, s.Discount)
+			totcost += fac.CapitalCost * disc.DiscountFactor(t)
 		}
 		if err := rows.Err(); err != nil {
 			return math.Inf(1), err
@@ -141,7 +143,7 @@ func ObjANS2014(scen *Scenario, db *sql.DB, simid []byte) (float64, error) {
 			}
 			for nuc, qty := range mat {
 				nucstr := fmt.Sprint(nuc)
-				totcost += PV(s.NuclideCost[nucstr]*float64(qty)*(1-fac.WasteDiscount), t, s.Discount)
+				totcost += s.NuclideCost[nucstr] * float64(qty) * (1 - fac.WasteDiscount) * disc.DiscountFactor(t)
 			}
 		}
 	}
@@ -156,7 +158,9 @@ func ObjANS2014(scen *Scenario, db *sql.DB, simid []byte) (float64, error) {
 	return totcost / (mwh + 1e-30) * mult, nil
 }
 
+// PV returns the present (t=0) value of the amount amt incurred at time step
+// (month) nt using the annual discount rate compounded monthly (see
+// Scenario.DiscountFactor).
 func PV(amt float64, nt int, rate float64) float64 {
-	monrate := rate / 12
-	return amt / math.Pow(1+monrate, float64(nt))
+	return amt * (&Scenario{Discount: rate}).DiscountFactor(nt)
 }
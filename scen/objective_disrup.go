@@ -7,7 +7,15 @@ import (
 	"sync"
 )
 
+// Disruption describes a single perturbation of a scenario (e.g. a facility
+// shutdown or construction) that occurs at a particular time.  Sets of
+// disruptions are used by the disrup-* objective modes to compute a
+// probability weighted objective over several possible disruption times.
+// Disruption sets are normally specified in a scenario's CustomConfig, but
+// they can also be built directly and checked with ValidateDisruptions.
 type Disruption struct {
+	// Name is an optional label identifying the disruption.
+	Name string
 	// Time is the time step on which the disruption occurs (i.e. facility
 	// shutdown, facility construction, or objective change).
 	Time int
@@ -44,6 +52,48 @@ type Disruption struct {
 	KnownBest float64
 }
 
+// ValidateDisruptions returns an error if any of the disruptions in ds has
+// a negative probability.
+func ValidateDisruptions(ds []Disruption) error {
+	for i, d := range ds {
+		if d.Prob < 0 {
+			return fmt.Errorf("disruption %v (%v) has negative probability %v", i, disrupLabel(d), d.Prob)
+		}
+	}
+	return nil
+}
+
+// NormalizeDisruptions returns a copy of ds with the probabilities of all
+// disruptions scaled so that they sum to 1.  An error is returned if ds
+// contains negative probabilities or if all probabilities are zero.
+func NormalizeDisruptions(ds []Disruption) ([]Disruption, error) {
+	if err := ValidateDisruptions(ds); err != nil {
+		return nil, err
+	}
+
+	tot := 0.0
+	for _, d := range ds {
+		tot += d.Prob
+	}
+	if tot == 0 {
+		return nil, errors.New("cannot normalize disruptions with zero total probability")
+	}
+
+	normed := make([]Disruption, len(ds))
+	for i, d := range ds {
+		d.Prob /= tot
+		normed[i] = d
+	}
+	return normed, nil
+}
+
+func disrupLabel(d Disruption) string {
+	if d.Name != "" {
+		return d.Name
+	}
+	return fmt.Sprintf("t=%v", d.Time)
+}
+
 type disrupOpt int
 
 const (
@@ -155,6 +205,9 @@ func disrupModeLin(s *Scenario, obj ObjExecFunc) (float64, error) {
 		}
 		disrups[i] = d
 	}
+	if err := ValidateDisruptions(disrups); err != nil {
+		return math.Inf(1), fmt.Errorf("disrup-multi-lin: %v", err)
+	}
 
 	subobjs, err := runDisrupSims(s, obj, disrups)
 	if err != nil {
@@ -172,7 +225,7 @@ func disrupModeLin(s *Scenario, obj ObjExecFunc) (float64, error) {
 		subobjs[i] = wPre*subobjs[i] + wPost*disrups[i].KnownBest
 	}
 
-	objval := aggregateObj(s.SimDur, disrups, subobjs)
+	objval := aggregateObj(s.SimDur, s.InterpMethod, s.NIntervals(), disrups, subobjs)
 	return objval, nil
 }
 
@@ -188,13 +241,16 @@ func disrupMode(s *Scenario, obj ObjExecFunc) (float64, error) {
 
 		disrups[i] = d
 	}
+	if err := ValidateDisruptions(disrups); err != nil {
+		return math.Inf(1), fmt.Errorf("disrup-multi: %v", err)
+	}
 
 	subobjs, err := runDisrupSims(s, obj, disrups)
 	if err != nil {
 		return math.Inf(1), err
 	}
 
-	objval := aggregateObj(s.SimDur, disrups, subobjs)
+	objval := aggregateObj(s.SimDur, s.InterpMethod, s.NIntervals(), disrups, subobjs)
 	return objval, nil
 }
 
@@ -202,8 +258,9 @@ func disrupMode(s *Scenario, obj ObjExecFunc) (float64, error) {
 // sub-objective values and generates interpolating functions for both the
 // disruption probabilities vs time and sub-objectives vs time and integrates
 // over their product and returns the mean outcome given the disruption
-// probability distribution.
-func aggregateObj(simdur int, disrups []Disruption, subobjs []float64) float64 {
+// probability distribution.  The interpolation method is one of the
+// InterpMethod values and the integrals use ninterval intervals.
+func aggregateObj(simdur int, method string, ninterval int, disrups []Disruption, subobjs []float64) float64 {
 	sampled := []Disruption{}
 	for _, d := range disrups {
 		if d.Sample {
@@ -211,15 +268,16 @@ func aggregateObj(simdur int, disrups []Disruption, subobjs []float64) float64 {
 		}
 	}
 
-	objVsTime := interpolate(zip(sampled, subobjs))
-	probVsTime := interpolate(extractProbs(disrups))
+	interp := interpolators[method]
+	objVsTime := interp(zip(sampled, subobjs))
+	probVsTime := interp(extractProbs(disrups))
 
 	t0 := 0.0
 	tend := float64(simdur)
-	objval := integrateMid(productOf(objVsTime, probVsTime), t0, tend, 10000)
+	objval := integrateMid(productOf(objVsTime, probVsTime), t0, tend, ninterval)
 	// calculate probability of no disruption and assume objective for that
 	// case is same as disruption occuring at t_end
-	nodisruptail := (1 - integrateMid(probVsTime, t0, tend, 10000)) * objVsTime(tend)
+	nodisruptail := (1 - integrateMid(probVsTime, t0, tend, ninterval)) * objVsTime(tend)
 	objval += nodisruptail
 
 	return objval
@@ -228,6 +286,10 @@ func aggregateObj(simdur int, disrups []Disruption, subobjs []float64) float64 {
 func parseDisrup(disrup map[string]interface{}, opts disrupOpt) (Disruption, error) {
 	d := Disruption{}
 
+	if name, ok := disrup["Name"]; ok {
+		d.Name = name.(string)
+	}
+
 	if s, ok := disrup["Sample"]; ok {
 		d.Sample = s.(float64) != 0
 	}
@@ -297,7 +359,7 @@ func runDisrupSims(s *Scenario, obj ObjExecFunc, disrups []Disruption) (objs []f
 
 	wg.Wait()
 	if errinner != nil {
-		return nil, fmt.Errorf("remote sub-simulation execution failed: %v", errinner)
+		return nil, fmt.Errorf("remote sub-simulation execution failed: %w", errinner)
 	}
 	return objs, nil
 }
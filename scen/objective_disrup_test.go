@@ -0,0 +1,53 @@
+package scen
+
+import (
+	"math"
+	"testing"
+)
+
+func TestNormalizeDisruptions(t *testing.T) {
+	disrups := []Disruption{
+		{Name: "early", Time: 2, Prob: 1},
+		{Name: "mid", Time: 4, Prob: 2},
+		{Name: "late", Time: 6, Prob: 1},
+	}
+
+	normed, err := NormalizeDisruptions(disrups)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []float64{0.25, 0.5, 0.25}
+	tot := 0.0
+	for i, d := range normed {
+		tot += d.Prob
+		if math.Abs(d.Prob-want[i]) > 1e-12 {
+			t.Errorf("disruption %v: want prob %v, got %v", d.Name, want[i], d.Prob)
+		}
+	}
+	if math.Abs(tot-1) > 1e-12 {
+		t.Errorf("normalized probabilities sum to %v, want 1", tot)
+	}
+	if disrups[1].Prob != 2 {
+		t.Errorf("NormalizeDisruptions modified its input")
+	}
+}
+
+func TestNormalizeDisruptionsInvalid(t *testing.T) {
+	if _, err := NormalizeDisruptions([]Disruption{{Time: 1, Prob: 0}, {Time: 2}}); err == nil {
+		t.Errorf("expected error normalizing zero total probability")
+	}
+	if _, err := NormalizeDisruptions([]Disruption{{Time: 1, Prob: 1}, {Time: 2, Prob: -1}}); err == nil {
+		t.Errorf("expected error normalizing negative probability")
+	}
+}
+
+func TestParseDisrupName(t *testing.T) {
+	d, err := parseDisrup(map[string]interface{}{"Name": "sep-shutdown", "Time": 10.0, "KillProto": "sep"}, optNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Name != "sep-shutdown" || d.Time != 10 || d.KillProto != "sep" {
+		t.Errorf("parsed wrong disruption: %+v", d)
+	}
+}
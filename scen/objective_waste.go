@@ -0,0 +1,73 @@
+package scen
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+)
+
+// ObjWasteCost returns the present value (t=0) of the waste holding cost
+// accumulated over the simulation:
+//
+//	sum over t, proto, nuc of
+//	    mass(proto, nuc, t) * NuclideCost[nuc] * (1 - WasteDiscount[proto]) * DiscountFactor(t)
+//
+// where mass(proto, nuc, t) is the mass (kg) of nuclide nuc held in the
+// inventories of all agents of prototype proto at time step t, NuclideCost
+// is keyed by nuclide id (e.g. "922350000" - see NuclideNotation), and
+// WasteDiscount is taken from the matching entry in Facs (zero for
+// prototypes not in Facs - so e.g. repositories must be exempted with a
+// WasteDiscount of 1).  Each time step's cost is discounted using the
+// scenario's annual Discount rate and Compounding convention (see
+// Scenario.DiscountFactor).  Because inventories are evaluated separately at
+// every time step, inventory changes - including those from decay, if cyclus
+// is configured to decay materials - are accounted for.
+//
+// The following tables/columns from the post-processed (see
+// github.com/rwcarlsen/cyan/post) cyclus database are used:
+//
+//   - TimeList: SimId, Time
+//   - Inventories: SimId, AgentId, StartTime, EndTime, QualId, Quantity
+//   - Compositions: SimId, QualId, NucId, MassFrac
+//   - Agents: SimId, AgentId, Prototype
+//
+// An inventory entry is held at time t if StartTime <= t < EndTime.
+func ObjWasteCost(scen *Scenario, db *sql.DB, simid []byte) (float64, error) {
+	q := `
+		SELECT tl.Time, a.Prototype, cmp.NucId, TOTAL(cmp.MassFrac * inv.Quantity)
+		FROM TimeList AS tl
+		JOIN Inventories AS inv ON inv.SimId = tl.SimId AND inv.StartTime <= tl.Time AND inv.EndTime > tl.Time
+		JOIN Compositions AS cmp ON cmp.SimId = inv.SimId AND cmp.QualId = inv.QualId
+		JOIN Agents AS a ON a.SimId = inv.SimId AND a.AgentId = inv.AgentId
+		WHERE tl.SimId = ?
+		GROUP BY tl.Time, a.Prototype, cmp.NucId
+		`
+
+	costs := scen.nuclideCosts()
+	discounts := map[string]float64{}
+	for _, fac := range scen.Facs {
+		discounts[fac.Proto] = fac.WasteDiscount
+	}
+
+	rows, err := db.Query(q, simid)
+	if err != nil {
+		return math.Inf(1), err
+	}
+	defer rows.Close()
+
+	totcost := 0.0
+	for rows.Next() {
+		var t, nucid int
+		var proto string
+		var mass float64
+		if err := rows.Scan(&t, &proto, &nucid, &mass); err != nil {
+			return math.Inf(1), err
+		}
+		cost := mass * costs[fmt.Sprint(nucid)] * (1 - discounts[proto])
+		totcost += cost * scen.DiscountFactor(t)
+	}
+	if err := rows.Err(); err != nil {
+		return math.Inf(1), err
+	}
+	return totcost, nil
+}
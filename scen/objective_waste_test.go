@@ -0,0 +1,160 @@
+package scen
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/rwcarlsen/go-sqlite3"
+)
+
+func TestObjWasteCost(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudlus-waste")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "waste.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	simid := []byte("sim1")
+	other := []byte("sim2")
+	stmts := []string{
+		"CREATE TABLE TimeList (SimId BLOB, Time INTEGER);",
+		"CREATE TABLE Agents (SimId BLOB, AgentId INTEGER, Prototype TEXT);",
+		"CREATE TABLE Compositions (SimId BLOB, QualId INTEGER, NucId INTEGER, MassFrac REAL);",
+		"CREATE TABLE Inventories (SimId BLOB, ResourceId INTEGER, AgentId INTEGER, StartTime INTEGER, EndTime INTEGER, QualId INTEGER, Quantity REAL);",
+	}
+	for _, stmt := range stmts {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	exec := func(q string, args ...interface{}) {
+		if _, err := db.Exec(q, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, id := range [][]byte{simid, other} {
+		for tm := 0; tm < 4; tm++ {
+			exec("INSERT INTO TimeList VALUES (?,?)", id, tm)
+		}
+		exec("INSERT INTO Agents VALUES (?,1,'reactor'),(?,2,'repo'),(?,3,'sep')", id, id, id)
+		exec("INSERT INTO Compositions VALUES (?,1,922350000,0.5),(?,1,942390000,0.5),(?,2,942390000,1)", id, id, id)
+	}
+
+	// reactor: qual 1 for t=0,1 and qual 2 for t=1,2,3
+	exec("INSERT INTO Inventories VALUES (?,1,1,0,2,1,10)", simid)
+	exec("INSERT INTO Inventories VALUES (?,2,1,1,4,2,4)", simid)
+	// repo: exempt
+	exec("INSERT INTO Inventories VALUES (?,3,2,0,4,2,100)", simid)
+	// sep: decaying inventory - 8 kg for t=0,1 and 6 kg for t=2,3
+	exec("INSERT INTO Inventories VALUES (?,4,3,0,2,2,8)", simid)
+	exec("INSERT INTO Inventories VALUES (?,5,3,2,4,2,6)", simid)
+	// different simulation: must be ignored
+	exec("INSERT INTO Inventories VALUES (?,6,3,0,4,1,1000)", other)
+
+	scen := &Scenario{
+		NuclideCost: map[string]float64{"922350000": 1, "942390000": 2},
+		Discount:    0.12,
+		Facs: []Facility{
+			{Proto: "reactor", WasteDiscount: 0.5},
+			{Proto: "repo", WasteDiscount: 1},
+		},
+	}
+
+	// undiscounted cost per time step: reactor (half waived) + sep
+	costs := []float64{
+		(5*1+5*2)*0.5 + 8*2,
+		(5*1+5*2+4*2)*0.5 + 8*2,
+		(4*2)*0.5 + 6*2,
+		(4*2)*0.5 + 6*2,
+	}
+	want := 0.0
+	for tm, c := range costs {
+		want += c / math.Pow(1.01, float64(tm))
+	}
+
+	got, err := ObjWasteCost(scen, db, simid)
+	if err != nil {
+		t.Fatal(err)
+	} else if math.Abs(got-want) > 1e-9 {
+		t.Errorf("got waste cost %v, want %v", got, want)
+	}
+
+	scen.Compounding = CompoundContinuous
+	want = 0.0
+	for tm, c := range costs {
+		want += c * math.Exp(-0.01*float64(tm))
+	}
+	got, err = ObjWasteCost(scen, db, simid)
+	if err != nil {
+		t.Fatal(err)
+	} else if math.Abs(got-want) > 1e-9 {
+		t.Errorf("continuous compounding: got waste cost %v, want %v", got, want)
+	}
+}
+
+func TestDiscountCompounding(t *testing.T) {
+	const rate = 0.12
+	const nt = 24
+	monthly := &Scenario{Discount: rate}
+	continuous := &Scenario{Discount: rate, Compounding: CompoundContinuous}
+
+	// flat cost stream of 1 per time step
+	summ, sumc := 0.0, 0.0
+	for tm := 0; tm < nt; tm++ {
+		summ += monthly.DiscountFactor(tm)
+		sumc += continuous.DiscountFactor(tm)
+	}
+
+	wantm := (1 - math.Pow(1.01, -nt)) / (1 - 1/1.01)
+	wantc := (1 - math.Exp(-0.01*nt)) / (1 - math.Exp(-0.01))
+	if math.Abs(summ-wantm) > 1e-9 {
+		t.Errorf("monthly: got PV %v, want %v", summ, wantm)
+	}
+	if math.Abs(sumc-wantc) > 1e-9 {
+		t.Errorf("continuous: got PV %v, want %v", sumc, wantc)
+	}
+	if !(sumc < summ) {
+		t.Errorf("continuous PV %v should be less than monthly PV %v", sumc, summ)
+	}
+	if got, want := PV(2, nt, rate), 2*monthly.DiscountFactor(nt); got != want {
+		t.Errorf("PV: got %v, want %v", got, want)
+	}
+
+	// a year out, factors should match the familiar annual conventions
+	if got, want := monthly.DiscountFactor(12), 1/math.Pow(1.01, 12); math.Abs(got-want) > 1e-12 {
+		t.Errorf("monthly factor at t=12: got %v, want %v", got, want)
+	}
+	if got, want := continuous.DiscountFactor(12), math.Exp(-rate); math.Abs(got-want) > 1e-12 {
+		t.Errorf("continuous factor at t=12: got %v, want %v", got, want)
+	}
+
+	explicit := &Scenario{Discount: rate, Compounding: CompoundMonthly}
+	if got, want := explicit.DiscountFactor(7), monthly.DiscountFactor(7); got != want {
+		t.Errorf("explicit monthly factor %v != default factor %v", got, want)
+	}
+
+	for _, c := range []string{"", CompoundMonthly, CompoundContinuous, "daily"} {
+		s := &Scenario{
+			SimDur:      2,
+			BuildPeriod: 1,
+			Facs:        []Facility{{Proto: "Proto1", Cap: 1}},
+			MinPower:    []float64{0},
+			MaxPower:    []float64{0},
+			Compounding: c,
+		}
+		if err := s.Validate(); (err != nil) != (c == "daily") {
+			t.Errorf("Compounding %q: got validation error %v", c, err)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package scen
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/rwcarlsen/cyan/post"
+	"github.com/rwcarlsen/cyan/query"
+)
+
+// Post-processing metrics for Scenario.PostMetrics.  Each names a table that
+// post-processing adds to the cyclus output database.
+const (
+	// PostAgents builds the Agents table (each agent's prototype, lifetime,
+	// and enter and exit times).
+	PostAgents = "agents"
+	// PostTimeList builds the TimeList table of all simulation time steps.
+	PostTimeList = "timelist"
+	// PostInventories builds the Inventories table of every agent's
+	// material holdings over time.  This is the expensive part of
+	// post-processing - it walks the entire resource history - and it
+	// requires the other tables too, so selecting it runs the full cyan
+	// post-processing pipeline.
+	PostInventories = "inventories"
+)
+
+// ObjPostMetrics lists the post-processing metrics each of the ObjFuncs
+// requires.  Objective functions not listed here require the full
+// post-processing pipeline.
+var ObjPostMetrics = map[string][]string{
+	"":                   {PostAgents},
+	"slowvfast":          {PostAgents},
+	"slowvfast-penalty":  {PostAgents},
+	"slowvfast-penalty2": {PostAgents},
+	"slowvfast-fueled":   {PostAgents},
+	"ans2014":            {PostAgents, PostTimeList, PostInventories},
+	"waste-cost":         {PostAgents, PostTimeList, PostInventories},
+}
+
+var postMetrics = map[string]bool{PostAgents: true, PostTimeList: true, PostInventories: true}
+
+// partialPostTable names the table listing the simulations that only have
+// some of their post-processing tables built.  cyan's post package treats
+// any simulation with Agents rows as fully post-processed, so these rows
+// are removed before the full pipeline is run.
+const partialPostTable = "PartialPost"
+
+// PostProcess post-processes the cyclus output database db and returns the
+// ids of the simulations in it.  Only the scenario's PostMetrics are built
+// unless it is empty or includes PostInventories, in which case the full
+// cyan post-processing pipeline is run (see post.Process).  Simulations
+// that have already been fully post-processed are skipped and ones that
+// were only partially post-processed are redone.
+func (s *Scenario) PostProcess(db *sql.DB) (simids [][]byte, err error) {
+	want := map[string]bool{}
+	for _, m := range s.PostMetrics {
+		if !postMetrics[m] {
+			return nil, fmt.Errorf("invalid PostMetrics entry '%v'", m)
+		}
+		want[m] = true
+	}
+
+	stmts := []string{
+		"CREATE TABLE IF NOT EXISTS TimeSeriesPower (SimId BLOB,AgentId INTEGER,Time INTEGER, Value REAL);",
+		"CREATE TABLE IF NOT EXISTS Agents (SimId BLOB,AgentId INTEGER,Kind TEXT,Spec TEXT,Prototype TEXT,ParentId INTEGER,Lifetime INTEGER,EnterTime INTEGER,ExitTime INTEGER);",
+		"CREATE TABLE IF NOT EXISTS AgentExit (SimId BLOB,AgentId INTEGER,ExitTime INTEGER);",
+		"CREATE TABLE IF NOT EXISTS TimeList (SimId BLOB, Time INTEGER);",
+		"CREATE TABLE IF NOT EXISTS " + partialPostTable + " (SimId BLOB);",
+	}
+	for _, stmt := range stmts {
+		if _, err := db.Exec(stmt); err != nil {
+			return nil, err
+		}
+	}
+
+	simids, err = post.GetSimIds(db)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range simids {
+		if err := postSim(db, id, want); err != nil {
+			return nil, err
+		}
+	}
+	if len(want) == 0 || want[PostInventories] {
+		return post.Process(db)
+	}
+
+	stmts = []string{
+		query.Index("TimeSeriesPower", "SimId", "AgentId", "Time", "Value"),
+		query.Index("Agents", "SimId", "Prototype"),
+		query.Index("Agents", "SimId", "AgentId", "Prototype"),
+		query.Index("TimeList", "Time"),
+		query.Index("TimeList", "SimId", "Time"),
+	}
+	for _, stmt := range stmts {
+		if _, err := db.Exec(stmt); err != nil {
+			return nil, err
+		}
+	}
+	return simids, nil
+}
+
+// postSim builds the wanted post-processing tables (other than
+// PostInventories) for simulation simid and records it in partialPostTable.
+// The Agents and TimeList tables are built the same way cyan's post package
+// builds them.  Earlier partial post-processing of the simulation is removed
+// first.  If the full pipeline is wanted, only that removal is done and
+// post.Process builds the rest.
+func postSim(db *sql.DB, simid []byte, want map[string]bool) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var n int
+	err = tx.QueryRow("SELECT COUNT(*) FROM "+partialPostTable+" WHERE SimId = ?", simid).Scan(&n)
+	if err != nil {
+		return err
+	} else if n > 0 {
+		for _, tbl := range []string{"Agents", "TimeList", partialPostTable} {
+			if _, err := tx.Exec("DELETE FROM "+tbl+" WHERE SimId = ?", simid); err != nil {
+				return err
+			}
+		}
+	} else {
+		err = tx.QueryRow("SELECT COUNT(*) FROM Agents WHERE SimId = ?", simid).Scan(&n)
+		if err != nil {
+			return err
+		} else if n > 0 {
+			return nil // already fully post-processed
+		}
+	}
+
+	if len(want) == 0 || want[PostInventories] {
+		return tx.Commit()
+	}
+
+	_, err = tx.Exec(`INSERT INTO Agents
+		SELECT n.SimId,n.AgentId,n.Kind,n.Spec,n.Prototype,n.ParentId,n.Lifetime,n.EnterTime,x.ExitTime
+		FROM AgentEntry AS n
+		LEFT JOIN AgentExit AS x ON n.AgentId = x.AgentId AND n.SimId = x.SimId
+		WHERE n.SimId = ?;`, simid)
+	if err != nil {
+		return err
+	}
+
+	if want[PostTimeList] {
+		var dur int
+		if err := tx.QueryRow("SELECT Duration FROM Info WHERE SimId = ?;", simid).Scan(&dur); err != nil {
+			return err
+		}
+		for t := 0; t < dur; t++ {
+			if _, err := tx.Exec("INSERT INTO TimeList VALUES (?, ?);", simid, t); err != nil {
+				return err
+			}
+		}
+	}
+
+	if _, err := tx.Exec("INSERT INTO "+partialPostTable+" VALUES (?);", simid); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
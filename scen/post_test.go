@@ -0,0 +1,116 @@
+package scen
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/rwcarlsen/go-sqlite3"
+)
+
+func TestPostProcess(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudlus-post")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "post.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	exec := func(q string, args ...interface{}) {
+		if _, err := db.Exec(q, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exec("CREATE TABLE Info (SimId BLOB, Duration INTEGER);")
+	exec("CREATE TABLE AgentEntry (SimId BLOB, AgentId INTEGER, Kind TEXT, Spec TEXT, Prototype TEXT, ParentId INTEGER, Lifetime INTEGER, EnterTime INTEGER);")
+	exec("INSERT INTO Info VALUES (?, 5)", []byte("sim1"))
+	exec("INSERT INTO AgentEntry VALUES (?,1,'Facility',':a:b','reactor',0,-1,0),(?,2,'Facility',':a:b','reactor',0,3,1)", []byte("sim1"), []byte("sim1"))
+
+	count := func(q string) int {
+		n := 0
+		if err := db.QueryRow(q).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	s := &Scenario{PostMetrics: []string{PostAgents, PostTimeList}}
+	for i := 0; i < 2; i++ {
+		simids, err := s.PostProcess(db)
+		if err != nil {
+			t.Fatal(err)
+		} else if len(simids) != 1 || string(simids[0]) != "sim1" {
+			t.Errorf("got simids %q, want [sim1]", simids)
+		}
+	}
+
+	// the second run must not duplicate anything
+	if n := count("SELECT COUNT(*) FROM Agents WHERE Prototype = 'reactor'"); n != 2 {
+		t.Errorf("got %v agents, want 2", n)
+	}
+	if n := count("SELECT COUNT(*) FROM TimeList"); n != 5 {
+		t.Errorf("got %v time steps, want 5", n)
+	}
+	if n := count("SELECT COUNT(*) FROM sqlite_master WHERE name = 'Inventories'"); n != 0 {
+		t.Errorf("Inventories table was created without being requested")
+	}
+
+	// the full pipeline redoes partially post-processed simulations
+	s.PostMetrics = nil
+	if _, err := s.PostProcess(db); err != nil {
+		t.Fatal(err)
+	}
+	if n := count("SELECT COUNT(*) FROM Agents"); n != 2 {
+		t.Errorf("after full post-processing: got %v agents, want 2", n)
+	}
+	if n := count("SELECT COUNT(*) FROM TimeList"); n != 5 {
+		t.Errorf("after full post-processing: got %v time steps, want 5", n)
+	}
+	if n := count("SELECT COUNT(*) FROM sqlite_master WHERE name = 'Inventories'"); n != 1 {
+		t.Errorf("full post-processing didn't build the Inventories table")
+	}
+	if n := count("SELECT COUNT(*) FROM " + partialPostTable); n != 0 {
+		t.Errorf("fully post-processed simulation is still marked partial")
+	}
+
+	s.PostMetrics = []string{"bogus"}
+	if _, err := s.PostProcess(db); err == nil {
+		t.Errorf("invalid PostMetrics entry was not rejected")
+	}
+}
+
+func TestPostMetricsProblems(t *testing.T) {
+	tests := []struct {
+		obj     string
+		metrics []string
+		ok      bool
+	}{
+		{"", nil, true},
+		{"", []string{PostAgents}, true},
+		{"slowvfast", []string{PostTimeList}, false},
+		{"ans2014", []string{PostAgents, PostTimeList}, false},
+		{"ans2014", []string{PostAgents, PostTimeList, PostInventories}, true},
+		{"", []string{PostAgents, "bogus"}, false},
+	}
+	for _, test := range tests {
+		s := &Scenario{
+			SimDur:      2,
+			BuildPeriod: 1,
+			Facs:        []Facility{{Proto: "Proto1", Cap: 1}},
+			MinPower:    []float64{0},
+			MaxPower:    []float64{0},
+			ObjFunc:     test.obj,
+			PostMetrics: test.metrics,
+		}
+		if err := s.Validate(); (err == nil) != test.ok {
+			t.Errorf("ObjFunc %q with PostMetrics %v: got validation error %v", test.obj, test.metrics, err)
+		}
+	}
+}
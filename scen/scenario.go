@@ -2,33 +2,116 @@ package scen
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/binary"
+	"encoding/csv"
 	"encoding/json"
+	"encoding/xml"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"math"
+	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"text/template"
+
+	"github.com/rwcarlsen/cyan/nuc"
+)
+
+// Discount compounding conventions for Scenario.Compounding.
+const (
+	CompoundMonthly    = "monthly"
+	CompoundContinuous = "continuous"
+)
+
+// Nuclide notations for Scenario.NuclideNotation.
+const (
+	// NotationId only accepts cyclus nuclide ids (e.g. "922350000").
+	NotationId = "id"
+	// NotationAny also accepts the other nuclide forms understood by
+	// cyclus/cyan (e.g. "U235", "Am242m", or "92235").
+	NotationAny = "any"
+)
+
+// Cyclus output formats for Scenario.CyclusOutFormat.
+const (
+	OutSQLite = "sqlite"
+	OutHDF5   = "hdf5"
 )
 
+// outFormats maps cyclus output formats to the output file extension (which
+// cyclus selects its output backend by) and the database/sql driver used to
+// post-process and compute objectives from the output.  Formats without a
+// driver can't be post-processed - neither the post package nor the
+// objective functions can read HDF5 output yet.
+var outFormats = map[string]struct{ Ext, Driver string }{
+	OutSQLite: {".sqlite", "sqlite3"},
+	OutHDF5:   {".h5", ""},
+}
+
 // Facility represents a cyclus agent prototype that could be built by the
 // optimizer.
 type Facility struct {
 	Proto string
-	// Cap is the net/effective power generation capacity of the facility
-	// which must include any non-unity capacity factor.
+	// Cap is the net (nameplate) power generation capacity of the facility.
 	Cap float64
+	// CapFactor is the fraction (in (0, 1]) of Cap the facility generates on
+	// average accounting for availability.  Zero (i.e. unset) means 1.  All
+	// power capacity calculations (e.g. for satisfying MinPower and
+	// MaxPower) use the effective capacity Cap*CapFactor.
+	CapFactor float64
+	// CapSchedule optionally ramps or derates the facility's capacity over
+	// its life.  Each sample gives the fraction of Cap (Y) available at an
+	// age (X, in timesteps since the facility was built).  Fractions are
+	// interpolated linearly between samples and held constant before the
+	// first and after the last sample.  Ages must be non-negative and
+	// strictly increasing.  If empty, the full Cap is available at every
+	// age.  New builds are sized by their capacity at age zero.
+	CapSchedule []Sample
 	// The lifetime of the facility (in timesteps). The lifetime must also
 	// be specified manually (consistent with this value) in the prototype
-	// definition in the cyclus input template file.
+	// definition in the cyclus input template file.  Zero or InfiniteLife
+	// means the facility never retires.
 	Life int
 	// BuildAfter is the time step after which this facility type can be built.
 	// -1 for never available, and 0 for always available.
 	BuildAfter int
+	// BuildBefore is the time step at (and after) which this facility type
+	// can no longer be built.  Zero (or negative) means there is no upper
+	// bound.  Together with BuildAfter, this defines the window of time
+	// during which the facility is available for deployment.
+	BuildBefore int
 	// FracOfProto names a prototype that build fractions of this prototype
-	// are a portion of.
+	// are a portion of.  A facility may not list itself, and FracOfProtos
+	// relationships between facilities must not form cycles.
 	FracOfProtos []string
+	// MaxBuild is the maximum total number of this prototype that may ever
+	// be built (including StartBuilds).  Zero means unlimited.  Any power
+	// capacity that can't be satisfied by a reactor because of this limit is
+	// passed on to the next reactor type.
+	MaxBuild int
+	// WasteDiscount is the fraction (between 0 and 1) of the waste cost (see
+	// NuclideCost) that is waived for material held by this prototype - e.g.
+	// 1 for a repository.
+	WasteDiscount float64
+	// BuildBlock is the number of facilities that must be deployed together
+	// - e.g. 4 for a 4-pack of small modular reactors.  The number built at
+	// any time is always a multiple of BuildBlock.  Zero (i.e. unset) means
+	// 1.
+	BuildBlock int
+	// Implicit designates the reactor that builds whatever new power
+	// capacity the other reactors' build fractions leave unsatisfied (see
+	// TransformVars).  It has no variable of its own, so it is the reactor
+	// the optimizer falls back on - e.g. the reference technology.  At most
+	// one facility may set it and only on a buildable reactor.  If none do,
+	// the first reactor in Facs is implicit.
+	Implicit bool
 }
 
 // Alive returns whether or not a facility built at the specified time is
@@ -37,57 +120,216 @@ func (f *Facility) Alive(built, t int) bool { return Alive(built, t, f.Life) }
 
 // Available returns true if the facility type can be built at time t.
 func (f *Facility) Available(t int) bool {
-	return t >= f.BuildAfter && f.BuildAfter >= 0
+	return t >= f.BuildAfter && f.BuildAfter >= 0 && (f.BuildBefore <= 0 || t < f.BuildBefore)
+}
+
+// EffCap returns the effective power capacity of the facility - i.e. Cap
+// adjusted by CapFactor.
+func (f *Facility) EffCap() float64 {
+	if f.CapFactor == 0 {
+		return f.Cap
+	}
+	return f.Cap * f.CapFactor
+}
+
+// CapAt returns the effective power capacity (see EffCap) of a facility of
+// the given age (in timesteps since it was built) according to its
+// CapSchedule.
+func (f *Facility) CapAt(age int) float64 {
+	ss := f.CapSchedule
+	switch {
+	case len(ss) == 0:
+		return f.EffCap()
+	case float64(age) <= ss[0].X:
+		return f.EffCap() * ss[0].Y
+	case float64(age) >= ss[len(ss)-1].X:
+		return f.EffCap() * ss[len(ss)-1].Y
+	}
+	return f.EffCap() * linearAt(ss, float64(age))
+}
+
+// block returns the facility's effective BuildBlock.
+func (f *Facility) block() int {
+	if f.BuildBlock <= 0 {
+		return 1
+	}
+	return f.BuildBlock
+}
+
+// roundBuild rounds n facilities to the nearest whole (non-negative) number
+// of build blocks and returns the number of facilities.
+func (f *Facility) roundBuild(n float64) int {
+	b := float64(f.block())
+	return int(math.Max(0, math.Floor(n/b+0.5))) * f.block()
 }
 
+// limitBuild returns nbuild reduced as necessary so that building it on top
+// of the nbuilt facilities already built does not exceed MaxBuild.  The
+// result is kept a multiple of BuildBlock.
+func (f *Facility) limitBuild(nbuild, nbuilt int) int {
+	if f.MaxBuild <= 0 || nbuilt+nbuild <= f.MaxBuild {
+		return nbuild
+	}
+	n := int(math.Max(0, float64(f.MaxBuild-nbuilt)))
+	return n / f.block() * f.block()
+}
+
+// InfiniteLife is the lifetime of facilities that never retire.  It matches
+// cyclus' own convention for agent lifetimes.
+const InfiniteLife = -1
+
 type Build struct {
 	Time  int
 	Proto string
 	N     int
-	Life  int
-	fac   Facility
+	// Life is the lifetime (in timesteps) of the built facilities.  Zero
+	// means the lifetime is inherited from the prototype's Facility, and
+	// InfiniteLife means the facilities never retire regardless of the
+	// prototype's lifetime.
+	Life int
+	fac  Facility
 }
 
 // Alive returns whether or not the facility is still operabing/active at t.
 func (b Build) Alive(t int) bool { return Alive(b.Time, t, b.Lifetime()) }
 
+// Lifetime returns the effective lifetime of the built facilities (see
+// Build.Life) - InfiniteLife if they never retire.
 func (b Build) Lifetime() int {
 	if b.Life > 0 {
 		return b.Life
-	} else if b.fac.Life > 0 {
+	} else if b.Life == 0 && b.fac.Life > 0 {
 		return b.fac.Life
 	} else {
-		return -1
+		return InfiniteLife
 	}
 }
 
 // Alive returns whether or not a facility with the given lifetime and built
-// at the specified time is still operating/active at t.
+// at the specified time is still operating/active at t.  A lifetime of zero
+// or less (e.g. InfiniteLife) means the facility never retires.
 func Alive(built, t, life int) bool {
 	return built <= t && (built+life > t || life <= 0)
 }
 
+// FacGroup is a constraint on the fraction of a scenario's deployed power
+// capacity supplied by a group of prototypes.
+type FacGroup struct {
+	// Name identifies the group in constraint violations.
+	Name string
+	// Protos are the prototypes (from Facs) in the group.
+	Protos []string
+	// MinFrac and MaxFrac bound the fraction of the total power capacity
+	// deployed at each build period that the group's facilities must
+	// supply.  A MaxFrac of zero means there is no maximum.
+	MinFrac float64
+	MaxFrac float64
+}
+
+// GroupViolation describes a build period in which a FacGroup constraint is
+// violated.
+type GroupViolation struct {
+	Group  string
+	Period int
+	Time   int
+	// Frac is the fraction of the power capacity the group supplied.
+	Frac float64
+	// Min and Max are the group's MinFrac and MaxFrac.
+	Min, Max float64
+}
+
+func (v GroupViolation) String() string {
+	return fmt.Sprintf("group %v supplies %.3g of the power capacity at time %v (period %v) - want %v to %v", v.Group, v.Frac, v.Time, v.Period, v.Min, v.Max)
+}
+
 type Scenario struct {
 	// SimDur is the simulation duration in timesteps (months)
 	SimDur int
 	// BuildOffset is the number of timesteps after simulation start at which
 	// deployments actually begin.  This allows facilities and other initial
-	// conditions to be set up and run before the deploying begins.
+	// conditions to be set up and run before the deploying begins.  The
+	// first build period starts at BuildOffset+1 (see PeriodTimes for the
+	// full timing model).
 	BuildOffset int
 	// TrailingDur is the number of timesteps of the simulation duration that
 	// are reserved for wind-down - no new deployments will be made.
 	TrailingDur int
 	// CyclusTmpl is the relative path to the text templated cyclus input file
-	// rooted from the directory of the scenario file.
+	// rooted from the directory of the scenario file.  The template is
+	// executed with the scenario as its data and has the following helper
+	// functions available in addition to the standard text/template ones:
+	//
+	//   * add, sub, mul, div: integer arithmetic on two arguments (e.g.
+	//     {{add .SimDur .BuildOffset}}).
+	//
+	//   * seq: returns the integers from its first argument up to (but not
+	//     including) its second (e.g. {{range seq 0 .SimDur}}).
+	//
+	//   * periodTimes: returns the time steps of each of the scenario's
+	//     build periods in order.
+	//
+	//   * include: returns the contents of the named file (relative to and
+	//     inside the directory of the scenario file) - e.g.
+	//     {{include "regions.xml"}}.
+	//
+	// The scenario's Deployments method provides the builds grouped by
+	// prototype with ready to use time steps.
 	CyclusTmpl string
+	// CyclusTmplPartials are the relative paths (like CyclusTmpl) of
+	// additional template files parsed together with CyclusTmpl.  Each file
+	// is a template named by its base file name that the others can execute
+	// - e.g. {{template "reactors.xml" .}} - and the templates it defines
+	// with {{define "name"}} are available too.  See TmplPartials for the
+	// order the files are parsed in.
+	CyclusTmplPartials []string
+	// TmplVariants are named sets of template partials (like
+	// CyclusTmplPartials) - e.g. one per underlying reactor model.
+	// TmplVariant selects the set used, so a scenario can switch between
+	// models without duplicating the scenario or its main template.
+	TmplVariants map[string][]string
+	// TmplVariant names the entry of TmplVariants whose partials are parsed
+	// with the template.  If empty, no variant partials are used.
+	TmplVariant string
+	// AuxFiles are the relative paths (rooted from the directory of the
+	// scenario file like CyclusTmpl) of auxiliary files needed to run the
+	// scenario - e.g. recipe files or XML includes referenced by the
+	// template.  They are sent along with remotely run scenarios and placed
+	// at the same relative paths.  Cyclus is always run from the scenario
+	// file's directory so relative references to them resolve.
+	AuxFiles []string
+	// CyclusOutFormat is the format of the cyclus output database: "sqlite"
+	// (the default if empty) or "hdf5".  Scenarios can only be run and
+	// post-processed locally if there is a driver available for the format
+	// (see PostDriver).
+	CyclusOutFormat string
+	// PostMetrics optionally restricts post-processing of the cyclus output
+	// database to the listed tables (see PostAgents, PostTimeList, and
+	// PostInventories) to save time on large databases.  It must include
+	// every metric the objective function requires (see ObjPostMetrics).
+	// The full post-processing pipeline is run if it is empty.
+	PostMetrics []string
 	// BuildPeriod is the number of timesteps between timesteps in which
 	// facilities are deployed
 	BuildPeriod int
 	// NuclideCost represents the waste cost per kg material per time step for
-	// each nuclide in the entire simulation (repository's exempt).  This is
-	// just information that can optionally be used by some objective
-	// functions.
+	// each nuclide in the entire simulation (repository's exempt - see
+	// Facility.WasteDiscount).  Keys are nuclide ids (e.g. "922350000") or
+	// any other form allowed by NuclideNotation.  This is just information
+	// that can optionally be used by some objective functions (e.g.
+	// ObjWasteCost).
 	NuclideCost map[string]float64
+	// NuclideNotation is the notation of the NuclideCost keys: "id" (the
+	// default) or "any" (see NotationId and NotationAny).  Keys in other
+	// forms are converted to nuclide ids when costs are computed -
+	// NuclideCost itself is left as given.
+	NuclideNotation string
+	// NuclideCostFile is the optional path (relative paths are rooted from
+	// the directory of the scenario file) of a table of nuclide costs shared
+	// between scenarios.  It is either a JSON object mapping nuclide ids to
+	// costs or - if the name ends in ".csv" - a CSV file with nuclide id and
+	// cost columns (and an optional header row).  Decode merges its entries
+	// into NuclideCost; entries given inline in NuclideCost take precedence.
+	NuclideCostFile string
 	// ObjFunc is the name of the objective function in the
 	// ObjFuncs map variable to be used for
 	// objective value calculations.
@@ -115,13 +357,32 @@ type Scenario struct {
 	// fire off one simulation for each sub-simulation - causing problems.
 	SingleCalc bool
 	// Discount represents the nominal annual discount rate (including
-	// inflation) for the simulation.
+	// inflation) for the simulation.  Objective functions convert it to a
+	// per time step (month) discount factor according to Compounding.
 	Discount float64
+	// Compounding is the convention used to convert Discount into a per time
+	// step discount factor for a cost incurred at time step t (see
+	// DiscountFactor).  It must be one of:
+	//
+	//   * "" or "monthly": 1 / (1 + Discount/12)^t
+	//
+	//   * "continuous": exp(-Discount * t/12)
+	Compounding string
 	// CustomConfig is for internal use for
 	// configuration used in things like disruption scenarios where each run
 	// or objective evaluation consists of multiple simulations with various
 	// perturbations.
 	CustomConfig map[string]interface{}
+	// InterpMethod is the method used by the disrup-multi objective modes
+	// to interpolate disruption probabilities and sub-objective values
+	// between disruption times: "" or "linear" for linear interpolation, or
+	// "pchip" for monotone cubic splines (see InterpPCHIP).
+	InterpMethod string
+	// IntegrationIntervals is the number of intervals used by the
+	// disrup-multi objective modes to integrate the sub-objectives over the
+	// disruption probability distribution.  More intervals are more accurate
+	// but slower.  DefaultIntegrationIntervals is used if it is zero.
+	IntegrationIntervals int
 	// Facs is a list of facilities that could be built and associated
 	// parameters relevant to the optimization objective.
 	Facs []Facility
@@ -131,11 +392,47 @@ type Scenario struct {
 	// MaxPower is a series of max deployed power capacity requirements that
 	// must be maintained for each build period.
 	MaxPower []float64
+	// PowerUnit names the unit of the scenario's power values - the
+	// facilities' Cap, MinPower and MaxPower (e.g. "MWe").  It is
+	// informational only.
+	PowerUnit string
+	// PowerScale is the number of cyclus power units (i.e. the units of
+	// power in the cyclus input file template and in cyclus output) per
+	// PowerUnit - e.g. 1000 for a GWe scenario whose reactors are MWe in
+	// cyclus.  All deployment calculations (TransformVars, PowerCap,
+	// PowerDeficit, etc.) work in PowerUnit - PowerScale is only applied
+	// where scenario power meets cyclus power: objectives compare
+	// CyclusPower(PowerCap(...)) to cyclus' power output and templates use
+	// the "power" func to convert scenario power values.  Zero means 1.
+	PowerScale float64
+	// SoftPower, if true, makes MinPower a soft constraint: TransformVars
+	// doesn't force any builds to satisfy it, and instead CalcObjective adds
+	// a penalty of PowerPenalty times the power capacity deficit below
+	// MinPower integrated over all the build periods' time steps (see
+	// PowerDeficit).
+	SoftPower bool
+	// PowerPenalty is the objective penalty per unit of power capacity
+	// deficit per time step for SoftPower scenarios.
+	PowerPenalty float64
+	// Groups constrain the share of the deployed power capacity supplied by
+	// groups of prototypes (e.g. advanced reactors).  They are not enforced
+	// by TransformVars - CheckGroupConstraints reports the build periods in
+	// which the Builds violate them.
+	Groups []FacGroup
 	// StartBuilds holds the set of build schedule values for all agents
 	// initially in the scenario (not added/deployed by optimizer).
 	StartBuilds []Build
-	// Builds holds all scenario deployments (including startbuilds).  This is
-	// only non-nil after TransformVars has been called.
+	// ForcedBuilds holds future deployments that are fixed regardless of
+	// the optimizer's variables (e.g. plants already under construction).
+	// TransformVars always includes them, and their capacity counts toward
+	// the power bounds of the build period they fall in - even if they are
+	// built after the period starts - so variable driven builds only fill
+	// the remainder.  They must be after BuildOffset and before the
+	// TrailingDur wind-down.
+	ForcedBuilds []Build
+	// Builds holds all scenario deployments (including startbuilds and
+	// forced builds).  This is only non-nil after TransformVars has been
+	// called.
 	Builds []Build
 	// File is the name of the scenario file. This is for internal use and
 	// does not need to be filled out by the user.
@@ -144,8 +441,23 @@ type Scenario struct {
 	// input file in i.e. the '<simhandle>' tag in the simulation control
 	// param section.
 	Handle string
+	// Env holds extra environment variables (e.g. CYCLUS_PATH) for the
+	// cyclus process(es) run for this scenario.  They are merged into the
+	// inherited environment with values here overriding inherited values of
+	// the same name (see Environ).
+	Env map[string]string
 	// tmpl is a cache for the templated cyclus input file
 	tmpl *template.Template
+	// tmplSrc holds the files tmpl was parsed from - CyclusTmpl followed by
+	// its partials (see Hash) - and tmplGiven is true if they were given to
+	// ParseTmpl and AddTmplPartial rather than read from disk.
+	tmplSrc   []tmplFile
+	tmplGiven bool
+}
+
+// tmplFile is the name and text of a cyclus input file template or partial.
+type tmplFile struct {
+	Name, Text string
 }
 
 func (s *Scenario) Clone() *Scenario {
@@ -156,6 +468,61 @@ func (s *Scenario) Clone() *Scenario {
 	return clone
 }
 
+// Hash returns a SHA-256 hash of the scenario configuration together with
+// vars that can be used as a key for caching simulation results.  The
+// scenario is serialized canonically (fixed field order and sorted map keys)
+// and File is ignored so that identical scenarios in different locations
+// hash the same.  If vars is non-nil, Builds is also ignored since it is
+// fully determined by vars (see TransformVars).  The text of the cyclus input
+// template and its partials as parsed (see ParseTmpl) and the contents of any
+// AuxFiles (if they can be read) are included so that edits to them change
+// the hash as well.  AuxFiles are skipped for templates given to ParseTmpl since they
+// can't include them.  An error is returned if the template can't be parsed
+// or the scenario can't be serialized - e.g. if it has NaN or infinite
+// values.
+func (s *Scenario) Hash(vars []float64) ([32]byte, error) {
+	var sum [32]byte
+	c := *s
+	c.File = ""
+	if vars != nil {
+		c.Builds = nil
+	}
+
+	h := sha256.New()
+	data, err := json.Marshal(&c)
+	if err != nil {
+		return sum, err
+	}
+	h.Write(data)
+
+	binary.Write(h, binary.LittleEndian, int64(len(vars)))
+	for _, v := range vars {
+		binary.Write(h, binary.LittleEndian, math.Float64bits(v))
+	}
+
+	if s.tmpl == nil && s.CyclusTmpl != "" {
+		if err := s.parseTmpl(); err != nil {
+			return sum, err
+		}
+	}
+	for _, f := range s.tmplSrc {
+		for _, str := range []string{f.Name, f.Text} {
+			binary.Write(h, binary.LittleEndian, int64(len(str)))
+			h.Write([]byte(str))
+		}
+	}
+	if !s.tmplGiven {
+		for _, name := range s.AuxFiles {
+			if aux, err := ioutil.ReadFile(filepath.Join(s.Dir(), name)); err == nil {
+				h.Write(aux)
+			}
+		}
+	}
+
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
+
 func (s *Scenario) reactors() []Facility {
 	rs := []Facility{}
 	for _, fac := range s.Facs {
@@ -166,6 +533,17 @@ func (s *Scenario) reactors() []Facility {
 	return rs
 }
 
+// implicitReactor returns the index (into reactors()) of the implicit reactor
+// (see Facility.Implicit).
+func (s *Scenario) implicitReactor() int {
+	for i, fac := range s.reactors() {
+		if fac.Implicit {
+			return i
+		}
+	}
+	return 0
+}
+
 func (s *Scenario) notreactors() []Facility {
 	fs := []Facility{}
 	for _, fac := range s.Facs {
@@ -176,6 +554,77 @@ func (s *Scenario) notreactors() []Facility {
 	return fs
 }
 
+// Summary returns a single line overview of the scenario for logs and CLI
+// output, e.g.:
+//
+//	SimDur 240, 10 build periods, 4 facilities (2 reactors, 1 support, 1 unbuildable), 30 vars, MinPower 10..70, MaxPower 20..80
+//
+// MinPower and MaxPower are reported as the range of their values over all
+// build periods.
+func (s *Scenario) Summary() string {
+	nreactor, nsupport, nnever := 0, 0, 0
+	for _, fac := range s.Facs {
+		switch {
+		case fac.BuildAfter < 0:
+			nnever++
+		case fac.Cap > 0:
+			nreactor++
+		default:
+			nsupport++
+		}
+	}
+	// same as NVars but without building the facility lists
+	nvars := (nreactor + nsupport) * s.nperiods()
+
+	return fmt.Sprintf("SimDur %v, %v build periods, %v facilities (%v reactors, %v support, %v unbuildable), %v vars, MinPower %v, MaxPower %v",
+		s.SimDur, s.nperiods(), len(s.Facs), nreactor, nsupport, nnever, nvars, valRange(s.MinPower), valRange(s.MaxPower))
+}
+
+// valRange formats the minimum and maximum of vals as "min..max" or "-" if
+// vals is empty.
+func valRange(vals []float64) string {
+	if len(vals) == 0 {
+		return "-"
+	}
+	lo, hi := vals[0], vals[0]
+	for _, v := range vals[1:] {
+		lo, hi = math.Min(lo, v), math.Max(hi, v)
+	}
+	return fmt.Sprintf("%v..%v", lo, hi)
+}
+
+// Prototypes returns the sorted names of all prototypes referenced by the
+// scenario: those in Facs, in the FracOfProtos of each facility, in Groups,
+// and in StartBuilds, ForcedBuilds, and Builds.  Names not defined in Facs
+// are included too (e.g. to check for typos against the cyclus template).
+func (s *Scenario) Prototypes() []string {
+	seen := map[string]bool{}
+	for _, fac := range s.Facs {
+		seen[fac.Proto] = true
+		for _, proto := range fac.FracOfProtos {
+			seen[proto] = true
+		}
+	}
+	for _, g := range s.Groups {
+		for _, proto := range g.Protos {
+			seen[proto] = true
+		}
+	}
+	for _, bs := range [][]Build{s.StartBuilds, s.ForcedBuilds, s.Builds} {
+		for _, b := range bs {
+			seen[b.Proto] = true
+		}
+	}
+	delete(seen, "")
+
+	protos := make([]string, 0, len(seen))
+	for proto := range seen {
+		protos = append(protos, proto)
+	}
+	sort.Strings(protos)
+	return protos
+}
+
 func (s *Scenario) Prototype(proto string) (Facility, error) {
 	for _, fac := range s.Facs {
 		if fac.Proto == proto {
@@ -185,29 +634,123 @@ func (s *Scenario) Prototype(proto string) (Facility, error) {
 	return Facility{}, fmt.Errorf("no prototype named '%v'", proto)
 }
 
-func (s *Scenario) NVars() int { return s.NVarsPerPeriod() * s.nperiods() }
+// NVars returns the length of the variable vector consumed by TransformVars
+// - NVarsPerPeriod variables for each of the NPeriods build periods.
+func (s *Scenario) NVars() int { return s.NVarsPerPeriod() * s.NPeriods() }
 
+// NVarsPerPeriod returns the number of variables for each build period: one
+// for the total power capacity followed by one for each facility prototype
+// except the implicit reactor (see TransformVars for the ordering and
+// VarNames for labels).
 func (s *Scenario) NVarsPerPeriod() int {
 	numFacVars := len(s.reactors()) + len(s.notreactors()) - 1
 	numPowerVars := 1
 	return numFacVars + numPowerVars
 }
 
+// varIndex returns the index of the j'th variable of the given build period
+// in the scenario's variable vector (see TransformVars for the ordering).
+func (s *Scenario) varIndex(period, j int) int {
+	return period*s.NVarsPerPeriod() + j
+}
+
+// varAt returns the j'th variable of the given build period from vars.  An
+// error naming the period and facility (varfacs[j]) is returned instead of
+// panicking if the variable's index is out of range.
+func (s *Scenario) varAt(vars []float64, varfacs []Facility, period, j int) (float64, error) {
+	index := s.varIndex(period, j)
+	if j < 0 || j >= len(varfacs) || index < 0 || index >= len(vars) {
+		name := "unknown"
+		if j == 0 {
+			name = "power"
+		} else if j > 0 && j < len(varfacs) {
+			name = varfacs[j].Proto
+		}
+		return 0, fmt.Errorf("var index %v (period %v, facility %v, var %v of %v) is out of range for %v vars",
+			index, period, name, j, s.NVarsPerPeriod(), len(vars))
+	}
+	return vars[index], nil
+}
+
+// supportOrder returns the indices (into notreactors()) of the scenario's
+// non-reactor facilities ordered such that each facility comes after all
+// the facilities named in its FracOfProtos.  Facilities are otherwise kept in
+// their original order.  An error is returned if a facility lists itself in
+// FracOfProtos or if FracOfProtos relationships form a cycle.
+func (s *Scenario) supportOrder() ([]int, error) {
+	facs := s.notreactors()
+	index := map[string]int{}
+	for i, fac := range facs {
+		index[fac.Proto] = i
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make([]int, len(facs))
+	order := make([]int, 0, len(facs))
+	path := []string{}
+
+	var visit func(i int) error
+	visit = func(i int) error {
+		fac := facs[i]
+		if state[i] == visited {
+			return nil
+		} else if state[i] == visiting {
+			for k, proto := range path {
+				if proto == fac.Proto {
+					cycle := append(append([]string{}, path[k:]...), fac.Proto)
+					return fmt.Errorf("FracOfProtos dependency cycle: %v", strings.Join(cycle, " -> "))
+				}
+			}
+		}
+
+		state[i] = visiting
+		path = append(path, fac.Proto)
+		for _, proto := range fac.FracOfProtos {
+			if proto == fac.Proto {
+				return fmt.Errorf("prototype %v lists itself in FracOfProtos", fac.Proto)
+			} else if k, ok := index[proto]; ok {
+				if err := visit(k); err != nil {
+					return err
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		state[i] = visited
+		order = append(order, i)
+		return nil
+	}
+
+	for i := range facs {
+		if err := visit(i); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
 func (s *Scenario) periodFacOrder() (varfacs []Facility, implicitreactor Facility) {
 	err := s.Validate()
 	if err != nil {
 		panic(err.Error())
 	}
 
+	reactors := s.reactors()
+	implicit := s.implicitReactor()
 	facs := []Facility{}
 	facs = append(facs, Facility{}) // add blank to account for power var offset
-	for _, fac := range s.reactors()[1:] {
-		facs = append(facs, fac)
+	for i, fac := range reactors {
+		if i != implicit {
+			facs = append(facs, fac)
+		}
 	}
 	for _, fac := range s.notreactors() {
 		facs = append(facs, fac)
 	}
-	return facs, s.reactors()[0]
+	return facs, reactors[implicit]
 }
 
 func (s *Scenario) PrintStats() {
@@ -228,29 +771,57 @@ func (s *Scenario) PrintStats() {
 		minpow := s.MinPower[i]
 		fmt.Printf("t%v: capbuilt=%v, currpow=%v, minpow=%v, maxpow=%v\n", t, capbuilt, currpow, minpow, maxpow)
 	}
+	for _, v := range s.CheckGroupConstraints() {
+		fmt.Println(v)
+	}
 }
 
+// TransformSched returns the variables that (approximately) reproduce the
+// scenario's Builds (see InvertBuilds).
 func (s *Scenario) TransformSched() ([]float64, error) {
-	err := s.Validate()
-	if err != nil {
-		return nil, err
-	}
-
 	builds := map[string][]Build{}
 	for _, b := range s.Builds {
 		builds[b.Proto] = append(builds[b.Proto], b)
 	}
+	return s.InvertBuilds(builds)
+}
 
-	startbuilds := map[string][]Build{}
-	for _, b := range s.StartBuilds {
-		startbuilds[b.Proto] = append(startbuilds[b.Proto], b)
+// InvertBuilds is the inverse of TransformVars: it returns the variables
+// (power capacity fractions and facility fractions for each build period)
+// that reproduce the build schedule builds as closely as possible.  Like the
+// map returned by TransformVars, builds must include the scenario's
+// StartBuilds and ForcedBuilds.  The inversion is lossy - TransformVars
+// rounds to whole facilities (and build blocks), so many variable vectors
+// produce the same schedule and the nearest one is returned, and builds that
+// don't fall on build period times or that exceed the power bounds can't be
+// represented at all.  Transforming the result back reproduces builds to
+// within rounding.
+func (s *Scenario) InvertBuilds(builds map[string][]Build) ([]float64, error) {
+	err := s.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	all := []Build{}
+	withfacs := map[string][]Build{}
+	for proto, blds := range builds {
+		fac, err := s.Prototype(proto)
+		if err != nil {
+			return nil, err
+		}
+		for _, b := range blds {
+			b.fac = fac
+			all = append(all, b)
+			withfacs[proto] = append(withfacs[proto], b)
+		}
 	}
+	builds = withfacs
 
 	varfacs, _ := s.periodFacOrder()
 	vars := make([]float64, s.NVars())
 	for i, t := range s.periodTimes() {
-		currpow := s.PowerCap(builds, t)
-		capbuilt := s.CapBuilt(s.Builds, t) - s.CapBuilt(s.StartBuilds, t)
+		currpow := s.PowerCap(builds, t) + s.forcedCap(t)
+		capbuilt := s.CapBuilt(all, t) - s.CapBuilt(s.StartBuilds, t) - s.CapBuilt(s.ForcedBuilds, t)
 		prevpow := currpow - capbuilt
 
 		maxpow := s.MaxPower[i]
@@ -260,7 +831,7 @@ func (s *Scenario) TransformSched() ([]float64, error) {
 
 		powervar := math.Min(1, (capbuilt-minbuild)/powerrange)
 		powervar = math.Max(0, powervar)
-		vars[i*s.NVarsPerPeriod()] = powervar
+		vars[s.varIndex(i, 0)] = powervar
 
 		// handle reactor builds
 		capleft := math.Max(1e-10, capbuilt)
@@ -268,16 +839,18 @@ func (s *Scenario) TransformSched() ([]float64, error) {
 		j := 1
 		for j = 1; j < s.NVarsPerPeriod(); j++ {
 			fac := varfacs[j]
-			if fac.Cap > 0 && fac.Available(t) {
-				protocap := s.CapBuilt(builds[fac.Proto], t)
-				index := i*s.NVarsPerPeriod() + j
-				vars[index] = math.Min(1, protocap/capleft)
-				vars[index] = math.Max(0, vars[index])
-				capleft -= protocap
-			} else {
+			if fac.Cap == 0 {
 				// done processing reactors (except last one)
 				break
+			} else if !fac.Available(t) {
+				continue
 			}
+
+			protocap := s.CapBuilt(builds[fac.Proto], t)
+			index := s.varIndex(i, j)
+			vars[index] = math.Min(1, protocap/math.Max(1e-10, capleft))
+			vars[index] = math.Max(0, vars[index])
+			capleft -= protocap
 		}
 
 		// handle other facilities
@@ -290,7 +863,7 @@ func (s *Scenario) TransformSched() ([]float64, error) {
 			nref := s.naliveproto(builds, t, fac.FracOfProtos...)
 			nhave := s.naliveproto(builds, t, fac.Proto)
 
-			index := i*s.NVarsPerPeriod() + j
+			index := s.varIndex(i, j)
 			vars[index] = math.Min(1, float64(nhave)/float64(nref))
 			vars[index] = math.Max(0, vars[index])
 		}
@@ -308,6 +881,8 @@ func (s *Scenario) NBuilt(builds []Build, t int) int {
 	return n
 }
 
+// CapBuilt returns the power capacity of the builds made at time step t as of
+// when they are built (see Facility.CapAt).
 func (s *Scenario) CapBuilt(builds []Build, t int) float64 {
 	tot := 0.0
 	for _, b := range builds {
@@ -316,7 +891,7 @@ func (s *Scenario) CapBuilt(builds []Build, t int) float64 {
 			if err != nil {
 				panic(err.Error())
 			}
-			tot += float64(b.N) * fac.Cap
+			tot += float64(b.N) * fac.CapAt(0)
 		}
 	}
 	return tot
@@ -332,7 +907,7 @@ func (s *Scenario) splice(origvars []float64) []float64 {
 outer:
 	for i, t := range s.periodTimes() {
 		for j := 0; j < s.NVarsPerPeriod(); j++ {
-			index := i*s.NVarsPerPeriod() + j
+			index := s.varIndex(i, j)
 			if index >= len(s.SpliceVars) {
 				break outer
 			}
@@ -347,23 +922,103 @@ outer:
 }
 
 // TransformVars takes a sequence of input variables for the scenario and
-// transforms them into a set of prototype/facility deployments. The sequence
-// of the vars follows this pattern: fac1_t1, fac1_t2, ..., fac1_tn, fac2_t1,
-// ..., facm_t1, facm_t2, ..., facm_tn.
+// transforms them into a set of prototype/facility deployments. The vars are
+// ordered period-major: all the variables for the first build period come
+// first, followed by all the variables for the second period, etc. (i.e. the
+// j'th variable of period i is at index i*NVarsPerPeriod()+j).  Within each
+// period, the first variable is the new power capacity variable, followed by
+// one variable for each reactor type except the implicit one (see
+// Facility.Implicit), followed by one variable for each non-reactor facility
+// type - all in the order they are listed in Facs.  VarNames returns labels
+// in this same order.
 //
 // The first reactor type variable represents the total fraction of new built
 // power capacity satisfied by that reactor on the given time step.  For each
-// subsequent reactor type (except the last), the variables represent the
-// fraction of the remaining power capacity satisfied by that reactor type
-// (e.g. the third reactor type's variable can be used to calculate its
-// fraction like this (1-(react1frac + (1-react1frac) * react2frac)) *
-// react3frac).  The last reactor type fraction is simply the remainining
-// unsatisfied power capacity.
+// subsequent reactor type, the variables represent the fraction of the
+// remaining power capacity satisfied by that reactor type (e.g. the third
+// reactor type's variable can be used to calculate its fraction like this
+// (1-(react1frac + (1-react1frac) * react2frac)) * react3frac).  The
+// implicit reactor is built last with simply the remaining unsatisfied power
+// capacity - so it is the only reactor guaranteed to be built whenever new
+// capacity is needed, and which reactor it is changes the meaning of all the
+// other reactors' fractions.  Reactor builds are rounded to the nearest whole
+// number (of build blocks) of their effective capacity, except that the
+// implicit reactor is rounded up where needed to meet MinPower (unless
+// SoftPower is set) as long as that doesn't exceed MaxPower.
 func (s *Scenario) TransformVars(vars []float64) (map[string][]Build, error) {
 	err := s.Validate()
 	if err != nil {
 		return nil, err
-	} else if len(vars) != s.NVars() {
+	}
+
+	builds := map[string][]Build{}
+	for _, b := range s.StartBuilds {
+		builds[b.Proto] = append(builds[b.Proto], b)
+	}
+	return s.transformVars(builds, -1, vars)
+}
+
+// forcedCap returns the capacity of ForcedBuilds built after time step t
+// but before the end of the build period starting at t - as of when they
+// are built (see Facility.CapAt).  ForcedBuilds at t itself are already
+// operating then.
+func (s *Scenario) forcedCap(t int) float64 {
+	tot := 0.0
+	for _, b := range s.ForcedBuilds {
+		if b.Time > t && b.Time < t+s.BuildPeriod {
+			tot += float64(b.N) * b.fac.CapAt(0)
+		}
+	}
+	return tot
+}
+
+// TransformVarsFrom is the same as TransformVars except that deployments are
+// added on top of the baseline schedule in base instead of just StartBuilds.
+// This allows part of a build schedule to be fixed while optimizing the
+// rest.  base must include any StartBuilds that should be deployed (the map
+// returned by TransformVars does) - ForcedBuilds after the latest build time
+// in base are added automatically.  All build periods at or before the
+// latest build time in base are left untouched - variables for those periods
+// are ignored.  Baseline builds count toward the existing power capacity
+// (which forms the lower bound for new capacity in later periods) and
+// toward each prototype's MaxBuild limit exactly like builds made by
+// TransformVars do.  base is not modified.
+func (s *Scenario) TransformVarsFrom(base map[string][]Build, vars []float64) (map[string][]Build, error) {
+	err := s.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	protos := map[string]Facility{}
+	for _, fac := range s.Facs {
+		protos[fac.Proto] = fac
+	}
+
+	frozen := -1
+	builds := map[string][]Build{}
+	for proto, blds := range base {
+		fac, ok := protos[proto]
+		if !ok {
+			return nil, fmt.Errorf("baseline build prototype '%v' is not defined in Facs", proto)
+		}
+		for _, b := range blds {
+			if b.Proto != proto {
+				return nil, fmt.Errorf("baseline build for prototype '%v' listed under '%v'", b.Proto, proto)
+			}
+			b.fac = fac
+			builds[proto] = append(builds[proto], b)
+			if b.Time > frozen {
+				frozen = b.Time
+			}
+		}
+	}
+	return s.transformVars(builds, frozen, vars)
+}
+
+// transformVars adds variable-driven deployments to builds for all build
+// periods after time frozen.
+func (s *Scenario) transformVars(builds map[string][]Build, frozen int, vars []float64) (map[string][]Build, error) {
+	if len(vars) != s.NVars() {
 		return nil, fmt.Errorf("wrong number of vars: want %v, got %v", s.NVars(), len(vars))
 	}
 
@@ -380,53 +1035,89 @@ func (s *Scenario) TransformVars(vars []float64) (map[string][]Build, error) {
 		}
 	}
 
-	builds := map[string][]Build{}
-	for _, b := range s.StartBuilds {
-		builds[b.Proto] = append(builds[b.Proto], b)
+	order, err := s.supportOrder()
+	if err != nil {
+		return nil, err
+	}
+	nreactors := len(s.reactors())
+
+	for _, b := range s.ForcedBuilds {
+		if b.Time > frozen {
+			builds[b.Proto] = append(builds[b.Proto], b)
+		}
 	}
 
 	varfacs, implicitreactor := s.periodFacOrder()
 	for i, t := range s.periodTimes() {
+		if t <= frozen {
+			continue
+		}
 		minpow := s.MinPower[i]
 		maxpow := s.MaxPower[i]
-		currpower := s.PowerCap(builds, t)
-		powervar := vars[i*s.NVarsPerPeriod()]
+		forced := s.forcedCap(t)
+		currpower := s.PowerCap(builds, t) + forced
+		powervar, err := s.varAt(vars, varfacs, i, 0)
+		if err != nil {
+			return nil, err
+		}
 
 		lowerbound := math.Max(currpower, minpow)
+		if s.SoftPower {
+			lowerbound = currpower
+		}
 		powerrange := math.Max(0, maxpow-lowerbound)
 		newpower := powervar*powerrange + lowerbound
 		captobuild := math.Max(newpower-currpower, 0)
 
 		// handle reactor builds
 		capleft := captobuild
-		j := 1 // skip j = 0 which is the power cap variable
-		for j = 1; j < s.NVarsPerPeriod(); j++ {
-			val := vars[i*s.NVarsPerPeriod()+j]
+		// skip j = 0 which is the power cap variable
+		for j := 1; j < s.NVarsPerPeriod(); j++ {
+			val, err := s.varAt(vars, varfacs, i, j)
+			if err != nil {
+				return nil, err
+			}
 			fac := varfacs[j]
-			if fac.Cap > 0 && fac.Available(t) {
-				wantcap := val * capleft
-				nbuild := int(math.Max(0, math.Floor(wantcap/fac.Cap+0.5)))
-				capleft -= float64(nbuild) * fac.Cap
-
-				if nbuild > 0 {
-					builds[fac.Proto] = append(builds[fac.Proto], Build{
-						Time:  t,
-						Proto: fac.Proto,
-						N:     nbuild,
-						fac:   fac,
-					})
-				}
-			} else {
+			// new builds are sized by their capacity at the period's start
+			// when PowerCap evaluates them
+			unitcap := fac.CapAt(0)
+			if fac.Cap == 0 {
 				// done processing reactors (except last one)
 				break
+			} else if !fac.Available(t) || unitcap <= 0 {
+				// unavailable reactors pass their share on to the next one
+				continue
+			}
+
+			wantcap := val * capleft
+			nbuild := fac.roundBuild(wantcap / unitcap)
+			nbuild = fac.limitBuild(nbuild, s.nbuiltproto(builds, fac.Proto))
+			capleft -= float64(nbuild) * unitcap
+
+			if nbuild > 0 {
+				builds[fac.Proto] = append(builds[fac.Proto], Build{
+					Time:  t,
+					Proto: fac.Proto,
+					N:     nbuild,
+					fac:   fac,
+				})
 			}
 		}
 
 		// handle last (implicit) reactor
 		fac := implicitreactor
-		if fac.Available(t) {
+		if unitcap := fac.CapAt(0); fac.Available(t) && unitcap > 0 {
 			wantcap := capleft
-			nbuild := int(math.Max(0, math.Floor(wantcap/fac.Cap+0.5)))
+			nbuild := fac.roundBuild(wantcap / unitcap)
+			pow := s.PowerCap(builds, t) + forced
+			if !s.SoftPower && pow+float64(nbuild)*unitcap < minpow && pow+float64(nbuild+fac.block())*unitcap <= maxpow {
+				// rounding down to whole reactors (or blocks) of their
+				// effective capacity would leave the min power constraint
+				// unmet - round up unless that breaks the max power
+				// constraint instead (see FeasibilityReport)
+				nbuild += fac.block()
+			}
+			nbuild = fac.limitBuild(nbuild, s.nbuiltproto(builds, fac.Proto))
 
 			if nbuild > 0 {
 				builds[fac.Proto] = append(builds[fac.Proto], Build{
@@ -438,9 +1129,14 @@ func (s *Scenario) TransformVars(vars []float64) (map[string][]Build, error) {
 			}
 		}
 
-		// handle other facilities
-		for ; j < s.NVarsPerPeriod(); j++ {
-			facfrac := vars[i*s.NVarsPerPeriod()+j]
+		// handle other facilities - in dependency order so each facility's
+		// FracOfProtos are fully built before it is
+		for _, k := range order {
+			j := nreactors + k
+			facfrac, err := s.varAt(vars, varfacs, i, j)
+			if err != nil {
+				return nil, err
+			}
 			fac := varfacs[j]
 			if !fac.Available(t) { // skip
 				continue
@@ -449,7 +1145,8 @@ func (s *Scenario) TransformVars(vars []float64) (map[string][]Build, error) {
 			haven := float64(s.naliveproto(builds, t, fac.Proto))
 			needn := facfrac * float64(s.naliveproto(builds, t, fac.FracOfProtos...))
 			wantn := math.Max(0, needn-haven)
-			nbuild := int(math.Floor(wantn + 0.5))
+			nbuild := fac.roundBuild(wantn)
+			nbuild = fac.limitBuild(nbuild, s.nbuiltproto(builds, fac.Proto))
 			if nbuild > 0 {
 				builds[fac.Proto] = append(builds[fac.Proto], Build{
 					Time:  t,
@@ -485,96 +1182,712 @@ func (s *Scenario) naliveproto(facs map[string][]Build, t int, protos ...string)
 	return count
 }
 
+// nbuiltproto returns the total number of facilities of the given prototype
+// ever built in facs (regardless of whether or not they are still alive).
+func (s *Scenario) nbuiltproto(facs map[string][]Build, proto string) int {
+	count := 0
+	for _, b := range facs[proto] {
+		count += b.N
+	}
+	return count
+}
+
+// PowerCap returns the total effective power capacity of the builds
+// operating at time step t - accounting for each facility's CapSchedule.
 func (s *Scenario) PowerCap(builds map[string][]Build, t int) float64 {
 	pow := 0.0
 	for _, buildsproto := range builds {
 		for _, b := range buildsproto {
 			if b.Alive(t) {
-				pow += b.fac.Cap * float64(b.N)
+				pow += b.fac.CapAt(t-b.Time) * float64(b.N)
 			}
 		}
 	}
 	return pow
 }
 
+// CyclusPower converts power p in the scenario's PowerUnit to cyclus power
+// units (see PowerScale).
+func (s *Scenario) CyclusPower(p float64) float64 {
+	if s.PowerScale == 0 {
+		return p
+	}
+	return p * s.PowerScale
+}
+
+// PowerDeficit returns the power capacity shortfall of the scenario's Builds
+// below MinPower summed over every time step of each build period.
+func (s *Scenario) PowerDeficit() float64 {
+	builds := map[string][]Build{}
+	for _, b := range s.Builds {
+		builds[b.Proto] = append(builds[b.Proto], b)
+	}
+
+	deficit := 0.0
+	for i, start := range s.PeriodTimes() {
+		for t := start; t < start+s.BuildPeriod && t < s.SimDur; t++ {
+			deficit += math.Max(0, s.MinPower[i]-s.PowerCap(builds, t))
+		}
+	}
+	return deficit
+}
+
+// CheckGroupConstraints returns a violation for each group in Groups and
+// build period where the fraction of the power capacity supplied by the
+// group's facilities in the scenario's Builds is outside its bounds.
+// Periods with no power capacity deployed are skipped.
+func (s *Scenario) CheckGroupConstraints() []GroupViolation {
+	const eps = 1e-9
+
+	builds := map[string][]Build{}
+	for _, b := range s.Builds {
+		builds[b.Proto] = append(builds[b.Proto], b)
+	}
+
+	var violations []GroupViolation
+	for i, t := range s.PeriodTimes() {
+		total := s.PowerCap(builds, t)
+		if total == 0 {
+			continue
+		}
+		for _, g := range s.Groups {
+			groupbuilds := map[string][]Build{}
+			for _, proto := range g.Protos {
+				groupbuilds[proto] = builds[proto]
+			}
+			frac := s.PowerCap(groupbuilds, t) / total
+			if frac < g.MinFrac-eps || (g.MaxFrac > 0 && frac > g.MaxFrac+eps) {
+				violations = append(violations, GroupViolation{
+					Group:  g.Name,
+					Period: i,
+					Time:   t,
+					Frac:   frac,
+					Min:    g.MinFrac,
+					Max:    g.MaxFrac,
+				})
+			}
+		}
+	}
+	return violations
+}
+
+// Deployment holds all the deployments of one prototype as parallel lists
+// (in time order) for use in templates.
+type Deployment struct {
+	Proto string
+	// Times are the absolute simulation time steps of the builds.
+	Times []int
+	// N is the number of facilities built at each time.
+	N []int
+	// Lifetimes is the lifetime of the facilities built at each time (see
+	// Build.Lifetime).
+	Lifetimes []int
+}
+
+// Deployments returns the scenario's Builds (including StartBuilds and
+// ForcedBuilds) grouped by prototype in Facs order.  It is intended for use
+// in the cyclus input template (e.g. {{range .Deployments}}...{{end}}).
+// Build times are already absolute simulation time steps - build periods
+// start after BuildOffset (see TransformVars) and StartBuilds before
+// BuildOffset are included as is - so templates don't need to do any offset
+// arithmetic.  Times before the simulation start are clamped to 0 and builds
+// at or after SimDur (which could never happen) are dropped along with
+// builds of zero facilities.
+func (s *Scenario) Deployments() []Deployment {
+	builds := append([]Build{}, s.Builds...)
+	sort.SliceStable(builds, func(i, j int) bool { return builds[i].Time < builds[j].Time })
+
+	index := map[string]int{}
+	var deps []Deployment
+	for _, fac := range s.Facs {
+		if _, ok := index[fac.Proto]; !ok {
+			index[fac.Proto] = len(deps)
+			deps = append(deps, Deployment{Proto: fac.Proto})
+		}
+	}
+
+	for _, b := range builds {
+		t := b.Time
+		if t < 0 {
+			t = 0
+		} else if t >= s.SimDur || b.N == 0 {
+			continue
+		}
+
+		i, ok := index[b.Proto]
+		if !ok {
+			index[b.Proto] = len(deps)
+			i = len(deps)
+			deps = append(deps, Deployment{Proto: b.Proto})
+		}
+		d := &deps[i]
+		d.Times = append(d.Times, t)
+		d.N = append(d.N, b.N)
+		d.Lifetimes = append(d.Lifetimes, b.Lifetime())
+	}
+
+	nonempty := deps[:0]
+	for _, d := range deps {
+		if len(d.Times) > 0 {
+			nonempty = append(nonempty, d)
+		}
+	}
+	return nonempty
+}
+
+// ScheduleCSV writes the deployment schedule in builds as CSV to w for
+// analysis in other tools.  After a header row, there is one row per
+// prototype for each time step with builds containing the time step, the
+// prototype, the number of facilities built, and the total power capacity
+// (see PowerCap) of all builds operating at that time step.  Rows are sorted
+// by time and then prototype.
+func (s *Scenario) ScheduleCSV(w io.Writer, builds map[string][]Build) error {
+	type key struct {
+		t     int
+		proto string
+	}
+	counts := map[key]int{}
+	var keys []key
+	for proto, bs := range builds {
+		for _, b := range bs {
+			k := key{b.Time, proto}
+			if _, ok := counts[k]; !ok {
+				keys = append(keys, k)
+			}
+			counts[k] += b.N
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].t != keys[j].t {
+			return keys[i].t < keys[j].t
+		}
+		return keys[i].proto < keys[j].proto
+	})
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"time", "prototype", "count", "cumulative_power"})
+	for _, k := range keys {
+		cw.Write([]string{
+			strconv.Itoa(k.t),
+			k.proto,
+			strconv.Itoa(counts[k]),
+			strconv.FormatFloat(s.PowerCap(builds, k.t), 'g', -1, 64),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// Environ returns the environment (in os.Environ form) for running cyclus
+// for this scenario: the current process environment with the scenario's Env
+// variables added - replacing any inherited variables of the same name.
+func (s *Scenario) Environ() []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		name := kv
+		if i := strings.Index(kv, "="); i >= 0 {
+			name = kv[:i]
+		}
+		if _, ok := s.Env[name]; !ok {
+			env = append(env, kv)
+		}
+	}
+
+	names := make([]string, 0, len(s.Env))
+	for name := range s.Env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		env = append(env, name+"="+s.Env[name])
+	}
+	return env
+}
+
+// NIntervals returns the number of integration intervals for the
+// disrup-multi objective modes - DefaultIntegrationIntervals if
+// IntegrationIntervals is zero.
+func (s *Scenario) NIntervals() int {
+	if s.IntegrationIntervals == 0 {
+		return DefaultIntegrationIntervals
+	}
+	return s.IntegrationIntervals
+}
+
+// OutFormat returns the scenario's cyclus output format - OutSQLite if
+// CyclusOutFormat is empty.
+func (s *Scenario) OutFormat() string {
+	if s.CyclusOutFormat == "" {
+		return OutSQLite
+	}
+	return s.CyclusOutFormat
+}
+
+// CyclusOutExt returns the file extension for the scenario's cyclus output
+// database (e.g. ".sqlite") - cyclus picks its output backend based on it.
+func (s *Scenario) CyclusOutExt() string { return outFormats[s.OutFormat()].Ext }
+
+// PostDriver returns the name of the database/sql driver for post-processing
+// the scenario's cyclus output database.  It returns an error if the output
+// format can't be post-processed.
+func (s *Scenario) PostDriver() (string, error) {
+	f, ok := outFormats[s.OutFormat()]
+	if !ok {
+		return "", fmt.Errorf("invalid CyclusOutFormat '%v'", s.CyclusOutFormat)
+	} else if f.Driver == "" {
+		return "", fmt.Errorf("cyclus output format '%v' is not supported: no driver available to post-process it (use '%v')", s.OutFormat(), OutSQLite)
+	}
+	return f.Driver, nil
+}
+
+// TmplPartials returns the relative paths of the template partials parsed
+// with CyclusTmpl in the order they are parsed: CyclusTmplPartials followed by
+// the partials of the selected TmplVariant.  CyclusTmpl itself is parsed
+// first.  A template defined (or named) by a file replaces any template with
+// the same name from an earlier file - so a variant's partials can override
+// default definitions.
+func (s *Scenario) TmplPartials() []string {
+	names := append([]string{}, s.CyclusTmplPartials...)
+	return append(names, s.TmplVariants[s.TmplVariant]...)
+}
+
 func (s *Scenario) CyclusTmplPath() string {
-	return filepath.Join(filepath.Dir(s.File), s.CyclusTmpl)
+	return filepath.Join(s.Dir(), s.CyclusTmpl)
 }
 
-// Validate returns an error if the scenario is ill-configured.
+// Dir returns the directory of the scenario file which relative paths (e.g.
+// CyclusTmpl and AuxFiles) are rooted from.
+func (s *Scenario) Dir() string { return filepath.Dir(s.File) }
+
+// Validate returns an error if the scenario is ill-configured - the first of
+// its Problems.
 func (s *Scenario) Validate() error {
+	if probs := s.Problems(); len(probs) > 0 {
+		return probs[0]
+	}
+	return nil
+}
+
+// Problems returns every configuration problem with the scenario (e.g. for
+// reporting them all at once to a scenario author) - or nil if it is valid.
+// Like Validate, it also prepares the scenario for use (e.g. parsing the
+// cyclus input template).
+func (s *Scenario) Problems() []error {
+	var probs []error
+	addf := func(format string, args ...interface{}) {
+		probs = append(probs, fmt.Errorf(format, args...))
+	}
+
 	if min, max := len(s.MinPower), len(s.MaxPower); min != max {
-		return fmt.Errorf("MaxPower length %v != MinPower length %v", max, min)
+		addf("MaxPower length %v != MinPower length %v", max, min)
+	}
+	for i, pow := range s.MinPower {
+		if pow < 0 {
+			addf("MinPower[%v] is negative (%v)", i, pow)
+		}
+	}
+	for i, pow := range s.MaxPower {
+		if pow < 0 {
+			addf("MaxPower[%v] is negative (%v)", i, pow)
+		}
+	}
+
+	if s.BuildPeriod <= 0 {
+		addf("BuildPeriod must be positive, got %v", s.BuildPeriod)
+	} else if s.BuildOffset < 0 || s.TrailingDur < 0 {
+		addf("BuildOffset (%v) and TrailingDur (%v) must not be negative", s.BuildOffset, s.TrailingDur)
+	} else if s.BuildOffset+s.TrailingDur+2 > s.SimDur {
+		addf("SimDur %v is too short for any build periods with BuildOffset %v and TrailingDur %v (need SimDur >= %v)",
+			s.SimDur, s.BuildOffset, s.TrailingDur, s.BuildOffset+s.TrailingDur+2)
+	}
+
+	if !(s.PowerScale >= 0) {
+		addf("PowerScale must be positive, got %v", s.PowerScale)
+	}
+	if s.PowerPenalty < 0 {
+		addf("PowerPenalty must not be negative, got %v", s.PowerPenalty)
+	}
+
+	switch s.Compounding {
+	case "", CompoundMonthly, CompoundContinuous:
+	default:
+		addf("invalid Compounding '%v' (must be '%v' or '%v')", s.Compounding, CompoundMonthly, CompoundContinuous)
+	}
+	if _, ok := interpolators[s.InterpMethod]; !ok {
+		addf("invalid InterpMethod '%v' (must be '%v' or '%v')", s.InterpMethod, InterpLinear, InterpPCHIP)
+	}
+	if s.IntegrationIntervals < 0 {
+		addf("IntegrationIntervals must not be negative, got %v", s.IntegrationIntervals)
+	}
+	if s.ObjMode == "disrup-multi" || s.ObjMode == "disrup-multi-lin" {
+		// the disruption probabilities are interpolated between disruptions
+		if ds, _ := s.CustomConfig["disrup-multi"].([]interface{}); len(ds) < 2 {
+			addf("%v mode needs at least 2 disruptions in CustomConfig[\"disrup-multi\"], got %v", s.ObjMode, len(ds))
+		}
+	}
+	if _, ok := outFormats[s.OutFormat()]; !ok {
+		addf("invalid CyclusOutFormat '%v' (must be '%v' or '%v')", s.CyclusOutFormat, OutSQLite, OutHDF5)
+	}
+	if len(s.PostMetrics) > 0 {
+		have := map[string]bool{}
+		for _, m := range s.PostMetrics {
+			if !postMetrics[m] {
+				addf("invalid PostMetrics entry '%v' (must be '%v', '%v' or '%v')", m, PostAgents, PostTimeList, PostInventories)
+			}
+			have[m] = true
+		}
+		need, ok := ObjPostMetrics[s.ObjFunc]
+		if !ok {
+			need = []string{PostAgents, PostTimeList, PostInventories}
+		}
+		for _, m := range need {
+			if !have[m] {
+				addf("PostMetrics is missing '%v' required by ObjFunc '%v'", m, s.ObjFunc)
+			}
+		}
+	}
+
+	for _, name := range s.AuxFiles {
+		if !inside(name) {
+			addf("AuxFiles path '%v' must be relative to and inside the scenario file's directory", name)
+		}
+	}
+	for _, name := range s.CyclusTmplPartials {
+		if !inside(name) {
+			addf("CyclusTmplPartials path '%v' must be relative to and inside the scenario file's directory", name)
+		}
+	}
+	variants := []string{}
+	for variant, names := range s.TmplVariants {
+		variants = append(variants, variant)
+		for _, name := range names {
+			if !inside(name) {
+				addf("TmplVariants %v path '%v' must be relative to and inside the scenario file's directory", variant, name)
+			}
+		}
+	}
+	if _, ok := s.TmplVariants[s.TmplVariant]; s.TmplVariant != "" && !ok {
+		sort.Strings(variants)
+		addf("invalid TmplVariant '%v' (must be one of: %v)", s.TmplVariant, strings.Join(variants, ", "))
+	}
+
+	switch s.NuclideNotation {
+	case "", NotationId, NotationAny:
+		if _, err := s.normNuclideCosts(); err != nil {
+			probs = append(probs, err)
+		}
+	default:
+		addf("invalid NuclideNotation '%v' (must be '%v' or '%v')", s.NuclideNotation, NotationId, NotationAny)
 	}
 
-	var err error
 	if s.tmpl == nil && s.CyclusTmpl != "" {
-		s.tmpl, err = template.ParseFiles(s.CyclusTmplPath())
-		if err != nil {
-			return err
+		if err := s.parseTmpl(); err != nil {
+			probs = append(probs, err)
 		}
 	}
 
 	np := s.nperiods()
 	lmin := len(s.MinPower)
 	if np != lmin {
-		return fmt.Errorf("number power constraints %v != number build periods %v", lmin, np)
+		addf("number power constraints %v != number build periods %v", lmin, np)
 	}
 
 	protos := map[string]Facility{}
 	havereactor := false
-	for _, fac := range s.Facs {
-		if fac.Cap > 0 {
+	for i, fac := range s.Facs {
+		if fac.Proto == "" {
+			addf("Facs[%v] has no Proto", i)
+		}
+		if fac.Cap > 0 && fac.BuildAfter >= 0 {
 			havereactor = true
 		}
 		if fac.Cap == 0 && len(fac.FracOfProtos) == 0 && fac.BuildAfter >= 0 {
-			return fmt.Errorf("prototype %v needs at least one prototype defined in FracOfProtos", fac.Proto)
+			addf("prototype %v needs at least one prototype defined in FracOfProtos", fac.Proto)
+		}
+		if fac.MaxBuild < 0 {
+			addf("prototype %v has negative MaxBuild %v", fac.Proto, fac.MaxBuild)
+		}
+		if fac.CapFactor < 0 || fac.CapFactor > 1 {
+			addf("prototype %v has CapFactor %v outside of (0, 1]", fac.Proto, fac.CapFactor)
+		}
+		if fac.WasteDiscount < 0 || fac.WasteDiscount > 1 {
+			addf("prototype %v has WasteDiscount %v outside of [0, 1]", fac.Proto, fac.WasteDiscount)
+		}
+		if fac.Life < InfiniteLife {
+			addf("prototype %v has invalid Life %v", fac.Proto, fac.Life)
+		}
+		if fac.BuildBlock < 0 {
+			addf("prototype %v has BuildBlock %v (must be at least 1)", fac.Proto, fac.BuildBlock)
+		}
+		for j, smp := range fac.CapSchedule {
+			if smp.X < 0 || (j > 0 && smp.X <= fac.CapSchedule[j-1].X) {
+				addf("prototype %v has CapSchedule ages that are negative or not strictly increasing", fac.Proto)
+				break
+			} else if smp.Y < 0 {
+				addf("prototype %v has negative CapSchedule fraction %v at age %v", fac.Proto, smp.Y, smp.X)
+			}
 		}
 		protos[fac.Proto] = fac
 	}
 	if !havereactor {
-		return fmt.Errorf("scenario has no nonzero capacity (i.e. reactor) prototypes")
+		// TransformVars needs at least one for its implicit reactor
+		addf("scenario has no buildable reactor prototypes (i.e. with nonzero Cap and BuildAfter >= 0)")
+	}
+	implicit := []string{}
+	for _, fac := range s.Facs {
+		if !fac.Implicit {
+			continue
+		} else if fac.Cap <= 0 || fac.BuildAfter < 0 {
+			addf("prototype %v is Implicit but isn't a buildable reactor (i.e. with nonzero Cap and BuildAfter >= 0)", fac.Proto)
+		}
+		implicit = append(implicit, fac.Proto)
+	}
+	if len(implicit) > 1 {
+		addf("only one prototype may be Implicit, got %v", strings.Join(implicit, ", "))
+	}
+	for _, fac := range s.Facs {
+		for _, proto := range fac.FracOfProtos {
+			if _, ok := protos[proto]; !ok {
+				addf("prototype %v has FracOfProtos entry '%v' that is not defined in Facs", fac.Proto, proto)
+			}
+		}
+	}
+	if _, err := s.supportOrder(); err != nil {
+		probs = append(probs, err)
+	}
+	for i, g := range s.Groups {
+		for _, proto := range g.Protos {
+			if _, ok := protos[proto]; !ok {
+				addf("Groups[%v] (%v) prototype '%v' is not defined in Facs", i, g.Name, proto)
+			}
+		}
+		if g.MinFrac < 0 || g.MinFrac > 1 || g.MaxFrac < 0 || g.MaxFrac > 1 {
+			addf("Groups[%v] (%v) fractions must be between 0 and 1", i, g.Name)
+		} else if g.MaxFrac > 0 && g.MinFrac > g.MaxFrac {
+			addf("Groups[%v] (%v) MinFrac %v > MaxFrac %v", i, g.Name, g.MinFrac, g.MaxFrac)
+		}
 	}
 
 	for i, p := range s.StartBuilds {
 		fac, ok := protos[p.Proto]
 		if !ok {
-			return fmt.Errorf("StartBuild prototype '%v' is not defined in Facs", p.Proto)
+			addf("StartBuild prototype '%v' is not defined in Facs", p.Proto)
+		} else if p.Life < InfiniteLife {
+			addf("StartBuild of prototype '%v' has invalid Life %v", p.Proto, p.Life)
 		}
 		s.StartBuilds[i].fac = fac
 	}
 
+	for i, p := range s.ForcedBuilds {
+		fac, ok := protos[p.Proto]
+		if !ok {
+			addf("ForcedBuild prototype '%v' is not defined in Facs", p.Proto)
+		} else if p.Life < InfiniteLife {
+			addf("ForcedBuild of prototype '%v' has invalid Life %v", p.Proto, p.Life)
+		} else if p.N < 0 {
+			addf("ForcedBuild of prototype '%v' has negative N %v", p.Proto, p.N)
+		} else if p.Time <= s.BuildOffset {
+			addf("ForcedBuild of prototype '%v' at time %v is not after BuildOffset %v (use StartBuilds for initial conditions)", p.Proto, p.Time, s.BuildOffset)
+		} else if end := s.SimDur - s.TrailingDur; p.Time >= end {
+			addf("ForcedBuild of prototype '%v' at time %v is not before the wind-down starting at time %v (SimDur - TrailingDur)", p.Proto, p.Time, end)
+		}
+		s.ForcedBuilds[i].fac = fac
+	}
+
 	for i, p := range s.Builds {
 		fac, ok := protos[p.Proto]
 		if !ok {
-			return fmt.Errorf("Build prototype '%v' is not defined in Facs", p.Proto)
+			addf("Build prototype '%v' is not defined in Facs", p.Proto)
+		} else if p.Life < InfiniteLife {
+			addf("Build of prototype '%v' has invalid Life %v", p.Proto, p.Life)
 		}
 		s.Builds[i].fac = fac
 	}
 
-	return nil
+	return probs
 }
 
+// Load reads and validates the JSON scenario in the named file.
 func (s *Scenario) Load(fname string) error {
-	if s == nil {
-		s = &Scenario{}
+	f, err := os.Open(fname)
+	if err != nil {
+		return err
 	}
-	data, err := ioutil.ReadFile(fname)
+	defer f.Close()
+
+	s.File = fname
+	return s.Decode(f)
+}
+
+// Decode reads a JSON scenario from r into s and validates it.  If s.File is
+// already set, it is kept (overriding any File value in the JSON) and the
+// cyclus template path is resolved relative to its directory.  Otherwise
+// the template path is resolved relative to the working directory.
+func (s *Scenario) Decode(r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
 	if err != nil {
 		return err
 	}
+
+	fname := s.File
 	if err := json.Unmarshal(data, s); err != nil {
 		if serr, ok := err.(*json.SyntaxError); ok {
+			label := fname
+			if label == "" {
+				label = "scenario"
+			}
 			line, col := findLine(data, serr.Offset)
-			return fmt.Errorf("%s:%d:%d: %v", fname, line, col, err)
+			return fmt.Errorf("%s:%d:%d: %v", label, line, col, err)
 		}
 		return err
 	}
 
-	s.File = fname
+	if fname != "" {
+		s.File = fname
+	}
+	if err := s.loadNuclideCosts(); err != nil {
+		return err
+	}
 	return s.Validate()
 }
 
+// loadNuclideCosts merges the costs in NuclideCostFile into NuclideCost
+// without overwriting existing entries - for the same nuclide in any form
+// allowed by NuclideNotation.
+func (s *Scenario) loadNuclideCosts() error {
+	if s.NuclideCostFile == "" {
+		return nil
+	}
+
+	path := s.NuclideCostFile
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(s.Dir(), path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to load NuclideCostFile: %v", err)
+	}
+	defer f.Close()
+
+	costs := map[string]float64{}
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		costs, err = readNuclideCostCSV(f)
+	} else {
+		err = json.NewDecoder(f).Decode(&costs)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid NuclideCostFile %v: %v", s.NuclideCostFile, err)
+	}
+
+	inline := map[string]bool{}
+	for key := range s.NuclideCost {
+		inline[s.nuclideId(key)] = true
+	}
+	if s.NuclideCost == nil {
+		s.NuclideCost = map[string]float64{}
+	}
+	for nuc, cost := range costs {
+		if !inline[s.nuclideId(nuc)] {
+			s.NuclideCost[nuc] = cost
+		}
+	}
+	return nil
+}
+
+// readNuclideCostCSV reads "nuclide,cost" records from r.  A first record
+// with a non-numeric cost is treated as a header and skipped.
+func readNuclideCostCSV(r io.Reader) (map[string]float64, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = 2
+	cr.TrimLeadingSpace = true
+	recs, err := cr.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	costs := map[string]float64{}
+	for i, rec := range recs {
+		cost, err := strconv.ParseFloat(rec[1], 64)
+		if err != nil && i == 0 {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("line %v: invalid cost '%v'", i+1, rec[1])
+		}
+		costs[rec[0]] = cost
+	}
+	return costs, nil
+}
+
+// nuclideId returns the nuclide id of the NuclideCost key in
+// NuclideNotation - or key itself if it isn't a recognized nuclide.
+func (s *Scenario) nuclideId(key string) string {
+	if s.NuclideNotation == NotationAny {
+		if n, err := nuc.Id(key); err == nil {
+			return strconv.Itoa(int(n))
+		}
+	}
+	return key
+}
+
+// nuclideCosts returns NuclideCost keyed by nuclide id (see
+// normNuclideCosts).  NuclideCost is returned as is if it is invalid.
+func (s *Scenario) nuclideCosts() map[string]float64 {
+	costs, err := s.normNuclideCosts()
+	if err != nil {
+		return s.NuclideCost
+	}
+	return costs
+}
+
+// normNuclideCosts checks that all NuclideCost keys are nuclides in
+// NuclideNotation and returns a copy of NuclideCost keyed by nuclide id.
+// The returned error lists every unrecognized key.
+func (s *Scenario) normNuclideCosts() (map[string]float64, error) {
+	nucs := make([]string, 0, len(s.NuclideCost))
+	for key := range s.NuclideCost {
+		nucs = append(nucs, key)
+	}
+	sort.Strings(nucs)
+
+	costs := make(map[string]float64, len(s.NuclideCost))
+	keys := map[string]string{}
+	var bad, dups []string
+	for _, key := range nucs {
+		id := s.nuclideId(key)
+		if !validNuclide(id) {
+			bad = append(bad, fmt.Sprintf("'%v'", key))
+			continue
+		} else if other, ok := keys[id]; ok {
+			dups = append(dups, fmt.Sprintf("'%v' and '%v'", other, key))
+			continue
+		}
+		keys[id] = key
+		costs[id] = s.NuclideCost[key]
+	}
+
+	if len(bad) > 0 {
+		want := "nuclide ids (e.g. 922350000)"
+		if s.NuclideNotation == NotationAny {
+			want = "nuclides (e.g. 922350000 or U235)"
+		}
+		return nil, fmt.Errorf("NuclideCost has unrecognized keys %v - they must be %v", strings.Join(bad, ", "), want)
+	} else if len(dups) > 0 {
+		return nil, fmt.Errorf("NuclideCost has keys for the same nuclide: %v", strings.Join(dups, ", "))
+	}
+	return costs, nil
+}
+
+// validNuclide returns true if nuc is a cyclus nuclide id (ZZZAAAMMMM) -
+// e.g. "922350000" for U-235 or "920000000" for elemental uranium.
+func validNuclide(nuc string) bool {
+	id, err := strconv.Atoi(nuc)
+	if err != nil || id <= 0 || strconv.Itoa(id) != nuc {
+		return false
+	}
+	z, a := id/10000000, id/10000%1000
+	return z >= 1 && z <= 118 && (a == 0 || a >= z)
+}
+
 func (s *Scenario) CalcTotalObjective(execfn ObjExecFunc) (float64, error) {
 	if s.SingleCalc {
 		return execfn(s)
@@ -594,25 +1907,210 @@ func (s *Scenario) CalcTotalObjective(execfn ObjExecFunc) (float64, error) {
 // stored in dbfile under the given simulation id.
 func (s *Scenario) CalcObjective(dbfile string, simid []byte) (float64, error) {
 	if fn, ok := ObjFuncs[s.ObjFunc]; ok {
-		db, err := sql.Open("sqlite3", dbfile)
+		driver, err := s.PostDriver()
+		if err != nil {
+			return math.Inf(1), err
+		}
+		db, err := sql.Open(driver, dbfile)
 		if err != nil {
 			return math.Inf(1), err
 		}
 		defer db.Close()
 
-		return fn(s, db, simid)
+		val, err := fn(s, db, simid)
+		if err != nil || !s.SoftPower {
+			return val, err
+		}
+		return val + s.PowerPenalty*s.PowerDeficit(), nil
 	} else {
 		return math.Inf(1), fmt.Errorf("invalid objective name '%v'", s.ObjFunc)
 	}
 }
 
+var (
+	tmplProtoDef   = regexp.MustCompile(`(?s)<prototype>\s*<name>\s*([^<>{}\s]+)\s*</name>`)
+	tmplAgent      = regexp.MustCompile(`(?s)<agent>.*?</agent>`)
+	tmplAgentProto = regexp.MustCompile(`<prototype>\s*([^<>{}\s]+)\s*</prototype>`)
+)
+
+// CheckTmplPrototypes compares the prototypes defined in the scenario's
+// cyclus input file template with its Facs.  It returns a warning for each
+// prototype in Facs that the template doesn't define and for each template
+// prototype that is neither in Facs nor deployed directly by an agent in the
+// template.  The template is scanned (not rendered) for literal prototype
+// names, so the warnings are best-effort - e.g. names generated by template
+// actions or included files are missed.  The template's partials (see
+// TmplPartials) are scanned along with it.
+func (s *Scenario) CheckTmplPrototypes() (warnings []string, err error) {
+	data, err := ioutil.ReadFile(s.CyclusTmplPath())
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range s.TmplPartials() {
+		partial, err := ioutil.ReadFile(filepath.Join(s.Dir(), name))
+		if err != nil {
+			return nil, err
+		}
+		data = append(append(data, '\n'), partial...)
+	}
+
+	defined := map[string]bool{}
+	for _, m := range tmplProtoDef.FindAllSubmatch(data, -1) {
+		defined[string(m[1])] = true
+	}
+	deployed := map[string]bool{}
+	for _, agent := range tmplAgent.FindAll(data, -1) {
+		for _, m := range tmplAgentProto.FindAllSubmatch(agent, -1) {
+			deployed[string(m[1])] = true
+		}
+	}
+
+	facs := map[string]bool{}
+	for _, fac := range s.Facs {
+		facs[fac.Proto] = true
+		if !defined[fac.Proto] {
+			warnings = append(warnings, fmt.Sprintf("prototype %v is not defined in cyclus template %v", fac.Proto, s.CyclusTmpl))
+		}
+	}
+	unused := []string{}
+	for proto := range defined {
+		if !facs[proto] && !deployed[proto] {
+			unused = append(unused, proto)
+		}
+	}
+	sort.Strings(unused)
+	for _, proto := range unused {
+		warnings = append(warnings, fmt.Sprintf("cyclus template prototype %v is not in Facs", proto))
+	}
+	return warnings, nil
+}
+
+// parseTmpl parses the scenario's cyclus input file template and its
+// partials (see TmplPartials) with all the template helper functions (see
+// CyclusTmpl) available into tmpl.
+func (s *Scenario) parseTmpl() error {
+	path := s.CyclusTmplPath()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	tmpl, err := template.New(filepath.Base(path)).Funcs(s.tmplFuncs()).Parse(string(data))
+	if err != nil {
+		return err
+	}
+	s.tmpl, s.tmplGiven = tmpl, false
+	s.tmplSrc = []tmplFile{{s.CyclusTmpl, string(data)}}
+
+	for _, name := range s.TmplPartials() {
+		data, err := ioutil.ReadFile(filepath.Join(s.Dir(), name))
+		if err != nil {
+			s.tmpl = nil
+			return err
+		} else if err := s.addPartial(name, string(data)); err != nil {
+			s.tmpl = nil
+			return err
+		}
+	}
+	return nil
+}
+
+// ParseTmpl uses text as the scenario's cyclus input file template instead
+// of reading it from CyclusTmpl.  The include function is not available to
+// such templates because there is no scenario directory to read files from.
+func (s *Scenario) ParseTmpl(text string) error {
+	name := "cyclus-tmpl"
+	if s.CyclusTmpl != "" {
+		name = filepath.Base(s.CyclusTmpl)
+	}
+	funcs := s.tmplFuncs()
+	funcs["include"] = func(name string) (string, error) {
+		return "", fmt.Errorf("cannot include '%v' from a template given as text", name)
+	}
+	tmpl, err := template.New(name).Funcs(funcs).Parse(text)
+	if err != nil {
+		return err
+	}
+	s.tmpl, s.tmplGiven = tmpl, true
+	s.tmplSrc = []tmplFile{{s.CyclusTmpl, text}}
+	return nil
+}
+
+// AddTmplPartial parses text as the template partial with the given path
+// (see CyclusTmplPartials) into the template given to ParseTmpl.  Partials
+// must be added in TmplPartials order.
+func (s *Scenario) AddTmplPartial(path, text string) error {
+	if s.tmpl == nil {
+		return fmt.Errorf("cannot add template partial '%v' before ParseTmpl", path)
+	}
+	return s.addPartial(path, text)
+}
+
+// addPartial parses text as the template partial with the given path into
+// tmpl.  Like template.ParseFiles, the partial is named by the path's base
+// name and replaces any template of the same name.
+func (s *Scenario) addPartial(path, text string) error {
+	name := filepath.Base(path)
+	t := s.tmpl
+	if name != t.Name() {
+		t = t.New(name)
+	}
+	if _, err := t.Parse(text); err != nil {
+		return err
+	}
+	s.tmplSrc = append(s.tmplSrc, tmplFile{path, text})
+	return nil
+}
+
+func (s *Scenario) tmplFuncs() template.FuncMap {
+	return template.FuncMap{
+		"add": func(a, b int) int { return a + b },
+		"sub": func(a, b int) int { return a - b },
+		"mul": func(a, b int) int { return a * b },
+		"div": func(a, b int) (int, error) {
+			if b == 0 {
+				return 0, fmt.Errorf("template div: division by zero")
+			}
+			return a / b, nil
+		},
+		"seq": func(start, end int) []int {
+			vals := []int{}
+			for i := start; i < end; i++ {
+				vals = append(vals, i)
+			}
+			return vals
+		},
+		"periodTimes": s.periodTimes,
+		"power":       s.CyclusPower,
+		"include": func(name string) (string, error) {
+			if !inside(name) {
+				return "", fmt.Errorf("cannot include '%v': path must be relative to and inside the scenario file's directory", name)
+			}
+			data, err := ioutil.ReadFile(filepath.Join(s.Dir(), name))
+			return string(data), err
+		},
+	}
+}
+
+// inside returns true if the path name is relative and doesn't lead out of
+// the directory it is relative to.
+func inside(name string) bool {
+	clean := filepath.Clean(name)
+	return !filepath.IsAbs(clean) && clean != ".." && !strings.HasPrefix(clean, ".."+string(filepath.Separator))
+}
+
+// GenCyclusInfile renders the scenario's cyclus input file template.  If the
+// input file is XML (see xmlInfile) but not well-formed, it is returned along
+// with an error from ValidateInfile.  Other input file formats (e.g. JSON)
+// aren't validated.
 func (s *Scenario) GenCyclusInfile() ([]byte, error) {
 	if s.Handle == "" {
 		s.Handle = "none"
 	}
 
 	if s.tmpl == nil {
-		s.tmpl = template.Must(template.ParseFiles(s.CyclusTmplPath()))
+		if err := s.parseTmpl(); err != nil {
+			return nil, err
+		}
 	}
 
 	var buf bytes.Buffer
@@ -620,9 +2118,52 @@ func (s *Scenario) GenCyclusInfile() ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	return buf.Bytes(), nil
+	data := buf.Bytes()
+	if !s.xmlInfile(data) {
+		return data, nil
+	}
+	return data, ValidateInfile(data)
+}
+
+// xmlInfile returns true if the rendered input file data is XML - i.e. the
+// template file has an ".xml" extension or data starts with "<".
+func (s *Scenario) xmlInfile(data []byte) bool {
+	return strings.EqualFold(filepath.Ext(s.CyclusTmpl), ".xml") || bytes.HasPrefix(bytes.TrimSpace(data), []byte("<"))
+}
+
+// ValidateInfile returns an error if data is not well-formed XML.  The error
+// reports the line and column near the first bad token.
+func ValidateInfile(data []byte) error {
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		_, err := dec.Token()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			line, col := findLine(data, dec.InputOffset())
+			return fmt.Errorf("malformed cyclus input file near line %v, col %v: %v", line, col, err)
+		}
+	}
+}
+
+// WriteInfile renders the scenario's cyclus input file and writes it to path
+// without running cyclus.  This is useful for debugging cyclus templates.
+// Malformed input files are still written (to help track down template
+// bugs), but the validation error is returned.
+func (s *Scenario) WriteInfile(path string) error {
+	data, err := s.GenCyclusInfile()
+	if data == nil {
+		return err
+	}
+	if werr := ioutil.WriteFile(path, data, 0644); werr != nil {
+		return werr
+	}
+	return err
 }
 
+// VarNames returns a label of the form "t[period]_f[j]" for each variable
+// in the same order TransformVars expects them, where j is the variable's
+// index within its build period (see TransformVars).
 func (s *Scenario) VarNames() []string {
 	names := make([]string, 0, s.NVars())
 	varfacs, _ := s.periodFacOrder()
@@ -634,6 +2175,56 @@ func (s *Scenario) VarNames() []string {
 	return names
 }
 
+// Kinds of scenario variables (see VarInfo).
+const (
+	// VarPower is the variable for the new power capacity built in a period.
+	VarPower = "power"
+	// VarReactor is the variable for the fraction of the remaining new power
+	// capacity satisfied by a reactor prototype.
+	VarReactor = "reactor"
+	// VarSupport is the variable for the number of a non-reactor prototype
+	// deployed as a fraction of its FracOfProtos.
+	VarSupport = "support"
+)
+
+// VarInfo describes the role of a single scenario variable.
+type VarInfo struct {
+	// Index is the variable's index in the vector passed to TransformVars.
+	Index int
+	// Period is the build period the variable applies to and Time is that
+	// period's deployment time step.
+	Period int
+	Time   int
+	// Kind is one of VarPower, VarReactor, or VarSupport.
+	Kind string
+	// Proto is the prototype deployed by the variable (empty for VarPower
+	// variables).
+	Proto string
+}
+
+// VarSpec describes each of the scenario's variables in the same order
+// TransformVars expects them (and VarNames labels them) - period-major with
+// the power variable first in each period followed by reactor and then
+// support facility variables.
+func (s *Scenario) VarSpec() []VarInfo {
+	spec := make([]VarInfo, 0, s.NVars())
+	varfacs, _ := s.periodFacOrder()
+	for i, t := range s.PeriodTimes() {
+		for j, fac := range varfacs {
+			info := VarInfo{Index: s.varIndex(i, j), Period: i, Time: t, Proto: fac.Proto}
+			if j == 0 {
+				info.Kind = VarPower
+			} else if fac.Cap > 0 {
+				info.Kind = VarReactor
+			} else {
+				info.Kind = VarSupport
+			}
+			spec = append(spec, info)
+		}
+	}
+	return spec
+}
+
 func (s *Scenario) LowerBounds() []float64 {
 	return make([]float64, s.NVars())
 }
@@ -645,9 +2236,7 @@ func (s *Scenario) UpperBounds() []float64 {
 		for j, fac := range facs {
 			if j == 0 { // power var
 				up = append(up, 1)
-			} else if fac.BuildAfter == -1 { // never can build
-				up = append(up, 0)
-			} else if fac.BuildAfter > 0 && fac.BuildAfter > t {
+			} else if !fac.Available(t) {
 				up = append(up, 0)
 			} else {
 				up = append(up, 1)
@@ -657,26 +2246,61 @@ func (s *Scenario) UpperBounds() []float64 {
 	return up
 }
 
+// timeOf returns the time step at which build period starts (see
+// PeriodTimes).
 func (s *Scenario) timeOf(period int) int {
 	return period*s.BuildPeriod + 1 + s.BuildOffset
 }
 
+// periodOf returns the build period that time is in - i.e. the last period
+// whose start time (see timeOf) is <= time.  It is the inverse of timeOf for
+// period start times.  Times at or before BuildOffset give negative periods
+// and times in the wind-down give periods >= NPeriods().
 func (s *Scenario) periodOf(time int) int {
-	return (time - s.BuildOffset - 1) / s.BuildPeriod
+	dt := time - s.BuildOffset - 1
+	if dt < 0 {
+		// round toward -infinity rather than zero
+		return -((-dt + s.BuildPeriod - 1) / s.BuildPeriod)
+	}
+	return dt / s.BuildPeriod
 }
 
-func (s *Scenario) periodTimes() []int {
-	periods := make([]int, s.nperiods())
+// PeriodTimes returns the time step at which deployments are made for each
+// of the scenario's build periods in order.  The scenario's time steps are
+// laid out like this (with n = NPeriods() and P = BuildPeriod):
+//
+//	0             BuildOffset+1       BuildOffset+1+P          SimDur-TrailingDur    SimDur
+//	|-- initial --|---- period 0 -----|---- period 1 ---| ... |---- wind-down ----|
+//
+// Steps 0 through BuildOffset are for initial conditions: StartBuilds (and
+// Builds) there are simply deployed as given.  Build period i starts at step
+// BuildOffset+1+i*P - always after BuildOffset - and the last period
+// (n-1) starts before the TrailingDur wind-down steps at the end of the
+// simulation.  StartBuilds after BuildOffset are allowed and count as
+// existing capacity in the periods they overlap.  ForcedBuilds must fall
+// within the build periods (after BuildOffset and before the wind-down)
+// because they count toward the power bounds of the period they are in.
+func (s *Scenario) PeriodTimes() []int {
+	periods := make([]int, s.NPeriods())
 	for i := range periods {
 		periods[i] = s.timeOf(i)
 	}
 	return periods
 }
 
-func (s *Scenario) nperiods() int {
+// NPeriods returns the number of build periods in the scenario.  Zero is
+// returned for scenarios with no room for build periods (see Validate).
+func (s *Scenario) NPeriods() int {
+	if s.BuildPeriod <= 0 || s.SimDur-s.BuildOffset-s.TrailingDur-2 < 0 {
+		return 0
+	}
 	return (s.SimDur-s.BuildOffset-s.TrailingDur-2)/s.BuildPeriod + 1
 }
 
+func (s *Scenario) periodTimes() []int { return s.PeriodTimes() }
+
+func (s *Scenario) nperiods() int { return s.NPeriods() }
+
 func findLine(data []byte, pos int64) (line, col int) {
 	line = 1
 	buf := bytes.NewBuffer(data)
@@ -1,6 +1,18 @@
 package scen
 
-import "testing"
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
 
 type alivetest struct {
 	Built    int
@@ -27,6 +39,94 @@ func TestAlive(t *testing.T) {
 	}
 }
 
+func TestLifetime(t *testing.T) {
+	tests := []struct {
+		FacLife   int
+		BuildLife int
+		Want      int
+	}{
+		{FacLife: 10, BuildLife: 0, Want: 10},
+		{FacLife: 10, BuildLife: 5, Want: 5},
+		{FacLife: 10, BuildLife: InfiniteLife, Want: InfiniteLife},
+		{FacLife: 0, BuildLife: 0, Want: InfiniteLife},
+		{FacLife: InfiniteLife, BuildLife: 0, Want: InfiniteLife},
+		{FacLife: InfiniteLife, BuildLife: 5, Want: 5},
+		{FacLife: 0, BuildLife: InfiniteLife, Want: InfiniteLife},
+	}
+
+	for _, test := range tests {
+		fac := Facility{Proto: "reactor", Cap: 1, Life: test.FacLife}
+		b := Build{Time: 1, Proto: "reactor", N: 1, Life: test.BuildLife, fac: fac}
+		if got := b.Lifetime(); got != test.Want {
+			t.Errorf("facility life %v, build life %v: got Lifetime %v, want %v", test.FacLife, test.BuildLife, got, test.Want)
+		}
+
+		const later = 1000
+		if got, want := b.Alive(later), test.Want == InfiniteLife; got != want {
+			t.Errorf("facility life %v, build life %v: Alive(%v)=%v, want %v", test.FacLife, test.BuildLife, later, got, want)
+		}
+		if got, want := fac.Alive(1, later), test.FacLife <= 0; got != want {
+			t.Errorf("facility life %v: Facility.Alive(1, %v)=%v, want %v", test.FacLife, later, got, want)
+		}
+	}
+
+	s := &Scenario{
+		SimDur:      2,
+		BuildPeriod: 1,
+		Facs:        []Facility{{Proto: "reactor", Cap: 1, Life: 10}},
+		MinPower:    []float64{0},
+		MaxPower:    []float64{0},
+		Builds:      []Build{{Time: 1, Proto: "reactor", N: 1, Life: InfiniteLife}},
+	}
+	if err := s.Validate(); err != nil {
+		t.Errorf("build with infinite life failed validation: %v", err)
+	} else if got := s.Builds[0].Lifetime(); got != InfiniteLife {
+		t.Errorf("validated build with infinite life: got Lifetime %v, want %v", got, InfiniteLife)
+	}
+
+	s.Builds[0].Life = -2
+	if err := s.Validate(); err == nil {
+		t.Errorf("build with Life -2 passed validation")
+	}
+	s.Builds[0].Life = 0
+	s.Facs[0].Life = -2
+	if err := s.Validate(); err == nil {
+		t.Errorf("facility with Life -2 passed validation")
+	}
+}
+
+func TestAvailable(t *testing.T) {
+	tests := []struct {
+		Fac   Facility
+		Time  int
+		Avail bool
+	}{
+		// open-ended
+		{Facility{BuildAfter: 0}, 0, true},
+		{Facility{BuildAfter: 0}, 1000, true},
+		{Facility{BuildAfter: 5}, 4, false},
+		{Facility{BuildAfter: 5}, 5, true},
+		{Facility{BuildAfter: 5}, 1000, true},
+		// closed window
+		{Facility{BuildAfter: 5, BuildBefore: 10}, 4, false},
+		{Facility{BuildAfter: 5, BuildBefore: 10}, 5, true},
+		{Facility{BuildAfter: 5, BuildBefore: 10}, 9, true},
+		{Facility{BuildAfter: 5, BuildBefore: 10}, 10, false},
+		{Facility{BuildAfter: 0, BuildBefore: 10}, 0, true},
+		// never available
+		{Facility{BuildAfter: -1}, 0, false},
+		{Facility{BuildAfter: -1, BuildBefore: 10}, 5, false},
+		{Facility{BuildAfter: 10, BuildBefore: 5}, 7, false},
+	}
+
+	for _, test := range tests {
+		got := test.Fac.Available(test.Time)
+		if got != test.Avail {
+			t.Errorf("Available(t=%v) for BuildAfter=%v, BuildBefore=%v: got %v, want %v", test.Time, test.Fac.BuildAfter, test.Fac.BuildBefore, got, test.Avail)
+		}
+	}
+}
+
 func TestPeriodTimes(t *testing.T) {
 	var tests = []struct {
 		Dur    int
@@ -38,6 +138,8 @@ func TestPeriodTimes(t *testing.T) {
 		{13, 3, 0, []int{1, 4, 7, 10}},
 		{2, 1, 0, []int{1}},
 		{1, 1, 0, []int{}},
+		{0, 2, 0, []int{}},
+		{15, 0, 0, []int{}},
 		{15, 3, 1, []int{2, 5, 8, 11, 14}},
 		{15, 3, 2, []int{3, 6, 9, 12}},
 		{16, 3, 2, []int{3, 6, 9, 12, 15}},
@@ -50,7 +152,10 @@ func TestPeriodTimes(t *testing.T) {
 			BuildOffset: test.Offset,
 		}
 
-		got := s.periodTimes()
+		got := s.PeriodTimes()
+		if n := s.NPeriods(); n != len(test.Want) {
+			t.Errorf("case %v: NPeriods() = %v, want %v", i, n, len(test.Want))
+		}
 		if len(got) != len(test.Want) {
 			t.Errorf("case %v (dur=%v, per=%v, offset=%v): want %v, got %v", i, test.Dur, test.Period, test.Offset, test.Want, got)
 		} else {
@@ -176,6 +281,88 @@ func TestTransformVars(tt *testing.T) {
 				"Proto1": {10, 15, 25, 35, 70},
 				"Proto2": {5, 3, 5, 5, 17},
 			},
+		}, {
+			// MaxBuild on Proto2 pushes unmet capacity onto the implicit
+			// reactor (Proto1).
+			Scen: &Scenario{
+				SimDur:      10,
+				BuildPeriod: 2,
+				Facs: []Facility{
+					{Proto: "Proto1", Cap: 1, Life: 0},
+					{Proto: "Proto2", Cap: 1, Life: 0, MaxBuild: 5},
+				},
+				MaxPower: []float64{10, 20, 40, 60, 70},
+				MinPower: []float64{10, 10, 10, 10, 70},
+			},
+			Vars:     []float64{.5, 1, .5, 1, .5, 1, .5, 1, .5, 1},
+			PowerExp: []float64{10, 15, 28, 44, 70},
+			BuildExp: map[string][]int{
+				"Proto1": {5, 5, 13, 16, 26},
+				"Proto2": {5, 0, 0, 0, 0},
+			},
+		}, {
+			// Proto2 is only available before t=5 - after which its share
+			// rolls onto Proto3 and the implicit reactor.
+			Scen: &Scenario{
+				SimDur:      10,
+				BuildPeriod: 2,
+				Facs: []Facility{
+					{Proto: "Proto1", Cap: 1, Life: 0},
+					{Proto: "Proto2", Cap: 1, Life: 0, BuildBefore: 5},
+					{Proto: "Proto3", Cap: 1, Life: 0},
+				},
+				MaxPower: []float64{10, 20, 40, 60, 70},
+				MinPower: []float64{10, 10, 10, 10, 70},
+			},
+			Vars:     []float64{.5, 1, .5, .5, 1, .5, .5, 1, .5, .5, 1, .5, .5, 1, .5},
+			PowerExp: []float64{10, 15, 28, 44, 70},
+			BuildExp: map[string][]int{
+				"Proto1": {0, 0, 7, 8, 13},
+				"Proto2": {10, 5, 0, 0, 0},
+				"Proto3": {0, 0, 6, 8, 13},
+			},
+		}, {
+			// Proto2 is a fraction of Proto3 which is listed after it -
+			// Proto3 must be built first.
+			Scen: &Scenario{
+				SimDur:      10,
+				BuildPeriod: 2,
+				Facs: []Facility{
+					{Proto: "Proto1", Cap: 1, Life: 0},
+					{Proto: "Proto2", Cap: 0, Life: 0, FracOfProtos: []string{"Proto3"}},
+					{Proto: "Proto3", Cap: 0, Life: 0, FracOfProtos: []string{"Proto1"}},
+				},
+				MaxPower: []float64{10, 20, 40, 60, 70},
+				MinPower: []float64{10, 10, 10, 10, 70},
+			},
+			Vars:     []float64{.5, 1, .5, .5, 1, .5, .5, 1, .5, .5, 1, .5, .5, 1, .5},
+			PowerExp: []float64{10, 15, 28, 44, 70},
+			BuildExp: map[string][]int{
+				"Proto1": {10, 5, 13, 16, 26},
+				"Proto2": {5, 3, 6, 8, 13},
+				"Proto3": {5, 3, 6, 8, 13},
+			},
+		}, {
+			// BuildPeriod (4) differs from the number of vars per period
+			// (3) - vars must be strided by the latter.
+			Scen: &Scenario{
+				SimDur:      13,
+				BuildPeriod: 4,
+				Facs: []Facility{
+					{Proto: "Proto1", Cap: 1, Life: 0},
+					{Proto: "Proto2", Cap: 1, Life: 0},
+					{Proto: "Proto3", Cap: 1, Life: 0},
+				},
+				MaxPower: []float64{10, 20, 30},
+				MinPower: []float64{10, 20, 30},
+			},
+			Vars:     []float64{0, 1, 0, 0, 0, 1, 0, 0, 0},
+			PowerExp: []float64{10, 20, 30},
+			BuildExp: map[string][]int{
+				"Proto1": {0, 0, 10},
+				"Proto2": {10, 0, 0},
+				"Proto3": {0, 10, 0},
+			},
 		},
 	}
 
@@ -298,3 +485,1745 @@ func TestVarNames(t *testing.T) {
 	t.Logf("LowerBounds:\n%v", s.LowerBounds())
 	t.Logf("UpperBounds:\n%v", s.UpperBounds())
 }
+
+func TestVarSpec(t *testing.T) {
+	s := &Scenario{
+		SimDur:      10,
+		BuildPeriod: 2,
+		Facs: []Facility{
+			{Proto: "Proto1", Cap: 1},
+			{Proto: "Proto2", Cap: 1},
+			{Proto: "Proto3", FracOfProtos: []string{"Proto1", "Proto2"}},
+		},
+		MinPower: []float64{10, 20, 30, 40, 50},
+		MaxPower: []float64{10, 20, 30, 40, 50},
+	}
+
+	spec := s.VarSpec()
+	if len(spec) != s.NVars() {
+		t.Fatalf("got %v var infos, want %v", len(spec), s.NVars())
+	}
+
+	kinds := []string{VarPower, VarReactor, VarSupport}
+	protos := []string{"", "Proto2", "Proto3"}
+	names := s.VarNames()
+	for k, info := range spec {
+		period, j := k/len(kinds), k%len(kinds)
+		want := VarInfo{Index: k, Period: period, Time: s.PeriodTimes()[period], Kind: kinds[j], Proto: protos[j]}
+		if info != want {
+			t.Errorf("var %v (%v): got %+v, want %+v", k, names[k], info, want)
+		}
+	}
+}
+
+// TestVarNamesOrder checks that each variable labeled by VarNames controls
+// the deployment of the facility in the build period its label says it does.
+func TestVarNamesOrder(t *testing.T) {
+	s := &Scenario{
+		SimDur:      10,
+		BuildPeriod: 2,
+		Facs: []Facility{
+			{Proto: "Proto1", Cap: 1},
+			{Proto: "Proto2", Cap: 1},
+			{Proto: "Proto3", FracOfProtos: []string{"Proto1", "Proto2"}},
+		},
+		MinPower: []float64{10, 20, 30, 40, 50},
+		MaxPower: []float64{10, 20, 30, 40, 50},
+	}
+	// variable index within each period to the prototype it deploys
+	facprotos := map[int]string{1: "Proto2", 2: "Proto3"}
+
+	names := s.VarNames()
+	if len(names) != s.NVars() {
+		t.Fatalf("got %v var names, want %v", len(names), s.NVars())
+	}
+
+	for k, name := range names {
+		var period, j int
+		if _, err := fmt.Sscanf(name, "t%d_f%d", &period, &j); err != nil {
+			t.Fatalf("var %v: bad name %q: %v", k, name, err)
+		}
+		proto, ok := facprotos[j]
+		if !ok {
+			continue // power var
+		}
+
+		vars := make([]float64, s.NVars())
+		vars[k] = 1
+		builds, err := s.TransformVars(vars)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := s.periodTimes()[period]
+		if len(builds[proto]) == 0 {
+			t.Errorf("var %v (%v): no %v builds, want builds at t=%v", k, name, proto, want)
+		}
+		for _, b := range builds[proto] {
+			if b.Time != want {
+				t.Errorf("var %v (%v): %v built at t=%v, want only t=%v", k, name, proto, b.Time, want)
+			}
+		}
+	}
+}
+
+func TestFracOfProtosCycles(t *testing.T) {
+	tests := []struct {
+		Facs []Facility
+		Err  string
+	}{
+		{
+			Facs: []Facility{
+				{Proto: "R", Cap: 1},
+				{Proto: "A", FracOfProtos: []string{"B"}},
+				{Proto: "B", FracOfProtos: []string{"R"}},
+			},
+		}, {
+			Facs: []Facility{
+				{Proto: "R", Cap: 1},
+				{Proto: "A", FracOfProtos: []string{"R", "A"}},
+			},
+			Err: "prototype A lists itself in FracOfProtos",
+		}, {
+			Facs: []Facility{
+				{Proto: "R", Cap: 1},
+				{Proto: "A", FracOfProtos: []string{"B"}},
+				{Proto: "B", FracOfProtos: []string{"A"}},
+			},
+			Err: "FracOfProtos dependency cycle: A -> B -> A",
+		}, {
+			Facs: []Facility{
+				{Proto: "R", Cap: 1},
+				{Proto: "A", FracOfProtos: []string{"R"}},
+				{Proto: "B", FracOfProtos: []string{"C"}},
+				{Proto: "C", FracOfProtos: []string{"R", "D"}},
+				{Proto: "D", FracOfProtos: []string{"B"}},
+			},
+			Err: "FracOfProtos dependency cycle: B -> C -> D -> B",
+		}, {
+			Facs: []Facility{
+				{Proto: "Reactor", Cap: 1},
+				{Proto: "Sep", FracOfProtos: []string{"Raector"}},
+			},
+			Err: "prototype Sep has FracOfProtos entry 'Raector' that is not defined in Facs",
+		},
+	}
+
+	for i, test := range tests {
+		s := &Scenario{
+			SimDur:      10,
+			BuildPeriod: 2,
+			Facs:        test.Facs,
+			MinPower:    []float64{10, 20, 30, 40, 50},
+			MaxPower:    []float64{10, 20, 30, 40, 50},
+		}
+		err := s.Validate()
+		if test.Err == "" && err != nil {
+			t.Errorf("case %v: unexpected error: %v", i+1, err)
+		} else if test.Err != "" && (err == nil || err.Error() != test.Err) {
+			t.Errorf("case %v: got error %v, want %v", i+1, err, test.Err)
+		}
+	}
+}
+
+func TestProblems(t *testing.T) {
+	s := &Scenario{
+		SimDur:      10,
+		BuildPeriod: 2,
+		Facs: []Facility{
+			{Proto: "reactor", Cap: 1, MaxBuild: -1},
+			{Proto: "repo", FracOfProtos: []string{"nope"}},
+		},
+		MinPower:    []float64{-1, 0, 0, 0},
+		MaxPower:    []float64{0, 0, 0, 0, 0},
+		StartBuilds: []Build{{Proto: "missing", N: 1}},
+	}
+
+	probs := s.Problems()
+	want := []string{
+		"MaxPower length 5 != MinPower length 4",
+		"MinPower[0] is negative (-1)",
+		"number power constraints 4 != number build periods 5",
+		"prototype reactor has negative MaxBuild -1",
+		"prototype repo has FracOfProtos entry 'nope' that is not defined in Facs",
+		"StartBuild prototype 'missing' is not defined in Facs",
+	}
+	if len(probs) != len(want) {
+		t.Fatalf("got %v problems, want %v: %v", len(probs), len(want), probs)
+	}
+	for i, p := range probs {
+		if p.Error() != want[i] {
+			t.Errorf("problem %v: got %q, want %q", i, p, want[i])
+		}
+	}
+
+	// Validate reports just the first problem
+	if err := s.Validate(); err == nil || err.Error() != want[0] {
+		t.Errorf("Validate: got %v, want %v", err, want[0])
+	}
+
+	// disrup-multi modes interpolate between at least two disruptions
+	s = &Scenario{SimDur: 10, BuildPeriod: 5, MinPower: []float64{0, 0}, MaxPower: []float64{0, 0}}
+	s.Facs = []Facility{{Proto: "lwr", Cap: 1, Life: 20}}
+	s.ObjMode = "disrup-multi"
+	disrup := map[string]interface{}{"Time": 5.0, "Prob": 0.1, "Sample": 1.0}
+	s.CustomConfig = map[string]interface{}{"disrup-multi": []interface{}{disrup}}
+	if err := s.Validate(); err == nil || !strings.Contains(err.Error(), "at least 2 disruptions") {
+		t.Errorf("Validate with one disruption: got %v, want error", err)
+	}
+	s.CustomConfig["disrup-multi"] = []interface{}{disrup, disrup}
+	if err := s.Validate(); err != nil {
+		t.Errorf("Validate with two disruptions: %v", err)
+	}
+}
+
+func TestCyclusOutFormat(t *testing.T) {
+	tests := []struct {
+		Format, Ext, Driver string
+		Supported           bool
+	}{
+		{"", ".sqlite", "sqlite3", true},
+		{OutSQLite, ".sqlite", "sqlite3", true},
+		{OutHDF5, ".h5", "", false},
+	}
+
+	for _, test := range tests {
+		s := &Scenario{CyclusOutFormat: test.Format}
+		if ext := s.CyclusOutExt(); ext != test.Ext {
+			t.Errorf("format '%v': got extension %v, want %v", test.Format, ext, test.Ext)
+		}
+		driver, err := s.PostDriver()
+		if test.Supported && err != nil {
+			t.Errorf("format '%v': unexpected error %v", test.Format, err)
+		} else if !test.Supported && err == nil {
+			t.Errorf("format '%v': got driver %v, want error", test.Format, driver)
+		} else if driver != test.Driver {
+			t.Errorf("format '%v': got driver %v, want %v", test.Format, driver, test.Driver)
+		}
+	}
+
+	s := &Scenario{CyclusOutFormat: OutHDF5}
+	if _, err := s.CalcObjective("cyclus.h5", nil); err == nil || !strings.Contains(err.Error(), "hdf5") {
+		t.Errorf("CalcObjective for hdf5 output: got error %v, want unsupported format error", err)
+	}
+
+	s = &Scenario{SimDur: 10, BuildPeriod: 5, MinPower: []float64{0, 0}, MaxPower: []float64{0, 0}}
+	s.Facs = []Facility{{Proto: "lwr", Cap: 1, Life: 20}}
+	if err := s.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	s.CyclusOutFormat = "csv"
+	if err := s.Validate(); err == nil || !strings.Contains(err.Error(), "CyclusOutFormat") {
+		t.Errorf("Validate with unknown CyclusOutFormat: got %v, want error", err)
+	}
+}
+
+func TestValidatePeriods(t *testing.T) {
+	tests := []struct {
+		SimDur, BuildPeriod, BuildOffset, TrailingDur int
+		NPeriods                                      int
+		Valid                                         bool
+	}{
+		{SimDur: 10, BuildPeriod: 0, NPeriods: 0, Valid: false},
+		{SimDur: 10, BuildPeriod: -2, NPeriods: 0, Valid: false},
+		{SimDur: 10, BuildPeriod: 2, BuildOffset: -1, NPeriods: 5, Valid: false},
+		{SimDur: 10, BuildPeriod: 2, TrailingDur: -1, NPeriods: 5, Valid: false},
+		// smallest possible scenario with a build period
+		{SimDur: 2, BuildPeriod: 1, NPeriods: 1, Valid: true},
+		{SimDur: 7, BuildPeriod: 3, BuildOffset: 2, TrailingDur: 3, NPeriods: 1, Valid: true},
+		// one time step too short
+		{SimDur: 1, BuildPeriod: 1, NPeriods: 0, Valid: false},
+		{SimDur: 6, BuildPeriod: 3, BuildOffset: 2, TrailingDur: 3, NPeriods: 0, Valid: false},
+		{SimDur: 3, BuildPeriod: 1, BuildOffset: 2, TrailingDur: 3, NPeriods: 0, Valid: false},
+	}
+
+	for i, test := range tests {
+		s := &Scenario{
+			SimDur:      test.SimDur,
+			BuildPeriod: test.BuildPeriod,
+			BuildOffset: test.BuildOffset,
+			TrailingDur: test.TrailingDur,
+			Facs:        []Facility{{Proto: "Proto1", Cap: 1}},
+			MinPower:    make([]float64, test.NPeriods),
+			MaxPower:    make([]float64, test.NPeriods),
+		}
+
+		if n := s.nperiods(); n != test.NPeriods {
+			t.Errorf("case %v: got %v periods, want %v", i+1, n, test.NPeriods)
+		}
+
+		err := s.Validate()
+		if test.Valid && err != nil {
+			t.Errorf("case %v: unexpected error: %v", i+1, err)
+		} else if !test.Valid && err == nil {
+			t.Errorf("case %v: expected validation error", i+1)
+		}
+	}
+}
+
+func TestVarAtRange(t *testing.T) {
+	s := &Scenario{
+		SimDur:      10,
+		BuildPeriod: 2,
+		Facs: []Facility{
+			{Proto: "Proto1", Cap: 1},
+			{Proto: "Proto2", Cap: 1},
+		},
+		MinPower: []float64{10, 20, 30, 40, 50},
+		MaxPower: []float64{10, 20, 30, 40, 50},
+	}
+	varfacs, _ := s.periodFacOrder()
+	vars := make([]float64, s.NVars()-1)
+
+	if _, err := s.varAt(vars, varfacs, 0, 1); err != nil {
+		t.Errorf("unexpected error for in-range var: %v", err)
+	}
+
+	_, err := s.varAt(vars, varfacs, 4, 1)
+	if err == nil {
+		t.Fatal("expected error for out-of-range var")
+	}
+	for _, want := range []string{"period 4", "facility Proto2"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not contain %q", err, want)
+		}
+	}
+}
+
+func TestHash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudlus-scen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tmplpath := filepath.Join(dir, "tmpl.xml")
+	if err := ioutil.WriteFile(tmplpath, []byte("<simulation/>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	newscen := func() *Scenario {
+		return &Scenario{
+			SimDur:      10,
+			BuildPeriod: 2,
+			CyclusTmpl:  "tmpl.xml",
+			File:        filepath.Join(dir, "scenario.json"),
+			NuclideCost: map[string]float64{"922350000": 1, "942390000": 2, "10010000": 3},
+			Facs:        []Facility{{Proto: "Proto1", Cap: 1}},
+			MinPower:    []float64{10, 20, 30, 40, 50},
+			MaxPower:    []float64{10, 20, 30, 40, 50},
+		}
+	}
+	vars := []float64{.5, .5, .5, .5, .5}
+
+	s := newscen()
+	h := hash(t, s, vars)
+
+	if got := hash(t, newscen(), vars); got != h {
+		t.Errorf("identical scenarios hashed differently")
+	}
+
+	moved := newscen()
+	moved.File = filepath.Join(dir, "other.json")
+	if got := hash(t, moved, vars); got != h {
+		t.Errorf("scenario File changed the hash")
+	}
+
+	if got := hash(t, s, []float64{.5, .5, .5, .5, .6}); got == h {
+		t.Errorf("different vars produced the same hash")
+	}
+
+	cost := newscen()
+	cost.NuclideCost["922350000"] = 5
+	if got := hash(t, cost, vars); got == h {
+		t.Errorf("different NuclideCost produced the same hash")
+	}
+
+	if err := ioutil.WriteFile(tmplpath, []byte("<simulation></simulation>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := hash(t, newscen(), vars); got == h {
+		t.Errorf("changed cyclus template produced the same hash")
+	}
+
+	nan := newscen()
+	nan.PowerPenalty = math.NaN()
+	if _, err := nan.Hash(vars); err == nil {
+		t.Errorf("scenario with a NaN value hashed without error")
+	}
+}
+
+// hash returns s.Hash(vars) failing the test on error.
+func hash(t *testing.T, s *Scenario, vars []float64) [32]byte {
+	h, err := s.Hash(vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestDecode(t *testing.T) {
+	const data = `{
+	"SimDur": 10,
+	"BuildPeriod": 2,
+	"Facs": [{"Proto": "Proto1", "Cap": 1}],
+	"MinPower": [10, 10, 10, 10, 10],
+	"MaxPower": [20, 20, 20, 20, 20]
+}`
+
+	s := &Scenario{}
+	if err := s.Decode(strings.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if s.SimDur != 10 || len(s.Facs) != 1 || s.Facs[0].Proto != "Proto1" {
+		t.Errorf("scenario decoded incorrectly: %+v", s)
+	}
+	if got := s.NVars(); got != 5 {
+		t.Errorf("wrong number of vars: got %v, want 5", got)
+	}
+
+	// invalid scenarios must fail validation
+	s = &Scenario{}
+	if err := s.Decode(strings.NewReader(`{"SimDur": 10, "BuildPeriod": 2}`)); err == nil {
+		t.Errorf("expected validation error for scenario with no power constraints")
+	}
+
+	// syntax errors should report their location
+	s = &Scenario{}
+	err := s.Decode(strings.NewReader("{\n\"SimDur\": 10,,\n}"))
+	if err == nil || !strings.HasPrefix(err.Error(), "scenario:2:") {
+		t.Errorf("expected syntax error at line 2, got %v", err)
+	}
+}
+
+func TestTmplFuncs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudlus-scen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const tmpl = `{{add .SimDur 2}} {{sub .SimDur 2}} {{mul .BuildPeriod 3}} {{div .SimDur 3}}
+{{range seq 0 3}}{{.}},{{end}}
+{{range periodTimes}}{{.}},{{end}}`
+	err = ioutil.WriteFile(filepath.Join(dir, "tmpl.xml"), []byte(tmpl), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Scenario{
+		SimDur:      10,
+		BuildPeriod: 2,
+		CyclusTmpl:  "tmpl.xml",
+		File:        filepath.Join(dir, "scenario.json"),
+		Facs:        []Facility{{Proto: "Proto1", Cap: 1}},
+		MaxPower:    []float64{10, 20, 40, 60, 70},
+		MinPower:    []float64{10, 10, 10, 10, 70},
+	}
+
+	data, err := s.GenCyclusInfile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "12 8 6 3\n0,1,2,\n1,3,5,7,9,"
+	if got := string(data); got != want {
+		t.Errorf("rendered template:\ngot  %q\nwant %q", got, want)
+	}
+}
+
+func TestAuxFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudlus-scen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"tmpl.xml":           `<simulation>{{include "regions/region.xml"}}</simulation>`,
+		"regions/region.xml": `<region>{{.SimDur}}</region>`,
+	}
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := &Scenario{
+		SimDur:     10,
+		CyclusTmpl: "tmpl.xml",
+		File:       filepath.Join(dir, "scenario.json"),
+		AuxFiles:   []string{"regions/region.xml"},
+	}
+	data, err := s.GenCyclusInfile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// included files are inserted verbatim - not executed as templates
+	want := "<simulation><region>{{.SimDur}}</region></simulation>"
+	if got := string(data); got != want {
+		t.Errorf("rendered template:\ngot  %q\nwant %q", got, want)
+	}
+
+	// edits to aux files change the scenario hash
+	h1 := hash(t, s, nil)
+	ioutil.WriteFile(filepath.Join(dir, "regions/region.xml"), []byte("<region/>"), 0644)
+	if h2 := hash(t, s, nil); h1 == h2 {
+		t.Errorf("hash unchanged after editing aux file")
+	}
+
+	for _, name := range []string{"../outside.xml", "/abs/path.xml", "a/../../outside.xml"} {
+		s := &Scenario{
+			SimDur:      2,
+			BuildPeriod: 1,
+			Facs:        []Facility{{Proto: "Proto1", Cap: 1}},
+			MinPower:    []float64{0},
+			MaxPower:    []float64{0},
+			AuxFiles:    []string{"ok/file.xml", name},
+		}
+		if err := s.Validate(); err == nil {
+			t.Errorf("AuxFiles path %q passed validation", name)
+		}
+
+		tmpl := `<simulation>{{include "` + name + `"}}</simulation>`
+		if err := ioutil.WriteFile(filepath.Join(dir, "include.xml"), []byte(tmpl), 0644); err != nil {
+			t.Fatal(err)
+		}
+		s = &Scenario{CyclusTmpl: "include.xml", File: filepath.Join(dir, "scenario.json")}
+		if _, err := s.GenCyclusInfile(); err == nil || !strings.Contains(err.Error(), "inside the scenario file's directory") {
+			t.Errorf("include %q: got error %v", name, err)
+		}
+	}
+}
+
+func TestTmplPartials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudlus-scen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"tmpl.xml":            `<simulation>{{template "reactors.xml" .}}{{template "fuel" .}}</simulation>`,
+		"parts/reactors.xml":  `<prototype><name>lwr</name></prototype>{{define "fuel"}}<fuel>uox</fuel>{{end}}`,
+		"models/mox/fuel.xml": `{{define "fuel"}}<fuel>mox {{.SimDur}}</fuel>{{end}}`,
+	}
+	for name, data := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	newscen := func(variant string) *Scenario {
+		return &Scenario{
+			SimDur:             10,
+			BuildPeriod:        2,
+			CyclusTmpl:         "tmpl.xml",
+			CyclusTmplPartials: []string{"parts/reactors.xml"},
+			TmplVariants:       map[string][]string{"mox": {"models/mox/fuel.xml"}, "uox": nil},
+			TmplVariant:        variant,
+			File:               filepath.Join(dir, "scenario.json"),
+			Facs:               []Facility{{Proto: "lwr", Cap: 1}},
+			MaxPower:           []float64{10, 20, 40, 60, 70},
+			MinPower:           []float64{10, 10, 10, 10, 70},
+		}
+	}
+
+	tests := []struct {
+		variant string
+		fuel    string
+	}{
+		{"", "<fuel>uox</fuel>"},
+		{"uox", "<fuel>uox</fuel>"},
+		// the variant's definition replaces the default one
+		{"mox", "<fuel>mox 10</fuel>"},
+	}
+	for _, test := range tests {
+		s := newscen(test.variant)
+		data, err := s.GenCyclusInfile()
+		if err != nil {
+			t.Errorf("variant %q: %v", test.variant, err)
+			continue
+		}
+		want := "<simulation><prototype><name>lwr</name></prototype>" + test.fuel + "</simulation>"
+		if got := string(data); got != want {
+			t.Errorf("variant %q rendered template:\ngot  %q\nwant %q", test.variant, got, want)
+		}
+	}
+
+	// partials are scanned for prototypes
+	if warnings, err := newscen("").CheckTmplPrototypes(); err != nil {
+		t.Fatal(err)
+	} else if len(warnings) > 0 {
+		t.Errorf("got prototype warnings %v, want none", warnings)
+	}
+
+	if hash(t, newscen("mox"), nil) == hash(t, newscen("uox"), nil) {
+		t.Errorf("different variants hash the same")
+	}
+
+	// partials given as text (e.g. from a job's input files) are hashed as
+	// parsed rather than read from the scenario directory
+	given := func(fuel string) [32]byte {
+		s := newscen("mox")
+		s.File = ""
+		if err := s.ParseTmpl(files["tmpl.xml"]); err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range s.TmplPartials() {
+			text := files[name]
+			if name == "models/mox/fuel.xml" {
+				text = fuel
+			}
+			if err := s.AddTmplPartial(name, text); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return hash(t, s, nil)
+	}
+	if given(files["models/mox/fuel.xml"]) == given(`{{define "fuel"}}<fuel>thorium</fuel>{{end}}`) {
+		t.Errorf("different partials given as text hash the same")
+	}
+	missing := newscen("mox")
+	missing.TmplVariants["mox"] = []string{"models/mox/missing.xml"}
+	if _, err := missing.Hash(nil); err == nil {
+		t.Errorf("scenario with a missing partial hashed without error")
+	}
+
+	s := newscen("thorium")
+	if err := s.Validate(); err == nil || !strings.Contains(err.Error(), "invalid TmplVariant 'thorium' (must be one of: mox, uox)") {
+		t.Errorf("unknown variant: got error %v", err)
+	}
+	s = newscen("")
+	s.CyclusTmplPartials = []string{"../reactors.xml"}
+	if err := s.Validate(); err == nil || !strings.Contains(err.Error(), "CyclusTmplPartials") {
+		t.Errorf("partial outside scenario directory: got error %v", err)
+	}
+}
+
+func TestNuclideCostFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudlus-scen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"costs.json": `{"922350000": 1, "942390000": 2}`,
+		"costs.csv":  "nuclide,cost\n922350000, 1\n942390000, 2\n",
+		"bad.csv":    "nuclide,cost\n922350000,1\n942390000,lots\n",
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	const tmpl = `{
+	"SimDur": 10,
+	"BuildPeriod": 2,
+	"NuclideCostFile": %q,
+	"NuclideCost": {"942390000": 5, "10010000": 3},
+	"Facs": [{"Proto": "Proto1", "Cap": 1}],
+	"MinPower": [10, 10, 10, 10, 10],
+	"MaxPower": [20, 20, 20, 20, 20]
+}`
+	want := map[string]float64{"922350000": 1, "942390000": 5, "10010000": 3}
+	for _, name := range []string{"costs.json", "costs.csv"} {
+		s := &Scenario{File: filepath.Join(dir, "scenario.json")}
+		if err := s.Decode(strings.NewReader(fmt.Sprintf(tmpl, name))); err != nil {
+			t.Errorf("%v: %v", name, err)
+			continue
+		}
+		if !reflect.DeepEqual(s.NuclideCost, want) {
+			t.Errorf("%v: NuclideCost:\ngot  %v\nwant %v", name, s.NuclideCost, want)
+		}
+	}
+
+	for _, name := range []string{"bad.csv", "missing.json"} {
+		s := &Scenario{File: filepath.Join(dir, "scenario.json")}
+		if err := s.Decode(strings.NewReader(fmt.Sprintf(tmpl, name))); err == nil {
+			t.Errorf("%v: expected error loading NuclideCostFile", name)
+		}
+	}
+
+	// inline entries take precedence over the file for the same nuclide in
+	// another notation
+	s := &Scenario{File: filepath.Join(dir, "scenario.json")}
+	anytmpl := strings.Replace(tmpl, `"942390000": 5`, `"Pu239": 5`, 1)
+	anytmpl = strings.Replace(anytmpl, `"SimDur"`, `"NuclideNotation": "any", "SimDur"`, 1)
+	if err := s.Decode(strings.NewReader(fmt.Sprintf(anytmpl, "costs.json"))); err != nil {
+		t.Errorf("inline Pu239 with file 942390000: %v", err)
+	} else if got := s.nuclideCosts(); !reflect.DeepEqual(got, want) {
+		t.Errorf("inline Pu239 with file 942390000: costs:\ngot  %v\nwant %v", got, want)
+	}
+
+	for _, nuc := range []string{"U235", "0922350000", "-922350000", "1190000000", "920500000", ""} {
+		s := &Scenario{
+			SimDur:      2,
+			BuildPeriod: 1,
+			Facs:        []Facility{{Proto: "Proto1", Cap: 1}},
+			MinPower:    []float64{0},
+			MaxPower:    []float64{0},
+			NuclideCost: map[string]float64{"922350000": 1, nuc: 1},
+		}
+		if err := s.Validate(); err == nil {
+			t.Errorf("NuclideCost key %q passed validation", nuc)
+		}
+	}
+}
+
+func TestNuclideNotation(t *testing.T) {
+	newScen := func(notation string, costs map[string]float64) *Scenario {
+		return &Scenario{
+			SimDur:          2,
+			BuildPeriod:     1,
+			Facs:            []Facility{{Proto: "Proto1", Cap: 1}},
+			MinPower:        []float64{0},
+			MaxPower:        []float64{0},
+			NuclideCost:     costs,
+			NuclideNotation: notation,
+		}
+	}
+
+	s := newScen(NotationAny, map[string]float64{"U235": 1, "Am242m": 2, "942390000": 3, "92238": 4})
+	if err := s.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]float64{"922350000": 1, "952420001": 2, "942390000": 3, "922380000": 4}
+	if got := s.nuclideCosts(); !reflect.DeepEqual(got, want) {
+		t.Errorf("costs:\ngot  %v\nwant %v", got, want)
+	} else if _, ok := s.NuclideCost["U235"]; !ok || len(s.NuclideCost) != 4 {
+		t.Errorf("validation changed NuclideCost to %v", s.NuclideCost)
+	}
+
+	// every unrecognized key is reported at once
+	s = newScen(NotationAny, map[string]float64{"U235": 1, "Xx1": 2, "foo": 3})
+	if err := s.Validate(); err == nil {
+		t.Errorf("unrecognized NuclideCost keys passed validation")
+	} else if msg := err.Error(); !strings.Contains(msg, "'Xx1'") || !strings.Contains(msg, "'foo'") || strings.Contains(msg, "'U235'") {
+		t.Errorf("error doesn't list exactly the unrecognized keys: %v", err)
+	}
+
+	// the same nuclide in two forms is ambiguous
+	if err := newScen(NotationAny, map[string]float64{"U235": 1, "922350000": 2}).Validate(); err == nil {
+		t.Errorf("duplicate NuclideCost nuclides passed validation")
+	}
+
+	if err := newScen(NotationId, map[string]float64{"U235": 1}).Validate(); err == nil {
+		t.Errorf("nuclide name passed validation with notation %q", NotationId)
+	}
+	if err := newScen("zaid", nil).Validate(); err == nil {
+		t.Errorf("invalid NuclideNotation passed validation")
+	}
+}
+
+func TestWriteInfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudlus-scen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const tmpl = `<simulation><duration>{{.SimDur}}</duration></simulation>`
+	err = ioutil.WriteFile(filepath.Join(dir, "tmpl.xml"), []byte(tmpl), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Scenario{
+		SimDur:     10,
+		CyclusTmpl: "tmpl.xml",
+		File:       filepath.Join(dir, "scenario.json"),
+	}
+
+	path := filepath.Join(dir, "infile.xml")
+	if err := s.WriteInfile(path); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "<simulation><duration>10</duration></simulation>"
+	if got := string(data); got != want {
+		t.Errorf("written infile:\ngot  %q\nwant %q", got, want)
+	}
+}
+
+func TestValidateInfile(t *testing.T) {
+	tests := []struct {
+		Data string
+		Line int
+	}{
+		{"<simulation><control></control></simulation>", 0},
+		{"<simulation>\n<control>\n</simulation>", 3},
+		{"<simulation>\n<control>&bogus;</control>\n</simulation>", 2},
+		{"<simulation>\n<control>\n", 3},
+	}
+
+	for i, test := range tests {
+		err := ValidateInfile([]byte(test.Data))
+		if test.Line == 0 {
+			if err != nil {
+				t.Errorf("case %v: unexpected error: %v", i+1, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("case %v: expected error for malformed xml", i+1)
+		} else if want := fmt.Sprintf("line %v,", test.Line); !strings.Contains(err.Error(), want) {
+			t.Errorf("case %v: error %q does not contain %q", i+1, err, want)
+		}
+	}
+
+	// only XML input files are validated when rendered
+	tmpls := []struct {
+		Name, Text string
+		Valid      bool
+	}{
+		{"", `{"simulation": {"control": {"duration": {{.SimDur}}}}}`, true},
+		{"tmpl.json", `{"simulation": {{.SimDur}}`, true},
+		{"", "\n<simulation>\n<control>\n", false},
+		{"tmpl.xml", "duration</simulation>", false},
+	}
+	for _, test := range tmpls {
+		s := &Scenario{SimDur: 10, CyclusTmpl: test.Name}
+		if err := s.ParseTmpl(test.Text); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.GenCyclusInfile(); (err == nil) != test.Valid {
+			t.Errorf("template %q %q: got error %v", test.Name, test.Text, err)
+		}
+	}
+}
+
+func TestEnviron(t *testing.T) {
+	os.Setenv("CLOUDLUS_TEST_INHERITED", "inherited")
+	os.Setenv("CLOUDLUS_TEST_OVERRIDDEN", "inherited")
+	defer os.Unsetenv("CLOUDLUS_TEST_INHERITED")
+	defer os.Unsetenv("CLOUDLUS_TEST_OVERRIDDEN")
+
+	s := &Scenario{Env: map[string]string{
+		"CLOUDLUS_TEST_OVERRIDDEN": "scenario",
+		"CLOUDLUS_TEST_NEW":        "a=b",
+	}}
+
+	want := map[string]string{
+		"CLOUDLUS_TEST_INHERITED":  "inherited",
+		"CLOUDLUS_TEST_OVERRIDDEN": "scenario",
+		"CLOUDLUS_TEST_NEW":        "a=b",
+	}
+	got := map[string]string{}
+	for _, kv := range s.Environ() {
+		i := strings.Index(kv, "=")
+		name := kv[:i]
+		if _, ok := want[name]; !ok {
+			continue
+		} else if _, dup := got[name]; dup {
+			t.Errorf("variable %v appears more than once", name)
+		}
+		got[name] = kv[i+1:]
+	}
+
+	for name, val := range want {
+		if got[name] != val {
+			t.Errorf("%v: got %q, want %q", name, got[name], val)
+		}
+	}
+}
+
+func TestTransformVarsFrom(t *testing.T) {
+	s := &Scenario{
+		SimDur:      10,
+		BuildPeriod: 3,
+		Facs:        []Facility{{Proto: "reactor", Cap: 1, Life: 100}},
+		MinPower:    []float64{0, 0, 0},
+		MaxPower:    []float64{10, 20, 30},
+	}
+
+	full, err := s.TransformVars([]float64{0.5, 0.5, 0.5})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// freeze the first period (t=1) of the schedule
+	base := map[string][]Build{}
+	for _, b := range full["reactor"] {
+		if b.Time <= 1 {
+			base["reactor"] = append(base["reactor"], b)
+		}
+	}
+	if len(base["reactor"]) != 1 || base["reactor"][0].N != 5 {
+		t.Fatalf("unexpected baseline schedule %+v", base)
+	}
+
+	// the first period's var must be ignored
+	builds, err := s.TransformVarsFrom(base, []float64{0, 1, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Build{
+		{Time: 1, Proto: "reactor", N: 5},
+		{Time: 4, Proto: "reactor", N: 15},
+		{Time: 7, Proto: "reactor", N: 10},
+	}
+	got := builds["reactor"]
+	if len(got) != len(want) {
+		t.Fatalf("got builds %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i].Time != want[i].Time || got[i].N != want[i].N {
+			t.Errorf("build %v: got %+v, want %+v", i, got[i], want[i])
+		}
+	}
+	if len(s.Builds) != len(want) {
+		t.Errorf("Scenario.Builds not updated: %+v", s.Builds)
+	}
+	if len(base["reactor"]) != 1 {
+		t.Errorf("baseline schedule was modified: %+v", base)
+	}
+
+	_, err = s.TransformVarsFrom(map[string][]Build{"bogus": {{Time: 1, Proto: "bogus", N: 1}}}, []float64{0, 0, 0})
+	if err == nil {
+		t.Errorf("expected error for baseline build of unknown prototype")
+	}
+}
+
+func TestInvertBuilds(t *testing.T) {
+	s := &Scenario{
+		SimDur:      13,
+		BuildPeriod: 3,
+		Facs: []Facility{
+			{Proto: "lwr", Cap: 1, Life: 6},
+			{Proto: "smr", Cap: 0.3},
+			{Proto: "repo", FracOfProtos: []string{"lwr", "smr"}},
+		},
+		MinPower:    []float64{5, 10, 15, 20},
+		MaxPower:    []float64{10, 20, 30, 40},
+		StartBuilds: []Build{{Time: 1, Proto: "lwr", N: 2}},
+	}
+
+	vars := []float64{
+		0.3, 0.6, 0.5,
+		0.8, 0.2, 0.1,
+		0.0, 1.0, 0.3,
+		0.5, 0.5, 0.2,
+	}
+	if len(vars) != s.NVars() {
+		t.Fatalf("test has %v vars, scenario needs %v", len(vars), s.NVars())
+	}
+
+	builds, err := s.TransformVars(vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inv, err := s.InvertBuilds(builds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rebuilds, err := s.TransformVars(inv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, fac := range s.Facs {
+		for _, tm := range s.periodTimes() {
+			want := s.NBuilt(builds[fac.Proto], tm)
+			got := s.NBuilt(rebuilds[fac.Proto], tm)
+			if diff := got - want; diff < -1 || diff > 1 {
+				t.Errorf("%v built at t=%v: got %v after round trip, want %v (+/- 1)", fac.Proto, tm, got, want)
+			}
+		}
+	}
+
+	if _, err := s.InvertBuilds(map[string][]Build{"bogus": {{Time: 1, Proto: "bogus", N: 1}}}); err == nil {
+		t.Errorf("expected error for build of unknown prototype")
+	}
+}
+
+func TestForcedBuilds(t *testing.T) {
+	newScen := func(forced []Build) *Scenario {
+		return &Scenario{
+			SimDur:       10,
+			BuildPeriod:  3,
+			Facs:         []Facility{{Proto: "reactor", Cap: 1, Life: 100}},
+			MinPower:     []float64{0, 10, 10},
+			MaxPower:     []float64{0, 10, 10},
+			ForcedBuilds: forced,
+		}
+	}
+	vars := []float64{0, 0, 0}
+
+	s := newScen(nil)
+	builds, err := s.TransformVars(vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := s.NBuilt(builds["reactor"], 4); n != 10 {
+		t.Fatalf("unforced: built %v reactors at t=4, want 10", n)
+	}
+
+	// a forced build in the middle of the second period (t=4-6) counts
+	// toward its power bounds
+	s = newScen([]Build{{Time: 5, Proto: "reactor", N: 4}})
+	builds, err = s.TransformVars(vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := s.NBuilt(builds["reactor"], 4); n != 6 {
+		t.Errorf("forced: built %v reactors at t=4, want 6", n)
+	}
+	if n := s.NBuilt(builds["reactor"], 5); n != 4 {
+		t.Errorf("forced build not included: built %v reactors at t=5, want 4", n)
+	}
+	if n := s.NBuilt(builds["reactor"], 7); n != 0 {
+		t.Errorf("forced: built %v reactors at t=7, want 0", n)
+	}
+	if len(s.Builds) != 2 {
+		t.Errorf("got Builds %+v, want the optimizer and forced builds", s.Builds)
+	}
+
+	// round trips through InvertBuilds
+	inv, err := s.InvertBuilds(builds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rebuilds, err := s.TransformVars(inv)
+	if err != nil {
+		t.Fatal(err)
+	} else if n := s.NBuilt(rebuilds["reactor"], 4); n != 6 {
+		t.Errorf("round trip: built %v reactors at t=4, want 6", n)
+	}
+
+	s = newScen([]Build{{Time: 5, Proto: "bogus", N: 4}})
+	if err := s.Validate(); err == nil {
+		t.Errorf("forced build of unknown prototype passed validation")
+	}
+}
+
+func TestCapFactor(t *testing.T) {
+	tests := []struct {
+		CapFactor float64
+		WantN     int
+		Valid     bool
+	}{
+		{0, 10, true}, // unset means 1
+		{1, 10, true},
+		{0.9, 11, true}, // extra reactor needed to satisfy MinPower
+		{0.5, 20, true},
+		{-0.1, 0, false},
+		{1.5, 0, false},
+	}
+
+	for _, test := range tests {
+		s := &Scenario{
+			SimDur:      2,
+			BuildPeriod: 1,
+			Facs:        []Facility{{Proto: "reactor", Cap: 1, CapFactor: test.CapFactor}},
+			MinPower:    []float64{10},
+			MaxPower:    []float64{10},
+		}
+
+		builds, err := s.TransformVars([]float64{0})
+		if !test.Valid {
+			if err == nil {
+				t.Errorf("CapFactor %v: expected validation error", test.CapFactor)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("CapFactor %v: %v", test.CapFactor, err)
+			continue
+		}
+
+		if n := s.nbuiltproto(builds, "reactor"); n != test.WantN {
+			t.Errorf("CapFactor %v: built %v reactors, want %v", test.CapFactor, n, test.WantN)
+		}
+		if pow, want := s.PowerCap(builds, 1), float64(test.WantN)*s.Facs[0].EffCap(); pow != want {
+			t.Errorf("CapFactor %v: got power capacity %v, want %v", test.CapFactor, pow, want)
+		}
+	}
+}
+
+func TestCapSchedule(t *testing.T) {
+	ramp := []Sample{{X: 0, Y: 0.5}, {X: 2, Y: 1}}
+	fac := Facility{Proto: "reactor", Cap: 2, CapSchedule: ramp}
+	for age, want := range []float64{1, 1.5, 2, 2, 2} {
+		if got := fac.CapAt(age); got != want {
+			t.Errorf("CapAt(%v): got %v, want %v", age, got, want)
+		}
+	}
+
+	newScen := func(sched []Sample) *Scenario {
+		return &Scenario{
+			SimDur:      5,
+			BuildPeriod: 1,
+			Facs:        []Facility{{Proto: "reactor", Cap: 1, CapSchedule: sched}},
+			MinPower:    []float64{10, 10, 10, 10},
+			MaxPower:    []float64{10, 10, 10, 10},
+		}
+	}
+
+	// constant capacity satisfies MinPower from the first build on
+	constant := newScen(nil)
+	builds, err := constant.TransformVars([]float64{0, 0, 0, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pow := constant.PowerCap(builds, 1); pow != 10 {
+		t.Errorf("constant capacity: got power capacity %v at t=1, want 10", pow)
+	}
+	if d := constant.PowerDeficit(); d != 0 {
+		t.Errorf("constant capacity: got power deficit %v, want 0", d)
+	}
+
+	// ramping facilities are sized by their capacity when built, so MinPower
+	// is met while they are young
+	ramped := newScen(ramp)
+	builds, err = ramped.TransformVars([]float64{0, 0, 0, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, tm := range ramped.PeriodTimes() {
+		if pow := ramped.PowerCap(builds, tm); pow < ramped.MinPower[i] {
+			t.Errorf("ramped capacity: got power capacity %v at t=%v, want at least %v", pow, tm, ramped.MinPower[i])
+		}
+	}
+	if n := ramped.nbuiltproto(builds, "reactor"); n != 20 {
+		t.Errorf("ramped capacity: built %v reactors, want 20", n)
+	}
+	if d := ramped.PowerDeficit(); d != 0 {
+		t.Errorf("ramped capacity: got power deficit %v, want 0", d)
+	}
+
+	bad := newScen([]Sample{{X: 2, Y: 1}, {X: 1, Y: 1}})
+	if err := bad.Validate(); err == nil {
+		t.Errorf("CapSchedule with decreasing ages passed validation")
+	}
+	bad = newScen([]Sample{{X: 0, Y: -1}})
+	if err := bad.Validate(); err == nil {
+		t.Errorf("CapSchedule with negative fraction passed validation")
+	}
+}
+
+func TestBuildBlock(t *testing.T) {
+	s := &Scenario{
+		SimDur:      5,
+		BuildPeriod: 1,
+		Facs:        []Facility{{Proto: "smr", Cap: 1, BuildBlock: 4}},
+		MinPower:    []float64{1, 5, 9, 10},
+		MaxPower:    []float64{4, 8, 12, 12},
+	}
+
+	builds, err := s.TransformVars(make([]float64, s.NVars()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, b := range builds["smr"] {
+		if b.N%4 != 0 {
+			t.Errorf("time %v: built %v, want a multiple of 4", b.Time, b.N)
+		}
+	}
+	for i, tm := range s.periodTimes() {
+		if pow := s.PowerCap(builds, tm); pow < s.MinPower[i] {
+			t.Errorf("time %v: power capacity %v below MinPower %v", tm, pow, s.MinPower[i])
+		}
+	}
+	if n := s.nbuiltproto(builds, "smr"); n != 12 {
+		t.Errorf("built %v total, want 12", n)
+	}
+
+	s.Facs[0].BuildBlock = -1
+	if err := s.Validate(); err == nil {
+		t.Errorf("negative BuildBlock passed validation")
+	}
+}
+
+// Rounding to whole facilities isn't carried between periods - each period
+// builds toward its target from the capacity actually deployed - so the
+// rounding error must stay within half a facility's capacity rather than
+// accumulating over many periods.
+func TestTransformVarsRounding(t *testing.T) {
+	const nperiods = 40
+	s := &Scenario{
+		SimDur:      nperiods + 1,
+		BuildPeriod: 1,
+		Facs: []Facility{
+			{Proto: "lwr", Cap: 1.1, Life: 1000},
+			{Proto: "smr", Cap: 0.7, Life: 1000},
+		},
+	}
+	for i := 0; i < nperiods; i++ {
+		pow := 0.37 * float64(i+1)
+		s.MinPower = append(s.MinPower, pow)
+		s.MaxPower = append(s.MaxPower, pow)
+	}
+
+	vars := make([]float64, s.NVars())
+	for i := range vars {
+		vars[i] = 0.5
+	}
+	builds, err := s.TransformVars(vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	maxerr := 1.1 / 2
+	for i, tm := range s.PeriodTimes() {
+		pow := s.PowerCap(builds, tm)
+		if diff := math.Abs(pow - s.MinPower[i]); diff > maxerr+1e-9 {
+			t.Errorf("period %v: power capacity %v is %v from target %v (max rounding error %v)", i, pow, diff, s.MinPower[i], maxerr)
+		}
+	}
+}
+
+func TestGroupConstraints(t *testing.T) {
+	s := &Scenario{
+		SimDur:      4,
+		BuildPeriod: 1,
+		Facs: []Facility{
+			{Proto: "lwr", Cap: 1},
+			{Proto: "adv", Cap: 1},
+			{Proto: "repo", FracOfProtos: []string{"lwr"}},
+		},
+		MinPower: []float64{0, 0, 0},
+		MaxPower: []float64{10, 10, 10},
+		Groups: []FacGroup{
+			{Name: "advanced", Protos: []string{"adv"}, MinFrac: 0.2, MaxFrac: 0.4},
+			{Name: "reactors", Protos: []string{"lwr", "adv"}, MinFrac: 1},
+		},
+	}
+	if err := s.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	s.Builds = []Build{
+		{Time: 1, Proto: "lwr", N: 4, fac: s.Facs[0]},
+		{Time: 2, Proto: "adv", N: 1, fac: s.Facs[1]},
+		{Time: 3, Proto: "adv", N: 3, fac: s.Facs[1]},
+		{Time: 3, Proto: "repo", N: 1, fac: s.Facs[2]},
+	}
+
+	got := s.CheckGroupConstraints()
+	want := []GroupViolation{
+		{Group: "advanced", Period: 0, Time: 1, Frac: 0, Min: 0.2, Max: 0.4},
+		{Group: "advanced", Period: 2, Time: 3, Frac: 0.5, Min: 0.2, Max: 0.4},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got violations %v, want %v", got, want)
+	}
+
+	s.Groups = []FacGroup{
+		{Name: "bad", Protos: []string{"nope"}},
+		{Name: "inverted", Protos: []string{"adv"}, MinFrac: 0.5, MaxFrac: 0.1},
+		{Name: "range", Protos: []string{"adv"}, MaxFrac: 2},
+	}
+	probs := s.Problems()
+	if len(probs) != 3 {
+		t.Fatalf("got problems %v, want 3", probs)
+	}
+	for i, want := range []string{"'nope' is not defined", "MinFrac 0.5 > MaxFrac 0.1", "between 0 and 1"} {
+		if !strings.Contains(probs[i].Error(), want) {
+			t.Errorf("problem %v: got %q, want it to contain %q", i, probs[i], want)
+		}
+	}
+}
+
+func TestSoftPower(t *testing.T) {
+	s := &Scenario{
+		SimDur:      7,
+		BuildPeriod: 2,
+		Facs:        []Facility{{Proto: "reactor", Cap: 1}},
+		MinPower:    []float64{2, 4, 6},
+		MaxPower:    []float64{10, 10, 10},
+	}
+
+	// hard constraints force enough builds to satisfy MinPower
+	if _, err := s.TransformVars(make([]float64, s.NVars())); err != nil {
+		t.Fatal(err)
+	}
+	if d := s.PowerDeficit(); d != 0 {
+		t.Errorf("hard MinPower: got deficit %v, want 0", d)
+	}
+
+	// soft constraints build nothing for zero vars - the deficit is MinPower
+	// integrated over each 2 time step period
+	s.SoftPower = true
+	builds, err := s.TransformVars(make([]float64, s.NVars()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := s.nbuiltproto(builds, "reactor"); n != 0 {
+		t.Errorf("soft MinPower: built %v reactors, want 0", n)
+	}
+	if d, want := s.PowerDeficit(), 2*(2.0+4+6); d != want {
+		t.Errorf("soft MinPower: got deficit %v, want %v", d, want)
+	}
+
+	// the power var still spans up to MaxPower
+	vars := make([]float64, s.NVars())
+	vars[0] = 0.5
+	builds, err = s.TransformVars(vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pow := s.PowerCap(builds, s.PeriodTimes()[0]); pow != 5 {
+		t.Errorf("soft MinPower: got power %v for var 0.5, want 5", pow)
+	}
+	if d, want := s.PowerDeficit(), 2*(6.0-5); d != want {
+		t.Errorf("soft MinPower: got deficit %v, want %v", d, want)
+	}
+
+	s.PowerPenalty = -1
+	if err := s.Validate(); err == nil {
+		t.Errorf("negative PowerPenalty passed validation")
+	}
+}
+
+func TestImplicitReactor(t *testing.T) {
+	newscen := func(implicit string) *Scenario {
+		s := &Scenario{
+			SimDur:      3,
+			BuildPeriod: 2,
+			MinPower:    []float64{0},
+			MaxPower:    []float64{8},
+			Facs:        []Facility{{Proto: "lwr", Cap: 1}, {Proto: "sfr", Cap: 1}},
+		}
+		for i := range s.Facs {
+			s.Facs[i].Implicit = s.Facs[i].Proto == implicit
+		}
+		return s
+	}
+
+	tests := []struct {
+		implicit string
+		varproto string
+		want     map[string]int
+	}{
+		// the first reactor is implicit by default
+		{"", "sfr", map[string]int{"sfr": 2, "lwr": 6}},
+		{"lwr", "sfr", map[string]int{"sfr": 2, "lwr": 6}},
+		{"sfr", "lwr", map[string]int{"lwr": 2, "sfr": 6}},
+	}
+	for _, test := range tests {
+		s := newscen(test.implicit)
+		// build all 8 units of capacity with a quarter of it from the
+		// non-implicit reactor
+		builds, err := s.TransformVars([]float64{1, 0.25})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for proto, n := range test.want {
+			if got := s.nbuiltproto(builds, proto); got != n {
+				t.Errorf("implicit %q: built %v %v, want %v", test.implicit, got, proto, n)
+			}
+		}
+		if spec := s.VarSpec(); spec[1].Proto != test.varproto {
+			t.Errorf("implicit %q: reactor var is for %v, want %v", test.implicit, spec[1].Proto, test.varproto)
+		}
+	}
+
+	s := newscen("lwr")
+	s.Facs[1].Implicit = true
+	if err := s.Validate(); err == nil || !strings.Contains(err.Error(), "only one prototype may be Implicit") {
+		t.Errorf("two implicit reactors: got error %v", err)
+	}
+
+	s = newscen("")
+	s.Facs = append(s.Facs, Facility{Proto: "repo", FracOfProtos: []string{"lwr"}, Implicit: true})
+	if err := s.Validate(); err == nil || !strings.Contains(err.Error(), "repo is Implicit") {
+		t.Errorf("implicit support facility: got error %v", err)
+	}
+}
+
+func TestPowerScale(t *testing.T) {
+	newscen := func(scale float64) *Scenario {
+		return &Scenario{
+			SimDur:      7,
+			BuildPeriod: 2,
+			Facs:        []Facility{{Proto: "reactor", Cap: 1}},
+			MinPower:    []float64{2, 4, 6},
+			MaxPower:    []float64{10, 10, 10},
+			PowerUnit:   "GWe",
+			PowerScale:  scale,
+		}
+	}
+
+	// scaling doesn't change the deployment math
+	vars := []float64{0.5, 0.5, 0.5}
+	unscaled, scaled := newscen(0), newscen(1000)
+	want, err := unscaled.TransformVars(vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := scaled.TransformVars(vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tm := range scaled.PeriodTimes() {
+		if pow, wantpow := scaled.PowerCap(got, tm), unscaled.PowerCap(want, tm); pow != wantpow {
+			t.Errorf("t=%v: scaled power %v != unscaled power %v", tm, pow, wantpow)
+		}
+	}
+
+	if p := unscaled.CyclusPower(3); p != 3 {
+		t.Errorf("zero PowerScale: got cyclus power %v, want 3", p)
+	}
+	if p := scaled.CyclusPower(3); p != 3000 {
+		t.Errorf("PowerScale 1000: got cyclus power %v, want 3000", p)
+	}
+
+	if err := scaled.ParseTmpl(`{{range .Facs}}<cap>{{power .Cap}}</cap>{{end}}`); err != nil {
+		t.Fatal(err)
+	}
+	data, err := scaled.GenCyclusInfile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(data), "<cap>1000</cap>"; got != want {
+		t.Errorf("power template func: got %q, want %q", got, want)
+	}
+
+	for _, scale := range []float64{-1, math.NaN()} {
+		s := newscen(scale)
+		if err := s.Validate(); err == nil || !strings.Contains(err.Error(), "PowerScale") {
+			t.Errorf("PowerScale %v: got validation error %v, want PowerScale error", scale, err)
+		}
+	}
+}
+
+func TestScheduleCSV(t *testing.T) {
+	s := &Scenario{
+		SimDur:      20,
+		BuildPeriod: 5,
+		Facs: []Facility{
+			{Proto: "lwr", Cap: 1, Life: 8},
+			{Proto: "fr", Cap: 0.5, CapFactor: 0.8},
+		},
+		MinPower: []float64{0, 0, 0, 0},
+		MaxPower: []float64{10, 10, 10, 10},
+		Builds: []Build{
+			{Time: 6, Proto: "lwr", N: 2},
+			{Time: 1, Proto: "lwr", N: 3},
+			{Time: 6, Proto: "fr", N: 1},
+			{Time: 6, Proto: "fr", N: 4},
+			{Time: 11, Proto: "fr", N: 2},
+		},
+	}
+	if err := s.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	builds := map[string][]Build{}
+	for _, b := range s.Builds {
+		builds[b.Proto] = append(builds[b.Proto], b)
+	}
+
+	var buf bytes.Buffer
+	if err := s.ScheduleCSV(&buf, builds); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "" +
+		"time,prototype,count,cumulative_power\n" +
+		"1,lwr,3,3\n" +
+		"6,fr,5,7\n" + // 3 lwr + 2 lwr + 5*0.4 fr
+		"6,lwr,2,7\n" +
+		"11,fr,2,4.8\n" // lwr from t=1 retired; 2 lwr + 7*0.4 fr
+	if got := buf.String(); got != want {
+		t.Errorf("got csv:\n%v\nwant:\n%v", got, want)
+	}
+
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := map[string]int{}
+	for _, row := range rows[1:] {
+		n, _ := strconv.Atoi(row[2])
+		counts[row[1]] += n
+	}
+	for proto, bs := range builds {
+		n := 0
+		for _, b := range bs {
+			n += b.N
+		}
+		if counts[proto] != n {
+			t.Errorf("prototype %v: csv has %v builds, want %v", proto, counts[proto], n)
+		}
+	}
+}
+
+func TestSummary(t *testing.T) {
+	s := &Scenario{
+		SimDur:      20,
+		BuildPeriod: 5,
+		Facs: []Facility{
+			{Proto: "lwr", Cap: 1},
+			{Proto: "fr", Cap: 0.5},
+			{Proto: "sep", FracOfProtos: []string{"fr"}},
+			{Proto: "old", Cap: 1, BuildAfter: -1},
+		},
+		MinPower: []float64{10, 0, 30, 20},
+		MaxPower: []float64{15, 25, 40, 50},
+	}
+	if err := s.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := s.NVars(), 12; got != want {
+		t.Fatalf("test scenario has %v vars, want %v", got, want)
+	}
+
+	want := "SimDur 20, 4 build periods, 4 facilities (2 reactors, 1 support, 1 unbuildable), 12 vars, MinPower 0..30, MaxPower 15..50"
+	if got := s.Summary(); got != want {
+		t.Errorf("got summary\n%v\nwant\n%v", got, want)
+	}
+
+	empty := &Scenario{}
+	want = "SimDur 0, 0 build periods, 0 facilities (0 reactors, 0 support, 0 unbuildable), 0 vars, MinPower -, MaxPower -"
+	if got := empty.Summary(); got != want {
+		t.Errorf("empty scenario: got summary\n%v\nwant\n%v", got, want)
+	}
+}
+
+func TestDeployments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudlus-scen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const tmpl = `{{range $d := .Deployments}}{{$d.Proto}}{{range $i, $t := $d.Times}} t{{$t}}n{{index $d.N $i}}{{end}};{{end}}`
+	err = ioutil.WriteFile(filepath.Join(dir, "tmpl.xml"), []byte(tmpl), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Scenario{
+		SimDur:      20,
+		BuildOffset: 6,
+		BuildPeriod: 5,
+		CyclusTmpl:  "tmpl.xml",
+		File:        filepath.Join(dir, "scenario.json"),
+		Facs: []Facility{
+			{Proto: "lwr", Cap: 1, Life: 30},
+			{Proto: "fr", Cap: 1},
+		},
+		MinPower: []float64{0, 0, 0},
+		MaxPower: []float64{1, 1, 1},
+		StartBuilds: []Build{
+			{Time: -3, Proto: "lwr", N: 2},
+			{Time: 2, Proto: "fr", N: 1},
+			{Time: 25, Proto: "fr", N: 1},
+		},
+	}
+	if _, err := s.TransformVars(make([]float64, s.NVars())); err != nil {
+		t.Fatal(err)
+	}
+	s.Builds = append(s.Builds,
+		Build{Time: 12, Proto: "fr", N: 3, fac: s.Facs[1]},
+		Build{Time: 7, Proto: "fr", N: 0, fac: s.Facs[1]},
+		Build{Time: 7, Proto: "lwr", N: 1, Life: 10, fac: s.Facs[0]},
+	)
+
+	deps := s.Deployments()
+	if len(deps) != 2 {
+		t.Fatalf("got %v deployments, want 2: %+v", len(deps), deps)
+	}
+	lwr, fr := deps[0], deps[1]
+	if lwr.Proto != "lwr" || fmt.Sprint(lwr.Times, lwr.N, lwr.Lifetimes) != "[0 7] [2 1] [30 10]" {
+		t.Errorf("got lwr deployment %+v", lwr)
+	}
+	if fr.Proto != "fr" || fmt.Sprint(fr.Times, fr.N, fr.Lifetimes) != "[2 12] [1 3] [-1 -1]" {
+		t.Errorf("got fr deployment %+v", fr)
+	}
+	data, err := s.GenCyclusInfile()
+	if data == nil {
+		t.Fatal(err)
+	}
+	want := "lwr t0n2 t7n1;fr t2n1 t12n3;"
+	if got := string(data); got != want {
+		t.Errorf("rendered template:\ngot  %q\nwant %q", got, want)
+	}
+}
+
+func TestBuildTiming(t *testing.T) {
+	newScen := func(start, forced []Build) *Scenario {
+		return &Scenario{
+			SimDur:       20,
+			BuildOffset:  5,
+			TrailingDur:  4,
+			BuildPeriod:  3,
+			Facs:         []Facility{{Proto: "reactor", Cap: 1, Life: 100}},
+			MinPower:     []float64{0, 0, 0, 0},
+			MaxPower:     []float64{10, 10, 10, 10},
+			StartBuilds:  start,
+			ForcedBuilds: forced,
+		}
+	}
+
+	s := newScen(nil, nil)
+	if got := fmt.Sprint(s.PeriodTimes()); got != "[6 9 12 15]" {
+		t.Errorf("got period times %v, want [6 9 12 15]", got)
+	}
+
+	tests := []struct {
+		start, forced []Build
+		ok            bool
+	}{
+		// initial conditions before (or at) BuildOffset
+		{[]Build{{Time: 0, Proto: "reactor", N: 1}, {Time: 5, Proto: "reactor", N: 1}}, nil, true},
+		// existing capacity coming online during the build periods
+		{[]Build{{Time: 10, Proto: "reactor", N: 1}}, nil, true},
+		{nil, []Build{{Time: 6, Proto: "reactor", N: 1}, {Time: 15, Proto: "reactor", N: 1}}, true},
+		{nil, []Build{{Time: 5, Proto: "reactor", N: 1}}, false},
+		{nil, []Build{{Time: 0, Proto: "reactor", N: 1}}, false},
+		{nil, []Build{{Time: 16, Proto: "reactor", N: 1}}, false},
+	}
+	for i, test := range tests {
+		s := newScen(test.start, test.forced)
+		builds, err := s.TransformVars(make([]float64, s.NVars()))
+		if (err == nil) != test.ok {
+			t.Errorf("case %v: got error %v, want ok=%v", i, err, test.ok)
+			continue
+		} else if err != nil {
+			continue
+		}
+
+		// fixed builds are deployed exactly as given
+		for _, b := range append(test.start, test.forced...) {
+			if n := s.NBuilt(builds[b.Proto], b.Time); n < b.N {
+				t.Errorf("case %v: got %v built at t=%v, want at least %v", i, n, b.Time, b.N)
+			}
+		}
+	}
+}
+
+func TestPeriodOf(t *testing.T) {
+	for _, s := range []*Scenario{
+		{SimDur: 20, BuildOffset: 5, TrailingDur: 4, BuildPeriod: 3},
+		{SimDur: 20, BuildOffset: 0, TrailingDur: 0, BuildPeriod: 1},
+		{SimDur: 30, BuildOffset: 2, TrailingDur: 3, BuildPeriod: 7},
+	} {
+		for p := -3; p <= s.NPeriods()+1; p++ {
+			if got := s.periodOf(s.timeOf(p)); got != p {
+				t.Errorf("%+v: periodOf(timeOf(%v)) = %v", s, p, got)
+			}
+		}
+
+		// every time is in the last period starting at or before it
+		for tm := -s.BuildPeriod; tm <= s.SimDur; tm++ {
+			want := -s.BuildPeriod - 1
+			for p := want; s.timeOf(p+1) <= tm; p++ {
+				want = p + 1
+			}
+			if got := s.periodOf(tm); got != want {
+				t.Errorf("%+v: periodOf(%v) = %v, want %v", s, tm, got, want)
+			}
+		}
+	}
+
+	s := &Scenario{SimDur: 20, BuildOffset: 5, TrailingDur: 4, BuildPeriod: 3}
+	tests := []struct{ time, period int }{
+		{0, -2}, {2, -2}, {3, -1}, {5, -1}, {6, 0}, {8, 0}, {9, 1}, {15, 3}, {17, 3}, {18, 4},
+	}
+	for _, test := range tests {
+		if got := s.periodOf(test.time); got != test.period {
+			t.Errorf("periodOf(%v) = %v, want %v", test.time, got, test.period)
+		}
+	}
+}
+
+func TestNoReactors(t *testing.T) {
+	facs := [][]Facility{
+		{{Proto: "repo", FracOfProtos: []string{"repo"}}},
+		{{Proto: "reactor", Cap: 1, BuildAfter: -1}, {Proto: "repo", FracOfProtos: []string{"reactor"}}},
+	}
+	for i, fs := range facs {
+		s := &Scenario{
+			SimDur:      4,
+			BuildPeriod: 1,
+			Facs:        fs,
+			MinPower:    []float64{0, 0, 0},
+			MaxPower:    []float64{1, 1, 1},
+		}
+		if err := s.Validate(); err == nil || !strings.Contains(err.Error(), "no buildable reactor") {
+			t.Errorf("case %v: got validation error %v, want missing reactor error", i, err)
+		}
+		if _, err := s.TransformVars(make([]float64, 3)); err == nil {
+			t.Errorf("case %v: TransformVars succeeded without any reactors", i)
+		}
+	}
+}
+
+func TestPrototypes(t *testing.T) {
+	s := &Scenario{
+		Facs: []Facility{
+			{Proto: "lwr", Cap: 1},
+			{Proto: "repo", FracOfProtos: []string{"lwr", "fr"}},
+		},
+		Groups:       []FacGroup{{Name: "adv", Protos: []string{"smr"}}},
+		StartBuilds:  []Build{{Proto: "lwr"}, {Proto: "sink"}},
+		ForcedBuilds: []Build{{Proto: "lwr"}},
+		Builds:       []Build{{Proto: "typo"}},
+	}
+	if got := fmt.Sprint(s.Prototypes()); got != "[fr lwr repo sink smr typo]" {
+		t.Errorf("got prototypes %v, want [fr lwr repo sink smr typo]", got)
+	}
+	if got := (&Scenario{}).Prototypes(); got == nil || len(got) != 0 {
+		t.Errorf("got prototypes %#v for an empty scenario, want an empty list", got)
+	}
+}
+
+func TestCheckTmplPrototypes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudlus-tmplprotos")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tmpl := `<simulation>
+  <prototype>
+    <name>lwr</name>
+  </prototype>
+  <prototype> <name>repo</name> </prototype>
+  <prototype><name>unused</name></prototype>
+  <prototype>
+    <name>deployer</name>
+    <config><DeployInst><prototypes>{{range .Builds}}<val>{{.Proto}}</val>{{end}}</prototypes></DeployInst></config>
+  </prototype>
+  <agent> <name>deployer1</name> <prototype>deployer</prototype> </agent>
+</simulation>`
+	if err := ioutil.WriteFile(filepath.Join(dir, "tmpl.xml"), []byte(tmpl), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Scenario{
+		File:       filepath.Join(dir, "scenario.json"),
+		CyclusTmpl: "tmpl.xml",
+		Facs:       []Facility{{Proto: "lwr"}, {Proto: "repo"}, {Proto: "fr"}},
+	}
+	warnings, err := s.CheckTmplPrototypes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "[prototype fr is not defined in cyclus template tmpl.xml cyclus template prototype unused is not in Facs]"
+	if got := fmt.Sprint(warnings); got != want {
+		t.Errorf("got warnings\n%v\nwant\n%v", got, want)
+	}
+
+	s.CyclusTmpl = "missing.xml"
+	if _, err := s.CheckTmplPrototypes(); err == nil {
+		t.Errorf("missing template was not reported")
+	}
+}